@@ -0,0 +1,178 @@
+package breach
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// Below this window the rest of the search reads lines one after another
+const scanWindow = 4096
+
+/**
+ * Corpus of breached password hashes in the Pwned Passwords downloadable format
+ * Every line is HASH:COUNT with the upper case hex SHA-1 or NTLM hash, lines are sorted by hash
+ * The file is searched in place, so even the full corpus needs no memory
+ */
+type Corpus struct {
+	file    *os.File
+	size    int64
+	hashLen int
+}
+
+/**
+ * Open the corpus, the hash is told by the length of the first line's hash
+ */
+func Open(path string) (*Corpus, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	corpus := &Corpus{file: file, size: info.Size()}
+
+	firstLine, err := corpus.lineAt(0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	hash, _, _ := strings.Cut(firstLine, ":")
+	if _, err := hex.DecodeString(hash); err != nil || (len(hash) != 40 && len(hash) != 32) {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a SHA-1 or NTLM Pwned Passwords file", path)
+	}
+
+	corpus.hashLen = len(hash)
+
+	return corpus, nil
+}
+
+func (corpus *Corpus) Close() error {
+	return corpus.file.Close()
+}
+
+/**
+ * How often the password was seen in breaches, 0 if never
+ */
+func (corpus *Corpus) Count(password string) (int, error) {
+
+	target := corpus.digest(password)
+
+	// Narrow down the window holding the first line whose hash is not below the target,
+	// lo always is the start of a line below the target or the start of the file
+	lo, hi := int64(0), corpus.size
+	for hi-lo > scanWindow {
+		mid := lo + (hi-lo)/2
+
+		start, err := corpus.nextLineStart(mid)
+		if err != nil {
+			return 0, err
+		}
+
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		line, err := corpus.lineAt(start)
+		if err != nil {
+			return 0, err
+		}
+
+		if lineHash(line) < target {
+			lo = start
+		} else {
+			hi = start
+		}
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(corpus.file, lo, corpus.size-lo))
+	for {
+		line, err := reader.ReadString('\n')
+		if line == "" && err != nil {
+			if err == io.EOF {
+				return 0, nil
+			}
+			return 0, err
+		}
+
+		hash := lineHash(line)
+		if hash > target {
+			return 0, nil
+		}
+		if hash == target {
+			_, count, _ := strings.Cut(strings.TrimSpace(line), ":")
+			return strconv.Atoi(count)
+		}
+	}
+}
+
+func (corpus *Corpus) digest(password string) string {
+
+	if corpus.hashLen == 32 {
+		// NTLM is MD4 of the UTF-16LE password
+		hash := md4.New()
+		for _, unit := range utf16.Encode([]rune(password)) {
+			hash.Write([]byte{byte(unit), byte(unit >> 8)})
+		}
+		return strings.ToUpper(hex.EncodeToString(hash.Sum(nil)))
+	}
+
+	digest := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(digest[:]))
+}
+
+/**
+ * Offset of the first line starting at or after the offset, the file size if there is none
+ */
+func (corpus *Corpus) nextLineStart(offset int64) (int64, error) {
+
+	if offset == 0 {
+		return 0, nil
+	}
+
+	buffer := make([]byte, 256)
+	for position := offset - 1; position < corpus.size; position += int64(len(buffer)) {
+		n, err := corpus.file.ReadAt(buffer, position)
+		if index := bytes.IndexByte(buffer[:n], '\n'); index >= 0 {
+			return position + int64(index) + 1, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+
+	return corpus.size, nil
+}
+
+func (corpus *Corpus) lineAt(offset int64) (string, error) {
+
+	line, err := bufio.NewReader(io.NewSectionReader(corpus.file, offset, corpus.size-offset)).ReadString('\n')
+	if line == "" && err != nil {
+		return "", err
+	}
+
+	return line, nil
+}
+
+func lineHash(line string) string {
+	hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return strings.ToUpper(hash)
+}
@@ -1,20 +1,62 @@
 package cert
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 	"os"
 	"path/filepath"
+
+	c "simple-micro-auth/src/configs"
 )
 
 var (
-	PrivateKey *rsa.PrivateKey
-	PublicKey  *rsa.PublicKey
-	tries      = 0
+	tries = 0
 )
 
+/**
+ * Generate a private key matching the signing algorithm
+ * @param algorithm string - JWT signing algorithm, e.g. RS256 or EdDSA
+ */
+func GenerateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "RS256", "RS512", "PS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "EdDSA":
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	}
+
+	return nil, fmt.Errorf("unsupported signing algorithm: %s", algorithm)
+}
+
+/**
+ * Check that the key type can be used with the signing algorithm
+ */
+func KeyMatchesAlgorithm(key crypto.PublicKey, algorithm string) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return algorithm == "RS256" || algorithm == "RS512" || algorithm == "PS256"
+	case *ecdsa.PublicKey:
+		return (algorithm == "ES256" && k.Curve == elliptic.P256()) ||
+			(algorithm == "ES384" && k.Curve == elliptic.P384())
+	case ed25519.PublicKey:
+		return algorithm == "EdDSA"
+	}
+
+	return false
+}
+
 /**
  * Create certificates
  * @param target string - certificate target
@@ -31,19 +73,18 @@ func CreateCertificates(target string) {
 	}
 
 	// Generate the private and public keys
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privateKey, err := GenerateKey(c.EnvJWTAlgorithm)
 	if err != nil {
 		panic(err)
 	}
 
-	publicKey := &privateKey.PublicKey
+	publicKey := privateKey.Public()
 
 	// Encode the private key
-	privateKeyBytes := x509.MarshalPKCS1PrivateKey(privateKey)
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privateKeyBytes,
-	})
+	privateKeyPEM, err := MarshalPrivateKeyPEM(privateKey)
+	if err != nil {
+		panic(err)
+	}
 
 	// Get private key file path
 	privateKeyFilePath := filepath.Join(dir, "private.pem")
@@ -67,7 +108,7 @@ func CreateCertificates(target string) {
 		panic(err)
 	}
 	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
+		Type:  "PUBLIC KEY",
 		Bytes: publicKeyBytes,
 	})
 
@@ -111,9 +152,7 @@ func ReadCertificates(target string) {
 	}
 
 	// Decode the pem file
-	privateKeyBlock, _ := pem.Decode(privateKeyPEM)
-
-	privateKey, err := x509.ParsePKCS1PrivateKey(privateKeyBlock.Bytes)
+	privateKey, err := ParsePrivateKeyPEM(privateKeyPEM)
 	if err != nil {
 		// Create certificates if private key is invalid or corrupt, then try to read them again
 		CreateCertificates(target)
@@ -121,6 +160,67 @@ func ReadCertificates(target string) {
 		return
 	}
 
-	PublicKey = &privateKey.PublicKey
-	PrivateKey = privateKey
+	// Replacing the key would leave every outstanding token unverifiable, so a changed or mistyped
+	// JWT_ALGORITHM stops the server instead. SIGNING_KEY_STORE=db rotates keys while the old ones keep verifying
+	if !KeyMatchesAlgorithm(privateKey.Public(), c.EnvJWTAlgorithm) {
+		panic(fmt.Sprintf("%s holds a key which can not sign %s: fix JWT_ALGORITHM or move the key away to create a new one",
+			privateKeyFilePath, c.EnvJWTAlgorithm))
+	}
+
+	key, err := NewKey(privateKey, c.EnvJWTAlgorithm)
+	if err != nil {
+		panic(err)
+	}
+
+	// Every realm reads its own certificates, so only tries of the current target count
+	tries = 0
+
+	KeysOf(target).Replace(key, nil)
+}
+
+/**
+ * Parse a private key .pem file
+ * Supports PKCS#8 keys as well as legacy PKCS#1 RSA and SEC 1 EC keys
+ */
+func ParsePrivateKeyPEM(privateKeyPEM []byte) (crypto.Signer, error) {
+
+	privateKeyBlock, _ := pem.Decode(privateKeyPEM)
+	if privateKeyBlock == nil {
+		return nil, fmt.Errorf("private key is not pem encoded")
+	}
+
+	switch privateKeyBlock.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(privateKeyBlock.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(privateKeyBlock.Bytes)
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(privateKeyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type")
+	}
+
+	return signer, nil
+}
+
+/**
+ * Encode a private key as PKCS#8 .pem file contents
+ */
+func MarshalPrivateKeyPEM(privateKey crypto.Signer) ([]byte, error) {
+
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privateKeyBytes,
+	}), nil
 }
@@ -0,0 +1,77 @@
+package cert
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+/**
+ * Decode a base64 encoded AES-256 master key
+ */
+func ParseMasterKey(encoded string) ([]byte, error) {
+	masterKey, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not base64 encoded")
+	}
+
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes long, got %d", len(masterKey))
+	}
+
+	return masterKey, nil
+}
+
+/**
+ * Encrypt data with AES-256-GCM
+ * @param associatedData []byte - data the ciphertext is bound to, must be the same for Decrypt
+ * @returns nonce followed by the ciphertext
+ */
+func Encrypt(plaintext []byte, masterKey []byte, associatedData []byte) ([]byte, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+/**
+ * Decrypt data encrypted with Encrypt
+ */
+func Decrypt(ciphertext []byte, masterKey []byte, associatedData []byte) ([]byte, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, sealed, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt: wrong master key or corrupt data")
+	}
+
+	return plaintext, nil
+}
+
+func newAEAD(masterKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
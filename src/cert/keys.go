@@ -0,0 +1,177 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+ * Signing key together with its key id and algorithm
+ * Signer is nil for keys which are only kept to verify tokens issued before a rotation
+ */
+type Key struct {
+	ID        string
+	Algorithm string
+	Signer    Signer
+	PublicKey crypto.PublicKey
+	CreatedAt time.Time
+}
+
+/**
+ * Set of keys of a single target
+ * The active key signs new tokens, every key of the set can verify them
+ */
+type KeySet struct {
+	mutex  sync.RWMutex
+	active Key
+	keys   map[string]Key
+}
+
+var (
+	// Keys signing and verifying tokens
+	Keys = NewKeySet()
+
+	// Key sets whose public keys may be handed out, by target name
+	targets      = map[string]*KeySet{"token": Keys}
+	targetsMutex sync.RWMutex
+)
+
+/**
+ * Make the public keys of the set available under the target name
+ */
+func RegisterTarget(target string, keys *KeySet) {
+	targetsMutex.Lock()
+	defer targetsMutex.Unlock()
+
+	targets[target] = keys
+}
+
+/**
+ * Key set of the target, an empty one is registered if the target has none yet
+ */
+func KeysOf(target string) *KeySet {
+	targetsMutex.Lock()
+	defer targetsMutex.Unlock()
+
+	keys, ok := targets[target]
+	if !ok {
+		keys = NewKeySet()
+		targets[target] = keys
+	}
+	return keys
+}
+
+func UnregisterTarget(target string) {
+	targetsMutex.Lock()
+	defer targetsMutex.Unlock()
+
+	delete(targets, target)
+}
+
+func LookupTarget(target string) (*KeySet, bool) {
+	targetsMutex.RLock()
+	defer targetsMutex.RUnlock()
+
+	keys, ok := targets[target]
+	return keys, ok
+}
+
+func NewKeySet(keys ...Key) *KeySet {
+	set := &KeySet{keys: map[string]Key{}}
+	if len(keys) > 0 {
+		set.Replace(keys[0], keys[1:])
+	}
+	return set
+}
+
+/**
+ * Replace keys of the set
+ * @param active Key - key to sign new tokens with
+ * @param others []Key - keys to keep verifying tokens with
+ */
+func (set *KeySet) Replace(active Key, others []Key) {
+	keys := make(map[string]Key, len(others)+1)
+	for _, key := range others {
+		keys[key.ID] = key
+	}
+	keys[active.ID] = active
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	set.active = active
+	set.keys = keys
+}
+
+func (set *KeySet) Active() Key {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	return set.active
+}
+
+func (set *KeySet) Lookup(kid string) (Key, bool) {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	key, ok := set.keys[kid]
+	return key, ok
+}
+
+/**
+ * All keys of the set, newest first
+ */
+func (set *KeySet) All() []Key {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	keys := make([]Key, 0, len(set.keys))
+	for _, key := range set.keys {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+
+	return keys
+}
+
+/**
+ * Derive a key id from the public key
+ */
+func KeyID(publicKey crypto.PublicKey) (string, error) {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal public key: %w", err)
+	}
+
+	thumbprint := sha256.Sum256(publicKeyBytes)
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint[:16]), nil
+}
+
+/**
+ * Create a signing key for the private key
+ * @param privateKey crypto.Signer - in-memory key or a handle to a key in an HSM
+ */
+func NewKey(privateKey crypto.Signer, algorithm string) (Key, error) {
+	kid, err := KeyID(privateKey.Public())
+	if err != nil {
+		return Key{}, err
+	}
+
+	return Key{
+		ID:        kid,
+		Algorithm: algorithm,
+		Signer:    NewSigner(privateKey, kid, algorithm),
+		PublicKey: privateKey.Public(),
+		CreatedAt: time.Now(),
+	}, nil
+}
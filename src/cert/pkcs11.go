@@ -0,0 +1,45 @@
+//go:build pkcs11
+
+package cert
+
+import (
+	"fmt"
+
+	c "simple-micro-auth/src/configs"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+/**
+ * Load the signing key from a PKCS#11 token
+ * The private key stays in the token, signing happens through the PKCS#11 module
+ */
+func LoadPKCS11Key(config c.PKCS11Config, algorithm string) (Key, error) {
+
+	if algorithm == "EdDSA" {
+		return Key{}, fmt.Errorf("EdDSA keys are not supported through PKCS#11")
+	}
+
+	context, err := crypto11.Configure(&crypto11.Config{
+		Path:       config.Module,
+		TokenLabel: config.TokenLabel,
+		Pin:        config.Pin,
+	})
+	if err != nil {
+		return Key{}, fmt.Errorf("could not open PKCS#11 token: %w", err)
+	}
+
+	privateKey, err := context.FindKeyPair(nil, []byte(config.KeyLabel))
+	if err != nil {
+		return Key{}, fmt.Errorf("could not find PKCS#11 key: %w", err)
+	}
+	if privateKey == nil {
+		return Key{}, fmt.Errorf("PKCS#11 key %s not found", config.KeyLabel)
+	}
+
+	if !KeyMatchesAlgorithm(privateKey.Public(), algorithm) {
+		return Key{}, fmt.Errorf("PKCS#11 key %s can not sign %s", config.KeyLabel, algorithm)
+	}
+
+	return NewKey(privateKey, algorithm)
+}
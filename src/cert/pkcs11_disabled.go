@@ -0,0 +1,16 @@
+//go:build !pkcs11
+
+package cert
+
+import (
+	"fmt"
+
+	c "simple-micro-auth/src/configs"
+)
+
+/**
+ * PKCS#11 needs cgo, so it is only compiled in with the pkcs11 build tag
+ */
+func LoadPKCS11Key(config c.PKCS11Config, algorithm string) (Key, error) {
+	return Key{}, fmt.Errorf("built without PKCS#11 support, rebuild with -tags pkcs11")
+}
@@ -0,0 +1,109 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+)
+
+/**
+ * Signs tokens without exposing the private key
+ * Implemented by in-memory keys, PKCS#11 tokens and Vault transit keys
+ */
+type Signer interface {
+	// Key id published in the kid header of tokens
+	KeyID() string
+	// JWT signing algorithm, e.g. RS256 or EdDSA
+	Algorithm() string
+	Public() crypto.PublicKey
+	// Sign the JWS signing input, returns the signature in JWS encoding
+	Sign(signingString string) ([]byte, error)
+}
+
+/**
+ * Signer backed by any crypto.Signer, be it an in-memory key or a handle to a key in an HSM
+ */
+type cryptoSigner struct {
+	key       crypto.Signer
+	kid       string
+	algorithm string
+}
+
+func NewSigner(key crypto.Signer, kid string, algorithm string) Signer {
+	return &cryptoSigner{key: key, kid: kid, algorithm: algorithm}
+}
+
+func (signer *cryptoSigner) KeyID() string {
+	return signer.kid
+}
+
+func (signer *cryptoSigner) Algorithm() string {
+	return signer.algorithm
+}
+
+func (signer *cryptoSigner) Public() crypto.PublicKey {
+	return signer.key.Public()
+}
+
+func (signer *cryptoSigner) Sign(signingString string) ([]byte, error) {
+
+	switch signer.algorithm {
+	case "RS256":
+		digest := sha256.Sum256([]byte(signingString))
+		return signer.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case "RS512":
+		digest := sha512.Sum512([]byte(signingString))
+		return signer.key.Sign(rand.Reader, digest[:], crypto.SHA512)
+	case "PS256":
+		digest := sha256.Sum256([]byte(signingString))
+		return signer.key.Sign(rand.Reader, digest[:], &rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash:       crypto.SHA256,
+		})
+	case "ES256":
+		digest := sha256.Sum256([]byte(signingString))
+		signature, err := signer.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		return ecdsaSignatureToJWS(signature, 32)
+	case "ES384":
+		digest := sha512.Sum384([]byte(signingString))
+		signature, err := signer.key.Sign(rand.Reader, digest[:], crypto.SHA384)
+		if err != nil {
+			return nil, err
+		}
+		return ecdsaSignatureToJWS(signature, 48)
+	case "EdDSA":
+		// Ed25519 hashes the message itself
+		return signer.key.Sign(rand.Reader, []byte(signingString), crypto.Hash(0))
+	}
+
+	return nil, fmt.Errorf("unsupported signing algorithm: %s", signer.algorithm)
+}
+
+/**
+ * Convert an ASN.1 ECDSA signature into the fixed size r || s form used by JWS
+ */
+func ecdsaSignatureToJWS(signature []byte, size int) ([]byte, error) {
+
+	var parsed struct {
+		R, S *big.Int
+	}
+
+	_, err := asn1.Unmarshal(signature, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ecdsa signature")
+	}
+
+	jwsSignature := make([]byte, 2*size)
+	parsed.R.FillBytes(jwsSignature[:size])
+	parsed.S.FillBytes(jwsSignature[size:])
+
+	return jwsSignature, nil
+}
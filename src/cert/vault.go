@@ -0,0 +1,267 @@
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	c "simple-micro-auth/src/configs"
+)
+
+/**
+ * Signer backed by a Vault transit key, the private key never leaves Vault
+ */
+type vaultSigner struct {
+	config    c.VaultConfig
+	client    *http.Client
+	version   int
+	kid       string
+	algorithm string
+	publicKey crypto.PublicKey
+}
+
+type vaultKeyResponse struct {
+	Data struct {
+		Type          string `json:"type"`
+		LatestVersion int    `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey    string    `json:"public_key"`
+			CreationTime time.Time `json:"creation_time"`
+		} `json:"keys"`
+	} `json:"data"`
+}
+
+type vaultSignResponse struct {
+	Data struct {
+		Signature string `json:"signature"`
+	} `json:"data"`
+}
+
+/**
+ * Load public keys of every version of the Vault transit key
+ * The latest version signs new tokens, older versions keep verifying tokens issued before Vault rotated the key
+ */
+func LoadVaultKeys(config c.VaultConfig, algorithm string) (Key, []Key, error) {
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	var keyResponse vaultKeyResponse
+	err := vaultRequest(client, config, http.MethodGet, "/keys/"+config.KeyName, nil, &keyResponse)
+	if err != nil {
+		return Key{}, nil, err
+	}
+
+	if !vaultKeyTypeMatches(keyResponse.Data.Type, algorithm) {
+		return Key{}, nil, fmt.Errorf("vault key of type %s can not sign %s", keyResponse.Data.Type, algorithm)
+	}
+
+	versions := []int{}
+	for version := range keyResponse.Data.Keys {
+		number, err := strconv.Atoi(version)
+		if err != nil {
+			return Key{}, nil, fmt.Errorf("malformed vault key version %s", version)
+		}
+		versions = append(versions, number)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	var active *Key
+	others := []Key{}
+
+	for _, version := range versions {
+		vaultKey := keyResponse.Data.Keys[strconv.Itoa(version)]
+
+		publicKey, err := parseVaultPublicKey(keyResponse.Data.Type, vaultKey.PublicKey)
+		if err != nil {
+			return Key{}, nil, err
+		}
+
+		kid, err := KeyID(publicKey)
+		if err != nil {
+			return Key{}, nil, err
+		}
+
+		key := Key{
+			ID:        kid,
+			Algorithm: algorithm,
+			PublicKey: publicKey,
+			CreatedAt: vaultKey.CreationTime,
+		}
+
+		if version == keyResponse.Data.LatestVersion {
+			key.Signer = &vaultSigner{
+				config:    config,
+				client:    client,
+				version:   version,
+				kid:       kid,
+				algorithm: algorithm,
+				publicKey: publicKey,
+			}
+			active = &key
+			continue
+		}
+
+		others = append(others, key)
+	}
+
+	if active == nil {
+		return Key{}, nil, fmt.Errorf("vault key %s has no public key for its latest version", config.KeyName)
+	}
+
+	return *active, others, nil
+}
+
+func (signer *vaultSigner) KeyID() string {
+	return signer.kid
+}
+
+func (signer *vaultSigner) Algorithm() string {
+	return signer.algorithm
+}
+
+func (signer *vaultSigner) Public() crypto.PublicKey {
+	return signer.publicKey
+}
+
+func (signer *vaultSigner) Sign(signingString string) ([]byte, error) {
+
+	request := map[string]interface{}{
+		"input":       base64.StdEncoding.EncodeToString([]byte(signingString)),
+		"key_version": signer.version,
+	}
+
+	path := "/sign/" + signer.config.KeyName
+
+	switch signer.algorithm {
+	case "RS256":
+		path += "/sha2-256"
+		request["signature_algorithm"] = "pkcs1v15"
+	case "RS512":
+		path += "/sha2-512"
+		request["signature_algorithm"] = "pkcs1v15"
+	case "PS256":
+		path += "/sha2-256"
+		request["signature_algorithm"] = "pss"
+		request["salt_length"] = "hash"
+	case "ES256":
+		path += "/sha2-256"
+		request["marshaling_algorithm"] = "jws"
+	case "ES384":
+		path += "/sha2-384"
+		request["marshaling_algorithm"] = "jws"
+	}
+
+	var signResponse vaultSignResponse
+	err := vaultRequest(signer.client, signer.config, http.MethodPost, path, request, &signResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	// Signatures look like vault:v1:<signature>
+	parts := strings.SplitN(signResponse.Data.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("malformed vault signature")
+	}
+
+	// ECDSA signatures marshaled for JWS come base64url encoded
+	if signer.algorithm == "ES256" || signer.algorithm == "ES384" {
+		return base64.RawURLEncoding.DecodeString(parts[2])
+	}
+
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+func vaultRequest(client *http.Client, config c.VaultConfig, method string, path string, body interface{}, response interface{}) error {
+
+	var requestBody bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&requestBody).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	url := strings.TrimRight(config.Address, "/") + "/v1/" + config.Mount + path
+
+	request, err := http.NewRequest(method, url, &requestBody)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-Vault-Token", config.Token)
+	request.Header.Set("Content-Type", "application/json")
+
+	httpResponse, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("vault request failed: %w", err)
+	}
+	defer httpResponse.Body.Close()
+
+	responseBody, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return fmt.Errorf("vault request failed: %w", err)
+	}
+
+	if httpResponse.StatusCode != http.StatusOK {
+		var errorResponse struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(responseBody, &errorResponse)
+
+		return fmt.Errorf("vault responded with status %d to %s %s: %s",
+			httpResponse.StatusCode, method, path, strings.Join(errorResponse.Errors, ", "))
+	}
+
+	err = json.Unmarshal(responseBody, response)
+	if err != nil {
+		return fmt.Errorf("malformed vault response: %w", err)
+	}
+
+	return nil
+}
+
+func vaultKeyTypeMatches(keyType string, algorithm string) bool {
+	switch keyType {
+	case "rsa-2048", "rsa-3072", "rsa-4096":
+		return algorithm == "RS256" || algorithm == "RS512" || algorithm == "PS256"
+	case "ecdsa-p256":
+		return algorithm == "ES256"
+	case "ecdsa-p384":
+		return algorithm == "ES384"
+	case "ed25519":
+		return algorithm == "EdDSA"
+	}
+
+	return false
+}
+
+/**
+ * Vault returns RSA and ECDSA public keys as .pem, Ed25519 ones as base64 of the raw key
+ */
+func parseVaultPublicKey(keyType string, encoded string) (crypto.PublicKey, error) {
+
+	if keyType == "ed25519" {
+		publicKey, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("malformed vault ed25519 public key")
+		}
+		return ed25519.PublicKey(publicKey), nil
+	}
+
+	publicKeyBlock, _ := pem.Decode([]byte(encoded))
+	if publicKeyBlock == nil {
+		return nil, fmt.Errorf("vault public key is not pem encoded")
+	}
+
+	return x509.ParsePKIXPublicKey(publicKeyBlock.Bytes)
+}
@@ -5,8 +5,11 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	m "simple-micro-auth/src/models"
+
 	"github.com/joho/godotenv"
 )
 
@@ -14,9 +17,73 @@ var (
 	EnvGoEnv          string
 	EnvDockerized     string
 	EnvJWTExpiration  time.Duration
+	EnvJWTAlgorithm   string
+	EnvJWTIssuer      string
+	EnvJWTClaims      []string
 	EnvBcryptCost     int
 	EnvPort           string
+	EnvHTTPPort       string
 	EnvPostgresConfig PostgresConfig
+
+	// Bounds of the ttl callers request, out of range requests are clamped or rejected
+	EnvJWTTtlMin        time.Duration
+	EnvJWTTtlMax        time.Duration
+	EnvJWTTtlOutOfRange string
+
+	// Client id to secret of clients allowed to introspect tokens
+	EnvIntrospectionClients map[string]string
+
+	// Authorization server of /authorize and /token
+	EnvOAuthLookupHash      string
+	EnvOAuthCodeTtl         time.Duration
+	EnvOAuthRefreshTokenTtl time.Duration
+
+	// Credentials always granted the admin scope, to assign the first roles
+	EnvAdminLookupHashes []string
+
+	EnvSigningKeyStore     string
+	EnvSigningKeyMasterKey string
+	EnvSigningKeyRotation  time.Duration
+	EnvSigningKeyRefresh   time.Duration
+	EnvSigningKeyRetention time.Duration
+
+	EnvPasswordPolicy m.PasswordPolicy
+	EnvSessionPolicy  m.SessionPolicy
+
+	// Pwned Passwords file of breached passwords, not checked if empty
+	EnvBreachedPasswordsFile        string
+	EnvBreachedPasswordsFlagOnLogin bool
+
+	// Lifetime of the restricted token GrantAuth issues when the password has to be changed
+	EnvPasswordChangeTokenTtl time.Duration
+
+	// Lifetime of the single use tokens of RequestPasswordReset
+	EnvPasswordResetTtl time.Duration
+
+	// Encrypts TOTP secrets, TOTP can not be enrolled without it
+	EnvMFAMasterKey    string
+	EnvTOTPIssuer      string
+	EnvMFAChallengeTtl time.Duration
+
+	// Relying party of passkey ceremonies
+	EnvWebAuthnRPID                    string
+	EnvWebAuthnRPName                  string
+	EnvWebAuthnOrigins                 []string
+	EnvWebAuthnRequireUserVerification bool
+	EnvWebAuthnChallengeTtl            time.Duration
+
+	// Delivery of passwordless login codes and links
+	EnvPasswordlessSender        string
+	EnvPasswordlessFile          string
+	EnvPasswordlessWebhookURL    string
+	EnvPasswordlessWebhookSecret string
+	EnvPasswordlessLinkURL       string
+	EnvPasswordlessTtl           time.Duration
+	EnvSMTPConfig                SMTPConfig
+
+	EnvSigner       string
+	EnvPKCS11Config PKCS11Config
+	EnvVaultConfig  VaultConfig
 )
 
 const projectDirName = "simple-micro-auth"
@@ -30,6 +97,28 @@ type PostgresConfig struct {
 	SslMode  string
 }
 
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+type PKCS11Config struct {
+	Module     string
+	TokenLabel string
+	Pin        string
+	KeyLabel   string
+}
+
+type VaultConfig struct {
+	Address string
+	Token   string
+	Mount   string
+	KeyName string
+}
+
 func init() {
 
 	var err error
@@ -53,6 +142,7 @@ func init() {
 		if err != nil {
 			EnvJWTExpiration, _ = time.ParseDuration("24h")
 		}
+		EnvJWTAlgorithm = os.Getenv("TEST_JWT_ALGORITHM")
 		EnvBcryptCost, err = strconv.Atoi(os.Getenv("TEST_BCRYPT_COST"))
 		if err != nil {
 			EnvBcryptCost = 10
@@ -71,6 +161,7 @@ func init() {
 		if err != nil {
 			EnvJWTExpiration, _ = time.ParseDuration("24h")
 		}
+		EnvJWTAlgorithm = os.Getenv("JWT_ALGORITHM")
 		EnvBcryptCost, err = strconv.Atoi(os.Getenv("BCRYPT_COST"))
 		if err != nil {
 			EnvBcryptCost = 10
@@ -84,6 +175,226 @@ func init() {
 		EnvPostgresConfig.SslMode = os.Getenv("DATABASE_SSLMODE")
 		EnvPostgresConfig.DBName = os.Getenv("DATABASE_DBNAME")
 	}
+
+	switch EnvJWTAlgorithm {
+	case "RS256", "RS512", "PS256", "ES256", "ES384", "EdDSA":
+	default:
+		EnvJWTAlgorithm = "RS256"
+	}
+
+	// HTTP endpoints, e.g. token introspection, are not served if empty
+	EnvHTTPPort = os.Getenv("HTTP_PORT")
+
+	EnvIntrospectionClients = map[string]string{}
+	for _, client := range strings.Split(os.Getenv("INTROSPECTION_CLIENTS"), ",") {
+		clientId, clientSecret, ok := strings.Cut(strings.TrimSpace(client), ":")
+		if ok && clientId != "" && clientSecret != "" {
+			EnvIntrospectionClients[clientId] = clientSecret
+		}
+	}
+
+	// Usernames of the login page are lookup hashes unless they are hashed like the ones of CreateAuth
+	EnvOAuthLookupHash = os.Getenv("OAUTH_LOOKUP_HASH")
+	if EnvOAuthLookupHash != "sha256" {
+		EnvOAuthLookupHash = "plain"
+	}
+	EnvOAuthCodeTtl, err = time.ParseDuration(os.Getenv("OAUTH_CODE_TTL"))
+	if err != nil || EnvOAuthCodeTtl <= 0 {
+		EnvOAuthCodeTtl, _ = time.ParseDuration("1m")
+	}
+	EnvOAuthRefreshTokenTtl, err = time.ParseDuration(os.Getenv("OAUTH_REFRESH_TOKEN_TTL"))
+	if err != nil || EnvOAuthRefreshTokenTtl <= 0 {
+		EnvOAuthRefreshTokenTtl, _ = time.ParseDuration("720h")
+	}
+
+	EnvAdminLookupHashes = []string{}
+	for _, lookupHash := range strings.Split(os.Getenv("ADMIN_LOOKUP_HASHES"), ",") {
+		if lookupHash = strings.TrimSpace(lookupHash); lookupHash != "" {
+			EnvAdminLookupHashes = append(EnvAdminLookupHashes, lookupHash)
+		}
+	}
+
+	EnvJWTIssuer = os.Getenv("JWT_ISSUER")
+	if EnvJWTIssuer == "" {
+		EnvJWTIssuer = "simple-micro-auth"
+	}
+
+	// Custom claims callers may put into tokens
+	EnvJWTClaims = []string{}
+	for _, claim := range strings.Split(os.Getenv("JWT_CUSTOM_CLAIMS"), ",") {
+		if claim = strings.TrimSpace(claim); claim != "" {
+			EnvJWTClaims = append(EnvJWTClaims, claim)
+		}
+	}
+
+	// Bounds of realms which have none of their own
+	EnvJWTTtlMin, err = time.ParseDuration(os.Getenv("JWT_TTL_MIN"))
+	if err != nil || EnvJWTTtlMin <= 0 {
+		EnvJWTTtlMin, _ = time.ParseDuration("1m")
+	}
+	EnvJWTTtlMax, err = time.ParseDuration(os.Getenv("JWT_TTL_MAX"))
+	if err != nil || EnvJWTTtlMax < EnvJWTTtlMin {
+		EnvJWTTtlMax = max(EnvJWTTtlMin, 720*time.Hour)
+	}
+	EnvJWTTtlOutOfRange = os.Getenv("JWT_TTL_OUT_OF_RANGE")
+	if EnvJWTTtlOutOfRange != "reject" {
+		EnvJWTTtlOutOfRange = "clamp"
+	}
+
+	// Password policy of realms which have none of their own
+	EnvPasswordPolicy.MinLength, err = strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH"))
+	if err != nil || EnvPasswordPolicy.MinLength < 1 {
+		EnvPasswordPolicy.MinLength = 1
+	}
+	EnvPasswordPolicy.MaxLength, err = strconv.Atoi(os.Getenv("PASSWORD_MAX_LENGTH"))
+	if err != nil || EnvPasswordPolicy.MaxLength < 1 || EnvPasswordPolicy.MaxLength > 72 {
+		// bcrypt only looks at the first 72 bytes
+		EnvPasswordPolicy.MaxLength = 72
+	}
+	for _, class := range strings.Split(os.Getenv("PASSWORD_REQUIRE"), ",") {
+		switch strings.TrimSpace(class) {
+		case "uppercase":
+			EnvPasswordPolicy.RequireUppercase = true
+		case "lowercase":
+			EnvPasswordPolicy.RequireLowercase = true
+		case "digit":
+			EnvPasswordPolicy.RequireDigit = true
+		case "symbol":
+			EnvPasswordPolicy.RequireSymbol = true
+		}
+	}
+	EnvPasswordPolicy.MaxRepeated, err = strconv.Atoi(os.Getenv("PASSWORD_MAX_REPEATED"))
+	if err != nil || EnvPasswordPolicy.MaxRepeated < 0 {
+		EnvPasswordPolicy.MaxRepeated = 0
+	}
+	EnvPasswordPolicy.MinStrength, err = strconv.Atoi(os.Getenv("PASSWORD_MIN_STRENGTH"))
+	if err != nil || EnvPasswordPolicy.MinStrength < 0 || EnvPasswordPolicy.MinStrength > 4 {
+		EnvPasswordPolicy.MinStrength = 0
+	}
+	EnvPasswordPolicy.DisallowLookupHash = os.Getenv("PASSWORD_DISALLOW_LOOKUP_HASH") == "true"
+	EnvPasswordPolicy.HistorySize, err = strconv.Atoi(os.Getenv("PASSWORD_HISTORY"))
+	if err != nil || EnvPasswordPolicy.HistorySize < 0 || EnvPasswordPolicy.HistorySize > 24 {
+		EnvPasswordPolicy.HistorySize = 0
+	}
+	EnvPasswordPolicy.MaxAgeDays, err = strconv.Atoi(os.Getenv("PASSWORD_MAX_AGE_DAYS"))
+	if err != nil || EnvPasswordPolicy.MaxAgeDays < 0 {
+		EnvPasswordPolicy.MaxAgeDays = 0
+	}
+	EnvPasswordChangeTokenTtl, err = time.ParseDuration(os.Getenv("PASSWORD_CHANGE_TOKEN_TTL"))
+	if err != nil || EnvPasswordChangeTokenTtl <= 0 {
+		EnvPasswordChangeTokenTtl, _ = time.ParseDuration("5m")
+	}
+	EnvPasswordResetTtl, err = time.ParseDuration(os.Getenv("PASSWORD_RESET_TTL"))
+	if err != nil || EnvPasswordResetTtl <= 0 {
+		EnvPasswordResetTtl, _ = time.ParseDuration("15m")
+	}
+
+	// Session policy of realms which have none of their own
+	EnvSessionPolicy.IdleTimeout, err = time.ParseDuration(os.Getenv("SESSION_IDLE_TIMEOUT"))
+	if err != nil || EnvSessionPolicy.IdleTimeout < 0 {
+		EnvSessionPolicy.IdleTimeout = 0
+	}
+	EnvSessionPolicy.MaxLifetime, err = time.ParseDuration(os.Getenv("SESSION_MAX_LIFETIME"))
+	if err != nil || EnvSessionPolicy.MaxLifetime < 0 {
+		EnvSessionPolicy.MaxLifetime = 0
+	}
+
+	EnvMFAMasterKey = os.Getenv("MFA_MASTER_KEY")
+	EnvTOTPIssuer = os.Getenv("TOTP_ISSUER")
+	if EnvTOTPIssuer == "" {
+		EnvTOTPIssuer = projectDirName
+	}
+	EnvMFAChallengeTtl, err = time.ParseDuration(os.Getenv("MFA_CHALLENGE_TTL"))
+	if err != nil || EnvMFAChallengeTtl <= 0 {
+		EnvMFAChallengeTtl, _ = time.ParseDuration("5m")
+	}
+
+	EnvWebAuthnRPID = os.Getenv("WEBAUTHN_RP_ID")
+	if EnvWebAuthnRPID == "" {
+		EnvWebAuthnRPID = "localhost"
+	}
+	EnvWebAuthnRPName = os.Getenv("WEBAUTHN_RP_NAME")
+	if EnvWebAuthnRPName == "" {
+		EnvWebAuthnRPName = projectDirName
+	}
+	EnvWebAuthnOrigins = []string{}
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			EnvWebAuthnOrigins = append(EnvWebAuthnOrigins, origin)
+		}
+	}
+	if len(EnvWebAuthnOrigins) == 0 {
+		EnvWebAuthnOrigins = []string{"https://" + EnvWebAuthnRPID}
+	}
+	EnvWebAuthnRequireUserVerification = os.Getenv("WEBAUTHN_USER_VERIFICATION") != "preferred"
+	EnvWebAuthnChallengeTtl, err = time.ParseDuration(os.Getenv("WEBAUTHN_CHALLENGE_TTL"))
+	if err != nil || EnvWebAuthnChallengeTtl <= 0 {
+		EnvWebAuthnChallengeTtl, _ = time.ParseDuration("5m")
+	}
+
+	// Codes and links are only logged unless a real sender is configured
+	EnvPasswordlessSender = os.Getenv("PASSWORDLESS_SENDER")
+	if EnvPasswordlessSender != "smtp" && EnvPasswordlessSender != "webhook" {
+		EnvPasswordlessSender = "file"
+	}
+	EnvPasswordlessFile = os.Getenv("PASSWORDLESS_FILE")
+	EnvPasswordlessWebhookURL = os.Getenv("PASSWORDLESS_WEBHOOK_URL")
+	EnvPasswordlessWebhookSecret = os.Getenv("PASSWORDLESS_WEBHOOK_SECRET")
+	EnvPasswordlessLinkURL = os.Getenv("PASSWORDLESS_LINK_URL")
+	EnvPasswordlessTtl, err = time.ParseDuration(os.Getenv("PASSWORDLESS_TTL"))
+	if err != nil || EnvPasswordlessTtl <= 0 {
+		EnvPasswordlessTtl, _ = time.ParseDuration("10m")
+	}
+
+	EnvSMTPConfig.Host = os.Getenv("SMTP_HOST")
+	EnvSMTPConfig.Port = os.Getenv("SMTP_PORT")
+	if EnvSMTPConfig.Port == "" {
+		EnvSMTPConfig.Port = "587"
+	}
+	EnvSMTPConfig.Username = os.Getenv("SMTP_USERNAME")
+	EnvSMTPConfig.Password = os.Getenv("SMTP_PASSWORD")
+	EnvSMTPConfig.From = os.Getenv("SMTP_FROM")
+
+	EnvBreachedPasswordsFile = os.Getenv("BREACHED_PASSWORDS_FILE")
+	EnvBreachedPasswordsFlagOnLogin = os.Getenv("BREACHED_PASSWORDS_FLAG_ON_LOGIN") == "true"
+
+	// Signing keys are kept in cert/ files unless shared between replicas through the db
+	EnvSigningKeyStore = os.Getenv("SIGNING_KEY_STORE")
+	if EnvSigningKeyStore != "db" {
+		EnvSigningKeyStore = "file"
+	}
+	EnvSigningKeyMasterKey = os.Getenv("SIGNING_KEY_MASTER_KEY")
+	EnvSigningKeyRotation, err = time.ParseDuration(os.Getenv("SIGNING_KEY_ROTATION"))
+	if err != nil {
+		EnvSigningKeyRotation = 0
+	}
+	EnvSigningKeyRefresh, err = time.ParseDuration(os.Getenv("SIGNING_KEY_REFRESH"))
+	if err != nil || EnvSigningKeyRefresh <= 0 {
+		EnvSigningKeyRefresh, _ = time.ParseDuration("1m")
+	}
+	EnvSigningKeyRetention, err = time.ParseDuration(os.Getenv("SIGNING_KEY_RETENTION"))
+	if err != nil {
+		EnvSigningKeyRetention, _ = time.ParseDuration("168h")
+	}
+
+	// Tokens are signed with local keys unless the key lives in an HSM or Vault
+	EnvSigner = os.Getenv("SIGNER")
+	if EnvSigner != "pkcs11" && EnvSigner != "vault" {
+		EnvSigner = "local"
+	}
+
+	EnvPKCS11Config.Module = os.Getenv("PKCS11_MODULE")
+	EnvPKCS11Config.TokenLabel = os.Getenv("PKCS11_TOKEN_LABEL")
+	EnvPKCS11Config.Pin = os.Getenv("PKCS11_PIN")
+	EnvPKCS11Config.KeyLabel = os.Getenv("PKCS11_KEY_LABEL")
+
+	EnvVaultConfig.Address = os.Getenv("VAULT_ADDR")
+	EnvVaultConfig.Token = os.Getenv("VAULT_TOKEN")
+	EnvVaultConfig.Mount = os.Getenv("VAULT_TRANSIT_MOUNT")
+	if EnvVaultConfig.Mount == "" {
+		EnvVaultConfig.Mount = "transit"
+	}
+	EnvVaultConfig.KeyName = os.Getenv("VAULT_TRANSIT_KEY")
 }
 
 func loadEnv() error {
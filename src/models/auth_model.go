@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type AuthDTO struct {
 	Id         int64
 	LookupHash string
@@ -14,18 +16,297 @@ type AuthDTOUpdate struct {
 }
 
 type CredentialsDTO struct {
+	RealmId    string
 	LookupHash string
 	Password   string
+	Status     string // active if empty
+	SubjectId  int64  // sub of tokens issued through /authorize
 }
 
 type CredentialsDTOUpdate struct {
+	RealmId     string
 	LookupHash  string
 	OldPassword string
 	NewPassword string
+	HistorySize int // Previous passwords the new one must not match, 0 keeps no history
 }
 
 type AuthResponse struct {
-	Id    int64
-	Token string
-	Error string
+	Id        int64
+	Token     string
+	Error     string
+	ExpiresAt int64
+}
+
+type TOTPDTO struct {
+	Secret        []byte // Encrypted, nil until the first enrollment is confirmed
+	PendingSecret []byte // Encrypted, enrolled but not confirmed yet
+	LastUsedStep  int64
+}
+
+type WebAuthnCredentialDTO struct {
+	CredentialId []byte
+	RealmId      string
+	LookupHash   string
+	PublicKey    []byte // COSE_Key
+	SignCount    uint32
+	Name         string
+	CreatedAt    time.Time
+	LastUsedAt   *time.Time
+}
+
+/**
+ * Pending passkey ceremony, LookupHash is empty for logins with discoverable credentials
+ */
+type WebAuthnChallengeDTO struct {
+	ChallengeHash string
+	RealmId       string
+	LookupHash    string
+	Ceremony      string // registration or login
+	ExpiresAt     time.Time
+}
+
+/**
+ * Pending passwordless login, CodeHash is empty for links
+ */
+type PasswordlessLoginDTO struct {
+	LoginHash  string
+	RealmId    string
+	LookupHash string
+	CodeHash   string
+	Attempts   int
+	ExpiresAt  time.Time
+}
+
+/**
+ * Parameters of a GrantAuth, kept while its second factor is pending
+ */
+type GrantDTO struct {
+	LookupHash       string            `json:"-"`
+	Id               int64             `json:"id"`
+	Ttl              string            `json:"ttl"`
+	Audience         []string          `json:"audience"`
+	Claims           map[string]string `json:"claims"`
+	PasswordBreached bool              `json:"passwordBreached"`
+	Client           ClientDTO         `json:"client"`
+}
+
+/**
+ * Client a session was started from, as reported by the caller
+ */
+type ClientDTO struct {
+	UserAgent string `json:"userAgent"`
+	Device    string `json:"device"`
+	IP        string `json:"ip"`
+}
+
+type SessionDTO struct {
+	SessionId       string
+	RealmId         string
+	LookupHash      string
+	Client          ClientDTO
+	CreatedAt       time.Time
+	LastRefreshedAt time.Time
+}
+
+/**
+ * Application logging users in through /authorize, SecretHash is empty for public clients
+ */
+type OAuthClientDTO struct {
+	ClientId     string
+	RealmId      string
+	Name         string
+	SecretHash   string
+	RedirectURIs []string
+	Scopes       []string
+	TokenTtlMin  time.Duration // Bound of the realm if 0
+	TokenTtlMax  time.Duration // Bound of the realm if 0
+	CreatedAt    time.Time
+}
+
+/**
+ * Authorization code waiting for its exchange at /token
+ */
+type OAuthCodeDTO struct {
+	CodeHash      string
+	RealmId       string
+	ClientId      string
+	LookupHash    string
+	SubjectId     int64
+	RedirectURI   string
+	CodeChallenge string // S256 of the code_verifier
+	Scopes        []string
+	Client        ClientDTO // Browser of the login, the session is started for it
+	Nonce         string    // Of the authorization request, echoed in ID tokens
+	AMR           []string  // Authentication methods of the login, e.g. pwd and otp
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+}
+
+/**
+ * Refresh token of an OAuth client, bound to the session started by the code exchange
+ */
+type OAuthRefreshTokenDTO struct {
+	TokenHash  string
+	RealmId    string
+	ClientId   string
+	LookupHash string
+	SubjectId  int64
+	Scopes     []string
+	SessionId  string
+	Nonce      string
+	AMR        []string
+	AuthTime   time.Time
+	ExpiresAt  time.Time
+}
+
+type OAuthConsentDTO struct {
+	RealmId    string
+	LookupHash string
+	ClientId   string
+	ClientName string
+	Scopes     []string
+	GrantedAt  time.Time
+}
+
+/**
+ * Login through /authorize waiting for the user to allow or deny the scopes
+ */
+type OAuthConsentRequestDTO struct {
+	ConsentHash string
+	RealmId     string
+	ClientId    string
+	Grant       GrantDTO
+	Scopes      []string
+	AMR         []string
+	ExpiresAt   time.Time
+}
+
+/**
+ * Backend service getting tokens of its own, it authenticates with a secret or, if PublicKey is set, a private_key_jwt assertion
+ */
+type MachineClientDTO struct {
+	ClientId   string
+	RealmId    string
+	Name       string
+	SecretHash string
+	PublicKey  []byte // JWK
+	Scopes     []string
+	CreatedAt  time.Time
+}
+
+type MFAChallengeDTO struct {
+	ChallengeHash string
+	RealmId       string
+	Grant         GrantDTO
+	Attempts      int
+	ExpiresAt     time.Time
+}
+
+type RealmDTO struct {
+	Id             string
+	TokenTtl       time.Duration
+	TokenTtlMin    time.Duration   // JWT_TTL_MIN if 0
+	TokenTtlMax    time.Duration   // JWT_TTL_MAX if 0
+	PasswordPolicy *PasswordPolicy // PASSWORD_* defaults if nil
+	SessionPolicy  *SessionPolicy  // SESSION_* defaults if nil
+	CreatedAt      time.Time
+}
+
+type PasswordPolicy struct {
+	MinLength          int  `json:"minLength"`
+	MaxLength          int  `json:"maxLength"`
+	RequireUppercase   bool `json:"requireUppercase"`
+	RequireLowercase   bool `json:"requireLowercase"`
+	RequireDigit       bool `json:"requireDigit"`
+	RequireSymbol      bool `json:"requireSymbol"`
+	MaxRepeated        int  `json:"maxRepeated"`
+	MinStrength        int  `json:"minStrength"`
+	DisallowLookupHash bool `json:"disallowLookupHash"`
+	HistorySize        int  `json:"historySize"`
+	MaxAgeDays         int  `json:"maxAgeDays"`
+}
+
+/**
+ * Limits of a session regardless of the token lifetimes requested, 0 disables a limit
+ */
+type SessionPolicy struct {
+	IdleTimeout time.Duration `json:"idleTimeout"` // Since the login or the last refresh
+	MaxLifetime time.Duration `json:"maxLifetime"` // Since the login
+}
+
+type CredentialsStatusDTO struct {
+	Status             string // active, disabled, locked or pending
+	PasswordChangedAt  time.Time
+	MustChangePassword bool
+	PasswordBreached   bool
+	SubjectId          int64 // 0 until recorded by CreateAuth or a login
+}
+
+type FieldError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+type RoleDTO struct {
+	Name   string
+	Scopes []string
+}
+
+type SigningKeyDTO struct {
+	Kid         string
+	Target      string
+	Algorithm   string
+	PrivateKey  []byte
+	PublicKey   []byte
+	CreatedAt   time.Time
+	ActivatesAt time.Time
+}
+
+type TokenDTO struct {
+	Id        int64
+	IssuedAt  int64
+	ExpiresAt int64
+	Noise     int64
+	Issuer    string
+	Audience  []string
+	Scopes    []string
+	Claims    map[string]interface{}
+	// Credentials the token is issued for, their account status is checked on use
+	LookupHash string
+	// jti, random if empty
+	TokenId string
+	// sid, the token is not bound to a session if empty
+	SessionId string
+	// Unix seconds of the login the token goes back to
+	AuthTime int64
+	// client_id, OAuth or machine client the token is issued to
+	ClientId string
+	// sub of tokens which are not issued for credentials, the numeric Id if empty
+	Subject string
+	// nonce, acr and amr of ID tokens
+	Nonce string
+	ACR   string
+	AMR   []string
+	// token_use, set to tell tokens which grant nothing, like ID tokens, from access tokens
+	TokenUse string
+}
+
+type TokenClaims struct {
+	Id        int64
+	Subject   string
+	ExpiresAt int64
+	IssuedAt  int64
+	NotBefore int64
+	AuthTime  int64
+	TokenId   string
+	Issuer    string
+	Audience  []string
+	Scopes    []string
+	SessionId string
+	ClientId  string
+	// Credentials of the token, empty for tokens issued before account status existed
+	LookupHash string
+	Custom     map[string]interface{}
 }
@@ -0,0 +1,49 @@
+package sender
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+// Serializes appends of concurrent logins to the same file
+var fileLock sync.Mutex
+
+/**
+ * Appends messages as JSON lines to a file, or logs them if the path is empty
+ * Codes and links end up in plain text, only meant for local testing
+ */
+type fileSender struct {
+	path string
+}
+
+func NewFileSender(path string) Sender {
+	return &fileSender{path: path}
+}
+
+func (sender *fileSender) Send(message Message) error {
+
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	if sender.path == "" {
+		log.Printf("passwordless login message: %s", line)
+		return nil
+	}
+
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	file, err := os.OpenFile(sender.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+
+	return err
+}
@@ -0,0 +1,46 @@
+package sender
+
+import (
+	"fmt"
+	"time"
+)
+
+/**
+ * Login code or link for a user, the sender decides how it reaches them
+ */
+type Message struct {
+	Destination string    `json:"destination"` // e.g. the email address
+	Channel     string    `json:"channel"`     // code or link
+	Code        string    `json:"code,omitempty"`
+	Link        string    `json:"link,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+/**
+ * Delivers passwordless login messages
+ * Implemented by SMTP, a webhook and a file or log for local testing
+ */
+type Sender interface {
+	Send(message Message) error
+}
+
+func (message Message) subject() string {
+	if message.Channel == "link" {
+		return "Your login link"
+	}
+	return "Your login code"
+}
+
+/**
+ * Plain text for senders which render the message themselves
+ */
+func (message Message) text() string {
+
+	expiresIn := time.Until(message.ExpiresAt).Round(time.Minute)
+
+	if message.Channel == "link" {
+		return fmt.Sprintf("Log in with this link, it expires in %s:\r\n\r\n%s\r\n", expiresIn, message.Link)
+	}
+
+	return fmt.Sprintf("Your login code is %s, it expires in %s.\r\n", message.Code, expiresIn)
+}
@@ -0,0 +1,54 @@
+package sender
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	c "simple-micro-auth/src/configs"
+)
+
+/**
+ * Emails messages, authenticating with PLAIN if a username is configured
+ * net/smtp upgrades to TLS with STARTTLS when the server offers it and refuses PLAIN without TLS unless on localhost
+ */
+type smtpSender struct {
+	config c.SMTPConfig
+}
+
+func NewSMTPSender(config c.SMTPConfig) Sender {
+	return &smtpSender{config: config}
+}
+
+func (sender *smtpSender) Send(message Message) error {
+
+	// Destinations come from callers, a line break would inject headers
+	if strings.ContainsAny(message.Destination, "\r\n") {
+		return fmt.Errorf("invalid destination")
+	}
+
+	var auth smtp.Auth
+	if sender.config.Username != "" {
+		auth = smtp.PlainAuth("", sender.config.Username, sender.config.Password, sender.config.Host)
+	}
+
+	headers := []string{
+		"From: " + sender.config.From,
+		"To: " + message.Destination,
+		"Subject: " + message.subject(),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	body := strings.Join(headers, "\r\n") + "\r\n\r\n" + message.text()
+
+	err := smtp.SendMail(net.JoinHostPort(sender.config.Host, sender.config.Port), auth, sender.config.From,
+		[]string{message.Destination}, []byte(body))
+	if err != nil {
+		return fmt.Errorf("sending email failed: %v", err)
+	}
+
+	return nil
+}
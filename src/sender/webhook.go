@@ -0,0 +1,61 @@
+package sender
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Header carrying the hex HMAC-SHA256 of the body, keyed with the webhook secret
+const SignatureHeader = "X-Signature-SHA256"
+
+/**
+ * POSTs messages as JSON, e.g. to a notification service which renders and delivers them
+ */
+type webhookSender struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func NewWebhookSender(url string, secret string) Sender {
+	return &webhookSender{url: url, secret: secret, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (sender *webhookSender) Send(message Message) error {
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, sender.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	// Lets the receiver tell the messages apart from forged ones
+	if sender.secret != "" {
+		mac := hmac.New(sha256.New, []byte(sender.secret))
+		mac.Write(body)
+		request.Header.Set(SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := sender.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+
+	return nil
+}
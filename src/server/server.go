@@ -4,8 +4,9 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"time"
 
-	"simple-micro-auth/src/cert"
 	"simple-micro-auth/src/configs"
 	pb "simple-micro-auth/src/proto"
 	"simple-micro-auth/src/services"
@@ -17,7 +18,16 @@ var grpcServer *grpc.Server
 
 func RunServer() {
 
-	cert.ReadCertificates("token")
+	err := services.LoadSigningKeys(services.DefaultRealm)
+	if err != nil {
+		log.Fatalf("failed to load signing keys: %v", err)
+	}
+	go services.WatchSigningKeys()
+
+	err = services.LoadBreachedPasswords()
+	if err != nil {
+		log.Fatalf("failed to load breached passwords: %v", err)
+	}
 
 	var host string
 
@@ -27,6 +37,10 @@ func RunServer() {
 		host = "127.0.0.1"
 	}
 
+	if configs.EnvHTTPPort != "" {
+		go RunHTTPServer(host)
+	}
+
 	listenPort := fmt.Sprintf("%s:%s", host, configs.EnvPort)
 
 	lis, err := net.Listen("tcp", listenPort)
@@ -48,6 +62,41 @@ func RunServer() {
 	}
 }
 
+/**
+ * Serve the HTTP endpoints, RFC 7662 token introspection for gateways which do not speak gRPC and the OAuth 2.0 and OpenID Connect login of clients
+ */
+func RunHTTPServer(host string) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/introspect", services.IntrospectionHandler)
+	mux.HandleFunc("/authorize", services.AuthorizeHandler)
+	mux.HandleFunc("/token", services.OAuthTokenHandler)
+	mux.HandleFunc("/userinfo", services.UserInfoHandler)
+	mux.HandleFunc("/.well-known/openid-configuration", services.OIDCMetadataHandler)
+	mux.HandleFunc("/jwks", services.OIDCMetadataHandler)
+	mux.HandleFunc("/realms/", services.OIDCMetadataHandler)
+
+	listenPort := fmt.Sprintf("%s:%s", host, configs.EnvHTTPPort)
+
+	fmt.Println("Listening on " + listenPort + " for HTTP")
+
+	// The login page faces browsers, so slow clients must not hold connections open
+	httpServer := &http.Server{
+		Addr:              listenPort,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		MaxHeaderBytes:    64 << 10,
+	}
+
+	err := httpServer.ListenAndServe()
+	if err != nil {
+		log.Fatalf("Error starting http server: %v", err)
+	}
+}
+
 func StopServer() {
 	grpcServer.Stop()
 }
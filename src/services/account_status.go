@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	pb "simple-micro-auth/src/proto"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Account status of credentials, only active ones can log in and use their tokens
+const (
+	statusActive   = "active"
+	statusDisabled = "disabled"
+	statusLocked   = "locked"
+	statusPending  = "pending"
+)
+
+/**
+ * Admin RPC, the credentials keep their password but tokens issued for them stop working at once
+ */
+func (service *AuthServiceServer) DisableAuth(ctx context.Context, req *pb.DisableAuthRequest) (*pb.AuthStatusResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	status := statusDisabled
+	if req.Lock {
+		status = statusLocked
+	}
+
+	err = db.SetAuthStatus(req.Realm, req.LookupHash, status)
+	if err != nil {
+		return &pb.AuthStatusResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.AuthStatusResponse{Error: ""}, nil
+}
+
+func (service *AuthServiceServer) EnableAuth(ctx context.Context, req *pb.EnableAuthRequest) (*pb.AuthStatusResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.SetAuthStatus(req.Realm, req.LookupHash, statusActive)
+	if err != nil {
+		return &pb.AuthStatusResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.AuthStatusResponse{Error: ""}, nil
+}
+
+func checkAccountStatus(status string) error {
+
+	switch status {
+	case statusActive:
+		return nil
+	case statusPending:
+		return fmt.Errorf("account pending verification")
+	default:
+		return fmt.Errorf("account %s", status)
+	}
+}
+
+/**
+ * Fail for tokens of credentials which are no longer active or were deleted
+ * Tokens without a lookup_hash claim were issued before account status existed and are not checked
+ */
+func checkAccountActive(claims jwt.MapClaims) error {
+
+	lookupHash, _ := claims["lookup_hash"].(string)
+	if lookupHash == "" {
+		return nil
+	}
+
+	issuer, _ := claims["iss"].(string)
+	realmId, ok := issuerRealm(issuer)
+	if !ok {
+		return fmt.Errorf("unknown issuer")
+	}
+
+	credentialsStatus, err := db.GetCredentialsStatus(realmId, lookupHash)
+	if err != nil {
+		return err
+	}
+
+	return checkAccountStatus(credentialsStatus.Status)
+}
+
+/**
+ * Every check a verified token has to pass before it is accepted, except by UpdateAuth
+ */
+func checkTokenActive(claims jwt.MapClaims) error {
+
+	err := checkRevoked(claims)
+	if err != nil {
+		return err
+	}
+
+	err = checkRestricted(claims)
+	if err != nil {
+		return err
+	}
+
+	err = checkAccountActive(claims)
+	if err != nil {
+		return err
+	}
+
+	err = checkMachineClient(claims)
+	if err != nil {
+		return err
+	}
+
+	return checkSession(claims)
+}
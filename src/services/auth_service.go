@@ -2,15 +2,23 @@ package services
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/rand"
-	"os"
 	"simple-micro-auth/src/cert"
 	c "simple-micro-auth/src/configs"
 	m "simple-micro-auth/src/models"
 	pb "simple-micro-auth/src/proto"
 	"strings"
 	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 var (
@@ -23,66 +31,151 @@ type AuthServiceServer struct {
 }
 
 func (service *AuthServiceServer) CreateAuth(ctx context.Context, req *pb.AuthRequest) (*pb.AuthResponse, error) {
+	err := authorizeAdminCredentials(ctx, req.Realm, req.LookupHash, true)
+	if _, ok := status.FromError(err); !ok {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkCustomClaims(req.Claims)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	realm, keys, err := resolveRealm(req.Realm)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	// Out of range lifetimes are rejected before anything is stored
+	_, err = realmTokenTtl(realm, req.Ttl)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	violations, err := checkNewPassword(realm, "password", req.Password, req.LookupHash)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	if len(violations) > 0 {
+		return passwordPolicyResponse(violations), nil
+	}
+
 	newCredentialsDTO := m.CredentialsDTO{
+		RealmId:    realm.Id,
 		LookupHash: req.LookupHash,
 		Password:   req.Password,
+		Status:     statusActive,
+		SubjectId:  req.Id,
+	}
+	if req.Pending {
+		newCredentialsDTO.Status = statusPending
 	}
-	err := db.CreateCredentials(newCredentialsDTO)
+	err = db.CreateCredentials(newCredentialsDTO)
 	if err != nil {
 		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
 	}
 
-	tokenTtl, err := time.ParseDuration(req.Ttl)
-	if err != nil {
-		tokenTtl = c.EnvJWTExpiration
+	// Pending credentials get their first token once EnableAuth verified them
+	if req.Pending {
+		return &pb.AuthResponse{Id: req.Id, Token: "", Error: ""}, nil
 	}
 
-	token, err := tokenHandler.CreateToken(
-		req.Id,
-		time.Now().Unix(),
-		time.Now().Add(tokenTtl).Unix(),
-		rand.Int63(),
-		cert.PrivateKey,
-	)
+	token, expiresAt, err := issueToken(realm, keys, req.LookupHash, req.Id, req.Ttl, req.Audience, req.Claims, clientFromPb(ctx, req.Client))
 	if err != nil {
 		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
 	}
 
-	return &pb.AuthResponse{Id: req.Id, Token: token, Error: ""}, nil
+	return &pb.AuthResponse{Id: req.Id, Token: token, Error: "", ExpiresAt: expiresAt}, nil
 }
 
 func (service *AuthServiceServer) UpdateAuth(ctx context.Context, req *pb.UpdateAuthRequest) (*pb.AuthResponse, error) {
+	err := checkCustomClaims(req.Claims)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	realm, keys, err := resolveRealm(req.Realm)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	_, err = realmTokenTtl(realm, req.Ttl)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	violations, err := checkNewPassword(realm, "newPassword", req.NewPassword, req.LookupHash)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	if len(violations) > 0 {
+		return passwordPolicyResponse(violations), nil
+	}
+
 	updCredentialsDTO := m.CredentialsDTOUpdate{
+		RealmId:     realm.Id,
 		LookupHash:  req.LookupHash,
 		OldPassword: req.OldPassword,
 		NewPassword: req.NewPassword,
+		HistorySize: realmPasswordPolicy(realm).HistorySize,
+	}
+
+	credentialsStatus, err := db.GetCredentialsStatus(realm.Id, req.LookupHash)
+	if err == nil {
+		err = checkAccountStatus(credentialsStatus.Status)
 	}
-	err := db.UpdateCredentials(updCredentialsDTO)
 	if err != nil {
 		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
 	}
 
-	tokenTtl, err := time.ParseDuration(req.Ttl)
+	// A password change token from GrantAuth stands in for the old password and is used up by the change
+	var passwordChangeClaims m.TokenClaims
+	if req.PasswordChangeToken != "" {
+		passwordChangeClaims, err = verifyPasswordChangeToken(req.PasswordChangeToken, keys, req.LookupHash)
+		if err != nil {
+			return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+		}
+		err = db.SetPassword(updCredentialsDTO)
+	} else {
+		err = db.UpdateCredentials(updCredentialsDTO)
+	}
+	if errors.Is(err, errPasswordReused) {
+		return passwordPolicyResponse([]m.FieldError{reusedPasswordError("newPassword", updCredentialsDTO.HistorySize)}), nil
+	}
 	if err != nil {
-		tokenTtl = c.EnvJWTExpiration
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	if passwordChangeClaims.TokenId != "" {
+		err = db.RevokeToken(passwordChangeClaims.TokenId, time.Unix(passwordChangeClaims.ExpiresAt, 0))
+		if err != nil {
+			return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+		}
 	}
 
-	token, err := tokenHandler.CreateToken(
-		req.Id,
-		time.Now().Unix(),
-		time.Now().Add(tokenTtl).Unix(),
-		rand.Int63(),
-		cert.PrivateKey,
-	)
+	token, expiresAt, err := issueToken(realm, keys, req.LookupHash, req.Id, req.Ttl, req.Audience, req.Claims, clientFromPb(ctx, req.Client))
 	if err != nil {
 		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
 	}
 
-	return &pb.AuthResponse{Id: req.Id, Token: token, Error: ""}, nil
+	return &pb.AuthResponse{Id: req.Id, Token: token, Error: "", ExpiresAt: expiresAt}, nil
 }
 
 func (service *AuthServiceServer) DeleteAuth(ctx context.Context, req *pb.DeleteAuthRequest) (*pb.DeleteAuthResponse, error) {
-	err := db.DeleteCredentials(req.LookupHash)
+	err := authorizeAdminCredentials(ctx, req.Realm, req.LookupHash, false)
+	if _, ok := status.FromError(err); !ok {
+		return &pb.DeleteAuthResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.DeleteCredentials(req.Realm, req.LookupHash)
 	if err != nil {
 		return &pb.DeleteAuthResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
 	}
@@ -91,79 +184,286 @@ func (service *AuthServiceServer) DeleteAuth(ctx context.Context, req *pb.Delete
 }
 
 func (service *AuthServiceServer) GrantAuth(ctx context.Context, req *pb.AuthRequest) (*pb.AuthResponse, error) {
+	err := checkCustomClaims(req.Claims)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	realm, keys, err := resolveRealm(req.Realm)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	_, err = realmTokenTtl(realm, req.Ttl)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
 	compareCredentialsDT := m.CredentialsDTO{
+		RealmId:    realm.Id,
 		LookupHash: req.LookupHash,
 		Password:   req.Password,
 	}
 
-	err := db.VerifyCredentials(compareCredentialsDT)
+	err = db.VerifyCredentials(compareCredentialsDT)
 	if err != nil {
 		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
 	}
 
-	tokenTtl, err := time.ParseDuration(req.Ttl)
+	grant := m.GrantDTO{
+		LookupHash:       req.LookupHash,
+		Id:               req.Id,
+		Ttl:              req.Ttl,
+		Audience:         req.Audience,
+		Claims:           req.Claims,
+		PasswordBreached: flagBreachedOnLogin(compareCredentialsDT),
+		Client:           clientFromPb(ctx, req.Client),
+	}
+
+	credentialsStatus, err := db.GetCredentialsStatus(realm.Id, req.LookupHash)
+	if err == nil {
+		err = checkAccountStatus(credentialsStatus.Status)
+	}
 	if err != nil {
-		tokenTtl = c.EnvJWTExpiration
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
 	}
 
-	token, err := tokenHandler.CreateToken(
-		req.Id,
-		time.Now().Unix(),
-		time.Now().Add(tokenTtl).Unix(),
-		rand.Int63(),
-		cert.PrivateKey,
-	)
+	// Credentials with a second factor get a challenge for CompleteMFA instead of a token
+	mfaResponse, err := startMFA(realm, grant)
 	if err != nil {
 		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
 	}
+	if mfaResponse != nil {
+		return mfaResponse, nil
+	}
 
-	return &pb.AuthResponse{Id: req.Id, Token: token, Error: ""}, nil
+	return grantToken(realm, keys, grant, credentialsStatus), nil
 }
 
 func (service *AuthServiceServer) VerifyCredentials(ctx context.Context, req *pb.CredentialsRequest) (*pb.VerifyResponse, error) {
+	realm, err := db.GetRealm(realmOrDefault(req.Realm))
+	if err != nil {
+		return &pb.VerifyResponse{Success: false, Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
 	compareCredentialsDT := m.CredentialsDTO{
+		RealmId:    realm.Id,
 		LookupHash: req.LookupHash,
 		Password:   req.Password,
 	}
 
-	err := db.VerifyCredentials(compareCredentialsDT)
+	err = db.VerifyCredentials(compareCredentialsDT)
+	if err != nil {
+		return &pb.VerifyResponse{Success: false, Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	passwordBreached := flagBreachedOnLogin(compareCredentialsDT)
+
+	credentialsStatus, err := db.GetCredentialsStatus(realm.Id, req.LookupHash)
+	if err == nil {
+		err = checkAccountStatus(credentialsStatus.Status)
+	}
 	if err != nil {
 		return &pb.VerifyResponse{Success: false, Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
 	}
 
-	return &pb.VerifyResponse{Success: true, Error: ""}, nil
+	mfaRequired, err := mfaEnrolled(realm.Id, req.LookupHash)
+	if err != nil {
+		return &pb.VerifyResponse{Success: false, Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.VerifyResponse{
+		Success:                true,
+		Error:                  "",
+		PasswordBreached:       passwordBreached,
+		PasswordChangeRequired: passwordChangeRequired(realm, credentialsStatus),
+		MfaRequired:            mfaRequired,
+	}, nil
 }
 
-func (service *AuthServiceServer) VerifyToken(ctx context.Context, req *pb.VerifyTokenRequest) (*pb.AuthResponse, error) {
-	id, err := tokenHandler.VerifyToken(req.Token, time.Now().Unix(), cert.PublicKey)
+func (service *AuthServiceServer) VerifyToken(ctx context.Context, req *pb.VerifyTokenRequest) (*pb.VerifyTokenResponse, error) {
+	_, keys, err := resolveRealm(req.Realm)
+	if err != nil {
+		return &pb.VerifyTokenResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	claims, err := tokenHandler.VerifyClaims(req.Token, time.Now().Unix(), keys, req.Issuer, req.Audience)
+	if err != nil {
+		return &pb.VerifyTokenResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
 
+	err = checkTokenActive(claims)
 	if err != nil {
-		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+		return &pb.VerifyTokenResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	tokenClaims, err := tokenHandler.ParseClaims(claims)
+	if err != nil {
+		return &pb.VerifyTokenResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
 	}
 
-	return &pb.AuthResponse{Id: id, Token: req.Token, Error: ""}, nil
+	claimsStruct, err := structpb.NewStruct(claims)
+	if err != nil {
+		return &pb.VerifyTokenResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	customStruct, err := structpb.NewStruct(tokenClaims.Custom)
+	if err != nil {
+		return &pb.VerifyTokenResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.VerifyTokenResponse{
+		Id:     tokenClaims.Id,
+		Token:  req.Token,
+		Error:  "",
+		Claims: claimsStruct,
+		TokenClaims: &pb.TokenClaims{
+			Subject:   tokenClaims.Subject,
+			ExpiresAt: tokenClaims.ExpiresAt,
+			IssuedAt:  tokenClaims.IssuedAt,
+			NotBefore: tokenClaims.NotBefore,
+			AuthTime:  tokenClaims.AuthTime,
+			TokenId:   tokenClaims.TokenId,
+			Issuer:    tokenClaims.Issuer,
+			Audience:  tokenClaims.Audience,
+			Scopes:    tokenClaims.Scopes,
+			SessionId: tokenClaims.SessionId,
+			ClientId:  tokenClaims.ClientId,
+			Custom:    customStruct,
+		},
+	}, nil
 }
 
 func (service *AuthServiceServer) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.AuthResponse, error) {
-	tokenTtl, err := time.ParseDuration(req.Ttl)
+	realm, keys, err := resolveRealm(req.Realm)
 	if err != nil {
-		tokenTtl = c.EnvJWTExpiration
+		return &pb.AuthResponse{Id: 0, Token: req.Token, Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
 	}
 
-	response := tokenHandler.RefreshToken(req.Token, tokenTtl)
+	tokenTtl, err := realmTokenTtl(realm, req.Ttl)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: req.Token, Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	// Revoked, password change and tokens of inactive accounts or ended sessions can not be refreshed, other errors are reported by RefreshToken itself
+	claims, err := tokenHandler.VerifyClaims(req.Token, time.Now().Unix(), keys, "", "")
+	if err == nil {
+		err = checkTokenActive(claims)
+		if err == nil {
+			tokenTtl, err = refreshTokenTtl(realm, claims, tokenTtl)
+		}
+		if err != nil {
+			return &pb.AuthResponse{Id: 0, Token: req.Token, Error: strings.ToValidUTF8("TokenError: "+err.Error(), "UTF-8_BUGFIX")}, nil
+		}
+	}
+
+	response := tokenHandler.RefreshToken(req.Token, tokenTtl, keys)
 
-	return &pb.AuthResponse{Id: response.Id, Token: response.Token, Error: strings.ToValidUTF8(response.Error, "UTF-8_BUGFIX")}, nil
+	sessionId, _ := claims["sid"].(string)
+	if response.Error == "" && sessionId != "" {
+		err = db.TouchSession(sessionId)
+		if err != nil {
+			return &pb.AuthResponse{Id: 0, Token: req.Token, Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+		}
+	}
+
+	return &pb.AuthResponse{Id: response.Id, Token: response.Token, Error: strings.ToValidUTF8(response.Error, "UTF-8_BUGFIX"), ExpiresAt: response.ExpiresAt}, nil
+}
+
+/**
+ * Revoke the token until it expires
+ * Only valid tokens carrying a jti claim can be revoked
+ */
+func (service *AuthServiceServer) RevokeToken(ctx context.Context, req *pb.RevokeTokenRequest) (*pb.RevokeTokenResponse, error) {
+	_, keys, err := resolveRealm(req.Realm)
+	if err != nil {
+		return &pb.RevokeTokenResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	claims, err := tokenHandler.VerifyClaims(req.Token, time.Now().Unix(), keys, "", "")
+	if err != nil {
+		return &pb.RevokeTokenResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	tokenClaims, err := tokenHandler.ParseClaims(claims)
+	if err != nil {
+		return &pb.RevokeTokenResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	if tokenClaims.TokenId == "" {
+		err = fmt.Errorf("token has no jti claim and can not be revoked")
+		return &pb.RevokeTokenResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	err = db.RevokeToken(tokenClaims.TokenId, time.Unix(tokenClaims.ExpiresAt, 0))
+	if err != nil {
+		return &pb.RevokeTokenResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RevokeTokenResponse{Error: ""}, nil
 }
 
 /**
  * Get public key
+ * Only targets registered in cert are served, keys never come from a path built out of the request
  */
 func (service *AuthServiceServer) GetPublicKey(ctx context.Context, req *pb.PublicKeyRequest) (*pb.PublicKeyResponse, error) {
 
-	target := req.Target
+	keys, ok := cert.LookupTarget(req.Target)
+	if req.Realm != "" && req.Target == "token" {
+		// Token keys of other realms are loaded on first use
+		var err error
+		_, keys, err = resolveRealm(req.Realm)
+		if errors.Is(err, errRealmNotFound) {
+			return nil, status.Errorf(codes.NotFound, "unknown realm")
+		}
+		if err != nil {
+			return &pb.PublicKeyResponse{PublicKey: []byte{}, Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+		}
+		ok = true
+	}
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown key target")
+	}
+
+	key := keys.Active()
+	if req.KeyId != "" {
+		key, ok = keys.Lookup(req.KeyId)
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "unknown key id")
+		}
+	}
+
+	var publicKey []byte
+	var err error
+
+	switch req.Format {
+	case pb.KeyFormat_DER:
+		publicKey, err = x509.MarshalPKIXPublicKey(key.PublicKey)
+	case pb.KeyFormat_PEM:
+		publicKey, err = x509.MarshalPKIXPublicKey(key.PublicKey)
+		if err == nil {
+			publicKey = pem.EncodeToMemory(&pem.Block{
+				Type:  "PUBLIC KEY",
+				Bytes: publicKey,
+			})
+		}
+	case pb.KeyFormat_JWK:
+		var jwk cert.JWK
+		jwk, err = cert.PublicJWK(key)
+		if err == nil {
+			publicKey, err = json.Marshal(jwk)
+		}
+	case pb.KeyFormat_JWKS:
+		var jwks cert.JWKS
+		jwks, err = cert.PublicJWKS(keys)
+		if err == nil {
+			publicKey, err = json.Marshal(jwks)
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown key format")
+	}
 
-	// Read the contents of the .pem file
-	publicKeyPEM, err := os.ReadFile("cert/" + target + "/public.pem")
 	if err != nil {
 		return &pb.PublicKeyResponse{
 			PublicKey: []byte{},
@@ -171,13 +471,12 @@ func (service *AuthServiceServer) GetPublicKey(ctx context.Context, req *pb.Publ
 		}, nil
 	}
 
-	// Decode the pem file
-	publicKeyBlock, _ := pem.Decode(publicKeyPEM)
-
 	// Create the response message and set the PublicKey field
 	return &pb.PublicKeyResponse{
-		PublicKey: publicKeyBlock.Bytes,
+		PublicKey: publicKey,
 		Error:     "",
+		Algorithm: key.Algorithm,
+		KeyId:     key.ID,
 	}, nil
 }
 
@@ -204,3 +503,208 @@ func (service *AuthServiceServer) Ping(ctx context.Context, req *pb.PingRequest)
 		return &pb.PingResponse{Message: "Hello there!"}, nil
 	}
 }
+
+/**
+ * Last step of a login, a password change token instead if the password has to be changed
+ */
+func grantToken(realm m.RealmDTO, keys *cert.KeySet, grant m.GrantDTO, credentialsStatus m.CredentialsStatusDTO) *pb.AuthResponse {
+
+	if passwordChangeRequired(realm, credentialsStatus) {
+		token, err := issuePasswordChangeToken(realm, keys, grant.LookupHash, grant.Id)
+		if err != nil {
+			return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}
+		}
+
+		return &pb.AuthResponse{
+			Id:                     grant.Id,
+			Token:                  token,
+			Error:                  "password change required",
+			PasswordBreached:       grant.PasswordBreached,
+			PasswordChangeRequired: true,
+		}
+	}
+
+	// Credentials created before subject ids were recorded get theirs from their first login
+	if credentialsStatus.SubjectId == 0 && grant.Id != 0 {
+		err := db.SetSubjectId(realm.Id, grant.LookupHash, grant.Id)
+		if err != nil {
+			return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}
+		}
+	}
+
+	token, expiresAt, err := issueToken(realm, keys, grant.LookupHash, grant.Id, grant.Ttl, grant.Audience, grant.Claims, grant.Client)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}
+	}
+
+	return &pb.AuthResponse{Id: grant.Id, Token: token, Error: "", PasswordBreached: grant.PasswordBreached, ExpiresAt: expiresAt}
+}
+
+/**
+ * Start a session and issue its first token of the realm for the subject, carrying the scopes of the roles assigned to the credentials
+ * @param ttl string - requested token lifetime, see realmTokenTtl
+ * @param client m.ClientDTO - client the session is started from
+ * @returns the token and its exp
+ */
+func issueToken(realm m.RealmDTO, keys *cert.KeySet, lookupHash string, id int64, ttl string, audience []string, claims map[string]string, client m.ClientDTO) (string, int64, error) {
+
+	requestedTtl, err := realmTokenTtl(realm, ttl)
+	if err != nil {
+		return "", 0, err
+	}
+
+	authTime := time.Now()
+	tokenTtl := sessionTokenTtl(realmSessionPolicy(realm), authTime, requestedTtl)
+
+	scopes, err := scopesOf(realm.Id, lookupHash)
+	if err != nil {
+		return "", 0, err
+	}
+
+	sessionId, err := startSession(realm, lookupHash, client)
+	if err != nil {
+		return "", 0, err
+	}
+
+	customClaims := make(map[string]interface{}, len(claims))
+	for name, value := range claims {
+		customClaims[name] = value
+	}
+
+	expiresAt := authTime.Add(tokenTtl).Unix()
+
+	token, err := tokenHandler.CreateToken(m.TokenDTO{
+		Id:         id,
+		IssuedAt:   authTime.Unix(),
+		ExpiresAt:  expiresAt,
+		Noise:      rand.Int63(),
+		Issuer:     realmIssuer(realm.Id),
+		Audience:   audience,
+		Scopes:     scopes,
+		Claims:     customClaims,
+		LookupHash: lookupHash,
+		SessionId:  sessionId,
+		AuthTime:   authTime.Unix(),
+	}, keys.Active().Signer)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return token, expiresAt, nil
+}
+
+/**
+ * Requested token lifetime within the bounds of the realm, the realm's one and then JWT_TTL if empty
+ * Lifetimes out of bounds are clamped to them, or rejected if JWT_TTL_OUT_OF_RANGE is reject
+ */
+func realmTokenTtl(realm m.RealmDTO, ttl string) (time.Duration, error) {
+
+	minTtl, maxTtl := realmTokenTtlBounds(realm)
+
+	if ttl == "" {
+		tokenTtl := c.EnvJWTExpiration
+		if realm.TokenTtl > 0 {
+			tokenTtl = realm.TokenTtl
+		}
+		return min(max(tokenTtl, minTtl), maxTtl), nil
+	}
+
+	tokenTtl, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("ttl must be a duration, e.g. 1h")
+	}
+
+	if tokenTtl >= minTtl && tokenTtl <= maxTtl {
+		return tokenTtl, nil
+	}
+
+	if c.EnvJWTTtlOutOfRange == "reject" {
+		return 0, fmt.Errorf("ttl must be between %s and %s", minTtl, maxTtl)
+	}
+
+	return min(max(tokenTtl, minTtl), maxTtl), nil
+}
+
+/**
+ * Shortest and longest token lifetime callers may request, JWT_TTL_MIN and JWT_TTL_MAX unless the realm has its own
+ */
+func realmTokenTtlBounds(realm m.RealmDTO) (time.Duration, time.Duration) {
+
+	minTtl, maxTtl := c.EnvJWTTtlMin, c.EnvJWTTtlMax
+	if realm.TokenTtlMin > 0 {
+		minTtl = realm.TokenTtlMin
+	}
+	if realm.TokenTtlMax > 0 {
+		maxTtl = realm.TokenTtlMax
+	}
+
+	return minTtl, maxTtl
+}
+
+/**
+ * Response for a password violating the policy, every violation is reported as a field error
+ */
+func passwordPolicyResponse(violations []m.FieldError) *pb.AuthResponse {
+	return &pb.AuthResponse{
+		Id:          0,
+		Token:       "",
+		Error:       errPasswordPolicy.Error(),
+		FieldErrors: fieldErrorsToPb(violations),
+	}
+}
+
+func fieldErrorsToPb(violations []m.FieldError) []*pb.FieldError {
+
+	fieldErrors := make([]*pb.FieldError, 0, len(violations))
+	for _, violation := range violations {
+		fieldErrors = append(fieldErrors, &pb.FieldError{
+			Field:   violation.Field,
+			Code:    violation.Code,
+			Message: strings.ToValidUTF8(violation.Message, "UTF-8_BUGFIX"),
+		})
+	}
+
+	return fieldErrors
+}
+
+/**
+ * Only claims allowed by JWT_CUSTOM_CLAIMS may be supplied by callers
+ */
+func checkCustomClaims(claims map[string]string) error {
+
+	for name := range claims {
+		allowed := false
+		for _, allowedClaim := range c.EnvJWTClaims {
+			allowed = allowed || allowedClaim == name
+		}
+
+		if !allowed || registeredClaims[name] {
+			return fmt.Errorf("claim %s is not allowed", name)
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Fail for tokens revoked by RevokeToken
+ * Tokens without a jti were issued before revocation existed and can not be revoked
+ */
+func checkRevoked(claims jwt.MapClaims) error {
+
+	tokenId, _ := claims["jti"].(string)
+	if tokenId == "" {
+		return nil
+	}
+
+	revoked, err := db.IsTokenRevoked(tokenId)
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		return fmt.Errorf("token revoked")
+	}
+
+	return nil
+}
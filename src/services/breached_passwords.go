@@ -0,0 +1,82 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"simple-micro-auth/src/breach"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+)
+
+// Not checked if BREACHED_PASSWORDS_FILE is not set
+var breachedPasswords *breach.Corpus
+
+/**
+ * Open BREACHED_PASSWORDS_FILE, once at startup
+ */
+func LoadBreachedPasswords() error {
+
+	if c.EnvBreachedPasswordsFile == "" || breachedPasswords != nil {
+		return nil
+	}
+
+	corpus, err := breach.Open(c.EnvBreachedPasswordsFile)
+	if err != nil {
+		return err
+	}
+
+	breachedPasswords = corpus
+
+	return nil
+}
+
+/**
+ * Reject passwords seen in breaches, the lookup is offline
+ * @param field string - name of the request field the password came in, e.g. newPassword
+ */
+func checkBreached(field string, password string) ([]m.FieldError, error) {
+
+	if breachedPasswords == nil || password == "" {
+		return nil, nil
+	}
+
+	count, err := breachedPasswords.Count(password)
+	if err != nil {
+		log.Println(err)
+		return nil, fmt.Errorf("error checking password against breached passwords")
+	}
+
+	if count == 0 {
+		return nil, nil
+	}
+
+	return []m.FieldError{{
+		Field:   field,
+		Code:    "breached",
+		Message: "password appeared in a data breach and must not be used",
+	}}, nil
+}
+
+/**
+ * After a successful login flag the credentials if their password is breached,
+ * so they can be made to change it, see BREACHED_PASSWORDS_FLAG_ON_LOGIN
+ * A failing check does not fail the login
+ */
+func flagBreachedOnLogin(credentials m.CredentialsDTO) bool {
+
+	if !c.EnvBreachedPasswordsFlagOnLogin {
+		return false
+	}
+
+	violations, err := checkBreached("password", credentials.Password)
+	if err != nil || len(violations) == 0 {
+		return false
+	}
+
+	err = db.FlagBreachedPassword(credentials.RealmId, credentials.LookupHash)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return true
+}
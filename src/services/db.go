@@ -2,24 +2,107 @@ package services
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	c "simple-micro-auth/src/configs"
 	m "simple-micro-auth/src/models"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type dbHandler interface {
 	CreateCredentials(auth m.CredentialsDTO) error
 	UpdateCredentials(auth m.CredentialsDTOUpdate) error
-	DeleteCredentials(lookupHash string) error
+	DeleteCredentials(realmId string, lookupHash string) error
 	VerifyCredentials(credentials m.CredentialsDTO) error
+	SetPassword(auth m.CredentialsDTOUpdate) error
+	FlagBreachedPassword(realmId string, lookupHash string) error
+	SetMustChangePassword(realmId string, lookupHash string, mustChange bool) error
+	SetAuthStatus(realmId string, lookupHash string, status string) error
+	GetCredentialsStatus(realmId string, lookupHash string) (m.CredentialsStatusDTO, error)
+	AnyCredentialsExist(realmId string, lookupHashes []string) (bool, error)
+
+	CreatePasswordReset(realmId string, lookupHash string, tokenHash string, expiresAt time.Time) error
+	GetPasswordReset(realmId string, tokenHash string) (string, error)
+	ConsumePasswordReset(realmId string, tokenHash string) (string, error)
+
+	GetTOTP(realmId string, lookupHash string) (m.TOTPDTO, error)
+	SetPendingTOTP(realmId string, lookupHash string, pendingSecret []byte) error
+	ConfirmTOTP(realmId string, lookupHash string, step int64) error
+	UseTOTPStep(realmId string, lookupHash string, step int64) (bool, error)
+	CreateMFAChallenge(challenge m.MFAChallengeDTO) error
+	ClaimMFAAttempt(realmId string, challengeHash string) (m.MFAChallengeDTO, error)
+	ConsumeMFAChallenge(realmId string, challengeHash string) error
+	ReplaceRecoveryCodes(realmId string, lookupHash string, codes []string) error
+	UseRecoveryCode(realmId string, lookupHash string, code string) (bool, error)
+	CountRecoveryCodes(realmId string, lookupHash string) (int, error)
+	CreateWebAuthnChallenge(challenge m.WebAuthnChallengeDTO) error
+	ConsumeWebAuthnChallenge(realmId string, challengeHash string, ceremony string) (m.WebAuthnChallengeDTO, error)
+	CreateWebAuthnCredential(credential m.WebAuthnCredentialDTO) error
+	GetWebAuthnCredential(realmId string, credentialId []byte) (m.WebAuthnCredentialDTO, error)
+	GetWebAuthnCredentials(realmId string, lookupHash string) ([]m.WebAuthnCredentialDTO, error)
+	UpdateWebAuthnSignCount(realmId string, credentialId []byte, oldSignCount uint32, newSignCount uint32) (bool, error)
+	CreatePasswordlessLogin(login m.PasswordlessLoginDTO) error
+	GetPasswordlessLogin(realmId string, loginHash string) (m.PasswordlessLoginDTO, error)
+	ClaimPasswordlessAttempt(realmId string, loginHash string) (m.PasswordlessLoginDTO, error)
+	ConsumePasswordlessLogin(realmId string, loginHash string) error
+	CreateSession(session m.SessionDTO) error
+	GetSessions(realmId string, lookupHash string) ([]m.SessionDTO, error)
+	GetSession(sessionId string) (m.SessionDTO, error)
+	SessionExists(sessionId string) (bool, error)
+	TouchSession(sessionId string) error
+	DeleteEndedSessions(realmId string, lookupHash string, policy m.SessionPolicy, retention time.Duration) error
+	DeleteSession(realmId string, lookupHash string, sessionId string) error
+	SetSubjectId(realmId string, lookupHash string, subjectId int64) error
+	CreateOAuthClient(client m.OAuthClientDTO) error
+	GetOAuthClient(clientId string) (m.OAuthClientDTO, error)
+	GetOAuthClients(realmId string) ([]m.OAuthClientDTO, error)
+	DeleteOAuthClient(realmId string, clientId string) error
+	CreateOAuthCode(code m.OAuthCodeDTO) error
+	ConsumeOAuthCode(codeHash string) (m.OAuthCodeDTO, error)
+	CreateOAuthRefreshToken(token m.OAuthRefreshTokenDTO) error
+	GetOAuthRefreshToken(tokenHash string) (m.OAuthRefreshTokenDTO, error)
+	ConsumeOAuthRefreshToken(tokenHash string, clientId string) (m.OAuthRefreshTokenDTO, error)
+	RecordOAuthConsent(consent m.OAuthConsentDTO) error
+	GetOAuthConsents(realmId string, lookupHash string) ([]m.OAuthConsentDTO, error)
+	DeleteOAuthConsent(realmId string, lookupHash string, clientId string) error
+	CreateOAuthConsentRequest(request m.OAuthConsentRequestDTO) error
+	ConsumeOAuthConsentRequest(realmId string, consentHash string) (m.OAuthConsentRequestDTO, error)
+	CreateMachineClient(client m.MachineClientDTO) error
+	GetMachineClient(clientId string) (m.MachineClientDTO, error)
+	GetMachineClients(realmId string) ([]m.MachineClientDTO, error)
+	DeleteMachineClient(realmId string, clientId string) error
+	UseClientAssertion(clientId string, tokenId string, expiresAt time.Time) (bool, error)
 	FlushDB() error
+
+	GetSigningKeys(target string, retention time.Duration) ([]m.SigningKeyDTO, error)
+	EnsureSigningKey(target string, algorithm string, rotation time.Duration, publishDelay time.Duration, generate func() (m.SigningKeyDTO, error)) error
+
+	RevokeToken(tokenId string, expiresAt time.Time) error
+	IsTokenRevoked(tokenId string) (bool, error)
+
+	SetRole(realmId string, role m.RoleDTO) error
+	DeleteRole(realmId string, name string) error
+	AssignRole(realmId string, lookupHash string, role string) error
+	UnassignRole(realmId string, lookupHash string, role string) error
+	GetRoles(realmId string, lookupHash string) ([]m.RoleDTO, error)
+	GetScopes(realmId string, lookupHash string) ([]string, error)
+
+	CreateRealm(realm m.RealmDTO) error
+	DeleteRealm(id string) error
+	SetRealmTokenTtl(id string, tokenTtl time.Duration, tokenTtlMin time.Duration, tokenTtlMax time.Duration) error
+	SetRealmPasswordPolicy(id string, policy *m.PasswordPolicy) error
+	SetRealmSessionPolicy(id string, policy *m.SessionPolicy) error
+	GetRealm(id string) (m.RealmDTO, error)
+	GetRealms() ([]m.RealmDTO, error)
 }
 
+var errPasswordReused = fmt.Errorf("password was used before")
+
 type dbHandlerImpl struct {
 	db *sql.DB
 }
@@ -33,8 +116,13 @@ func (handler *dbHandlerImpl) CreateCredentials(auth m.CredentialsDTO) error {
 		return err
 	}
 
-	_, err = handler.db.Exec(`INSERT INTO auth(lookup_hash, password_hash)
-	VALUES($1, $2)`, auth.LookupHash, passwordHash)
+	status := auth.Status
+	if status == "" {
+		status = statusActive
+	}
+
+	_, err = handler.db.Exec(`INSERT INTO auth(realm_id, lookup_hash, password_hash, status, subject_id)
+	VALUES($1, $2, $3, $4, $5)`, realmOrDefault(auth.RealmId), auth.LookupHash, passwordHash, status, auth.SubjectId)
 
 	if err != nil {
 		fmt.Println(err)
@@ -48,6 +136,7 @@ func (handler *dbHandlerImpl) CreateCredentials(auth m.CredentialsDTO) error {
 func (handler *dbHandlerImpl) UpdateCredentials(auth m.CredentialsDTOUpdate) error {
 
 	credentialsDTOToCompare := m.CredentialsDTO{
+		RealmId:    auth.RealmId,
 		LookupHash: auth.LookupHash,
 		Password:   auth.OldPassword,
 	}
@@ -57,6 +146,16 @@ func (handler *dbHandlerImpl) UpdateCredentials(auth m.CredentialsDTOUpdate) err
 		return err
 	}
 
+	return handler.SetPassword(auth)
+}
+
+/**
+ * Replace the password without checking the old one, clearing every reason to change it
+ */
+func (handler *dbHandlerImpl) SetPassword(auth m.CredentialsDTOUpdate) error {
+
+	realmId := realmOrDefault(auth.RealmId)
+
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(auth.NewPassword), c.EnvBcryptCost)
 	if err != nil {
 		fmt.Println(err)
@@ -64,7 +163,57 @@ func (handler *dbHandlerImpl) UpdateCredentials(auth m.CredentialsDTOUpdate) err
 		return err
 	}
 
-	_, err = handler.db.Exec(`UPDATE auth SET password_hash = $1 WHERE lookup_hash = $2`, passwordHash, auth.LookupHash)
+	tx, err := handler.db.Begin()
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error updating password_hash in db")
+		return err
+	}
+	defer tx.Rollback()
+
+	// Concurrent changes of the same credentials wait here, so each one checks the history the previous one left
+	var locked bool
+	err = tx.QueryRow(`SELECT true FROM auth WHERE realm_id = $1 AND lookup_hash = $2 FOR UPDATE`, realmId, auth.LookupHash).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("lookupHash not found")
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error updating password_hash in db")
+		return err
+	}
+
+	if auth.HistorySize > 0 {
+		reused, err := passwordReused(tx, realmId, auth.LookupHash, auth.NewPassword, auth.HistorySize)
+		if err != nil {
+			return err
+		}
+		if reused {
+			return errPasswordReused
+		}
+	}
+
+	// The replaced password moves to the history, which keeps HistorySize passwords together with the current one
+	_, err = tx.Exec(`INSERT INTO password_history(realm_id, lookup_hash, password_hash)
+	SELECT realm_id, lookup_hash, password_hash FROM auth WHERE realm_id = $1 AND lookup_hash = $2`,
+		realmId, auth.LookupHash)
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM password_history WHERE realm_id = $1 AND lookup_hash = $2 AND id NOT IN (
+			SELECT id FROM password_history WHERE realm_id = $1 AND lookup_hash = $2 ORDER BY id DESC LIMIT $3)`,
+			realmId, auth.LookupHash, max(auth.HistorySize-1, 0))
+	}
+	var result sql.Result
+	if err == nil {
+		result, err = tx.Exec(`UPDATE auth SET password_hash = $1, password_breached = false, must_change_password = false, password_changed_at = now()
+		WHERE realm_id = $2 AND lookup_hash = $3`,
+			passwordHash, realmId, auth.LookupHash)
+	}
+	if err == nil {
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			return fmt.Errorf("lookupHash not found")
+		}
+		err = tx.Commit()
+	}
 	if err != nil {
 		fmt.Println(err)
 		err = fmt.Errorf("error updating password_hash in db while this lookup_hash was found: " + auth.LookupHash)
@@ -74,9 +223,148 @@ func (handler *dbHandlerImpl) UpdateCredentials(auth m.CredentialsDTOUpdate) err
 	return err
 }
 
-func (handler *dbHandlerImpl) DeleteCredentials(lookupHash string) error {
+/**
+ * Whether the password matches the current one or one of the last historySize - 1 before it
+ */
+func passwordReused(tx *sql.Tx, realmId string, lookupHash string, password string, historySize int) (bool, error) {
+
+	rows, err := tx.Query(`(SELECT password_hash FROM auth WHERE realm_id = $1 AND lookup_hash = $2)
+	UNION ALL
+	(SELECT password_hash FROM password_history WHERE realm_id = $1 AND lookup_hash = $2 ORDER BY id DESC LIMIT $3)`,
+		realmId, lookupHash, historySize-1)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading password history from db")
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var passwordHash string
+		err = rows.Scan(&passwordHash)
+		if err != nil {
+			log.Println(err)
+			err = fmt.Errorf("error reading password history from db")
+			return false, err
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) == nil {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
+/**
+ * Mark the password of the credentials as breached and to be changed, cleared by the next password update
+ */
+func (handler *dbHandlerImpl) FlagBreachedPassword(realmId string, lookupHash string) error {
 
-	_, err := handler.db.Exec(`DELETE FROM auth WHERE lookup_hash = $1`, lookupHash)
+	_, err := handler.db.Exec(`UPDATE auth SET password_breached = true, must_change_password = true WHERE realm_id = $1 AND lookup_hash = $2`,
+		realmOrDefault(realmId), lookupHash)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error flagging breached password in db")
+		return err
+	}
+
+	return err
+}
+
+func (handler *dbHandlerImpl) SetMustChangePassword(realmId string, lookupHash string, mustChange bool) error {
+
+	result, err := handler.db.Exec(`UPDATE auth SET must_change_password = $1 WHERE realm_id = $2 AND lookup_hash = $3`,
+		mustChange, realmOrDefault(realmId), lookupHash)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error updating must_change_password in db")
+		return err
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		err = fmt.Errorf("lookupHash not found")
+		return err
+	}
+
+	return err
+}
+
+func (handler *dbHandlerImpl) SetAuthStatus(realmId string, lookupHash string, status string) error {
+
+	result, err := handler.db.Exec(`UPDATE auth SET status = $1 WHERE realm_id = $2 AND lookup_hash = $3`,
+		status, realmOrDefault(realmId), lookupHash)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error updating status in db")
+		return err
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		err = fmt.Errorf("lookupHash not found")
+		return err
+	}
+
+	return err
+}
+
+func (handler *dbHandlerImpl) GetCredentialsStatus(realmId string, lookupHash string) (m.CredentialsStatusDTO, error) {
+
+	var status m.CredentialsStatusDTO
+
+	err := handler.db.QueryRow(`SELECT status, password_changed_at, must_change_password, password_breached, subject_id FROM auth
+	WHERE realm_id = $1 AND lookup_hash = $2`, realmOrDefault(realmId), lookupHash).Scan(
+		&status.Status, &status.PasswordChangedAt, &status.MustChangePassword, &status.PasswordBreached, &status.SubjectId)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("lookupHash not found")
+		return status, err
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading credentials status from db")
+		return status, err
+	}
+
+	return status, err
+}
+
+/**
+ * Whether credentials with any of the lookup hashes exist in the realm
+ */
+func (handler *dbHandlerImpl) AnyCredentialsExist(realmId string, lookupHashes []string) (bool, error) {
+
+	var exist bool
+
+	err := handler.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM auth WHERE realm_id = $1 AND lookup_hash = ANY($2))`,
+		realmOrDefault(realmId), pq.Array(lookupHashes)).Scan(&exist)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading credentials from db")
+		return false, err
+	}
+
+	return exist, nil
+}
+
+/**
+ * Record the subject id of credentials which have none yet, the first one recorded sticks
+ */
+func (handler *dbHandlerImpl) SetSubjectId(realmId string, lookupHash string, subjectId int64) error {
+
+	_, err := handler.db.Exec(`UPDATE auth SET subject_id = $3 WHERE realm_id = $1 AND lookup_hash = $2 AND subject_id = 0`,
+		realmOrDefault(realmId), lookupHash, subjectId)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error setting subject id in db")
+		return err
+	}
+
+	return nil
+}
+
+func (handler *dbHandlerImpl) DeleteCredentials(realmId string, lookupHash string) error {
+
+	_, err := handler.db.Exec(`DELETE FROM auth WHERE realm_id = $1 AND lookup_hash = $2`, realmOrDefault(realmId), lookupHash)
 	if err != nil {
 		log.Println(err)
 		err = fmt.Errorf("error deleting credentials from db")
@@ -88,7 +376,8 @@ func (handler *dbHandlerImpl) DeleteCredentials(lookupHash string) error {
 
 func (handler *dbHandlerImpl) VerifyCredentials(credentials m.CredentialsDTO) error {
 
-	storedPasswordHashRow, err := handler.db.Query(`SELECT password_hash FROM auth WHERE lookup_hash = $1`, credentials.LookupHash)
+	storedPasswordHashRow, err := handler.db.Query(`SELECT password_hash FROM auth WHERE realm_id = $1 AND lookup_hash = $2`,
+		realmOrDefault(credentials.RealmId), credentials.LookupHash)
 	if err != nil {
 		fmt.Println(err)
 		err = fmt.Errorf("error reading password_hash from db")
@@ -122,6 +411,26 @@ func (handler *dbHandlerImpl) VerifyCredentials(credentials m.CredentialsDTO) er
 
 func (handler *dbHandlerImpl) FlushDB() error {
 	_, err := handler.db.Exec(`DELETE FROM auth`)
+	if err == nil {
+		_, err = handler.db.Exec(`DELETE FROM oauth_clients`)
+	}
+	if err == nil {
+		_, err = handler.db.Exec(`DELETE FROM machine_clients`)
+	}
+	if err == nil {
+		_, err = handler.db.Exec(`DELETE FROM revoked_tokens`)
+	}
+	if err == nil {
+		// The admin role comes with the schema and is kept
+		_, err = handler.db.Exec(`DELETE FROM roles WHERE name <> 'admin'`)
+	}
+	if err == nil {
+		// The default realm comes with the schema and is kept, other realms take their keys with them
+		_, err = handler.db.Exec(`DELETE FROM signing_keys WHERE target IN (SELECT 'realms/' || id FROM realms WHERE id <> 'default')`)
+	}
+	if err == nil {
+		_, err = handler.db.Exec(`DELETE FROM realms WHERE id <> 'default'`)
+	}
 
 	if err != nil {
 		log.Println(err)
@@ -159,15 +468,12 @@ func NewDBHandler() dbHandler {
 		panic(err)
 	}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS auth (
-		lookup_hash varchar(100) UNIQUE NOT NULL PRIMARY KEY,
-		password_hash varchar(100) NOT NULL
-	)`)
+	err = migrate(db)
 	if err != nil {
-		log.Fatal("error creating auth table")
+		log.Fatal("error migrating db: ", err)
 		panic(err)
 	} else {
-		log.Println("auth table exists or created")
+		log.Println("db schema is up to date")
 	}
 
 	return &dbHandlerImpl{db}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	m "simple-micro-auth/src/models"
+	"time"
+)
+
+/**
+ * Get signing keys of the target which can still verify tokens, the latest activated key first
+ * @param retention time.Duration - how long retired keys keep verifying tokens
+ */
+func (handler *dbHandlerImpl) GetSigningKeys(target string, retention time.Duration) ([]m.SigningKeyDTO, error) {
+
+	rows, err := handler.db.Query(`SELECT kid, target, algorithm, private_key, public_key, created_at, activates_at
+	FROM signing_keys
+	WHERE target = $1 AND (retired_at IS NULL OR retired_at > $2)
+	ORDER BY activates_at DESC`, target, time.Now().Add(-retention))
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading signing keys from db")
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []m.SigningKeyDTO{}
+
+	for rows.Next() {
+		var key m.SigningKeyDTO
+		err = rows.Scan(&key.Kid, &key.Target, &key.Algorithm, &key.PrivateKey, &key.PublicKey, &key.CreatedAt, &key.ActivatesAt)
+		if err != nil {
+			log.Println(err)
+			err = fmt.Errorf("error reading signing keys from db")
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+/**
+ * Create a signing key for the target if it has none, the latest one is older than rotation
+ * or was made for another algorithm
+ * Runs under an advisory lock, so only one replica generates the key
+ * @param rotation time.Duration - max age of the latest key, 0 disables rotation
+ * @param publishDelay time.Duration - time for other replicas to load a rotated key before it signs tokens
+ * @param generate func - creates the key to store, called only if a new key is needed
+ */
+func (handler *dbHandlerImpl) EnsureSigningKey(
+	target string,
+	algorithm string,
+	rotation time.Duration,
+	publishDelay time.Duration,
+	generate func() (m.SigningKeyDTO, error),
+) error {
+
+	tx, err := handler.db.Begin()
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error starting signing key transaction")
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('signing_keys:' || $1))`, target)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error locking signing keys")
+		return err
+	}
+
+	var latestAlgorithm string
+	var latestCreatedAt time.Time
+
+	err = tx.QueryRow(`SELECT algorithm, created_at FROM signing_keys
+	WHERE target = $1 AND retired_at IS NULL
+	ORDER BY activates_at DESC LIMIT 1`, target).Scan(&latestAlgorithm, &latestCreatedAt)
+
+	activatesAt := time.Now()
+
+	if err == nil {
+		expired := rotation > 0 && time.Since(latestCreatedAt) > rotation
+		if !expired && latestAlgorithm == algorithm {
+			return nil
+		}
+		// Give other replicas time to load the new key before it starts signing
+		activatesAt = activatesAt.Add(publishDelay)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		log.Println(err)
+		err = fmt.Errorf("error reading signing keys from db")
+		return err
+	}
+
+	key, err := generate()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE signing_keys SET retired_at = $2 WHERE target = $1 AND retired_at IS NULL`, target, activatesAt)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error retiring signing keys in db")
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO signing_keys(kid, target, algorithm, private_key, public_key, activates_at)
+	VALUES($1, $2, $3, $4, $5, $6)`, key.Kid, target, key.Algorithm, key.PrivateKey, key.PublicKey, activatesAt)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating signing key in db")
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating signing key in db")
+		return err
+	}
+
+	log.Printf("created %s signing key %s for %s", key.Algorithm, key.Kid, target)
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	m "simple-micro-auth/src/models"
+	"time"
+)
+
+var errMachineClientNotFound = fmt.Errorf("machine client not found")
+
+func (handler *dbHandlerImpl) CreateMachineClient(client m.MachineClientDTO) error {
+
+	scopes, err := json.Marshal(client.Scopes)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating machine client in db")
+		return err
+	}
+
+	var publicKey interface{}
+	if client.PublicKey != nil {
+		publicKey = string(client.PublicKey)
+	}
+
+	_, err = handler.db.Exec(`INSERT INTO machine_clients(client_id, realm_id, name, secret_hash, public_key, scopes)
+	VALUES($1, $2, $3, $4, $5, $6)`,
+		client.ClientId, realmOrDefault(client.RealmId), client.Name, client.SecretHash, publicKey, string(scopes))
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating machine client in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Client by its id alone, the realm of its tokens comes from the client
+ */
+func (handler *dbHandlerImpl) GetMachineClient(clientId string) (m.MachineClientDTO, error) {
+
+	client, err := scanMachineClient(handler.db.QueryRow(`SELECT client_id, realm_id, name, secret_hash, public_key, scopes, created_at
+	FROM machine_clients WHERE client_id = $1`, clientId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return m.MachineClientDTO{}, errMachineClientNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading machine client from db")
+		return m.MachineClientDTO{}, err
+	}
+
+	return client, nil
+}
+
+func (handler *dbHandlerImpl) GetMachineClients(realmId string) ([]m.MachineClientDTO, error) {
+
+	rows, err := handler.db.Query(`SELECT client_id, realm_id, name, secret_hash, public_key, scopes, created_at
+	FROM machine_clients WHERE realm_id = $1 ORDER BY created_at, client_id`, realmOrDefault(realmId))
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading machine clients from db")
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []m.MachineClientDTO{}
+	for rows.Next() {
+		client, err := scanMachineClient(rows)
+		if err != nil {
+			log.Println(err)
+			err = fmt.Errorf("error reading machine clients from db")
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	return clients, rows.Err()
+}
+
+/**
+ * Delete the client, its tokens are rejected from then on, see checkMachineClient
+ */
+func (handler *dbHandlerImpl) DeleteMachineClient(realmId string, clientId string) error {
+
+	result, err := handler.db.Exec(`DELETE FROM machine_clients WHERE realm_id = $1 AND client_id = $2`, realmOrDefault(realmId), clientId)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting machine client from db")
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return errMachineClientNotFound
+	}
+
+	return nil
+}
+
+/**
+ * Record the jti of a client assertion, expired ones of the client are dropped on the way
+ * @returns false if the assertion was used before
+ */
+func (handler *dbHandlerImpl) UseClientAssertion(clientId string, tokenId string, expiresAt time.Time) (bool, error) {
+
+	_, err := handler.db.Exec(`DELETE FROM client_assertions WHERE client_id = $1 AND expires_at < now()`, clientId)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error recording client assertion in db")
+		return false, err
+	}
+
+	result, err := handler.db.Exec(`INSERT INTO client_assertions(client_id, jti, expires_at) VALUES($1, $2, $3)
+	ON CONFLICT (client_id, jti) DO NOTHING`, clientId, tokenId, expiresAt)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error recording client assertion in db")
+		return false, err
+	}
+
+	inserted, _ := result.RowsAffected()
+
+	return inserted == 1, nil
+}
+
+func scanMachineClient(row interface{ Scan(dest ...any) error }) (m.MachineClientDTO, error) {
+
+	client := m.MachineClientDTO{}
+	var publicKey, scopes []byte
+
+	err := row.Scan(&client.ClientId, &client.RealmId, &client.Name, &client.SecretHash, &publicKey, &scopes, &client.CreatedAt)
+	if err != nil {
+		return m.MachineClientDTO{}, err
+	}
+
+	client.PublicKey = publicKey
+
+	err = json.Unmarshal(scopes, &client.Scopes)
+	if err != nil {
+		return m.MachineClientDTO{}, err
+	}
+
+	return client, nil
+}
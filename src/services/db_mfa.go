@@ -0,0 +1,282 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Wrong codes a challenge survives, then GrantAuth has to be repeated
+const maxMFAAttempts = 5
+
+var errInvalidMFAChallenge = fmt.Errorf("invalid or expired mfa challenge")
+
+/**
+ * TOTP enrollment of the credentials, empty if there is none
+ */
+func (handler *dbHandlerImpl) GetTOTP(realmId string, lookupHash string) (m.TOTPDTO, error) {
+
+	var totp m.TOTPDTO
+
+	err := handler.db.QueryRow(`SELECT secret, pending_secret, last_used_step FROM mfa_totp WHERE realm_id = $1 AND lookup_hash = $2`,
+		realmOrDefault(realmId), lookupHash).Scan(&totp.Secret, &totp.PendingSecret, &totp.LastUsedStep)
+	if err == sql.ErrNoRows {
+		return m.TOTPDTO{}, nil
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading totp from db")
+		return m.TOTPDTO{}, err
+	}
+
+	return totp, nil
+}
+
+/**
+ * Store a new encrypted secret, the confirmed one stays in use until ConfirmTOTP
+ */
+func (handler *dbHandlerImpl) SetPendingTOTP(realmId string, lookupHash string, pendingSecret []byte) error {
+
+	_, err := handler.db.Exec(`INSERT INTO mfa_totp(realm_id, lookup_hash, pending_secret) VALUES($1, $2, $3)
+	ON CONFLICT (realm_id, lookup_hash) DO UPDATE SET pending_secret = EXCLUDED.pending_secret`,
+		realmOrDefault(realmId), lookupHash, pendingSecret)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error storing totp in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Replace the secret by the pending one
+ * @param step int64 - step of the confirming code, it can not be used again
+ */
+func (handler *dbHandlerImpl) ConfirmTOTP(realmId string, lookupHash string, step int64) error {
+
+	result, err := handler.db.Exec(`UPDATE mfa_totp SET secret = pending_secret, pending_secret = NULL, last_used_step = $3
+	WHERE realm_id = $1 AND lookup_hash = $2 AND pending_secret IS NOT NULL`,
+		realmOrDefault(realmId), lookupHash, step)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error confirming totp in db")
+		return err
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		err = fmt.Errorf("no pending totp enrollment")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Use up the step of a valid code, false if it or a later one was used already
+ */
+func (handler *dbHandlerImpl) UseTOTPStep(realmId string, lookupHash string, step int64) (bool, error) {
+
+	result, err := handler.db.Exec(`UPDATE mfa_totp SET last_used_step = $3
+	WHERE realm_id = $1 AND lookup_hash = $2 AND last_used_step < $3`,
+		realmOrDefault(realmId), lookupHash, step)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error updating totp in db")
+		return false, err
+	}
+
+	updated, _ := result.RowsAffected()
+
+	return updated == 1, nil
+}
+
+func (handler *dbHandlerImpl) CreateMFAChallenge(challenge m.MFAChallengeDTO) error {
+
+	grantRequest, err := json.Marshal(challenge.Grant)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating mfa challenge in db")
+		return err
+	}
+
+	_, err = handler.db.Exec(`DELETE FROM mfa_challenges WHERE expires_at < now()`)
+	if err == nil {
+		_, err = handler.db.Exec(`INSERT INTO mfa_challenges(challenge_hash, realm_id, lookup_hash, grant_request, expires_at)
+		VALUES($1, $2, $3, $4, $5)`,
+			challenge.ChallengeHash, realmOrDefault(challenge.RealmId), challenge.Grant.LookupHash, string(grantRequest), challenge.ExpiresAt)
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating mfa challenge in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Count an attempt against a pending challenge which has not expired or run out of attempts, before its code is checked
+ * Concurrent attempts are counted one by one, so no more than maxMFAAttempts codes are ever checked
+ */
+func (handler *dbHandlerImpl) ClaimMFAAttempt(realmId string, challengeHash string) (m.MFAChallengeDTO, error) {
+
+	challenge := m.MFAChallengeDTO{ChallengeHash: challengeHash}
+	var grantRequest []byte
+
+	err := handler.db.QueryRow(`UPDATE mfa_challenges SET attempts = attempts + 1
+	WHERE realm_id = $1 AND challenge_hash = $2 AND expires_at > now() AND attempts < $3
+	RETURNING realm_id, lookup_hash, grant_request, attempts, expires_at`,
+		realmOrDefault(realmId), challengeHash, maxMFAAttempts).Scan(
+		&challenge.RealmId, &challenge.Grant.LookupHash, &grantRequest, &challenge.Attempts, &challenge.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return m.MFAChallengeDTO{}, errInvalidMFAChallenge
+	}
+	if err == nil {
+		err = json.Unmarshal(grantRequest, &challenge.Grant)
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error updating mfa challenge in db")
+		return m.MFAChallengeDTO{}, err
+	}
+
+	return challenge, nil
+}
+
+/**
+ * Use up the challenge after a valid code, of concurrent calls only one succeeds
+ * The attempt of the code was counted by ClaimMFAAttempt, it may have been the last one
+ */
+func (handler *dbHandlerImpl) ConsumeMFAChallenge(realmId string, challengeHash string) error {
+
+	result, err := handler.db.Exec(`DELETE FROM mfa_challenges
+	WHERE realm_id = $1 AND challenge_hash = $2 AND expires_at > now()`,
+		realmOrDefault(realmId), challengeHash)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting mfa challenge from db")
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return errInvalidMFAChallenge
+	}
+
+	return nil
+}
+
+/**
+ * Replace the recovery codes of the credentials, they are hashed with bcrypt like passwords
+ */
+func (handler *dbHandlerImpl) ReplaceRecoveryCodes(realmId string, lookupHash string, codes []string) error {
+
+	codeHashes := make([][]byte, 0, len(codes))
+	for _, code := range codes {
+		codeHash, err := bcrypt.GenerateFromPassword([]byte(code), c.EnvBcryptCost)
+		if err != nil {
+			log.Println(err)
+			err = fmt.Errorf("error creating recovery code hash with bcrypt")
+			return err
+		}
+		codeHashes = append(codeHashes, codeHash)
+	}
+
+	realmId = realmOrDefault(realmId)
+
+	tx, err := handler.db.Begin()
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error storing recovery codes in db")
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM mfa_recovery_codes WHERE realm_id = $1 AND lookup_hash = $2`, realmId, lookupHash)
+	for _, codeHash := range codeHashes {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(`INSERT INTO mfa_recovery_codes(realm_id, lookup_hash, code_hash) VALUES($1, $2, $3)`,
+			realmId, lookupHash, codeHash)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error storing recovery codes in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Use up the recovery code, false if it is not one of the credentials' unused codes
+ */
+func (handler *dbHandlerImpl) UseRecoveryCode(realmId string, lookupHash string, code string) (bool, error) {
+
+	rows, err := handler.db.Query(`SELECT id, code_hash FROM mfa_recovery_codes WHERE realm_id = $1 AND lookup_hash = $2`,
+		realmOrDefault(realmId), lookupHash)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading recovery codes from db")
+		return false, err
+	}
+	defer rows.Close()
+
+	var matchingId int64
+	for rows.Next() {
+		var id int64
+		var codeHash string
+		err = rows.Scan(&id, &codeHash)
+		if err != nil {
+			log.Println(err)
+			err = fmt.Errorf("error reading recovery codes from db")
+			return false, err
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(codeHash), []byte(code)) == nil {
+			matchingId = id
+			break
+		}
+	}
+	rows.Close()
+
+	if matchingId == 0 {
+		return false, nil
+	}
+
+	// Of concurrent uses of the same code only one deletes it
+	result, err := handler.db.Exec(`DELETE FROM mfa_recovery_codes WHERE id = $1`, matchingId)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting recovery code from db")
+		return false, err
+	}
+
+	deleted, _ := result.RowsAffected()
+
+	return deleted == 1, nil
+}
+
+func (handler *dbHandlerImpl) CountRecoveryCodes(realmId string, lookupHash string) (int, error) {
+
+	var count int
+
+	err := handler.db.QueryRow(`SELECT count(*) FROM mfa_recovery_codes WHERE realm_id = $1 AND lookup_hash = $2`,
+		realmOrDefault(realmId), lookupHash).Scan(&count)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading recovery codes from db")
+		return 0, err
+	}
+
+	return count, nil
+}
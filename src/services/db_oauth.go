@@ -0,0 +1,491 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	m "simple-micro-auth/src/models"
+	"time"
+)
+
+var (
+	errOAuthClientNotFound = fmt.Errorf("oauth client not found")
+	errInvalidOAuthGrant   = fmt.Errorf("invalid or expired grant")
+)
+
+func (handler *dbHandlerImpl) CreateOAuthClient(client m.OAuthClientDTO) error {
+
+	redirectURIs, err := json.Marshal(client.RedirectURIs)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth client in db")
+		return err
+	}
+
+	scopes, err := json.Marshal(client.Scopes)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth client in db")
+		return err
+	}
+
+	_, err = handler.db.Exec(`INSERT INTO oauth_clients(client_id, realm_id, name, secret_hash, redirect_uris, scopes, token_ttl_min, token_ttl_max)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+		client.ClientId, realmOrDefault(client.RealmId), client.Name, client.SecretHash, string(redirectURIs), string(scopes),
+		int64(client.TokenTtlMin/time.Second), int64(client.TokenTtlMax/time.Second))
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth client in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Client by its id alone, the realm of /authorize and /token requests comes from their client
+ */
+func (handler *dbHandlerImpl) GetOAuthClient(clientId string) (m.OAuthClientDTO, error) {
+
+	client, err := scanOAuthClient(handler.db.QueryRow(`SELECT client_id, realm_id, name, secret_hash, redirect_uris, scopes, token_ttl_min, token_ttl_max, created_at
+	FROM oauth_clients WHERE client_id = $1`, clientId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return m.OAuthClientDTO{}, errOAuthClientNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading oauth client from db")
+		return m.OAuthClientDTO{}, err
+	}
+
+	return client, nil
+}
+
+func (handler *dbHandlerImpl) GetOAuthClients(realmId string) ([]m.OAuthClientDTO, error) {
+
+	rows, err := handler.db.Query(`SELECT client_id, realm_id, name, secret_hash, redirect_uris, scopes, token_ttl_min, token_ttl_max, created_at
+	FROM oauth_clients WHERE realm_id = $1 ORDER BY created_at, client_id`, realmOrDefault(realmId))
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading oauth clients from db")
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []m.OAuthClientDTO{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			log.Println(err)
+			err = fmt.Errorf("error reading oauth clients from db")
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	return clients, rows.Err()
+}
+
+/**
+ * Delete the client, sessions it holds refresh tokens of end with it
+ */
+func (handler *dbHandlerImpl) DeleteOAuthClient(realmId string, clientId string) error {
+
+	tx, err := handler.db.Begin()
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting oauth client from db")
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM sessions WHERE sid IN (SELECT sid FROM oauth_refresh_tokens WHERE realm_id = $1 AND client_id = $2)`,
+		realmOrDefault(realmId), clientId)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting oauth client from db")
+		return err
+	}
+
+	result, err := tx.Exec(`DELETE FROM oauth_clients WHERE realm_id = $1 AND client_id = $2`, realmOrDefault(realmId), clientId)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting oauth client from db")
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return errOAuthClientNotFound
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting oauth client from db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Store an authorization code, expired codes are dropped on the way
+ */
+func (handler *dbHandlerImpl) CreateOAuthCode(code m.OAuthCodeDTO) error {
+
+	scopes, err := json.Marshal(code.Scopes)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth code in db")
+		return err
+	}
+
+	client, err := json.Marshal(code.Client)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth code in db")
+		return err
+	}
+
+	amr, err := json.Marshal(code.AMR)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth code in db")
+		return err
+	}
+
+	_, err = handler.db.Exec(`DELETE FROM oauth_codes WHERE expires_at < now()`)
+	if err == nil {
+		_, err = handler.db.Exec(`INSERT INTO oauth_codes(code_hash, realm_id, client_id, lookup_hash, subject_id, redirect_uri, code_challenge, scopes, client, nonce, amr, auth_time, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+			code.CodeHash, realmOrDefault(code.RealmId), code.ClientId, code.LookupHash, code.SubjectId, code.RedirectURI, code.CodeChallenge,
+			string(scopes), string(client), code.Nonce, string(amr), code.AuthTime, code.ExpiresAt)
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth code in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Use up the code, of concurrent exchanges only one gets it
+ */
+func (handler *dbHandlerImpl) ConsumeOAuthCode(codeHash string) (m.OAuthCodeDTO, error) {
+
+	code := m.OAuthCodeDTO{CodeHash: codeHash}
+	var scopes, client, amr []byte
+
+	err := handler.db.QueryRow(`DELETE FROM oauth_codes WHERE code_hash = $1 AND expires_at > now()
+	RETURNING realm_id, client_id, lookup_hash, subject_id, redirect_uri, code_challenge, scopes, client, nonce, amr, auth_time, expires_at`, codeHash).Scan(
+		&code.RealmId, &code.ClientId, &code.LookupHash, &code.SubjectId, &code.RedirectURI, &code.CodeChallenge, &scopes, &client,
+		&code.Nonce, &amr, &code.AuthTime, &code.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return m.OAuthCodeDTO{}, errInvalidOAuthGrant
+	}
+	if err == nil {
+		err = json.Unmarshal(scopes, &code.Scopes)
+	}
+	if err == nil {
+		err = json.Unmarshal(client, &code.Client)
+	}
+	if err == nil {
+		err = json.Unmarshal(amr, &code.AMR)
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading oauth code from db")
+		return m.OAuthCodeDTO{}, err
+	}
+
+	return code, nil
+}
+
+/**
+ * Store a refresh token, expired ones of the credentials are dropped on the way
+ */
+func (handler *dbHandlerImpl) CreateOAuthRefreshToken(token m.OAuthRefreshTokenDTO) error {
+
+	realmId := realmOrDefault(token.RealmId)
+
+	scopes, err := json.Marshal(token.Scopes)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth refresh token in db")
+		return err
+	}
+
+	amr, err := json.Marshal(token.AMR)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth refresh token in db")
+		return err
+	}
+
+	_, err = handler.db.Exec(`DELETE FROM oauth_refresh_tokens WHERE realm_id = $1 AND lookup_hash = $2 AND expires_at < now()`,
+		realmId, token.LookupHash)
+	if err == nil {
+		_, err = handler.db.Exec(`INSERT INTO oauth_refresh_tokens(token_hash, realm_id, client_id, lookup_hash, subject_id, scopes, sid, nonce, amr, auth_time, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+			token.TokenHash, realmId, token.ClientId, token.LookupHash, token.SubjectId, string(scopes), token.SessionId, token.Nonce, string(amr),
+			token.AuthTime, token.ExpiresAt)
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth refresh token in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Refresh token without using it up, to check the request before ConsumeOAuthRefreshToken
+ */
+func (handler *dbHandlerImpl) GetOAuthRefreshToken(tokenHash string) (m.OAuthRefreshTokenDTO, error) {
+
+	return scanOAuthRefreshToken(handler.db.QueryRow(`SELECT realm_id, client_id, lookup_hash, subject_id, scopes, sid, nonce, amr, auth_time, expires_at
+	FROM oauth_refresh_tokens WHERE token_hash = $1 AND expires_at > now()`, tokenHash), tokenHash)
+}
+
+/**
+ * Use up the refresh token of the client, it is replaced by a new one on every refresh
+ * Fails with errInvalidOAuthGrant if another request used it first
+ */
+func (handler *dbHandlerImpl) ConsumeOAuthRefreshToken(tokenHash string, clientId string) (m.OAuthRefreshTokenDTO, error) {
+
+	return scanOAuthRefreshToken(handler.db.QueryRow(`DELETE FROM oauth_refresh_tokens WHERE token_hash = $1 AND client_id = $2 AND expires_at > now()
+	RETURNING realm_id, client_id, lookup_hash, subject_id, scopes, sid, nonce, amr, auth_time, expires_at`, tokenHash, clientId), tokenHash)
+}
+
+func scanOAuthRefreshToken(row *sql.Row, tokenHash string) (m.OAuthRefreshTokenDTO, error) {
+
+	token := m.OAuthRefreshTokenDTO{TokenHash: tokenHash}
+	var scopes, amr []byte
+
+	err := row.Scan(&token.RealmId, &token.ClientId, &token.LookupHash, &token.SubjectId, &scopes, &token.SessionId, &token.Nonce, &amr,
+		&token.AuthTime, &token.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return m.OAuthRefreshTokenDTO{}, errInvalidOAuthGrant
+	}
+	if err == nil {
+		err = json.Unmarshal(scopes, &token.Scopes)
+	}
+	if err == nil {
+		err = json.Unmarshal(amr, &token.AMR)
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading oauth refresh token from db")
+		return m.OAuthRefreshTokenDTO{}, err
+	}
+
+	return token, nil
+}
+
+/**
+ * Record the scopes the user allowed the client, adding to those allowed before
+ */
+func (handler *dbHandlerImpl) RecordOAuthConsent(consent m.OAuthConsentDTO) error {
+
+	scopes, err := json.Marshal(consent.Scopes)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error recording oauth consent in db")
+		return err
+	}
+
+	_, err = handler.db.Exec(`INSERT INTO oauth_consents(realm_id, lookup_hash, client_id, scopes) VALUES($1, $2, $3, $4)
+	ON CONFLICT (realm_id, lookup_hash, client_id) DO UPDATE SET granted_at = now(),
+	scopes = (SELECT COALESCE(jsonb_agg(DISTINCT scope ORDER BY scope), '[]'::jsonb)
+		FROM jsonb_array_elements_text(oauth_consents.scopes || EXCLUDED.scopes) AS scope)`,
+		realmOrDefault(consent.RealmId), consent.LookupHash, consent.ClientId, string(scopes))
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error recording oauth consent in db")
+		return err
+	}
+
+	return nil
+}
+
+func (handler *dbHandlerImpl) GetOAuthConsents(realmId string, lookupHash string) ([]m.OAuthConsentDTO, error) {
+
+	rows, err := handler.db.Query(`SELECT consent.realm_id, consent.lookup_hash, consent.client_id, client.name, consent.scopes, consent.granted_at
+	FROM oauth_consents consent JOIN oauth_clients client ON client.client_id = consent.client_id
+	WHERE consent.realm_id = $1 AND consent.lookup_hash = $2
+	ORDER BY consent.granted_at DESC`, realmOrDefault(realmId), lookupHash)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading oauth consents from db")
+		return nil, err
+	}
+	defer rows.Close()
+
+	consents := []m.OAuthConsentDTO{}
+	for rows.Next() {
+		var consent m.OAuthConsentDTO
+		var scopes []byte
+		err = rows.Scan(&consent.RealmId, &consent.LookupHash, &consent.ClientId, &consent.ClientName, &scopes, &consent.GrantedAt)
+		if err == nil {
+			err = json.Unmarshal(scopes, &consent.Scopes)
+		}
+		if err != nil {
+			log.Println(err)
+			err = fmt.Errorf("error reading oauth consents from db")
+			return nil, err
+		}
+		consents = append(consents, consent)
+	}
+
+	return consents, rows.Err()
+}
+
+/**
+ * Delete the consent, sessions the client holds refresh tokens of for the credentials end with it
+ */
+func (handler *dbHandlerImpl) DeleteOAuthConsent(realmId string, lookupHash string, clientId string) error {
+
+	realmId = realmOrDefault(realmId)
+
+	tx, err := handler.db.Begin()
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting oauth consent from db")
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM sessions WHERE sid IN (SELECT sid FROM oauth_refresh_tokens WHERE realm_id = $1 AND lookup_hash = $2 AND client_id = $3)`,
+		realmId, lookupHash, clientId)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting oauth consent from db")
+		return err
+	}
+
+	result, err := tx.Exec(`DELETE FROM oauth_consents WHERE realm_id = $1 AND lookup_hash = $2 AND client_id = $3`,
+		realmId, lookupHash, clientId)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting oauth consent from db")
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return fmt.Errorf("oauth consent not found")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting oauth consent from db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Keep a login waiting for the user to allow the scopes, expired ones are dropped on the way
+ */
+func (handler *dbHandlerImpl) CreateOAuthConsentRequest(request m.OAuthConsentRequestDTO) error {
+
+	grantRequest, err := json.Marshal(request.Grant)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth consent request in db")
+		return err
+	}
+
+	scopes, err := json.Marshal(request.Scopes)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth consent request in db")
+		return err
+	}
+
+	amr, err := json.Marshal(request.AMR)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth consent request in db")
+		return err
+	}
+
+	_, err = handler.db.Exec(`DELETE FROM oauth_consent_requests WHERE expires_at < now()`)
+	if err == nil {
+		_, err = handler.db.Exec(`INSERT INTO oauth_consent_requests(consent_hash, realm_id, client_id, lookup_hash, grant_request, scopes, amr, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+			request.ConsentHash, realmOrDefault(request.RealmId), request.ClientId, request.Grant.LookupHash,
+			string(grantRequest), string(scopes), string(amr), request.ExpiresAt)
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating oauth consent request in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Use up the consent request whatever the user decides, of concurrent decisions only one gets it
+ */
+func (handler *dbHandlerImpl) ConsumeOAuthConsentRequest(realmId string, consentHash string) (m.OAuthConsentRequestDTO, error) {
+
+	request := m.OAuthConsentRequestDTO{ConsentHash: consentHash}
+	var grantRequest, scopes, amr []byte
+
+	err := handler.db.QueryRow(`DELETE FROM oauth_consent_requests WHERE realm_id = $1 AND consent_hash = $2 AND expires_at > now()
+	RETURNING realm_id, client_id, grant_request, scopes, amr, expires_at`, realmOrDefault(realmId), consentHash).Scan(
+		&request.RealmId, &request.ClientId, &grantRequest, &scopes, &amr, &request.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return m.OAuthConsentRequestDTO{}, errInvalidOAuthGrant
+	}
+	if err == nil {
+		err = json.Unmarshal(grantRequest, &request.Grant)
+	}
+	if err == nil {
+		err = json.Unmarshal(scopes, &request.Scopes)
+	}
+	if err == nil {
+		err = json.Unmarshal(amr, &request.AMR)
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading oauth consent request from db")
+		return m.OAuthConsentRequestDTO{}, err
+	}
+
+	return request, nil
+}
+
+func scanOAuthClient(row interface{ Scan(dest ...any) error }) (m.OAuthClientDTO, error) {
+
+	client := m.OAuthClientDTO{}
+	var redirectURIs, scopes []byte
+	var tokenTtlMin, tokenTtlMax int64
+
+	err := row.Scan(&client.ClientId, &client.RealmId, &client.Name, &client.SecretHash, &redirectURIs, &scopes,
+		&tokenTtlMin, &tokenTtlMax, &client.CreatedAt)
+	if err != nil {
+		return m.OAuthClientDTO{}, err
+	}
+
+	client.TokenTtlMin = time.Duration(tokenTtlMin) * time.Second
+	client.TokenTtlMax = time.Duration(tokenTtlMax) * time.Second
+
+	err = json.Unmarshal(redirectURIs, &client.RedirectURIs)
+	if err == nil {
+		err = json.Unmarshal(scopes, &client.Scopes)
+	}
+	if err != nil {
+		return m.OAuthClientDTO{}, err
+	}
+
+	return client, nil
+}
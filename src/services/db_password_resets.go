@@ -0,0 +1,86 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+var errInvalidResetToken = fmt.Errorf("invalid or expired reset token")
+
+/**
+ * Store a password reset, replacing pending resets of the credentials
+ * Expired resets are dropped on the way
+ * @param tokenHash string - hex sha256 of the reset token
+ */
+func (handler *dbHandlerImpl) CreatePasswordReset(realmId string, lookupHash string, tokenHash string, expiresAt time.Time) error {
+
+	realmId = realmOrDefault(realmId)
+
+	_, err := handler.db.Exec(`DELETE FROM password_resets WHERE expires_at < now() OR (realm_id = $1 AND lookup_hash = $2)`,
+		realmId, lookupHash)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting password resets from db")
+		return err
+	}
+
+	result, err := handler.db.Exec(`INSERT INTO password_resets(token_hash, realm_id, lookup_hash, expires_at)
+	SELECT $1, realm_id, lookup_hash, $4 FROM auth WHERE realm_id = $2 AND lookup_hash = $3`,
+		tokenHash, realmId, lookupHash, expiresAt)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating password reset in db")
+		return err
+	}
+
+	if created, _ := result.RowsAffected(); created == 0 {
+		err = fmt.Errorf("lookupHash not found")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Lookup hash of a pending reset, the reset stays usable
+ */
+func (handler *dbHandlerImpl) GetPasswordReset(realmId string, tokenHash string) (string, error) {
+
+	var lookupHash string
+
+	err := handler.db.QueryRow(`SELECT lookup_hash FROM password_resets WHERE realm_id = $1 AND token_hash = $2 AND expires_at > now()`,
+		realmOrDefault(realmId), tokenHash).Scan(&lookupHash)
+	if err == sql.ErrNoRows {
+		return "", errInvalidResetToken
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading password reset from db")
+		return "", err
+	}
+
+	return lookupHash, nil
+}
+
+/**
+ * Use up a pending reset, of concurrent calls with the same token only one succeeds
+ */
+func (handler *dbHandlerImpl) ConsumePasswordReset(realmId string, tokenHash string) (string, error) {
+
+	var lookupHash string
+
+	err := handler.db.QueryRow(`DELETE FROM password_resets WHERE realm_id = $1 AND token_hash = $2 AND expires_at > now()
+	RETURNING lookup_hash`, realmOrDefault(realmId), tokenHash).Scan(&lookupHash)
+	if err == sql.ErrNoRows {
+		return "", errInvalidResetToken
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting password reset from db")
+		return "", err
+	}
+
+	return lookupHash, nil
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	m "simple-micro-auth/src/models"
+)
+
+// Wrong codes a passwordless login survives, then it has to be started again
+const maxPasswordlessAttempts = 5
+
+var errInvalidPasswordlessLogin = fmt.Errorf("invalid or expired passwordless login")
+
+/**
+ * Store a pending login, replacing pending logins of the credentials so only the latest code or link works
+ * Expired logins are dropped on the way
+ */
+func (handler *dbHandlerImpl) CreatePasswordlessLogin(login m.PasswordlessLoginDTO) error {
+
+	realmId := realmOrDefault(login.RealmId)
+
+	var codeHash sql.NullString
+	if login.CodeHash != "" {
+		codeHash = sql.NullString{String: login.CodeHash, Valid: true}
+	}
+
+	_, err := handler.db.Exec(`DELETE FROM passwordless_logins WHERE expires_at < now() OR (realm_id = $1 AND lookup_hash = $2)`,
+		realmId, login.LookupHash)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting passwordless logins from db")
+		return err
+	}
+
+	result, err := handler.db.Exec(`INSERT INTO passwordless_logins(login_hash, realm_id, lookup_hash, code_hash, expires_at)
+	SELECT $1, realm_id, lookup_hash, $4, $5 FROM auth WHERE realm_id = $2 AND lookup_hash = $3`,
+		login.LoginHash, realmId, login.LookupHash, codeHash, login.ExpiresAt)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating passwordless login in db")
+		return err
+	}
+
+	if created, _ := result.RowsAffected(); created == 0 {
+		err = fmt.Errorf("lookupHash not found")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Pending login which has not expired or run out of attempts
+ */
+func (handler *dbHandlerImpl) GetPasswordlessLogin(realmId string, loginHash string) (m.PasswordlessLoginDTO, error) {
+
+	login := m.PasswordlessLoginDTO{LoginHash: loginHash}
+	var codeHash sql.NullString
+
+	err := handler.db.QueryRow(`SELECT realm_id, lookup_hash, code_hash, attempts, expires_at FROM passwordless_logins
+	WHERE realm_id = $1 AND login_hash = $2 AND expires_at > now() AND attempts < $3`,
+		realmOrDefault(realmId), loginHash, maxPasswordlessAttempts).Scan(
+		&login.RealmId, &login.LookupHash, &codeHash, &login.Attempts, &login.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return m.PasswordlessLoginDTO{}, errInvalidPasswordlessLogin
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading passwordless login from db")
+		return m.PasswordlessLoginDTO{}, err
+	}
+
+	login.CodeHash = codeHash.String
+
+	return login, nil
+}
+
+/**
+ * Count an attempt against a pending login which has not expired or run out of attempts, before its code is checked
+ * Concurrent attempts are counted one by one, so no more than maxPasswordlessAttempts codes are ever checked
+ */
+func (handler *dbHandlerImpl) ClaimPasswordlessAttempt(realmId string, loginHash string) (m.PasswordlessLoginDTO, error) {
+
+	login := m.PasswordlessLoginDTO{LoginHash: loginHash}
+	var codeHash sql.NullString
+
+	err := handler.db.QueryRow(`UPDATE passwordless_logins SET attempts = attempts + 1
+	WHERE realm_id = $1 AND login_hash = $2 AND expires_at > now() AND attempts < $3
+	RETURNING realm_id, lookup_hash, code_hash, attempts, expires_at`,
+		realmOrDefault(realmId), loginHash, maxPasswordlessAttempts).Scan(
+		&login.RealmId, &login.LookupHash, &codeHash, &login.Attempts, &login.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return m.PasswordlessLoginDTO{}, errInvalidPasswordlessLogin
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error updating passwordless login in db")
+		return m.PasswordlessLoginDTO{}, err
+	}
+
+	login.CodeHash = codeHash.String
+
+	return login, nil
+}
+
+/**
+ * Use up the login, of concurrent calls only one succeeds
+ * A valid code may have been checked with the last attempt ClaimPasswordlessAttempt counted
+ */
+func (handler *dbHandlerImpl) ConsumePasswordlessLogin(realmId string, loginHash string) error {
+
+	result, err := handler.db.Exec(`DELETE FROM passwordless_logins
+	WHERE realm_id = $1 AND login_hash = $2 AND expires_at > now() AND attempts <= $3`,
+		realmOrDefault(realmId), loginHash, maxPasswordlessAttempts)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting passwordless login from db")
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return errInvalidPasswordlessLogin
+	}
+
+	return nil
+}
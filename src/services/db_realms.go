@@ -0,0 +1,289 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	m "simple-micro-auth/src/models"
+	"time"
+)
+
+var errRealmNotFound = fmt.Errorf("realm not found")
+
+/**
+ * Create the realm together with its admin role
+ */
+func (handler *dbHandlerImpl) CreateRealm(realm m.RealmDTO) error {
+
+	tx, err := handler.db.Begin()
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating realm in db")
+		return err
+	}
+	defer tx.Rollback()
+
+	passwordPolicy, err := marshalPasswordPolicy(realm.PasswordPolicy)
+	if err != nil {
+		return err
+	}
+
+	sessionPolicy, err := marshalSessionPolicy(realm.SessionPolicy)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`INSERT INTO realms(id, token_ttl, token_ttl_min, token_ttl_max, password_policy, session_policy)
+	VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`,
+		realm.Id, int64(realm.TokenTtl/time.Second), int64(realm.TokenTtlMin/time.Second), int64(realm.TokenTtlMax/time.Second),
+		passwordPolicy, sessionPolicy)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating realm in db")
+		return err
+	}
+
+	created, err := result.RowsAffected()
+	if err == nil && created == 0 {
+		err = fmt.Errorf("realm already exists")
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO roles(realm_id, name) VALUES($1, 'admin')`, realm.Id)
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO role_scopes(realm_id, role_name, scope) VALUES($1, 'admin', $2)`, realm.Id, adminScope)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating realm in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Delete the realm with its credentials, roles and signing keys
+ */
+func (handler *dbHandlerImpl) DeleteRealm(id string) error {
+
+	tx, err := handler.db.Begin()
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting realm from db")
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM realms WHERE id = $1`, id)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting realm from db")
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err == nil && deleted == 0 {
+		return errRealmNotFound
+	}
+
+	_, err = tx.Exec(`DELETE FROM signing_keys WHERE target = $1`, realmTarget(id))
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting realm from db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Set the password policy of the realm
+ * @param policy *m.PasswordPolicy - nil for PASSWORD_* defaults
+ */
+func (handler *dbHandlerImpl) SetRealmPasswordPolicy(id string, policy *m.PasswordPolicy) error {
+
+	passwordPolicy, err := marshalPasswordPolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	result, err := handler.db.Exec(`UPDATE realms SET password_policy = $2 WHERE id = $1`, realmOrDefault(id), passwordPolicy)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error setting password policy in db")
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err == nil && updated == 0 {
+		return errRealmNotFound
+	}
+
+	return err
+}
+
+/**
+ * Set the default token lifetime of the realm and the bounds of the ttl callers request, 0 for JWT_* defaults
+ */
+func (handler *dbHandlerImpl) SetRealmTokenTtl(id string, tokenTtl time.Duration, tokenTtlMin time.Duration, tokenTtlMax time.Duration) error {
+
+	result, err := handler.db.Exec(`UPDATE realms SET token_ttl = $2, token_ttl_min = $3, token_ttl_max = $4 WHERE id = $1`,
+		realmOrDefault(id), int64(tokenTtl/time.Second), int64(tokenTtlMin/time.Second), int64(tokenTtlMax/time.Second))
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error setting token ttl in db")
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err == nil && updated == 0 {
+		return errRealmNotFound
+	}
+
+	return err
+}
+
+/**
+ * Set the session policy of the realm
+ * @param policy *m.SessionPolicy - nil for SESSION_* defaults
+ */
+func (handler *dbHandlerImpl) SetRealmSessionPolicy(id string, policy *m.SessionPolicy) error {
+
+	sessionPolicy, err := marshalSessionPolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	result, err := handler.db.Exec(`UPDATE realms SET session_policy = $2 WHERE id = $1`, realmOrDefault(id), sessionPolicy)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error setting session policy in db")
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err == nil && updated == 0 {
+		return errRealmNotFound
+	}
+
+	return err
+}
+
+func (handler *dbHandlerImpl) GetRealm(id string) (m.RealmDTO, error) {
+
+	realm, err := scanRealm(handler.db.QueryRow(`SELECT id, token_ttl, token_ttl_min, token_ttl_max, password_policy, session_policy, created_at FROM realms WHERE id = $1`,
+		realmOrDefault(id)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return m.RealmDTO{}, errRealmNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading realm from db")
+		return m.RealmDTO{}, err
+	}
+
+	return realm, nil
+}
+
+func (handler *dbHandlerImpl) GetRealms() ([]m.RealmDTO, error) {
+
+	rows, err := handler.db.Query(`SELECT id, token_ttl, token_ttl_min, token_ttl_max, password_policy, session_policy, created_at FROM realms ORDER BY id`)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading realms from db")
+		return nil, err
+	}
+	defer rows.Close()
+
+	realms := []m.RealmDTO{}
+
+	for rows.Next() {
+		realm, err := scanRealm(rows)
+		if err != nil {
+			log.Println(err)
+			err = fmt.Errorf("error reading realms from db")
+			return nil, err
+		}
+		realms = append(realms, realm)
+	}
+
+	return realms, rows.Err()
+}
+
+func scanRealm(row interface{ Scan(dest ...any) error }) (m.RealmDTO, error) {
+
+	realm := m.RealmDTO{}
+	var tokenTtl, tokenTtlMin, tokenTtlMax int64
+	var passwordPolicy, sessionPolicy []byte
+
+	err := row.Scan(&realm.Id, &tokenTtl, &tokenTtlMin, &tokenTtlMax, &passwordPolicy, &sessionPolicy, &realm.CreatedAt)
+	if err != nil {
+		return m.RealmDTO{}, err
+	}
+
+	realm.TokenTtl = time.Duration(tokenTtl) * time.Second
+	realm.TokenTtlMin = time.Duration(tokenTtlMin) * time.Second
+	realm.TokenTtlMax = time.Duration(tokenTtlMax) * time.Second
+
+	if passwordPolicy != nil {
+		realm.PasswordPolicy = &m.PasswordPolicy{}
+		err = json.Unmarshal(passwordPolicy, realm.PasswordPolicy)
+		if err != nil {
+			return m.RealmDTO{}, err
+		}
+	}
+
+	if sessionPolicy != nil {
+		realm.SessionPolicy = &m.SessionPolicy{}
+		err = json.Unmarshal(sessionPolicy, realm.SessionPolicy)
+		if err != nil {
+			return m.RealmDTO{}, err
+		}
+	}
+
+	return realm, nil
+}
+
+/**
+ * Encode the policy for the jsonb column, null if nil
+ */
+func marshalPasswordPolicy(policy *m.PasswordPolicy) (sql.NullString, error) {
+
+	if policy == nil {
+		return sql.NullString{}, nil
+	}
+
+	passwordPolicy, err := json.Marshal(policy)
+	if err != nil {
+		err = fmt.Errorf("error encoding password policy")
+		return sql.NullString{}, err
+	}
+
+	return sql.NullString{String: string(passwordPolicy), Valid: true}, nil
+}
+
+func marshalSessionPolicy(policy *m.SessionPolicy) (sql.NullString, error) {
+
+	if policy == nil {
+		return sql.NullString{}, nil
+	}
+
+	sessionPolicy, err := json.Marshal(policy)
+	if err != nil {
+		err = fmt.Errorf("error encoding session policy")
+		return sql.NullString{}, err
+	}
+
+	return sql.NullString{String: string(sessionPolicy), Valid: true}, nil
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	m "simple-micro-auth/src/models"
+
+	"github.com/lib/pq"
+)
+
+/**
+ * Create the role or replace the scopes it grants
+ */
+func (handler *dbHandlerImpl) SetRole(realmId string, role m.RoleDTO) error {
+
+	realmId = realmOrDefault(realmId)
+
+	tx, err := handler.db.Begin()
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error setting role in db")
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO roles(realm_id, name) VALUES($1, $2) ON CONFLICT DO NOTHING`, realmId, role.Name)
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM role_scopes WHERE realm_id = $1 AND role_name = $2`, realmId, role.Name)
+	}
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO role_scopes(realm_id, role_name, scope)
+		SELECT $1, $2, unnest($3::varchar[])
+		ON CONFLICT DO NOTHING`, realmId, role.Name, pq.Array(role.Scopes))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error setting role in db")
+		return err
+	}
+
+	return nil
+}
+
+func (handler *dbHandlerImpl) DeleteRole(realmId string, name string) error {
+
+	result, err := handler.db.Exec(`DELETE FROM roles WHERE realm_id = $1 AND name = $2`, realmOrDefault(realmId), name)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting role from db")
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err == nil && deleted == 0 {
+		err = fmt.Errorf("role not found")
+	}
+
+	return err
+}
+
+func (handler *dbHandlerImpl) AssignRole(realmId string, lookupHash string, role string) error {
+
+	realmId = realmOrDefault(realmId)
+
+	var authExists, roleExists bool
+
+	err := handler.db.QueryRow(`SELECT
+		EXISTS(SELECT 1 FROM auth WHERE realm_id = $1 AND lookup_hash = $2),
+		EXISTS(SELECT 1 FROM roles WHERE realm_id = $1 AND name = $3)`, realmId, lookupHash, role).Scan(&authExists, &roleExists)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error assigning role in db")
+		return err
+	}
+
+	if !authExists {
+		err = fmt.Errorf("lookupHash not found")
+		return err
+	}
+
+	if !roleExists {
+		err = fmt.Errorf("role not found")
+		return err
+	}
+
+	_, err = handler.db.Exec(`INSERT INTO auth_roles(realm_id, lookup_hash, role_name)
+	VALUES($1, $2, $3)
+	ON CONFLICT DO NOTHING`, realmId, lookupHash, role)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error assigning role in db")
+		return err
+	}
+
+	return nil
+}
+
+func (handler *dbHandlerImpl) UnassignRole(realmId string, lookupHash string, role string) error {
+
+	_, err := handler.db.Exec(`DELETE FROM auth_roles WHERE realm_id = $1 AND lookup_hash = $2 AND role_name = $3`,
+		realmOrDefault(realmId), lookupHash, role)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error unassigning role in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Get roles together with their scopes
+ * @param lookupHash string - only roles assigned to these credentials, every role if empty
+ */
+func (handler *dbHandlerImpl) GetRoles(realmId string, lookupHash string) ([]m.RoleDTO, error) {
+
+	rows, err := handler.db.Query(`SELECT r.name, COALESCE(array_agg(rs.scope ORDER BY rs.scope) FILTER (WHERE rs.scope IS NOT NULL), '{}')
+	FROM roles r
+	LEFT JOIN role_scopes rs ON rs.realm_id = r.realm_id AND rs.role_name = r.name
+	WHERE r.realm_id = $1
+	AND ($2 = '' OR r.name IN (SELECT role_name FROM auth_roles WHERE realm_id = $1 AND lookup_hash = $2))
+	GROUP BY r.name
+	ORDER BY r.name`, realmOrDefault(realmId), lookupHash)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading roles from db")
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []m.RoleDTO{}
+
+	for rows.Next() {
+		var role m.RoleDTO
+		err = rows.Scan(&role.Name, pq.Array(&role.Scopes))
+		if err != nil {
+			log.Println(err)
+			err = fmt.Errorf("error reading roles from db")
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+/**
+ * Get the scopes granted by every role assigned to the credentials
+ */
+func (handler *dbHandlerImpl) GetScopes(realmId string, lookupHash string) ([]string, error) {
+
+	scopes := []string{}
+
+	err := handler.db.QueryRow(`SELECT COALESCE(array_agg(DISTINCT rs.scope ORDER BY rs.scope), '{}')
+	FROM auth_roles ar
+	JOIN role_scopes rs ON rs.realm_id = ar.realm_id AND rs.role_name = ar.role_name
+	WHERE ar.realm_id = $1 AND ar.lookup_hash = $2`, realmOrDefault(realmId), lookupHash).Scan(pq.Array(&scopes))
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading scopes from db")
+		return nil, err
+	}
+
+	return scopes, nil
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	m "simple-micro-auth/src/models"
+	"time"
+)
+
+var errSessionNotFound = fmt.Errorf("session not found")
+
+func (handler *dbHandlerImpl) CreateSession(session m.SessionDTO) error {
+
+	result, err := handler.db.Exec(`INSERT INTO sessions(sid, realm_id, lookup_hash, user_agent, device, ip)
+	SELECT $1, realm_id, lookup_hash, $4, $5, $6 FROM auth WHERE realm_id = $2 AND lookup_hash = $3`,
+		session.SessionId, realmOrDefault(session.RealmId), session.LookupHash,
+		session.Client.UserAgent, session.Client.Device, session.Client.IP)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating session in db")
+		return err
+	}
+
+	if created, _ := result.RowsAffected(); created == 0 {
+		err = fmt.Errorf("lookupHash not found")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Sessions of the credentials, the most recently refreshed first
+ */
+func (handler *dbHandlerImpl) GetSessions(realmId string, lookupHash string) ([]m.SessionDTO, error) {
+
+	rows, err := handler.db.Query(`SELECT sid, realm_id, lookup_hash, user_agent, device, ip, created_at, last_refreshed_at FROM sessions
+	WHERE realm_id = $1 AND lookup_hash = $2
+	ORDER BY last_refreshed_at DESC`, realmOrDefault(realmId), lookupHash)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading sessions from db")
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []m.SessionDTO{}
+	for rows.Next() {
+		var session m.SessionDTO
+		err = rows.Scan(&session.SessionId, &session.RealmId, &session.LookupHash,
+			&session.Client.UserAgent, &session.Client.Device, &session.Client.IP,
+			&session.CreatedAt, &session.LastRefreshedAt)
+		if err != nil {
+			log.Println(err)
+			err = fmt.Errorf("error reading sessions from db")
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (handler *dbHandlerImpl) GetSession(sessionId string) (m.SessionDTO, error) {
+
+	session := m.SessionDTO{SessionId: sessionId}
+
+	err := handler.db.QueryRow(`SELECT realm_id, lookup_hash, user_agent, device, ip, created_at, last_refreshed_at FROM sessions WHERE sid = $1`,
+		sessionId).Scan(&session.RealmId, &session.LookupHash, &session.Client.UserAgent, &session.Client.Device, &session.Client.IP,
+		&session.CreatedAt, &session.LastRefreshedAt)
+	if err == sql.ErrNoRows {
+		return m.SessionDTO{}, errSessionNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading session from db")
+		return m.SessionDTO{}, err
+	}
+
+	return session, nil
+}
+
+func (handler *dbHandlerImpl) SessionExists(sessionId string) (bool, error) {
+
+	var exists bool
+
+	err := handler.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sessions WHERE sid = $1)`, sessionId).Scan(&exists)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading sessions from db")
+		return false, err
+	}
+
+	return exists, nil
+}
+
+/**
+ * Delete sessions of the credentials the session policy ended, they can not be refreshed anymore,
+ * and sessions of the realm unused for longer than the retention, which no token outlives
+ */
+func (handler *dbHandlerImpl) DeleteEndedSessions(realmId string, lookupHash string, policy m.SessionPolicy, retention time.Duration) error {
+
+	_, err := handler.db.Exec(`DELETE FROM sessions WHERE realm_id = $1
+	AND ((lookup_hash = $2 AND (($3 > 0 AND last_refreshed_at < now() - $3 * interval '1 second') OR ($4 > 0 AND created_at < now() - $4 * interval '1 second')))
+	OR last_refreshed_at < now() - $5 * interval '1 second')`,
+		realmOrDefault(realmId), lookupHash, int64(policy.IdleTimeout/time.Second), int64(policy.MaxLifetime/time.Second), retention.Seconds())
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting sessions from db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Record a refresh of a token of the session
+ */
+func (handler *dbHandlerImpl) TouchSession(sessionId string) error {
+
+	_, err := handler.db.Exec(`UPDATE sessions SET last_refreshed_at = now() WHERE sid = $1`, sessionId)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error updating session in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Delete the session of the credentials, its tokens stop working at once
+ */
+func (handler *dbHandlerImpl) DeleteSession(realmId string, lookupHash string, sessionId string) error {
+
+	result, err := handler.db.Exec(`DELETE FROM sessions WHERE realm_id = $1 AND lookup_hash = $2 AND sid = $3`,
+		realmOrDefault(realmId), lookupHash, sessionId)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting session from db")
+		return err
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return errSessionNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+/**
+ * Revoke the token with the jti
+ * Revocations of tokens which expired meanwhile are dropped on the way
+ * @param expiresAt time.Time - exp of the token, the revocation is kept until then
+ */
+func (handler *dbHandlerImpl) RevokeToken(tokenId string, expiresAt time.Time) error {
+
+	_, err := handler.db.Exec(`INSERT INTO revoked_tokens(jti, expires_at)
+	VALUES($1, $2)
+	ON CONFLICT (jti) DO NOTHING`, tokenId, expiresAt)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error revoking token in db")
+		return err
+	}
+
+	_, err = handler.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < now()`)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting expired revocations from db")
+		return err
+	}
+
+	return nil
+}
+
+func (handler *dbHandlerImpl) IsTokenRevoked(tokenId string) (bool, error) {
+
+	var revoked bool
+
+	err := handler.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = $1)`, tokenId).Scan(&revoked)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading revoked tokens from db")
+		return false, err
+	}
+
+	return revoked, nil
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	m "simple-micro-auth/src/models"
+)
+
+var errInvalidWebAuthnChallenge = fmt.Errorf("invalid or expired webauthn challenge")
+
+/**
+ * Store a pending ceremony, expired ones are dropped on the way
+ */
+func (handler *dbHandlerImpl) CreateWebAuthnChallenge(challenge m.WebAuthnChallengeDTO) error {
+
+	// Logins with discoverable credentials are not bound to credentials yet
+	var lookupHash sql.NullString
+	if challenge.LookupHash != "" {
+		lookupHash = sql.NullString{String: challenge.LookupHash, Valid: true}
+	}
+
+	_, err := handler.db.Exec(`DELETE FROM webauthn_challenges WHERE expires_at < now()`)
+	if err == nil {
+		_, err = handler.db.Exec(`INSERT INTO webauthn_challenges(challenge_hash, realm_id, lookup_hash, ceremony, expires_at)
+		VALUES($1, $2, $3, $4, $5)`,
+			challenge.ChallengeHash, realmOrDefault(challenge.RealmId), lookupHash, challenge.Ceremony, challenge.ExpiresAt)
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating webauthn challenge in db")
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * Use up a pending ceremony, of concurrent calls only one gets it
+ */
+func (handler *dbHandlerImpl) ConsumeWebAuthnChallenge(realmId string, challengeHash string, ceremony string) (m.WebAuthnChallengeDTO, error) {
+
+	challenge := m.WebAuthnChallengeDTO{ChallengeHash: challengeHash, Ceremony: ceremony}
+	var lookupHash sql.NullString
+
+	err := handler.db.QueryRow(`DELETE FROM webauthn_challenges
+	WHERE realm_id = $1 AND challenge_hash = $2 AND ceremony = $3 AND expires_at > now()
+	RETURNING realm_id, lookup_hash, expires_at`,
+		realmOrDefault(realmId), challengeHash, ceremony).Scan(&challenge.RealmId, &lookupHash, &challenge.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return m.WebAuthnChallengeDTO{}, errInvalidWebAuthnChallenge
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error deleting webauthn challenge from db")
+		return m.WebAuthnChallengeDTO{}, err
+	}
+
+	challenge.LookupHash = lookupHash.String
+
+	return challenge, nil
+}
+
+func (handler *dbHandlerImpl) CreateWebAuthnCredential(credential m.WebAuthnCredentialDTO) error {
+
+	result, err := handler.db.Exec(`INSERT INTO webauthn_credentials(credential_id, realm_id, lookup_hash, public_key, sign_count, name)
+	VALUES($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (realm_id, credential_id) DO NOTHING`,
+		credential.CredentialId, realmOrDefault(credential.RealmId), credential.LookupHash, credential.PublicKey, int64(credential.SignCount), credential.Name)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error creating webauthn credential in db")
+		return err
+	}
+
+	if created, _ := result.RowsAffected(); created == 0 {
+		err = fmt.Errorf("credential already registered")
+		return err
+	}
+
+	return nil
+}
+
+func (handler *dbHandlerImpl) GetWebAuthnCredential(realmId string, credentialId []byte) (m.WebAuthnCredentialDTO, error) {
+
+	credential := m.WebAuthnCredentialDTO{CredentialId: credentialId}
+	var signCount int64
+
+	err := handler.db.QueryRow(`SELECT realm_id, lookup_hash, public_key, sign_count, name, created_at, last_used_at
+	FROM webauthn_credentials WHERE realm_id = $1 AND credential_id = $2`,
+		realmOrDefault(realmId), credentialId).Scan(
+		&credential.RealmId, &credential.LookupHash, &credential.PublicKey, &signCount, &credential.Name, &credential.CreatedAt, &credential.LastUsedAt)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("unknown webauthn credential")
+		return m.WebAuthnCredentialDTO{}, err
+	}
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading webauthn credential from db")
+		return m.WebAuthnCredentialDTO{}, err
+	}
+
+	credential.SignCount = uint32(signCount)
+
+	return credential, nil
+}
+
+func (handler *dbHandlerImpl) GetWebAuthnCredentials(realmId string, lookupHash string) ([]m.WebAuthnCredentialDTO, error) {
+
+	rows, err := handler.db.Query(`SELECT credential_id, realm_id, public_key, sign_count, name, created_at, last_used_at
+	FROM webauthn_credentials WHERE realm_id = $1 AND lookup_hash = $2 ORDER BY created_at`,
+		realmOrDefault(realmId), lookupHash)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error reading webauthn credentials from db")
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []m.WebAuthnCredentialDTO{}
+	for rows.Next() {
+		credential := m.WebAuthnCredentialDTO{LookupHash: lookupHash}
+		var signCount int64
+		err = rows.Scan(&credential.CredentialId, &credential.RealmId, &credential.PublicKey, &signCount, &credential.Name, &credential.CreatedAt, &credential.LastUsedAt)
+		if err != nil {
+			log.Println(err)
+			err = fmt.Errorf("error reading webauthn credentials from db")
+			return nil, err
+		}
+		credential.SignCount = uint32(signCount)
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, nil
+}
+
+/**
+ * Store the sign count of a login, false if a concurrent login with the same count got there first
+ */
+func (handler *dbHandlerImpl) UpdateWebAuthnSignCount(realmId string, credentialId []byte, oldSignCount uint32, newSignCount uint32) (bool, error) {
+
+	result, err := handler.db.Exec(`UPDATE webauthn_credentials SET sign_count = $4, last_used_at = now()
+	WHERE realm_id = $1 AND credential_id = $2 AND sign_count = $3`,
+		realmOrDefault(realmId), credentialId, int64(oldSignCount), int64(newSignCount))
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error updating webauthn credential in db")
+		return false, err
+	}
+
+	updated, _ := result.RowsAffected()
+
+	return updated == 1, nil
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	c "simple-micro-auth/src/configs"
+	"strings"
+	"time"
+)
+
+/**
+ * Token introspection response as in RFC 7662
+ * Only active is set for tokens which are invalid, expired or revoked
+ */
+type introspectionResponse struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Nbf       int64    `json:"nbf,omitempty"`
+	Sub       string   `json:"sub,omitempty"`
+	Aud       []string `json:"aud,omitempty"`
+	Iss       string   `json:"iss,omitempty"`
+	Jti       string   `json:"jti,omitempty"`
+	Sid       string   `json:"sid,omitempty"`
+	ClientId  string   `json:"client_id,omitempty"`
+}
+
+/**
+ * Error response of the HTTP endpoints as in RFC 6749 section 5.2
+ */
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+/**
+ * POST /introspect
+ * Clients authenticate with HTTP Basic or client_id and client_secret form parameters,
+ * see INTROSPECTION_CLIENTS
+ */
+func IntrospectionHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, oauthError{Error: "invalid_request"})
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: "malformed form body"})
+		return
+	}
+
+	if !authenticateIntrospectionClient(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		writeJSON(w, http.StatusUnauthorized, oauthError{Error: "invalid_client"})
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: "token is required"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, introspect(token))
+}
+
+/**
+ * Any token which VerifyToken would reject is reported as inactive, without a reason
+ */
+func introspect(token string) introspectionResponse {
+
+	// Gateways do not know the realm, so it comes from the iss claim and is checked by the realm's keys
+	realmId, ok := tokenRealm(token)
+	if !ok {
+		return introspectionResponse{Active: false}
+	}
+
+	_, keys, err := resolveRealm(realmId)
+	if err != nil {
+		return introspectionResponse{Active: false}
+	}
+
+	tokenClaims, err := verifyActiveToken(token, keys)
+	if err != nil {
+		return introspectionResponse{Active: false}
+	}
+
+	if tokenClaims.NotBefore > time.Now().Unix() {
+		return introspectionResponse{Active: false}
+	}
+
+	return introspectionResponse{
+		Active:    true,
+		Scope:     strings.Join(tokenClaims.Scopes, " "),
+		TokenType: "Bearer",
+		Exp:       tokenClaims.ExpiresAt,
+		Iat:       tokenClaims.IssuedAt,
+		Nbf:       tokenClaims.NotBefore,
+		Sub:       tokenClaims.Subject,
+		Aud:       tokenClaims.Audience,
+		Iss:       tokenClaims.Issuer,
+		Jti:       tokenClaims.TokenId,
+		Sid:       tokenClaims.SessionId,
+		ClientId:  tokenClaims.ClientId,
+	}
+}
+
+func authenticateIntrospectionClient(r *http.Request) bool {
+
+	clientId, clientSecret, ok := requestClientCredentials(r)
+	if !ok {
+		return false
+	}
+
+	return checkIntrospectionClient(clientId, clientSecret)
+}
+
+/**
+ * Client credentials of the request, HTTP Basic or else client_id and client_secret form parameters
+ * @returns false for malformed credentials
+ */
+func requestClientCredentials(r *http.Request) (string, string, bool) {
+
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"), true
+	}
+
+	// Credentials in the Authorization header are form encoded, see RFC 6749 section 2.3.1
+	clientId, err := url.QueryUnescape(clientId)
+	if err != nil {
+		return "", "", false
+	}
+	clientSecret, err = url.QueryUnescape(clientSecret)
+	if err != nil {
+		return "", "", false
+	}
+
+	return clientId, clientSecret, true
+}
+
+func checkIntrospectionClient(clientId string, clientSecret string) bool {
+
+	expectedSecret, ok := c.EnvIntrospectionClients[clientId]
+	if !ok || clientId == "" {
+		return false
+	}
+
+	// Compare digests so neither content nor length of the secret leaks through timing
+	expectedDigest := sha256.Sum256([]byte(expectedSecret))
+	digest := sha256.Sum256([]byte(clientSecret))
+
+	return subtle.ConstantTimeCompare(expectedDigest[:], digest[:]) == 1
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, response interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	"sync"
+	"time"
+)
+
+var (
+	// Realms whose signing keys were loaded by this replica
+	loadedRealms      = map[string]bool{}
+	loadedRealmsMutex sync.RWMutex
+	// Loads in progress, one per realm so a slow signer of one realm does not hold up the others
+	realmLoads      = map[string]*sync.Mutex{}
+	realmLoadsMutex sync.Mutex
+)
+
+/**
+ * Load signing keys of the realm from the configured signer
+ * Realms other than the default one use their own Vault key and PKCS#11 key label, suffixed with the realm id
+ */
+func LoadSigningKeys(realm string) error {
+
+	target := realmTarget(realm)
+
+	switch c.EnvSigner {
+	case "vault":
+		vaultConfig := c.EnvVaultConfig
+		if realm != DefaultRealm {
+			vaultConfig.KeyName += "-" + realm
+		}
+		active, others, err := cert.LoadVaultKeys(vaultConfig, c.EnvJWTAlgorithm)
+		if err != nil {
+			return err
+		}
+		cert.KeysOf(target).Replace(active, others)
+	case "pkcs11":
+		pkcs11Config := c.EnvPKCS11Config
+		if realm != DefaultRealm {
+			pkcs11Config.KeyLabel += "-" + realm
+		}
+		key, err := cert.LoadPKCS11Key(pkcs11Config, c.EnvJWTAlgorithm)
+		if err != nil {
+			return err
+		}
+		cert.KeysOf(target).Replace(key, nil)
+	default:
+		if c.EnvSigningKeyStore == "db" {
+			err := SyncSigningKeys(target)
+			if err != nil {
+				return err
+			}
+		} else {
+			cert.ReadCertificates(target)
+		}
+	}
+
+	loadedRealmsMutex.Lock()
+	loadedRealms[realm] = true
+	loadedRealmsMutex.Unlock()
+
+	return nil
+}
+
+/**
+ * Signing keys of the realm, loaded on first use
+ */
+func realmKeys(realm string) (*cert.KeySet, error) {
+
+	if realmLoaded(realm) {
+		return cert.KeysOf(realmTarget(realm)), nil
+	}
+
+	// Replicas load each realm once, concurrent requests for it wait for the first one
+	realmLoadsMutex.Lock()
+	realmLoad, ok := realmLoads[realm]
+	if !ok {
+		realmLoad = &sync.Mutex{}
+		realmLoads[realm] = realmLoad
+	}
+	realmLoadsMutex.Unlock()
+
+	realmLoad.Lock()
+	defer realmLoad.Unlock()
+
+	if !realmLoaded(realm) {
+		err := LoadSigningKeys(realm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cert.KeysOf(realmTarget(realm)), nil
+}
+
+func realmLoaded(realm string) bool {
+
+	loadedRealmsMutex.RLock()
+	defer loadedRealmsMutex.RUnlock()
+
+	return loadedRealms[realm]
+}
+
+/**
+ * Drop signing keys of a deleted realm from this replica
+ */
+func unloadSigningKeys(realm string) {
+
+	loadedRealmsMutex.Lock()
+	delete(loadedRealms, realm)
+	loadedRealmsMutex.Unlock()
+
+	realmLoadsMutex.Lock()
+	delete(realmLoads, realm)
+	realmLoadsMutex.Unlock()
+
+	cert.UnregisterTarget(realmTarget(realm))
+}
+
+/**
+ * Make sure the target has a signing key in db and load its keys
+ * Keys created by any replica end up in every replica once they sync
+ */
+func SyncSigningKeys(target string) error {
+
+	masterKey, err := cert.ParseMasterKey(c.EnvSigningKeyMasterKey)
+	if err != nil {
+		return fmt.Errorf("invalid SIGNING_KEY_MASTER_KEY: %w", err)
+	}
+
+	err = db.EnsureSigningKey(
+		target,
+		c.EnvJWTAlgorithm,
+		c.EnvSigningKeyRotation,
+		2*c.EnvSigningKeyRefresh,
+		func() (m.SigningKeyDTO, error) {
+			return generateSigningKey(target, masterKey)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	storedKeys, err := db.GetSigningKeys(target, c.EnvSigningKeyRetention)
+	if err != nil {
+		return err
+	}
+
+	var active *cert.Key
+	others := []cert.Key{}
+
+	for _, storedKey := range storedKeys {
+		publicKey, err := x509.ParsePKIXPublicKey(storedKey.PublicKey)
+		if err != nil {
+			return fmt.Errorf("could not parse public key %s: %w", storedKey.Kid, err)
+		}
+
+		key := cert.Key{
+			ID:        storedKey.Kid,
+			Algorithm: storedKey.Algorithm,
+			PublicKey: publicKey,
+			CreatedAt: storedKey.CreatedAt,
+		}
+
+		// Keys come latest first, so the first activated one signs
+		if active != nil || storedKey.ActivatesAt.After(time.Now()) {
+			others = append(others, key)
+			continue
+		}
+
+		privateKeyBytes, err := cert.Decrypt(storedKey.PrivateKey, masterKey, []byte(storedKey.Kid))
+		if err != nil {
+			return fmt.Errorf("could not decrypt private key %s: %w", storedKey.Kid, err)
+		}
+
+		privateKey, err := x509.ParsePKCS8PrivateKey(privateKeyBytes)
+		if err != nil {
+			return fmt.Errorf("could not parse private key %s: %w", storedKey.Kid, err)
+		}
+
+		signer, ok := privateKey.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("private key %s can not sign", storedKey.Kid)
+		}
+
+		key.Signer = cert.NewSigner(signer, storedKey.Kid, storedKey.Algorithm)
+		active = &key
+	}
+
+	if active == nil {
+		return fmt.Errorf("no active signing key for %s", target)
+	}
+
+	cert.KeysOf(target).Replace(*active, others)
+
+	return nil
+}
+
+/**
+ * Reload signing keys of every loaded realm every SIGNING_KEY_REFRESH to pick up rotations made by
+ * other replicas or Vault, keys of realms deleted meanwhile are dropped
+ * Keys of files and PKCS#11 tokens do not change while running
+ */
+func WatchSigningKeys() {
+
+	if c.EnvSigner != "vault" && (c.EnvSigner != "local" || c.EnvSigningKeyStore != "db") {
+		return
+	}
+
+	ticker := time.NewTicker(c.EnvSigningKeyRefresh)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		loadedRealmsMutex.RLock()
+		realms := make([]string, 0, len(loadedRealms))
+		for realm := range loadedRealms {
+			realms = append(realms, realm)
+		}
+		loadedRealmsMutex.RUnlock()
+
+		for _, realm := range realms {
+			_, err := db.GetRealm(realm)
+			if errors.Is(err, errRealmNotFound) {
+				unloadSigningKeys(realm)
+				continue
+			}
+
+			err = LoadSigningKeys(realm)
+			if err != nil {
+				log.Printf("error reloading signing keys of realm %s: %v", realm, err)
+			}
+		}
+	}
+}
+
+func generateSigningKey(target string, masterKey []byte) (m.SigningKeyDTO, error) {
+
+	privateKey, err := cert.GenerateKey(c.EnvJWTAlgorithm)
+	if err != nil {
+		return m.SigningKeyDTO{}, err
+	}
+
+	kid, err := cert.KeyID(privateKey.Public())
+	if err != nil {
+		return m.SigningKeyDTO{}, err
+	}
+
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return m.SigningKeyDTO{}, err
+	}
+
+	encryptedPrivateKey, err := cert.Encrypt(privateKeyBytes, masterKey, []byte(kid))
+	if err != nil {
+		return m.SigningKeyDTO{}, err
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		return m.SigningKeyDTO{}, err
+	}
+
+	return m.SigningKeyDTO{
+		Kid:        kid,
+		Target:     target,
+		Algorithm:  c.EnvJWTAlgorithm,
+		PrivateKey: encryptedPrivateKey,
+		PublicKey:  publicKeyBytes,
+	}, nil
+}
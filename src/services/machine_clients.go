@@ -0,0 +1,357 @@
+package services
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"simple-micro-auth/src/cert"
+	m "simple-micro-auth/src/models"
+	pb "simple-micro-auth/src/proto"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// client_assertion_type of private_key_jwt, see RFC 7523 section 2.2
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// Assertions expiring later are refused, their jti is kept until they expire
+const maxClientAssertionTtl = 5 * time.Minute
+
+const (
+	machineClientSecret = "client_secret"
+	machineClientKey    = "private_key_jwt"
+)
+
+// Unknown clients, wrong secrets and bad assertions look the same to the caller
+var errInvalidMachineClient = fmt.Errorf("invalid client credentials")
+
+/**
+ * Register a backend service which gets tokens of its own with IssueClientToken or the client_credentials grant of /token
+ * Clients without a public key get a secret which is returned once, only its hash is stored
+ */
+func (service *AuthServiceServer) CreateMachineClient(ctx context.Context, req *pb.CreateMachineClientRequest) (*pb.MachineClientResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := machineClientFromPb(req)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	realm, err := db.GetRealm(req.Realm)
+	if err != nil {
+		return &pb.MachineClientResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+	client.RealmId = realm.Id
+
+	client.ClientId, err = newTokenId()
+	if err != nil {
+		return &pb.MachineClientResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	var clientSecret string
+	if client.PublicKey == nil {
+		clientSecret, err = newOAuthSecret()
+		if err != nil {
+			return &pb.MachineClientResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+		}
+		client.SecretHash = oauthSecretHash(clientSecret)
+	}
+
+	err = db.CreateMachineClient(client)
+	if err != nil {
+		return &pb.MachineClientResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.MachineClientResponse{Error: "", ClientId: client.ClientId, ClientSecret: clientSecret}, nil
+}
+
+/**
+ * Delete the client, tokens it was issued are rejected right away
+ */
+func (service *AuthServiceServer) DeleteMachineClient(ctx context.Context, req *pb.DeleteMachineClientRequest) (*pb.MachineClientResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.DeleteMachineClient(req.Realm, req.ClientId)
+	if err != nil {
+		return &pb.MachineClientResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.MachineClientResponse{Error: ""}, nil
+}
+
+func (service *AuthServiceServer) GetMachineClients(ctx context.Context, req *pb.GetMachineClientsRequest) (*pb.GetMachineClientsResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	clients, err := db.GetMachineClients(req.Realm)
+	if err != nil {
+		return &pb.GetMachineClientsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	response := &pb.GetMachineClientsResponse{Clients: []*pb.MachineClient{}, Error: ""}
+	for _, client := range clients {
+		authMethod := machineClientSecret
+		if client.PublicKey != nil {
+			authMethod = machineClientKey
+		}
+		response.Clients = append(response.Clients, &pb.MachineClient{
+			ClientId:   client.ClientId,
+			Name:       strings.ToValidUTF8(client.Name, "UTF-8_BUGFIX"),
+			Scopes:     client.Scopes,
+			AuthMethod: authMethod,
+			CreatedAt:  client.CreatedAt.Unix(),
+		})
+	}
+
+	return response, nil
+}
+
+/**
+ * Client credentials grant over gRPC, the token names the client in sub and client_id
+ * VerifyToken accepts it like any other token of the realm of the client
+ */
+func (service *AuthServiceServer) IssueClientToken(ctx context.Context, req *pb.ClientTokenRequest) (*pb.ClientTokenResponse, error) {
+
+	client, err := authenticateMachineClient(req.ClientId, req.ClientSecret, req.ClientAssertion)
+	if err != nil {
+		return &pb.ClientTokenResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	scopes, err := resolveOAuthScopes(client.Scopes, strings.Join(req.Scopes, " "))
+	if err != nil {
+		return &pb.ClientTokenResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	token, expiresAt, err := issueClientToken(client, scopes, req.Ttl, req.Audience)
+	if err != nil {
+		return &pb.ClientTokenResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.ClientTokenResponse{Error: "", Token: token, ExpiresAt: expiresAt, Scopes: scopes}, nil
+}
+
+/**
+ * Validate a client registration, the realm, id and secret are up to the caller
+ * Only the public members of the JWK are kept
+ */
+func machineClientFromPb(req *pb.CreateMachineClientRequest) (m.MachineClientDTO, error) {
+
+	client := m.MachineClientDTO{Name: strings.TrimSpace(req.Name)}
+
+	if len(client.Name) > maxOAuthClientNameLength {
+		return m.MachineClientDTO{}, fmt.Errorf("name must not be longer than %d bytes", maxOAuthClientNameLength)
+	}
+
+	var err error
+	client.Scopes, err = clientScopes(req.Scopes)
+	if err != nil {
+		return m.MachineClientDTO{}, err
+	}
+
+	if req.PublicKey == "" {
+		return client, nil
+	}
+
+	var jwk cert.JWK
+	err = json.Unmarshal([]byte(req.PublicKey), &jwk)
+	if err != nil {
+		return m.MachineClientDTO{}, fmt.Errorf("public key must be a JWK")
+	}
+
+	publicKey, err := cert.ParseJWK(jwk)
+	if err != nil {
+		return m.MachineClientDTO{}, err
+	}
+
+	if rsaKey, ok := publicKey.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 2048 {
+		return m.MachineClientDTO{}, fmt.Errorf("rsa public key must have at least 2048 bits")
+	}
+
+	client.PublicKey, err = json.Marshal(jwk)
+	if err != nil {
+		return m.MachineClientDTO{}, err
+	}
+
+	return client, nil
+}
+
+/**
+ * Client of a token request, by its secret or, if an assertion is given, by private_key_jwt
+ * The client id may be left out with an assertion, its iss names the client
+ */
+func authenticateMachineClient(clientId string, clientSecret string, assertion string) (m.MachineClientDTO, error) {
+
+	if assertion != "" {
+		return verifyClientAssertion(clientId, assertion)
+	}
+
+	if clientId == "" || clientSecret == "" {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+
+	client, err := db.GetMachineClient(clientId)
+	if errors.Is(err, errMachineClientNotFound) {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+	if err != nil {
+		return m.MachineClientDTO{}, err
+	}
+
+	secretHash := oauthSecretHash(clientSecret)
+	if client.SecretHash == "" || subtle.ConstantTimeCompare([]byte(secretHash), []byte(client.SecretHash)) != 1 {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+
+	return client, nil
+}
+
+/**
+ * JWT signed with the key of the client as in RFC 7523 section 3
+ * Its aud is the token endpoint or the issuer of the realm, and its jti works once
+ */
+func verifyClientAssertion(clientId string, assertion string) (m.MachineClientDTO, error) {
+
+	// The key to verify with depends on the client the assertion claims to be from
+	unverified := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(assertion, unverified)
+	if err != nil {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+
+	issuer, _ := unverified["iss"].(string)
+	if clientId == "" {
+		clientId = issuer
+	}
+	if clientId == "" || issuer != clientId {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+
+	client, err := db.GetMachineClient(clientId)
+	if errors.Is(err, errMachineClientNotFound) {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+	if err != nil {
+		return m.MachineClientDTO{}, err
+	}
+	if client.PublicKey == nil {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+
+	var jwk cert.JWK
+	err = json.Unmarshal(client.PublicKey, &jwk)
+	if err != nil {
+		return m.MachineClientDTO{}, err
+	}
+
+	publicKey, err := cert.ParseJWK(jwk)
+	if err != nil {
+		return m.MachineClientDTO{}, err
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(assertion, claims, func(token *jwt.Token) (interface{}, error) {
+		if !cert.KeyMatchesAlgorithm(publicKey, token.Method.Alg()) {
+			return nil, fmt.Errorf("unexpected signing method")
+		}
+		return publicKey, nil
+	}, jwt.WithIssuer(clientId), jwt.WithSubject(clientId))
+	if err != nil {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil || expiresAt.After(time.Now().Add(maxClientAssertionTtl)) {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+
+	audience, err := claims.GetAudience()
+	if err != nil || !(slices.Contains(audience, tokenEndpoint()) || slices.Contains(audience, realmIssuer(client.RealmId))) {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+
+	tokenId, _ := claims["jti"].(string)
+	if tokenId == "" {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+
+	unused, err := db.UseClientAssertion(client.ClientId, tokenId, expiresAt.Time)
+	if err != nil {
+		return m.MachineClientDTO{}, err
+	}
+	if !unused {
+		return m.MachineClientDTO{}, errInvalidMachineClient
+	}
+
+	return client, nil
+}
+
+/**
+ * Token of the client with the scopes, resolved by the caller against those allowed to the client
+ * @returns the token and its exp
+ */
+func issueClientToken(client m.MachineClientDTO, scopes []string, ttl string, audience []string) (string, int64, error) {
+
+	realm, keys, err := resolveRealm(client.RealmId)
+	if err != nil {
+		return "", 0, err
+	}
+
+	tokenTtl, err := realmTokenTtl(realm, ttl)
+	if err != nil {
+		return "", 0, err
+	}
+
+	issuedAt := time.Now()
+	expiresAt := issuedAt.Add(tokenTtl).Unix()
+
+	token, err := tokenHandler.CreateToken(m.TokenDTO{
+		Subject:   client.ClientId,
+		IssuedAt:  issuedAt.Unix(),
+		ExpiresAt: expiresAt,
+		Noise:     mathrand.Int63(),
+		Issuer:    realmIssuer(realm.Id),
+		Audience:  audience,
+		Scopes:    scopes,
+		ClientId:  client.ClientId,
+	}, keys.Active().Signer)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return token, expiresAt, nil
+}
+
+/**
+ * Fail for tokens of machine clients which were deleted
+ */
+func checkMachineClient(claims jwt.MapClaims) error {
+
+	clientId, ok := clientSubject(claims)
+	if !ok {
+		return nil
+	}
+
+	_, err := db.GetMachineClient(clientId)
+	if errors.Is(err, errMachineClientNotFound) {
+		return fmt.Errorf("client deleted")
+	}
+
+	return err
+}
@@ -0,0 +1,377 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	pb "simple-micro-auth/src/proto"
+	"simple-micro-auth/src/totp"
+	"strings"
+	"time"
+)
+
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+	// Lowercase letters and digits without the easily confused 0, 1, i, l and o
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+/**
+ * Start a TOTP enrollment, GrantAuth keeps working without a second factor until ConfirmTOTP
+ * Replacing a confirmed enrollment takes a code of it, so the password alone can not move MFA to another device
+ */
+func (service *AuthServiceServer) EnrollTOTP(ctx context.Context, req *pb.EnrollTOTPRequest) (*pb.EnrollTOTPResponse, error) {
+	realm, err := db.GetRealm(realmOrDefault(req.Realm))
+	if err != nil {
+		return &pb.EnrollTOTPResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	masterKey, err := cert.ParseMasterKey(c.EnvMFAMasterKey)
+	if err != nil {
+		err = fmt.Errorf("totp is not available, MFA_MASTER_KEY: %v", err)
+		return &pb.EnrollTOTPResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	err = db.VerifyCredentials(m.CredentialsDTO{RealmId: realm.Id, LookupHash: req.LookupHash, Password: req.Password})
+	if err != nil {
+		return &pb.EnrollTOTPResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	enrolled, err := mfaEnrolled(realm.Id, req.LookupHash)
+	if err == nil && enrolled {
+		_, err = verifySecondFactor(realm.Id, req.LookupHash, req.Code)
+	}
+	if err != nil {
+		return &pb.EnrollTOTPResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return &pb.EnrollTOTPResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	encryptedSecret, err := cert.Encrypt(secret, masterKey, totpAssociatedData(realm.Id, req.LookupHash))
+	if err != nil {
+		return &pb.EnrollTOTPResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	err = db.SetPendingTOTP(realm.Id, req.LookupHash, encryptedSecret)
+	if err != nil {
+		return &pb.EnrollTOTPResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.EnrollTOTPResponse{
+		Secret: totp.EncodeSecret(secret),
+		Uri:    totp.URI(c.EnvTOTPIssuer, req.LookupHash, secret),
+		Error:  "",
+	}, nil
+}
+
+/**
+ * Confirm the enrollment with a first code, proving the authenticator app got the secret
+ * Comes with a new set of recovery codes
+ */
+func (service *AuthServiceServer) ConfirmTOTP(ctx context.Context, req *pb.ConfirmTOTPRequest) (*pb.MFAResponse, error) {
+	realmId := realmOrDefault(req.Realm)
+
+	enrollment, err := db.GetTOTP(realmId, req.LookupHash)
+	if err == nil && enrollment.PendingSecret == nil {
+		err = fmt.Errorf("no pending totp enrollment")
+	}
+	if err != nil {
+		return &pb.MFAResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	secret, err := decryptTOTPSecret(realmId, req.LookupHash, enrollment.PendingSecret)
+	if err != nil {
+		return &pb.MFAResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	step, ok := totp.Validate(secret, req.Code, time.Now(), 0)
+	if !ok {
+		err = fmt.Errorf("invalid code")
+		return &pb.MFAResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	err = db.ConfirmTOTP(realmId, req.LookupHash, step)
+	if err != nil {
+		return &pb.MFAResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	recoveryCodes, err := replaceRecoveryCodes(realmId, req.LookupHash)
+	if err != nil {
+		return &pb.MFAResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.MFAResponse{Error: "", RecoveryCodes: recoveryCodes}, nil
+}
+
+/**
+ * Replace the recovery codes, e.g. when they are used up or were exposed
+ */
+func (service *AuthServiceServer) RegenerateRecoveryCodes(ctx context.Context, req *pb.RegenerateRecoveryCodesRequest) (*pb.MFAResponse, error) {
+	realmId := realmOrDefault(req.Realm)
+
+	err := db.VerifyCredentials(m.CredentialsDTO{RealmId: realmId, LookupHash: req.LookupHash, Password: req.Password})
+	if err != nil {
+		return &pb.MFAResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	_, err = verifySecondFactor(realmId, req.LookupHash, req.Code)
+	if err != nil {
+		return &pb.MFAResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	recoveryCodes, err := replaceRecoveryCodes(realmId, req.LookupHash)
+	if err != nil {
+		return &pb.MFAResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.MFAResponse{Error: "", RecoveryCodes: recoveryCodes}, nil
+}
+
+/**
+ * Second step of GrantAuth, issues the token for a valid code
+ * Every code is accepted once, wrong codes use up the attempts of the challenge
+ */
+func (service *AuthServiceServer) CompleteMFA(ctx context.Context, req *pb.CompleteMFARequest) (*pb.AuthResponse, error) {
+	realm, keys, err := resolveRealm(req.Realm)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	challengeHash := mfaChallengeHash(req.ChallengeId)
+
+	challenge, err := db.ClaimMFAAttempt(realm.Id, challengeHash)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	_, err = verifySecondFactor(realm.Id, challenge.Grant.LookupHash, req.Code)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	err = db.ConsumeMFAChallenge(realm.Id, challengeHash)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	// The account may have been disabled since the password was checked
+	credentialsStatus, err := db.GetCredentialsStatus(realm.Id, challenge.Grant.LookupHash)
+	if err == nil {
+		err = checkAccountStatus(credentialsStatus.Status)
+	}
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	recoveryCodesRemaining, err := db.CountRecoveryCodes(realm.Id, challenge.Grant.LookupHash)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	response := grantToken(realm, keys, challenge.Grant, credentialsStatus)
+	response.RecoveryCodesRemaining = int32(recoveryCodesRemaining)
+
+	return response, nil
+}
+
+/**
+ * Challenge for CompleteMFA if the credentials have a confirmed second factor, nil otherwise
+ */
+func startMFA(realm m.RealmDTO, grant m.GrantDTO) (*pb.AuthResponse, error) {
+
+	enrolled, err := mfaEnrolled(realm.Id, grant.LookupHash)
+	if err != nil || !enrolled {
+		return nil, err
+	}
+
+	challengeBytes := make([]byte, 32)
+	_, err = rand.Read(challengeBytes)
+	if err != nil {
+		return nil, err
+	}
+	challengeId := base64.RawURLEncoding.EncodeToString(challengeBytes)
+
+	err = db.CreateMFAChallenge(m.MFAChallengeDTO{
+		ChallengeHash: mfaChallengeHash(challengeId),
+		RealmId:       realm.Id,
+		Grant:         grant,
+		ExpiresAt:     time.Now().Add(c.EnvMFAChallengeTtl),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.AuthResponse{
+		Id:               grant.Id,
+		Token:            "",
+		Error:            "mfa required",
+		PasswordBreached: grant.PasswordBreached,
+		MfaRequired:      true,
+		MfaChallengeId:   challengeId,
+	}, nil
+}
+
+func mfaEnrolled(realmId string, lookupHash string) (bool, error) {
+
+	enrollment, err := db.GetTOTP(realmId, lookupHash)
+	if err != nil {
+		return false, err
+	}
+
+	return enrollment.Secret != nil, nil
+}
+
+/**
+ * Check a TOTP code against the confirmed secret or a recovery code and use it up
+ * @returns whether a recovery code was used
+ */
+func verifySecondFactor(realmId string, lookupHash string, code string) (bool, error) {
+
+	enrollment, err := db.GetTOTP(realmId, lookupHash)
+	if err == nil && enrollment.Secret == nil {
+		err = fmt.Errorf("totp is not enrolled")
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Anything but a TOTP code can only be a recovery code
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if !isTOTPCode(code) {
+		used, err := db.UseRecoveryCode(realmId, lookupHash, normalizeRecoveryCode(code))
+		if err != nil {
+			return false, err
+		}
+		if !used {
+			return false, fmt.Errorf("invalid code")
+		}
+		return true, nil
+	}
+
+	secret, err := decryptTOTPSecret(realmId, lookupHash, enrollment.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now(), enrollment.LastUsedStep)
+	if !ok {
+		return false, fmt.Errorf("invalid code")
+	}
+
+	// Concurrent requests with the same code race for the step, only one gets it
+	unused, err := db.UseTOTPStep(realmId, lookupHash, step)
+	if err != nil {
+		return false, err
+	}
+	if !unused {
+		return false, fmt.Errorf("invalid code")
+	}
+
+	return false, nil
+}
+
+func isTOTPCode(code string) bool {
+
+	if len(code) != totp.Digits {
+		return false
+	}
+
+	for _, char := range code {
+		if char < '0' || char > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+ * New set of recovery codes, returned in the xxxxx-xxxxx form users get to see
+ */
+func replaceRecoveryCodes(realmId string, lookupHash string) ([]string, error) {
+
+	codes := make([]string, 0, recoveryCodeCount)
+	normalizedCodes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := randomRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		normalizedCodes = append(normalizedCodes, string(code))
+		codes = append(codes, string(code[:recoveryCodeLength/2])+"-"+string(code[recoveryCodeLength/2:]))
+	}
+
+	err := db.ReplaceRecoveryCodes(realmId, lookupHash, normalizedCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+/**
+ * Unformatted recovery code with every character of the alphabet equally likely
+ */
+func randomRecoveryCode() ([]byte, error) {
+
+	// Bytes from the largest multiple of the alphabet size on would favor the first characters, they are drawn again
+	limit := 256 - 256%len(recoveryCodeAlphabet)
+
+	code := make([]byte, 0, recoveryCodeLength)
+	randomBytes := make([]byte, recoveryCodeLength)
+	for len(code) < recoveryCodeLength {
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, randomByte := range randomBytes {
+			if int(randomByte) < limit && len(code) < recoveryCodeLength {
+				code = append(code, recoveryCodeAlphabet[int(randomByte)%len(recoveryCodeAlphabet)])
+			}
+		}
+	}
+
+	return code, nil
+}
+
+/**
+ * Recovery codes are compared without case, separators and spaces
+ */
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func decryptTOTPSecret(realmId string, lookupHash string, encryptedSecret []byte) ([]byte, error) {
+
+	masterKey, err := cert.ParseMasterKey(c.EnvMFAMasterKey)
+	if err != nil {
+		return nil, fmt.Errorf("totp is not available, MFA_MASTER_KEY: %v", err)
+	}
+
+	return cert.Decrypt(encryptedSecret, masterKey, totpAssociatedData(realmId, lookupHash))
+}
+
+/**
+ * Secrets are bound to their credentials, so a secret copied to another row does not decrypt
+ */
+func totpAssociatedData(realmId string, lookupHash string) []byte {
+	return []byte("totp/" + realmOrDefault(realmId) + "/" + lookupHash)
+}
+
+func mfaChallengeHash(challengeId string) string {
+	digest := sha256.Sum256([]byte(challengeId))
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,330 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Lock id shared by all replicas migrating the same db
+const migrationsLockId = 7316720001
+
+/**
+ * Schema changes, applied in order exactly once
+ * Never edit an applied migration, append a new one instead
+ */
+var migrations = []string{
+	// 1: credentials
+	`CREATE TABLE IF NOT EXISTS auth (
+		lookup_hash varchar(100) UNIQUE NOT NULL PRIMARY KEY,
+		password_hash varchar(100) NOT NULL
+	)`,
+	// 2: signing keys shared between replicas, private keys are encrypted with the master key
+	`CREATE TABLE IF NOT EXISTS signing_keys (
+		kid varchar(64) NOT NULL PRIMARY KEY,
+		target varchar(100) NOT NULL,
+		algorithm varchar(10) NOT NULL,
+		private_key bytea NOT NULL,
+		public_key bytea NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		activates_at timestamptz NOT NULL DEFAULT now(),
+		retired_at timestamptz
+	)`,
+	// 3: revoked tokens by jti, kept until the token would have expired anyway
+	`CREATE TABLE IF NOT EXISTS revoked_tokens (
+		jti varchar(64) NOT NULL PRIMARY KEY,
+		expires_at timestamptz NOT NULL
+	)`,
+	// 4: roles granting scopes, assigned to credentials
+	`CREATE TABLE IF NOT EXISTS roles (
+		name varchar(100) NOT NULL PRIMARY KEY
+	);
+	CREATE TABLE IF NOT EXISTS role_scopes (
+		role_name varchar(100) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+		scope varchar(200) NOT NULL,
+		PRIMARY KEY (role_name, scope)
+	);
+	CREATE TABLE IF NOT EXISTS auth_roles (
+		lookup_hash varchar(100) NOT NULL REFERENCES auth(lookup_hash) ON DELETE CASCADE,
+		role_name varchar(100) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+		PRIMARY KEY (lookup_hash, role_name)
+	);
+	INSERT INTO roles(name) VALUES('admin') ON CONFLICT DO NOTHING;
+	INSERT INTO role_scopes(role_name, scope) VALUES('admin', 'auth:admin') ON CONFLICT DO NOTHING`,
+	// 5: realms, existing credentials and roles move to the default realm
+	`CREATE TABLE IF NOT EXISTS realms (
+		id varchar(64) NOT NULL PRIMARY KEY,
+		token_ttl bigint NOT NULL DEFAULT 0,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+	INSERT INTO realms(id) VALUES('default') ON CONFLICT DO NOTHING;
+	ALTER TABLE auth_roles
+		DROP CONSTRAINT IF EXISTS auth_roles_lookup_hash_fkey,
+		DROP CONSTRAINT IF EXISTS auth_roles_role_name_fkey,
+		DROP CONSTRAINT IF EXISTS auth_roles_pkey;
+	ALTER TABLE role_scopes
+		DROP CONSTRAINT IF EXISTS role_scopes_role_name_fkey,
+		DROP CONSTRAINT IF EXISTS role_scopes_pkey;
+	ALTER TABLE roles
+		DROP CONSTRAINT IF EXISTS roles_pkey;
+	ALTER TABLE auth
+		DROP CONSTRAINT IF EXISTS auth_pkey,
+		DROP CONSTRAINT IF EXISTS auth_lookup_hash_key;
+	ALTER TABLE auth
+		ADD COLUMN realm_id varchar(64) NOT NULL DEFAULT 'default' REFERENCES realms(id) ON DELETE CASCADE,
+		ADD PRIMARY KEY (realm_id, lookup_hash);
+	ALTER TABLE roles
+		ADD COLUMN realm_id varchar(64) NOT NULL DEFAULT 'default' REFERENCES realms(id) ON DELETE CASCADE,
+		ADD PRIMARY KEY (realm_id, name);
+	ALTER TABLE role_scopes
+		ADD COLUMN realm_id varchar(64) NOT NULL DEFAULT 'default',
+		ADD PRIMARY KEY (realm_id, role_name, scope),
+		ADD FOREIGN KEY (realm_id, role_name) REFERENCES roles(realm_id, name) ON DELETE CASCADE;
+	ALTER TABLE auth_roles
+		ADD COLUMN realm_id varchar(64) NOT NULL DEFAULT 'default',
+		ADD PRIMARY KEY (realm_id, lookup_hash, role_name),
+		ADD FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE,
+		ADD FOREIGN KEY (realm_id, role_name) REFERENCES roles(realm_id, name) ON DELETE CASCADE`,
+	// 6: password policy per realm, PASSWORD_* defaults if null
+	`ALTER TABLE realms ADD COLUMN IF NOT EXISTS password_policy jsonb`,
+	// 7: credentials whose password turned up in the breached passwords corpus on login
+	`ALTER TABLE auth ADD COLUMN IF NOT EXISTS password_breached boolean NOT NULL DEFAULT false`,
+	// 8: previous password hashes, the current one stays in auth
+	`CREATE TABLE IF NOT EXISTS password_history (
+		id bigserial NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL,
+		lookup_hash varchar(100) NOT NULL,
+		password_hash varchar(100) NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS password_history_credentials ON password_history(realm_id, lookup_hash, id)`,
+	// 9: forced password changes, the age of existing passwords counts from this migration
+	`ALTER TABLE auth
+		ADD COLUMN IF NOT EXISTS password_changed_at timestamptz NOT NULL DEFAULT now(),
+		ADD COLUMN IF NOT EXISTS must_change_password boolean NOT NULL DEFAULT false`,
+	// 10: pending password resets, only the sha256 of the reset token is stored
+	`CREATE TABLE IF NOT EXISTS password_resets (
+		token_hash varchar(64) NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL,
+		lookup_hash varchar(100) NOT NULL,
+		expires_at timestamptz NOT NULL,
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	)`,
+	// 11: account status, inactive credentials keep their password but can not log in or use their tokens
+	`ALTER TABLE auth ADD COLUMN IF NOT EXISTS status varchar(16) NOT NULL DEFAULT 'active'
+		CHECK (status IN ('active', 'disabled', 'locked', 'pending'))`,
+	// 12: TOTP secrets encrypted with MFA_MASTER_KEY and pending second login steps
+	`CREATE TABLE IF NOT EXISTS mfa_totp (
+		realm_id varchar(64) NOT NULL,
+		lookup_hash varchar(100) NOT NULL,
+		secret bytea,
+		pending_secret bytea,
+		last_used_step bigint NOT NULL DEFAULT 0,
+		PRIMARY KEY (realm_id, lookup_hash),
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS mfa_challenges (
+		challenge_hash varchar(64) NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL,
+		lookup_hash varchar(100) NOT NULL,
+		grant_request jsonb NOT NULL,
+		attempts integer NOT NULL DEFAULT 0,
+		expires_at timestamptz NOT NULL,
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	)`,
+	// 13: single use MFA recovery codes, hashed like passwords
+	`CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+		id bigserial NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL,
+		lookup_hash varchar(100) NOT NULL,
+		code_hash varchar(100) NOT NULL,
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS mfa_recovery_codes_credentials ON mfa_recovery_codes(realm_id, lookup_hash)`,
+	// 14: passkeys and their pending ceremonies, only the sha256 of a challenge is stored
+	`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+		credential_id bytea NOT NULL,
+		realm_id varchar(64) NOT NULL,
+		lookup_hash varchar(100) NOT NULL,
+		public_key bytea NOT NULL,
+		sign_count bigint NOT NULL DEFAULT 0,
+		name varchar(100) NOT NULL DEFAULT '',
+		created_at timestamptz NOT NULL DEFAULT now(),
+		last_used_at timestamptz,
+		PRIMARY KEY (realm_id, credential_id),
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS webauthn_credentials_credentials ON webauthn_credentials(realm_id, lookup_hash);
+	CREATE TABLE IF NOT EXISTS webauthn_challenges (
+		challenge_hash varchar(64) NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL,
+		lookup_hash varchar(100),
+		ceremony varchar(16) NOT NULL CHECK (ceremony IN ('registration', 'login')),
+		expires_at timestamptz NOT NULL,
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	)`,
+	// 15: pending passwordless logins by the sha256 of the login id or link token id, codes are hashed with the login id
+	`CREATE TABLE IF NOT EXISTS passwordless_logins (
+		login_hash varchar(64) NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL,
+		lookup_hash varchar(100) NOT NULL,
+		code_hash varchar(64),
+		attempts integer NOT NULL DEFAULT 0,
+		expires_at timestamptz NOT NULL,
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	)`,
+	// 16: sessions of the sid claim, tokens of a deleted session are rejected
+	`CREATE TABLE IF NOT EXISTS sessions (
+		sid varchar(64) NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL,
+		lookup_hash varchar(100) NOT NULL,
+		user_agent varchar(500) NOT NULL DEFAULT '',
+		device varchar(100) NOT NULL DEFAULT '',
+		ip varchar(64) NOT NULL DEFAULT '',
+		created_at timestamptz NOT NULL DEFAULT now(),
+		last_refreshed_at timestamptz NOT NULL DEFAULT now(),
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS sessions_credentials ON sessions(realm_id, lookup_hash)`,
+	// 17: session policy of the realm, SESSION_* defaults if null
+	`ALTER TABLE realms ADD COLUMN IF NOT EXISTS session_policy jsonb`,
+	// 18: bounds of the ttl callers request in seconds, JWT_TTL_MIN and JWT_TTL_MAX if 0
+	`ALTER TABLE realms
+		ADD COLUMN IF NOT EXISTS token_ttl_min bigint NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS token_ttl_max bigint NOT NULL DEFAULT 0`,
+	// 19: OAuth clients with their pending codes and refresh tokens by sha256, consents of users and the subject id of credentials for /authorize
+	`ALTER TABLE auth ADD COLUMN IF NOT EXISTS subject_id bigint NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS oauth_clients (
+		client_id varchar(64) NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL REFERENCES realms(id) ON DELETE CASCADE,
+		name varchar(100) NOT NULL DEFAULT '',
+		secret_hash varchar(100) NOT NULL DEFAULT '',
+		redirect_uris jsonb NOT NULL,
+		scopes jsonb NOT NULL,
+		token_ttl_min bigint NOT NULL DEFAULT 0,
+		token_ttl_max bigint NOT NULL DEFAULT 0,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS oauth_codes (
+		code_hash varchar(64) NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL,
+		client_id varchar(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+		lookup_hash varchar(100) NOT NULL,
+		subject_id bigint NOT NULL,
+		redirect_uri text NOT NULL,
+		code_challenge varchar(64) NOT NULL,
+		scopes jsonb NOT NULL,
+		client jsonb NOT NULL,
+		auth_time timestamptz NOT NULL,
+		expires_at timestamptz NOT NULL,
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS oauth_refresh_tokens (
+		token_hash varchar(64) NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL,
+		client_id varchar(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+		lookup_hash varchar(100) NOT NULL,
+		subject_id bigint NOT NULL,
+		scopes jsonb NOT NULL,
+		sid varchar(64) NOT NULL REFERENCES sessions(sid) ON DELETE CASCADE,
+		auth_time timestamptz NOT NULL,
+		expires_at timestamptz NOT NULL,
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS oauth_refresh_tokens_credentials ON oauth_refresh_tokens(realm_id, lookup_hash, client_id);
+	CREATE TABLE IF NOT EXISTS oauth_consents (
+		realm_id varchar(64) NOT NULL,
+		lookup_hash varchar(100) NOT NULL,
+		client_id varchar(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+		scopes jsonb NOT NULL,
+		granted_at timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (realm_id, lookup_hash, client_id),
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	)`,
+	// 20: nonce and authentication methods of the login behind OAuth codes and refresh tokens, for ID tokens
+	`ALTER TABLE oauth_codes
+		ADD COLUMN IF NOT EXISTS nonce varchar(255) NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS amr jsonb NOT NULL DEFAULT '[]';
+	ALTER TABLE oauth_refresh_tokens
+		ADD COLUMN IF NOT EXISTS nonce varchar(255) NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS amr jsonb NOT NULL DEFAULT '[]'`,
+	// 21: machine clients of the client credentials grant and the jti of their assertions until they expire
+	`CREATE TABLE IF NOT EXISTS machine_clients (
+		client_id varchar(64) NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL REFERENCES realms(id) ON DELETE CASCADE,
+		name varchar(100) NOT NULL DEFAULT '',
+		secret_hash varchar(100) NOT NULL DEFAULT '',
+		public_key jsonb,
+		scopes jsonb NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS client_assertions (
+		client_id varchar(64) NOT NULL REFERENCES machine_clients(client_id) ON DELETE CASCADE,
+		jti varchar(255) NOT NULL,
+		expires_at timestamptz NOT NULL,
+		PRIMARY KEY (client_id, jti)
+	)`,
+	// 22: sessions unused for longer than any token lives are purged per realm
+	`CREATE INDEX IF NOT EXISTS sessions_last_refreshed ON sessions(realm_id, last_refreshed_at)`,
+	// 23: logins through /authorize waiting for the user to allow scopes not granted to the client before
+	`CREATE TABLE IF NOT EXISTS oauth_consent_requests (
+		consent_hash varchar(64) NOT NULL PRIMARY KEY,
+		realm_id varchar(64) NOT NULL,
+		client_id varchar(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+		lookup_hash varchar(100) NOT NULL,
+		grant_request jsonb NOT NULL,
+		scopes jsonb NOT NULL,
+		amr jsonb NOT NULL,
+		expires_at timestamptz NOT NULL,
+		FOREIGN KEY (realm_id, lookup_hash) REFERENCES auth(realm_id, lookup_hash) ON DELETE CASCADE
+	)`,
+}
+
+/**
+ * Apply pending migrations
+ * Replicas starting at the same time wait for each other on an advisory lock
+ */
+func migrate(db *sql.DB) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationsLockId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer NOT NULL PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		_, err = tx.Exec(migrations[version])
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+
+		_, err = tx.Exec(`INSERT INTO schema_migrations(version) VALUES($1)`, version+1)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("applied migration %d", version+1)
+	}
+
+	return tx.Commit()
+}
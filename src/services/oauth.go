@@ -0,0 +1,425 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"net/url"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	pb "simple-micro-auth/src/proto"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const maxOAuthClientNameLength = 100
+
+/**
+ * Register an application logging users in through /authorize
+ * Confidential clients get a secret which is returned once, only its hash is stored
+ */
+func (service *AuthServiceServer) CreateOAuthClient(ctx context.Context, req *pb.CreateOAuthClientRequest) (*pb.OAuthClientResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := oauthClientFromPb(req)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	realm, err := db.GetRealm(req.Realm)
+	if err != nil {
+		return &pb.OAuthClientResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+	client.RealmId = realm.Id
+
+	client.ClientId, err = newTokenId()
+	if err != nil {
+		return &pb.OAuthClientResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	var clientSecret string
+	if req.Confidential {
+		clientSecret, err = newOAuthSecret()
+		if err != nil {
+			return &pb.OAuthClientResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+		}
+		client.SecretHash = oauthSecretHash(clientSecret)
+	}
+
+	err = db.CreateOAuthClient(client)
+	if err != nil {
+		return &pb.OAuthClientResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.OAuthClientResponse{Error: "", ClientId: client.ClientId, ClientSecret: clientSecret}, nil
+}
+
+/**
+ * Delete the client, the sessions of its refresh tokens end right away
+ */
+func (service *AuthServiceServer) DeleteOAuthClient(ctx context.Context, req *pb.DeleteOAuthClientRequest) (*pb.OAuthClientResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.DeleteOAuthClient(req.Realm, req.ClientId)
+	if err != nil {
+		return &pb.OAuthClientResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.OAuthClientResponse{Error: ""}, nil
+}
+
+func (service *AuthServiceServer) GetOAuthClients(ctx context.Context, req *pb.GetOAuthClientsRequest) (*pb.GetOAuthClientsResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	clients, err := db.GetOAuthClients(req.Realm)
+	if err != nil {
+		return &pb.GetOAuthClientsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	response := &pb.GetOAuthClientsResponse{Clients: []*pb.OAuthClient{}, Error: ""}
+	for _, client := range clients {
+		pbClient := &pb.OAuthClient{
+			ClientId:     client.ClientId,
+			Name:         strings.ToValidUTF8(client.Name, "UTF-8_BUGFIX"),
+			RedirectUris: client.RedirectURIs,
+			Scopes:       client.Scopes,
+			Confidential: client.SecretHash != "",
+			CreatedAt:    client.CreatedAt.Unix(),
+		}
+		if client.TokenTtlMin > 0 {
+			pbClient.TokenTtlMin = client.TokenTtlMin.String()
+		}
+		if client.TokenTtlMax > 0 {
+			pbClient.TokenTtlMax = client.TokenTtlMax.String()
+		}
+		response.Clients = append(response.Clients, pbClient)
+	}
+
+	return response, nil
+}
+
+/**
+ * Clients the user allowed to log them in, e.g. to show connected apps
+ */
+func (service *AuthServiceServer) ListOAuthConsents(ctx context.Context, req *pb.ListOAuthConsentsRequest) (*pb.ListOAuthConsentsResponse, error) {
+	_, err := authorizeCredentials(ctx, req.Realm, req.LookupHash)
+	if err != nil {
+		return nil, err
+	}
+
+	consents, err := db.GetOAuthConsents(req.Realm, req.LookupHash)
+	if err != nil {
+		return &pb.ListOAuthConsentsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	pbConsents := make([]*pb.OAuthConsent, 0, len(consents))
+	for _, consent := range consents {
+		pbConsents = append(pbConsents, &pb.OAuthConsent{
+			ClientId:   consent.ClientId,
+			ClientName: strings.ToValidUTF8(consent.ClientName, "UTF-8_BUGFIX"),
+			Scopes:     consent.Scopes,
+			GrantedAt:  consent.GrantedAt.Unix(),
+		})
+	}
+
+	return &pb.ListOAuthConsentsResponse{Consents: pbConsents, Error: ""}, nil
+}
+
+/**
+ * Disconnect a client, the sessions of its refresh tokens for the credentials end right away
+ */
+func (service *AuthServiceServer) RevokeOAuthConsent(ctx context.Context, req *pb.RevokeOAuthConsentRequest) (*pb.RevokeOAuthConsentResponse, error) {
+	_, err := authorizeCredentials(ctx, req.Realm, req.LookupHash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.DeleteOAuthConsent(req.Realm, req.LookupHash, req.ClientId)
+	if err != nil {
+		return &pb.RevokeOAuthConsentResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RevokeOAuthConsentResponse{Error: ""}, nil
+}
+
+/**
+ * Validate a client registration, the realm, id and secret are up to the caller
+ */
+func oauthClientFromPb(req *pb.CreateOAuthClientRequest) (m.OAuthClientDTO, error) {
+
+	client := m.OAuthClientDTO{Name: strings.TrimSpace(req.Name), RedirectURIs: req.RedirectUris}
+
+	if len(client.Name) > maxOAuthClientNameLength {
+		return m.OAuthClientDTO{}, fmt.Errorf("name must not be longer than %d bytes", maxOAuthClientNameLength)
+	}
+
+	if len(client.RedirectURIs) == 0 {
+		return m.OAuthClientDTO{}, fmt.Errorf("at least one redirect uri is required")
+	}
+	for _, redirectURI := range client.RedirectURIs {
+		err := checkRedirectURI(redirectURI)
+		if err != nil {
+			return m.OAuthClientDTO{}, err
+		}
+	}
+
+	var err error
+	client.Scopes, err = clientScopes(req.Scopes)
+	if err != nil {
+		return m.OAuthClientDTO{}, err
+	}
+
+	ttls := []struct {
+		name     string
+		value    string
+		duration *time.Duration
+	}{
+		{"token ttl min", req.TokenTtlMin, &client.TokenTtlMin},
+		{"token ttl max", req.TokenTtlMax, &client.TokenTtlMax},
+	}
+	for _, ttl := range ttls {
+		if ttl.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(ttl.value)
+		if err != nil || duration <= 0 {
+			return m.OAuthClientDTO{}, fmt.Errorf("%s must be a positive duration", ttl.name)
+		}
+		*ttl.duration = duration
+	}
+
+	if client.TokenTtlMin > 0 && client.TokenTtlMax > 0 && client.TokenTtlMin > client.TokenTtlMax {
+		return m.OAuthClientDTO{}, fmt.Errorf("token ttl min %s must not exceed token ttl max %s", client.TokenTtlMin, client.TokenTtlMax)
+	}
+
+	return client, nil
+}
+
+/**
+ * Scopes a client may request without duplicates, they must fit the space separated scope parameter of RFC 6749
+ */
+func clientScopes(scopes []string) ([]string, error) {
+
+	unique := []string{}
+	for _, scope := range scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\r\n\"\\") {
+			return nil, fmt.Errorf("scope %q is malformed", scope)
+		}
+		if !hasScope(unique, scope) {
+			unique = append(unique, scope)
+		}
+	}
+
+	return unique, nil
+}
+
+/**
+ * Redirect URIs are https, http on a loopback host or a private-use scheme of a native app, see RFC 8252
+ * Fragments are not allowed as the code is appended to the query
+ */
+func checkRedirectURI(redirectURI string) error {
+
+	parsed, err := url.Parse(redirectURI)
+	if err != nil || !parsed.IsAbs() || strings.Contains(redirectURI, "#") {
+		return fmt.Errorf("redirect uri %q must be an absolute uri without fragment", redirectURI)
+	}
+
+	switch {
+	case parsed.Scheme == "https" && parsed.Host != "":
+	case parsed.Scheme == "http" && isLoopbackHost(parsed.Hostname()):
+	// Private-use schemes are reverse domain names, e.g. com.example.app
+	case strings.Contains(parsed.Scheme, "."):
+	default:
+		return fmt.Errorf("redirect uri %q must be https, http on a loopback host or a private-use scheme", redirectURI)
+	}
+
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/**
+ * Redirect URI of an authorization request, it has to match a registered one exactly
+ * Clients with a single redirect URI may leave it out
+ */
+func resolveRedirectURI(client m.OAuthClientDTO, redirectURI string) (string, error) {
+
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		return client.RedirectURIs[0], nil
+	}
+
+	for _, registered := range client.RedirectURIs {
+		if registered == redirectURI {
+			return redirectURI, nil
+		}
+	}
+
+	return "", fmt.Errorf("redirect uri is not registered for the client")
+}
+
+/**
+ * Scopes of an authorization request, every scope of the client if it names none
+ */
+func resolveOAuthScopes(allowed []string, scope string) ([]string, error) {
+
+	requested := strings.Fields(scope)
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+
+	scopes := []string{}
+	for _, requestedScope := range requested {
+		if !hasScope(allowed, requestedScope) {
+			return nil, fmt.Errorf("scope %s is not allowed", requestedScope)
+		}
+		if !hasScope(scopes, requestedScope) {
+			scopes = append(scopes, requestedScope)
+		}
+	}
+
+	return scopes, nil
+}
+
+/**
+ * Default token lifetime of the realm within the bounds of the client, which narrow the bounds of the realm
+ */
+func oauthTokenTtl(realm m.RealmDTO, client m.OAuthClientDTO) time.Duration {
+
+	// An empty ttl is never out of range
+	tokenTtl, _ := realmTokenTtl(realm, "")
+
+	minTtl, maxTtl := realmTokenTtlBounds(realm)
+	if client.TokenTtlMin > 0 {
+		minTtl = max(minTtl, client.TokenTtlMin)
+	}
+	if client.TokenTtlMax > 0 {
+		maxTtl = min(maxTtl, client.TokenTtlMax)
+	}
+
+	return min(max(tokenTtl, minTtl), maxTtl)
+}
+
+/**
+ * Access token of the client for the subject of the session
+ * It only carries the granted scopes the roles of the credentials still grant, and openid for /userinfo
+ * @returns the token, its exp and its scopes
+ */
+func issueOAuthToken(realm m.RealmDTO, keys *cert.KeySet, clientId string, lookupHash string, subjectId int64, granted []string, sessionId string, authTime time.Time, ttl time.Duration) (string, int64, []string, error) {
+
+	roleScopes, err := scopesOf(realm.Id, lookupHash)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	scopes := []string{}
+	for _, scope := range granted {
+		if scope == openIdScope || hasScope(roleScopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	issuedAt := time.Now()
+	expiresAt := issuedAt.Add(ttl).Unix()
+
+	token, err := tokenHandler.CreateToken(m.TokenDTO{
+		Id:         subjectId,
+		IssuedAt:   issuedAt.Unix(),
+		ExpiresAt:  expiresAt,
+		Noise:      mathrand.Int63(),
+		Issuer:     realmIssuer(realm.Id),
+		Scopes:     scopes,
+		LookupHash: lookupHash,
+		SessionId:  sessionId,
+		AuthTime:   authTime.Unix(),
+		ClientId:   clientId,
+	}, keys.Active().Signer)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	return token, expiresAt, scopes, nil
+}
+
+/**
+ * Store a new refresh token, see OAUTH_REFRESH_TOKEN_TTL
+ * @returns the refresh token, only its hash is stored
+ */
+func issueOAuthRefreshToken(refreshToken m.OAuthRefreshTokenDTO) (string, error) {
+
+	token, err := newOAuthSecret()
+	if err != nil {
+		return "", err
+	}
+
+	refreshToken.TokenHash = oauthSecretHash(token)
+	refreshToken.ExpiresAt = time.Now().Add(c.EnvOAuthRefreshTokenTtl)
+
+	err = db.CreateOAuthRefreshToken(refreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+/**
+ * Random secret for client secrets, codes and refresh tokens
+ */
+func newOAuthSecret() (string, error) {
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+/**
+ * Secrets are random, so a plain sha256 is enough to store them
+ */
+func oauthSecretHash(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
+
+/**
+ * Lookup hash of a username entered on the login page, see OAUTH_LOOKUP_HASH
+ */
+func oauthLookupHash(username string) string {
+
+	username = strings.TrimSpace(username)
+	if c.EnvOAuthLookupHash != "sha256" {
+		return username
+	}
+
+	digest := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(digest[:])
+}
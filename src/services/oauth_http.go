@@ -0,0 +1,805 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Code verifiers as in RFC 7636 section 4.1
+var codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// Parameters of an authorization request, carried through the login page as hidden fields
+var authorizeParams = []string{"response_type", "client_id", "redirect_uri", "scope", "state", "nonce", "code_challenge", "code_challenge_method"}
+
+const maxNonceLength = 255
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+<style>
+body { font-family: sans-serif; max-width: 22rem; margin: 4rem auto; padding: 0 1rem; }
+label, input, button { display: block; width: 100%; box-sizing: border-box; }
+input { margin: .25rem 0 1rem; padding: .5rem; }
+button { padding: .5rem; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+{{if .ClientName}}<h1>Sign in to {{.ClientName}}</h1>{{else}}<h1>Sign in</h1>{{end}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Params}}
+{{if .ConsentId}}<p>Allow {{if .ClientName}}{{.ClientName}}{{else}}the app{{end}} to sign you in{{if .Scopes}} and use:{{end}}</p>
+{{else if .Scopes}}<p>It asks to use:</p>{{end}}
+{{if .Scopes}}<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<form method="post">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}
+{{if .ConsentId}}<input type="hidden" name="consent_id" value="{{.ConsentId}}">
+<button type="submit" name="consent" value="approve">Allow</button>
+<button type="submit" name="consent" value="deny">Deny</button>
+{{else}}{{if .ChallengeId}}<input type="hidden" name="challenge_id" value="{{.ChallengeId}}">
+<label for="code">Authentication or recovery code</label>
+<input id="code" name="code" autocomplete="one-time-code" required autofocus>
+{{else}}<label for="username">Username</label>
+<input id="username" name="username" value="{{.Username}}" autocomplete="username" required autofocus>
+<label for="password">Password</label>
+<input id="password" name="password" type="password" autocomplete="current-password" required>
+{{end}}
+<button type="submit">Sign in</button>
+{{end}}
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type loginPageData struct {
+	ClientName  string
+	Scopes      []string
+	Params      map[string]string // Nil if the request can not go on, only the error is shown
+	Username    string
+	ChallengeId string // Second step, MFA code instead of the password
+	ConsentId   string // Last step, the user allows or denies the scopes
+	Error       string
+}
+
+/**
+ * Validated authorization request
+ */
+type authorizeRequest struct {
+	client      m.OAuthClientDTO
+	realm       m.RealmDTO
+	redirectURI string
+	state       string
+	scopes      []string
+	params      map[string]string
+}
+
+/**
+ * Token response as in RFC 6749 section 5.1
+ */
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+}
+
+/**
+ * GET /authorize shows the login page, POST /authorize logs in and sends the browser back to the client with a code
+ * Only the authorization code flow with PKCE (S256) is supported, see RFC 6749 section 4.1 and RFC 7636
+ * After signing in the user allows or denies scopes not granted to the client before, consents are recorded for ListOAuthConsents
+ */
+func AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writeLoginPage(w, http.StatusMethodNotAllowed, loginPageData{Error: "Method not allowed"})
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		writeLoginPage(w, http.StatusBadRequest, loginPageData{Error: "Malformed request"})
+		return
+	}
+
+	// Errors before the redirect URI is known are shown to the user, the browser must not be sent to an unverified URI
+	client, err := db.GetOAuthClient(r.Form.Get("client_id"))
+	if errors.Is(err, errOAuthClientNotFound) {
+		writeLoginPage(w, http.StatusBadRequest, loginPageData{Error: "Unknown client"})
+		return
+	}
+	if err != nil {
+		writeLoginPage(w, http.StatusInternalServerError, loginPageData{Error: "Sign in is not available right now"})
+		return
+	}
+
+	redirectURI, err := resolveRedirectURI(client, r.Form.Get("redirect_uri"))
+	if err != nil {
+		writeLoginPage(w, http.StatusBadRequest, loginPageData{ClientName: client.Name, Error: "Invalid redirect URI"})
+		return
+	}
+
+	request := authorizeRequest{client: client, redirectURI: redirectURI, state: r.Form.Get("state"), params: map[string]string{}}
+	for _, name := range authorizeParams {
+		if value := r.Form.Get(name); value != "" {
+			request.params[name] = value
+		}
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		redirectAuthorizeError(w, r, request, "unsupported_response_type", "response_type must be code")
+		return
+	}
+
+	if r.Form.Get("code_challenge_method") != "S256" || len(r.Form.Get("code_challenge")) != base64.RawURLEncoding.EncodedLen(sha256.Size) {
+		redirectAuthorizeError(w, r, request, "invalid_request", "code_challenge with code_challenge_method S256 is required")
+		return
+	}
+
+	request.scopes, err = resolveOAuthScopes(client.Scopes, r.Form.Get("scope"))
+	if err != nil {
+		redirectAuthorizeError(w, r, request, "invalid_scope", err.Error())
+		return
+	}
+
+	if len(r.Form.Get("nonce")) > maxNonceLength {
+		redirectAuthorizeError(w, r, request, "invalid_request", fmt.Sprintf("nonce must be at most %d characters", maxNonceLength))
+		return
+	}
+
+	// There is no login to reuse, every request shows the login page
+	if r.Form.Get("prompt") == "none" {
+		redirectAuthorizeError(w, r, request, "login_required", "")
+		return
+	}
+
+	request.realm, err = db.GetRealm(client.RealmId)
+	if err != nil {
+		redirectAuthorizeError(w, r, request, "server_error", "")
+		return
+	}
+
+	page := loginPageData{ClientName: client.Name, Scopes: request.scopes, Params: request.params}
+
+	if r.Method == http.MethodGet {
+		writeLoginPage(w, http.StatusOK, page)
+		return
+	}
+
+	if r.PostForm.Get("consent_id") != "" {
+		authorizeConsent(w, r, request, page)
+		return
+	}
+
+	if r.PostForm.Get("challenge_id") != "" {
+		authorizeSecondFactor(w, r, request, page)
+		return
+	}
+
+	authorizePassword(w, r, request, page)
+}
+
+/**
+ * First step of the login page, finishes the login unless the credentials have a second factor
+ */
+func authorizePassword(w http.ResponseWriter, r *http.Request, request authorizeRequest, page loginPageData) {
+
+	page.Username = r.PostForm.Get("username")
+
+	credentials := m.CredentialsDTO{
+		RealmId:    request.realm.Id,
+		LookupHash: oauthLookupHash(page.Username),
+		Password:   r.PostForm.Get("password"),
+	}
+
+	// Unknown usernames and wrong passwords look the same
+	err := db.VerifyCredentials(credentials)
+	if err != nil {
+		page.Error = "Invalid username or password"
+		writeLoginPage(w, http.StatusUnauthorized, page)
+		return
+	}
+
+	flagBreachedOnLogin(credentials)
+
+	credentialsStatus, ok := checkLoginStatus(w, request, page, credentials.LookupHash)
+	if !ok {
+		return
+	}
+
+	grant := m.GrantDTO{LookupHash: credentials.LookupHash, Id: credentialsStatus.SubjectId, Client: clientFromHTTP(r)}
+
+	mfaResponse, err := startMFA(request.realm, grant)
+	if err != nil {
+		redirectAuthorizeError(w, r, request, "server_error", "")
+		return
+	}
+	if mfaResponse != nil {
+		page.ChallengeId = mfaResponse.MfaChallengeId
+		writeLoginPage(w, http.StatusOK, page)
+		return
+	}
+
+	askConsent(w, r, request, page, grant, []string{amrPassword})
+}
+
+/**
+ * Second step of the login page, the challenge of startMFA keeps who passed the first one
+ */
+func authorizeSecondFactor(w http.ResponseWriter, r *http.Request, request authorizeRequest, page loginPageData) {
+
+	challengeId := r.PostForm.Get("challenge_id")
+	challengeHash := mfaChallengeHash(challengeId)
+
+	challenge, err := db.ClaimMFAAttempt(request.realm.Id, challengeHash)
+	if err != nil {
+		page.Error = "The sign in expired, please start again"
+		writeLoginPage(w, http.StatusUnauthorized, page)
+		return
+	}
+
+	_, err = verifySecondFactor(request.realm.Id, challenge.Grant.LookupHash, r.PostForm.Get("code"))
+	if err != nil {
+		page.ChallengeId = challengeId
+		page.Error = "Invalid code"
+		writeLoginPage(w, http.StatusUnauthorized, page)
+		return
+	}
+
+	err = db.ConsumeMFAChallenge(request.realm.Id, challengeHash)
+	if err != nil {
+		page.Error = "The sign in expired, please start again"
+		writeLoginPage(w, http.StatusUnauthorized, page)
+		return
+	}
+
+	// The account may have been disabled since the password was checked
+	_, ok := checkLoginStatus(w, request, page, challenge.Grant.LookupHash)
+	if !ok {
+		return
+	}
+
+	askConsent(w, r, request, page, challenge.Grant, []string{amrPassword, amrOneTimeCode, amrMultiFactor})
+}
+
+/**
+ * Finish the login if the user granted the client the scopes before, otherwise show the consent step
+ * @param amr - how the user logged in, kept for finishAuthorize until the user decides
+ */
+func askConsent(w http.ResponseWriter, r *http.Request, request authorizeRequest, page loginPageData, grant m.GrantDTO, amr []string) {
+
+	consents, err := db.GetOAuthConsents(request.realm.Id, grant.LookupHash)
+	if err != nil {
+		redirectAuthorizeError(w, r, request, "server_error", "")
+		return
+	}
+
+	for _, consent := range consents {
+		if consent.ClientId == request.client.ClientId && hasAllScopes(consent.Scopes, request.scopes) {
+			finishAuthorize(w, r, request, grant, amr)
+			return
+		}
+	}
+
+	consentId, err := newOAuthSecret()
+	if err != nil {
+		redirectAuthorizeError(w, r, request, "server_error", "")
+		return
+	}
+
+	// A consent step takes as long as an MFA step
+	err = db.CreateOAuthConsentRequest(m.OAuthConsentRequestDTO{
+		ConsentHash: oauthSecretHash(consentId),
+		RealmId:     request.realm.Id,
+		ClientId:    request.client.ClientId,
+		Grant:       grant,
+		Scopes:      request.scopes,
+		AMR:         amr,
+		ExpiresAt:   time.Now().Add(c.EnvMFAChallengeTtl),
+	})
+	if err != nil {
+		redirectAuthorizeError(w, r, request, "server_error", "")
+		return
+	}
+
+	page.ConsentId = consentId
+	writeLoginPage(w, http.StatusOK, page)
+}
+
+/**
+ * Consent step of the login page, the user allows the scopes or the client gets access_denied
+ */
+func authorizeConsent(w http.ResponseWriter, r *http.Request, request authorizeRequest, page loginPageData) {
+
+	consent, err := db.ConsumeOAuthConsentRequest(request.realm.Id, oauthSecretHash(r.PostForm.Get("consent_id")))
+	if err != nil {
+		page.Error = "The sign in expired, please start again"
+		writeLoginPage(w, http.StatusUnauthorized, page)
+		return
+	}
+
+	// The hidden fields must still ask for what the user was shown
+	if consent.ClientId != request.client.ClientId || !slices.Equal(consent.Scopes, request.scopes) {
+		page.Error = "The sign in expired, please start again"
+		writeLoginPage(w, http.StatusUnauthorized, page)
+		return
+	}
+
+	if r.PostForm.Get("consent") != "approve" {
+		redirectAuthorizeError(w, r, request, "access_denied", "the user denied the request")
+		return
+	}
+
+	// The account may have been disabled while the user decided
+	_, ok := checkLoginStatus(w, request, page, consent.Grant.LookupHash)
+	if !ok {
+		return
+	}
+
+	finishAuthorize(w, r, request, consent.Grant, consent.AMR)
+}
+
+/**
+ * Show why credentials with the right password still can not sign in
+ */
+func checkLoginStatus(w http.ResponseWriter, request authorizeRequest, page loginPageData, lookupHash string) (m.CredentialsStatusDTO, bool) {
+
+	credentialsStatus, err := db.GetCredentialsStatus(request.realm.Id, lookupHash)
+	if err == nil {
+		err = checkAccountStatus(credentialsStatus.Status)
+	}
+	if err != nil {
+		page.Error = "This account can not sign in: " + err.Error()
+		writeLoginPage(w, http.StatusForbidden, page)
+		return m.CredentialsStatusDTO{}, false
+	}
+
+	if passwordChangeRequired(request.realm, credentialsStatus) {
+		page.Error = "The password of this account has to be changed before signing in"
+		writeLoginPage(w, http.StatusForbidden, page)
+		return m.CredentialsStatusDTO{}, false
+	}
+
+	// Tokens name the subject by its id, which credentials created before it was recorded do not have yet
+	if credentialsStatus.SubjectId == 0 {
+		page.Error = "This account can not sign in here yet"
+		writeLoginPage(w, http.StatusForbidden, page)
+		return m.CredentialsStatusDTO{}, false
+	}
+
+	return credentialsStatus, true
+}
+
+/**
+ * Record the consent and send the browser back to the client with a code for /token
+ * @param amr - how the user logged in, for ID tokens
+ */
+func finishAuthorize(w http.ResponseWriter, r *http.Request, request authorizeRequest, grant m.GrantDTO, amr []string) {
+
+	err := db.RecordOAuthConsent(m.OAuthConsentDTO{
+		RealmId:    request.realm.Id,
+		LookupHash: grant.LookupHash,
+		ClientId:   request.client.ClientId,
+		Scopes:     request.scopes,
+	})
+	if err != nil {
+		redirectAuthorizeError(w, r, request, "server_error", "")
+		return
+	}
+
+	code, err := newOAuthSecret()
+	if err != nil {
+		redirectAuthorizeError(w, r, request, "server_error", "")
+		return
+	}
+
+	err = db.CreateOAuthCode(m.OAuthCodeDTO{
+		CodeHash:      oauthSecretHash(code),
+		RealmId:       request.realm.Id,
+		ClientId:      request.client.ClientId,
+		LookupHash:    grant.LookupHash,
+		SubjectId:     grant.Id,
+		RedirectURI:   request.redirectURI,
+		CodeChallenge: request.params["code_challenge"],
+		Scopes:        request.scopes,
+		Client:        grant.Client,
+		Nonce:         request.params["nonce"],
+		AMR:           amr,
+		AuthTime:      time.Now(),
+		ExpiresAt:     time.Now().Add(c.EnvOAuthCodeTtl),
+	})
+	if err != nil {
+		redirectAuthorizeError(w, r, request, "server_error", "")
+		return
+	}
+
+	redirectAuthorize(w, r, request, url.Values{"code": {code}})
+}
+
+/**
+ * Send the browser back to the client with an error as in RFC 6749 section 4.1.2.1
+ */
+func redirectAuthorizeError(w http.ResponseWriter, r *http.Request, request authorizeRequest, errorCode string, description string) {
+
+	query := url.Values{"error": {errorCode}}
+	if description != "" {
+		query.Set("error_description", description)
+	}
+
+	redirectAuthorize(w, r, request, query)
+}
+
+/**
+ * Redirect to the redirect URI with state and iss, see RFC 9207, added to the query
+ */
+func redirectAuthorize(w http.ResponseWriter, r *http.Request, request authorizeRequest, query url.Values) {
+
+	if request.state != "" {
+		query.Set("state", request.state)
+	}
+	query.Set("iss", realmIssuer(request.client.RealmId))
+
+	redirectURI, _ := url.Parse(request.redirectURI)
+	redirectQuery := redirectURI.Query()
+	for name, values := range query {
+		redirectQuery[name] = values
+	}
+	redirectURI.RawQuery = redirectQuery.Encode()
+
+	http.Redirect(w, r, redirectURI.String(), http.StatusSeeOther)
+}
+
+func writeLoginPage(w http.ResponseWriter, statusCode int, page loginPageData) {
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(statusCode)
+
+	err := loginPage.Execute(w, page)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+/**
+ * POST /token
+ * Exchanges codes of /authorize and refresh tokens for access tokens, refresh tokens are replaced on every use
+ * Confidential clients authenticate with HTTP Basic or client_secret form parameters, public clients send client_id only
+ * Machine clients get tokens of their own with the client_credentials grant
+ */
+func OAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, oauthError{Error: "invalid_request"})
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: "malformed form body"})
+		return
+	}
+
+	var response oauthTokenResponse
+	var tokenErr *oauthError
+
+	// Machine clients are registered apart from OAuth clients and have no other grant
+	if r.PostForm.Get("grant_type") == "client_credentials" {
+		response, tokenErr = clientCredentialsToken(r)
+	} else {
+		response, tokenErr = oauthClientToken(r)
+	}
+
+	if tokenErr != nil {
+		statusCode := http.StatusBadRequest
+		switch tokenErr.Error {
+		case "invalid_client":
+			w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+			statusCode = http.StatusUnauthorized
+		case "server_error":
+			statusCode = http.StatusInternalServerError
+		}
+		writeJSON(w, statusCode, tokenErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+/**
+ * Grants of OAuth clients, the tokens are issued by the realm of the client
+ */
+func oauthClientToken(r *http.Request) (oauthTokenResponse, *oauthError) {
+
+	client, err := authenticateOAuthClient(r)
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_client"}
+	}
+
+	realm, keys, err := resolveRealm(client.RealmId)
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "server_error"}
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		return exchangeOAuthCode(r, realm, keys, client)
+	case "refresh_token":
+		return refreshOAuthToken(r, realm, keys, client)
+	}
+
+	return oauthTokenResponse{}, &oauthError{Error: "unsupported_grant_type"}
+}
+
+/**
+ * Client credentials grant of machine clients as in RFC 6749 section 4.4, there is no refresh token
+ * They authenticate with their secret like confidential OAuth clients or with a private_key_jwt client_assertion
+ */
+func clientCredentialsToken(r *http.Request) (oauthTokenResponse, *oauthError) {
+
+	clientId, clientSecret, ok := requestClientCredentials(r)
+	if !ok {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_client"}
+	}
+
+	assertion := r.PostForm.Get("client_assertion")
+	if assertion != "" && r.PostForm.Get("client_assertion_type") != clientAssertionType {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_request", ErrorDescription: "client_assertion_type must be " + clientAssertionType}
+	}
+
+	client, err := authenticateMachineClient(clientId, clientSecret, assertion)
+	if errors.Is(err, errInvalidMachineClient) {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_client"}
+	}
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "server_error"}
+	}
+
+	scopes, err := resolveOAuthScopes(client.Scopes, r.PostForm.Get("scope"))
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_scope", ErrorDescription: err.Error()}
+	}
+
+	token, expiresAt, err := issueClientToken(client, scopes, "", nil)
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "server_error"}
+	}
+
+	return oauthTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   expiresAt - time.Now().Unix(),
+		Scope:       strings.Join(scopes, " "),
+	}, nil
+}
+
+/**
+ * Start a session for the code and issue its first tokens, the code works once
+ */
+func exchangeOAuthCode(r *http.Request, realm m.RealmDTO, keys *cert.KeySet, client m.OAuthClientDTO) (oauthTokenResponse, *oauthError) {
+
+	code, err := db.ConsumeOAuthCode(oauthSecretHash(r.PostForm.Get("code")))
+	if errors.Is(err, errInvalidOAuthGrant) {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_grant", ErrorDescription: err.Error()}
+	}
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "server_error"}
+	}
+
+	if code.ClientId != client.ClientId {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_grant", ErrorDescription: "code was issued to another client"}
+	}
+
+	// PKCE binds the code to the client which started the login, so leaving out the redirect URI is fine, see OAuth 2.1
+	redirectURI := r.PostForm.Get("redirect_uri")
+	if redirectURI != "" && redirectURI != code.RedirectURI {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_grant", ErrorDescription: "redirect_uri does not match"}
+	}
+
+	if !checkCodeVerifier(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_grant", ErrorDescription: "code_verifier does not match"}
+	}
+
+	tokenErr := checkOAuthAccount(realm, code.LookupHash)
+	if tokenErr != nil {
+		return oauthTokenResponse{}, tokenErr
+	}
+
+	sessionId, err := startSession(realm, code.LookupHash, code.Client)
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "server_error"}
+	}
+
+	tokenTtl := sessionTokenTtl(realmSessionPolicy(realm), code.AuthTime, oauthTokenTtl(realm, client))
+
+	return issueOAuthTokens(realm, keys, client, m.OAuthRefreshTokenDTO{
+		RealmId:    realm.Id,
+		ClientId:   client.ClientId,
+		LookupHash: code.LookupHash,
+		SubjectId:  code.SubjectId,
+		Scopes:     code.Scopes,
+		SessionId:  sessionId,
+		Nonce:      code.Nonce,
+		AMR:        code.AMR,
+		AuthTime:   code.AuthTime,
+	}, code.Scopes, tokenTtl)
+}
+
+/**
+ * Replace the refresh token and issue a new access token of its session
+ * A narrower scope may be requested for the access token, the new refresh token keeps every granted scope
+ */
+func refreshOAuthToken(r *http.Request, realm m.RealmDTO, keys *cert.KeySet, client m.OAuthClientDTO) (oauthTokenResponse, *oauthError) {
+
+	tokenHash := oauthSecretHash(r.PostForm.Get("refresh_token"))
+
+	// Rejected requests leave the refresh token to its client, see RFC 6749 section 5.2
+	refreshToken, err := db.GetOAuthRefreshToken(tokenHash)
+	if errors.Is(err, errInvalidOAuthGrant) {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_grant", ErrorDescription: err.Error()}
+	}
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "server_error"}
+	}
+
+	if refreshToken.ClientId != client.ClientId {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_grant", ErrorDescription: "refresh token was issued to another client"}
+	}
+
+	scopes, err := resolveOAuthScopes(refreshToken.Scopes, r.PostForm.Get("scope"))
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_scope", ErrorDescription: err.Error()}
+	}
+
+	refreshToken, err = db.ConsumeOAuthRefreshToken(tokenHash, client.ClientId)
+	if errors.Is(err, errInvalidOAuthGrant) {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_grant", ErrorDescription: err.Error()}
+	}
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "server_error"}
+	}
+
+	tokenErr := checkOAuthAccount(realm, refreshToken.LookupHash)
+	if tokenErr != nil {
+		return oauthTokenResponse{}, tokenErr
+	}
+
+	tokenTtl, err := continueSessionTtl(realm, refreshToken.SessionId, refreshToken.AuthTime, refreshToken.AuthTime, oauthTokenTtl(realm, client))
+	if errors.Is(err, errSessionNotFound) {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_grant", ErrorDescription: "session revoked"}
+	}
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "invalid_grant", ErrorDescription: err.Error()}
+	}
+
+	err = db.TouchSession(refreshToken.SessionId)
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "server_error"}
+	}
+
+	return issueOAuthTokens(realm, keys, client, refreshToken, scopes, tokenTtl)
+}
+
+/**
+ * Access token with the scopes and a new refresh token for the session, plus an ID token for openid
+ */
+func issueOAuthTokens(realm m.RealmDTO, keys *cert.KeySet, client m.OAuthClientDTO, refreshToken m.OAuthRefreshTokenDTO, scopes []string, tokenTtl time.Duration) (oauthTokenResponse, *oauthError) {
+
+	accessToken, expiresAt, tokenScopes, err := issueOAuthToken(realm, keys, client.ClientId, refreshToken.LookupHash, refreshToken.SubjectId,
+		scopes, refreshToken.SessionId, refreshToken.AuthTime, tokenTtl)
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "server_error"}
+	}
+
+	newRefreshToken, err := issueOAuthRefreshToken(refreshToken)
+	if err != nil {
+		return oauthTokenResponse{}, &oauthError{Error: "server_error"}
+	}
+
+	response := oauthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    expiresAt - time.Now().Unix(),
+		RefreshToken: newRefreshToken,
+		Scope:        strings.Join(tokenScopes, " "),
+	}
+
+	if hasScope(tokenScopes, openIdScope) {
+		response.IdToken, err = issueIdToken(realm, keys, refreshToken, expiresAt)
+		if err != nil {
+			return oauthTokenResponse{}, &oauthError{Error: "server_error"}
+		}
+	}
+
+	return response, nil
+}
+
+/**
+ * Inactive accounts and passwords which have to be changed end the grant
+ */
+func checkOAuthAccount(realm m.RealmDTO, lookupHash string) *oauthError {
+
+	credentialsStatus, err := db.GetCredentialsStatus(realm.Id, lookupHash)
+	if err == nil {
+		err = checkAccountStatus(credentialsStatus.Status)
+	}
+	if err != nil {
+		return &oauthError{Error: "invalid_grant", ErrorDescription: err.Error()}
+	}
+
+	if passwordChangeRequired(realm, credentialsStatus) {
+		return &oauthError{Error: "invalid_grant", ErrorDescription: "password change required"}
+	}
+
+	return nil
+}
+
+/**
+ * Client of a /token request, confidential clients have to present their secret and public clients must not have one
+ */
+func authenticateOAuthClient(r *http.Request) (m.OAuthClientDTO, error) {
+
+	clientId, clientSecret, ok := requestClientCredentials(r)
+	if !ok || clientId == "" {
+		return m.OAuthClientDTO{}, errOAuthClientNotFound
+	}
+
+	client, err := db.GetOAuthClient(clientId)
+	if err != nil {
+		return m.OAuthClientDTO{}, err
+	}
+
+	if client.SecretHash == "" && clientSecret == "" {
+		return client, nil
+	}
+
+	secretHash := oauthSecretHash(clientSecret)
+	if client.SecretHash == "" || subtle.ConstantTimeCompare([]byte(secretHash), []byte(client.SecretHash)) != 1 {
+		return m.OAuthClientDTO{}, errOAuthClientNotFound
+	}
+
+	return client, nil
+}
+
+/**
+ * S256 of the code verifier has to be the code challenge of the authorization request, see RFC 7636 section 4.6
+ */
+func checkCodeVerifier(codeVerifier string, codeChallenge string) bool {
+
+	if !codeVerifierPattern.MatchString(codeVerifier) {
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(codeVerifier))
+	expected := base64.RawURLEncoding.EncodeToString(digest[:])
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(codeChallenge)) == 1
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scope of OpenID Connect requests, the client gets an ID token and its access token works at /userinfo
+const openIdScope = "openid"
+
+// Authentication methods of RFC 8176 in the amr claim
+const (
+	amrPassword    = "pwd"
+	amrOneTimeCode = "otp" // TOTP or recovery code
+	amrMultiFactor = "mfa"
+)
+
+// token_use of ID tokens, which are rejected as access tokens by checkRestricted
+const idTokenUse = "id"
+
+// acr levels, like AAL1 and AAL2 of NIST SP 800-63B
+const (
+	acrSingleFactor = "1"
+	acrMultiFactor  = "2"
+)
+
+/**
+ * Provider metadata as in OpenID Connect Discovery 1.0 section 3
+ */
+type openIdConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthSigningAlgs      []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	ACRValuesSupported                []string `json:"acr_values_supported"`
+	PromptValuesSupported             []string `json:"prompt_values_supported"`
+	AuthorizationResponseIssSupported bool     `json:"authorization_response_iss_parameter_supported"`
+}
+
+type userInfoResponse struct {
+	Sub string `json:"sub"`
+}
+
+/**
+ * GET /.well-known/openid-configuration and GET /jwks of the default realm,
+ * GET /realms/{id}/.well-known/openid-configuration and GET /realms/{id}/jwks of the others
+ * The paths follow realmIssuer, so JWT_ISSUER has to be the URL the HTTP endpoints are served at
+ */
+func OIDCMetadataHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, oauthError{Error: "invalid_request"})
+		return
+	}
+
+	realmId := DefaultRealm
+	path := r.URL.Path
+	if realmPath, ok := strings.CutPrefix(path, "/realms/"); ok {
+		realmId, path, _ = strings.Cut(realmPath, "/")
+		path = "/" + path
+
+		// The default realm is served at the root, like its issuer
+		if realmId == DefaultRealm || !realmIdPattern.MatchString(realmId) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	realm, keys, err := resolveRealm(realmId)
+	if errors.Is(err, errRealmNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+		return
+	}
+
+	switch path {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, openIdConfigurationOf(realm, keys))
+	case "/jwks":
+		jwks, err := cert.PublicJWKS(keys)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, oauthError{Error: "server_error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, jwks)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func openIdConfigurationOf(realm m.RealmDTO, keys *cert.KeySet) openIdConfiguration {
+
+	issuer := realmIssuer(realm.Id)
+
+	algorithms := []string{}
+	for _, key := range keys.All() {
+		if !slices.Contains(algorithms, key.Algorithm) {
+			algorithms = append(algorithms, key.Algorithm)
+		}
+	}
+
+	// /authorize, /token and /userinfo serve every realm, the client or token tells which one
+	return openIdConfiguration{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             c.EnvJWTIssuer + "/authorize",
+		TokenEndpoint:                     tokenEndpoint(),
+		UserInfoEndpoint:                  c.EnvJWTIssuer + "/userinfo",
+		JWKSURI:                           issuer + "/jwks",
+		ScopesSupported:                   []string{openIdScope},
+		ResponseTypesSupported:            []string{"code"},
+		ResponseModesSupported:            []string{"query"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", "client_credentials"},
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  algorithms,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "private_key_jwt", "none"},
+		TokenEndpointAuthSigningAlgs:      []string{"RS256", "RS512", "PS256", "ES256", "ES384", "EdDSA"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "acr", "amr", "sid"},
+		ACRValuesSupported:                []string{acrSingleFactor, acrMultiFactor},
+		PromptValuesSupported:             []string{"none", "login"},
+		AuthorizationResponseIssSupported: true,
+	}
+}
+
+/**
+ * GET or POST /userinfo with an access token of /token which was granted the openid scope
+ * Credentials only hold a password, so sub is all there is to tell
+ */
+func UserInfoHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, oauthError{Error: "invalid_request"})
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="userinfo"`)
+		writeJSON(w, http.StatusUnauthorized, oauthError{Error: "invalid_request", ErrorDescription: "bearer token is required"})
+		return
+	}
+
+	tokenClaims, err := verifyUserInfoToken(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="userinfo", error="invalid_token"`)
+		writeJSON(w, http.StatusUnauthorized, oauthError{Error: "invalid_token", ErrorDescription: err.Error()})
+		return
+	}
+
+	if tokenClaims.ClientId == "" || !hasScope(tokenClaims.Scopes, openIdScope) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="userinfo", error="insufficient_scope", scope="openid"`)
+		writeJSON(w, http.StatusForbidden, oauthError{Error: "insufficient_scope"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, userInfoResponse{Sub: tokenClaims.Subject})
+}
+
+/**
+ * URL of /token, the aud of private_key_jwt assertions
+ */
+func tokenEndpoint() string {
+	return c.EnvJWTIssuer + "/token"
+}
+
+func verifyUserInfoToken(token string) (m.TokenClaims, error) {
+
+	realmId, ok := tokenRealm(token)
+	if !ok {
+		return m.TokenClaims{}, fmt.Errorf("invalid token")
+	}
+
+	_, keys, err := resolveRealm(realmId)
+	if err != nil {
+		return m.TokenClaims{}, err
+	}
+
+	return verifyActiveToken(token, keys)
+}
+
+/**
+ * ID token of the login behind the refresh token, for the client it was issued to
+ * auth_time, nonce and amr stay those of the login across refreshes, see OpenID Connect Core 1.0 section 12.2
+ */
+func issueIdToken(realm m.RealmDTO, keys *cert.KeySet, refreshToken m.OAuthRefreshTokenDTO, expiresAt int64) (string, error) {
+
+	return tokenHandler.CreateToken(m.TokenDTO{
+		Id:        refreshToken.SubjectId,
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: expiresAt,
+		Noise:     mathrand.Int63(),
+		Issuer:    realmIssuer(realm.Id),
+		Audience:  []string{refreshToken.ClientId},
+		SessionId: refreshToken.SessionId,
+		AuthTime:  refreshToken.AuthTime.Unix(),
+		Nonce:     refreshToken.Nonce,
+		ACR:       loginACR(refreshToken.AMR),
+		AMR:       refreshToken.AMR,
+		TokenUse:  idTokenUse,
+	}, keys.Active().Signer)
+}
+
+func loginACR(amr []string) string {
+	if slices.Contains(amr, amrMultiFactor) {
+		return acrMultiFactor
+	}
+	return acrSingleFactor
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	pb "simple-micro-auth/src/proto"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Sole scope of tokens which can only be used to change the password
+const passwordChangeScope = "auth:password_change"
+
+// Claim binding a password change token to the credentials it was issued for
+const passwordChangeClaim = "lookup_hash"
+
+/**
+ * Admin RPC, the credentials get a password change token on their next GrantAuth until the password is changed
+ */
+func (service *AuthServiceServer) SetMustChangePassword(ctx context.Context, req *pb.SetMustChangePasswordRequest) (*pb.SetMustChangePasswordResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.SetMustChangePassword(req.Realm, req.LookupHash, req.MustChangePassword)
+	if err != nil {
+		return &pb.SetMustChangePasswordResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.SetMustChangePasswordResponse{Error: ""}, nil
+}
+
+/**
+ * Whether the credentials were flagged by an admin or a breach, or their password is older than maxAgeDays of the policy
+ */
+func passwordChangeRequired(realm m.RealmDTO, credentialsStatus m.CredentialsStatusDTO) bool {
+
+	if credentialsStatus.MustChangePassword {
+		return true
+	}
+
+	maxAgeDays := realmPasswordPolicy(realm).MaxAgeDays
+
+	return maxAgeDays > 0 && time.Since(credentialsStatus.PasswordChangedAt) > time.Duration(maxAgeDays)*24*time.Hour
+}
+
+/**
+ * Short lived token, see PASSWORD_CHANGE_TOKEN_TTL, which only UpdateAuth accepts
+ * It carries no role scopes, so it grants nothing else even where the restriction is not checked
+ */
+func issuePasswordChangeToken(realm m.RealmDTO, keys *cert.KeySet, lookupHash string, id int64) (string, error) {
+
+	return tokenHandler.CreateToken(m.TokenDTO{
+		Id:         id,
+		IssuedAt:   time.Now().Unix(),
+		ExpiresAt:  time.Now().Add(c.EnvPasswordChangeTokenTtl).Unix(),
+		Noise:      rand.Int63(),
+		Issuer:     realmIssuer(realm.Id),
+		Scopes:     []string{passwordChangeScope},
+		LookupHash: lookupHash,
+	}, keys.Active().Signer)
+}
+
+/**
+ * Verify a password change token for the credentials, it has to be revoked once the password is changed
+ */
+func verifyPasswordChangeToken(token string, keys *cert.KeySet, lookupHash string) (m.TokenClaims, error) {
+
+	claims, err := tokenHandler.VerifyClaims(token, time.Now().Unix(), keys, "", "")
+	if err != nil {
+		return m.TokenClaims{}, err
+	}
+
+	err = checkRevoked(claims)
+	if err != nil {
+		return m.TokenClaims{}, err
+	}
+
+	tokenClaims, err := tokenHandler.ParseClaims(claims)
+	if err != nil {
+		return m.TokenClaims{}, err
+	}
+
+	tokenLookupHash, _ := claims[passwordChangeClaim].(string)
+	if !hasScope(tokenClaims.Scopes, passwordChangeScope) || tokenLookupHash != lookupHash || tokenClaims.TokenId == "" {
+		return m.TokenClaims{}, fmt.Errorf("token is not a password change token for this lookupHash")
+	}
+
+	return tokenClaims, nil
+}
+
+/**
+ * Fail for password change tokens anywhere but UpdateAuth, for passwordless link tokens anywhere but CompletePasswordlessLogin
+ * and for ID tokens, which tell the client who logged in but grant nothing
+ * See checkTokenActive
+ */
+func checkRestricted(claims jwt.MapClaims) error {
+
+	scope, _ := claims["scope"].(string)
+	if hasScope(strings.Fields(scope), passwordChangeScope) {
+		return fmt.Errorf("token can only be used to change the password")
+	}
+	if hasScope(strings.Fields(scope), passwordlessLinkScope) {
+		return fmt.Errorf("token can only be used to complete a passwordless login")
+	}
+
+	if tokenUse, _ := claims["token_use"].(string); tokenUse == idTokenUse {
+		return fmt.Errorf("id tokens can not be used as access tokens")
+	}
+
+	return nil
+}
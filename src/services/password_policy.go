@@ -0,0 +1,174 @@
+package services
+
+import (
+	"fmt"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nbutton23/zxcvbn-go"
+)
+
+// bcrypt ignores everything after the first 72 bytes
+const maxPasswordBytes = 72
+
+// Every previous password is compared with bcrypt, so the history stays short
+const maxPasswordHistory = 24
+
+/**
+ * Password policy of the realm, PASSWORD_* defaults if it has none of its own
+ */
+func realmPasswordPolicy(realm m.RealmDTO) m.PasswordPolicy {
+	if realm.PasswordPolicy != nil {
+		return *realm.PasswordPolicy
+	}
+	return c.EnvPasswordPolicy
+}
+
+var errPasswordPolicy = fmt.Errorf("password does not satisfy the password policy")
+
+/**
+ * Every check a new password of the realm has to pass before it is stored, the history is checked by the db
+ */
+func checkNewPassword(realm m.RealmDTO, field string, password string, lookupHash string) ([]m.FieldError, error) {
+
+	violations := CheckPassword(realmPasswordPolicy(realm), field, password, lookupHash)
+
+	breached, err := checkBreached(field, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(violations, breached...), nil
+}
+
+func reusedPasswordError(field string, historySize int) m.FieldError {
+	return m.FieldError{
+		Field:   field,
+		Code:    "reused",
+		Message: fmt.Sprintf("password must differ from the last %d passwords", historySize),
+	}
+}
+
+/**
+ * Check the password against the policy before it is hashed
+ * Every violated rule is reported, so the caller can show them all at once
+ * @param field string - name of the request field the password came in, e.g. newPassword
+ * @param lookupHash string - credentials the password is for, passwords derived from it are rejected if the policy says so
+ */
+func CheckPassword(policy m.PasswordPolicy, field string, password string, lookupHash string) []m.FieldError {
+
+	violations := []m.FieldError{}
+
+	violate := func(code string, message string, args ...interface{}) {
+		violations = append(violations, m.FieldError{
+			Field:   field,
+			Code:    code,
+			Message: fmt.Sprintf(message, args...),
+		})
+	}
+
+	length := utf8.RuneCountInString(password)
+
+	if length < policy.MinLength || length == 0 {
+		violate("too_short", "password must be at least %d characters long", max(policy.MinLength, 1))
+	}
+
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		violate("too_long", "password must be at most %d characters long", policy.MaxLength)
+	} else if len(password) > maxPasswordBytes {
+		violate("too_long", "password must be at most %d bytes long", maxPasswordBytes)
+	}
+
+	var hasUppercase, hasLowercase, hasDigit, hasSymbol bool
+	for _, char := range password {
+		switch {
+		case unicode.IsUpper(char):
+			hasUppercase = true
+		case unicode.IsLower(char):
+			hasLowercase = true
+		case unicode.IsDigit(char):
+			hasDigit = true
+		case !unicode.IsLetter(char):
+			hasSymbol = true
+		}
+	}
+
+	if policy.RequireUppercase && !hasUppercase {
+		violate("missing_uppercase", "password must contain an uppercase letter")
+	}
+
+	if policy.RequireLowercase && !hasLowercase {
+		violate("missing_lowercase", "password must contain a lowercase letter")
+	}
+
+	if policy.RequireDigit && !hasDigit {
+		violate("missing_digit", "password must contain a digit")
+	}
+
+	if policy.RequireSymbol && !hasSymbol {
+		violate("missing_symbol", "password must contain a symbol")
+	}
+
+	if policy.MaxRepeated > 0 && longestRun(password) > policy.MaxRepeated {
+		violate("too_many_repeated", "password must not repeat a character more than %d times in a row", policy.MaxRepeated)
+	}
+
+	if policy.DisallowLookupHash && derivedFrom(password, lookupHash) {
+		violate("contains_lookup_hash", "password must not be derived from the lookup hash")
+	}
+
+	if policy.MinStrength > 0 && password != "" {
+		strength := zxcvbn.PasswordStrength(password, []string{lookupHash})
+		if strength.Score < policy.MinStrength {
+			violate("too_weak", "password is too easy to guess, strength %d of at least %d", strength.Score, policy.MinStrength)
+		}
+	}
+
+	return violations
+}
+
+/**
+ * Length of the longest run of the same character
+ */
+func longestRun(password string) int {
+
+	longest, current := 0, 0
+	var previous rune
+
+	for i, char := range []rune(password) {
+		if i > 0 && char == previous {
+			current++
+		} else {
+			current = 1
+		}
+		previous = char
+		longest = max(longest, current)
+	}
+
+	return longest
+}
+
+/**
+ * Whether the password contains the lookup hash, is part of it or is it reversed
+ */
+func derivedFrom(password string, lookupHash string) bool {
+
+	if password == "" || lookupHash == "" {
+		return false
+	}
+
+	password = strings.ToLower(password)
+	lookupHash = strings.ToLower(lookupHash)
+
+	reversed := []rune(password)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+
+	return strings.Contains(password, lookupHash) ||
+		strings.Contains(lookupHash, password) ||
+		strings.Contains(string(reversed), lookupHash)
+}
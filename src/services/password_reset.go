@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	pb "simple-micro-auth/src/proto"
+	"strings"
+	"time"
+)
+
+// Grants RequestPasswordReset to the service delivering reset tokens, without making it an admin
+const passwordResetScope = "auth:password_reset"
+
+/**
+ * Admin RPC, set the password without knowing the old one
+ * A temporary password has to be changed on the next GrantAuth
+ */
+func (service *AuthServiceServer) SetPassword(ctx context.Context, req *pb.SetPasswordRequest) (*pb.PasswordResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	realm, err := db.GetRealm(realmOrDefault(req.Realm))
+	if err != nil {
+		return &pb.PasswordResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	response := setPassword(realm, req.LookupHash, "password", req.Password)
+	if response.Error != "" || !req.Temporary {
+		return response, nil
+	}
+
+	err = db.SetMustChangePassword(realm.Id, req.LookupHash, true)
+	if err != nil {
+		return &pb.PasswordResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return response, nil
+}
+
+/**
+ * Issue a single use reset token for the credentials, replacing any pending one
+ * The token is returned once for the caller to deliver and only its hash is stored
+ */
+func (service *AuthServiceServer) RequestPasswordReset(ctx context.Context, req *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetResponse, error) {
+	err := authorizeScope(ctx, req.Realm, passwordResetScope)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenBytes := make([]byte, 32)
+	_, err = rand.Read(tokenBytes)
+	if err != nil {
+		return &pb.RequestPasswordResetResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	expiresAt := time.Now().Add(c.EnvPasswordResetTtl)
+
+	err = db.CreatePasswordReset(req.Realm, req.LookupHash, resetTokenHash(token), expiresAt)
+	if err != nil {
+		return &pb.RequestPasswordResetResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RequestPasswordResetResponse{Token: token, ExpiresAt: expiresAt.Unix(), Error: ""}, nil
+}
+
+/**
+ * Set a new password with a token of RequestPasswordReset
+ * A password violating the policy leaves the token usable for another try
+ */
+func (service *AuthServiceServer) ConfirmPasswordReset(ctx context.Context, req *pb.ConfirmPasswordResetRequest) (*pb.PasswordResponse, error) {
+	realm, err := db.GetRealm(realmOrDefault(req.Realm))
+	if err != nil {
+		return &pb.PasswordResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	tokenHash := resetTokenHash(req.Token)
+
+	lookupHash, err := db.GetPasswordReset(realm.Id, tokenHash)
+	if err != nil {
+		return &pb.PasswordResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	violations, err := checkNewPassword(realm, "newPassword", req.NewPassword, lookupHash)
+	if err != nil {
+		return &pb.PasswordResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	if len(violations) > 0 {
+		return &pb.PasswordResponse{Error: errPasswordPolicy.Error(), FieldErrors: fieldErrorsToPb(violations)}, nil
+	}
+
+	// Consuming it is what counts, the token may have been used meanwhile
+	// A reused password is only found afterwards, then a new reset has to be requested
+	lookupHash, err = db.ConsumePasswordReset(realm.Id, tokenHash)
+	if err != nil {
+		return &pb.PasswordResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return storePassword(realm, lookupHash, "newPassword", req.NewPassword), nil
+}
+
+/**
+ * Check and store a password which replaces the current one without the old one being known
+ */
+func setPassword(realm m.RealmDTO, lookupHash string, field string, password string) *pb.PasswordResponse {
+
+	violations, err := checkNewPassword(realm, field, password, lookupHash)
+	if err != nil {
+		return &pb.PasswordResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}
+	}
+
+	if len(violations) > 0 {
+		return &pb.PasswordResponse{Error: errPasswordPolicy.Error(), FieldErrors: fieldErrorsToPb(violations)}
+	}
+
+	return storePassword(realm, lookupHash, field, password)
+}
+
+/**
+ * Store a password which passed checkNewPassword, only the history is left to check
+ */
+func storePassword(realm m.RealmDTO, lookupHash string, field string, password string) *pb.PasswordResponse {
+
+	historySize := realmPasswordPolicy(realm).HistorySize
+
+	err := db.SetPassword(m.CredentialsDTOUpdate{
+		RealmId:     realm.Id,
+		LookupHash:  lookupHash,
+		NewPassword: password,
+		HistorySize: historySize,
+	})
+	if errors.Is(err, errPasswordReused) {
+		return &pb.PasswordResponse{
+			Error:       errPasswordPolicy.Error(),
+			FieldErrors: fieldErrorsToPb([]m.FieldError{reusedPasswordError(field, historySize)}),
+		}
+	}
+	if err != nil {
+		return &pb.PasswordResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}
+	}
+
+	return &pb.PasswordResponse{Error: ""}
+}
+
+func resetTokenHash(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
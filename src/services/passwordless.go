@@ -0,0 +1,284 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	mathrand "math/rand"
+	"net/url"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	pb "simple-micro-auth/src/proto"
+	"simple-micro-auth/src/sender"
+	"strings"
+	"time"
+)
+
+// Grants StartPasswordlessLogin to the service which knows where to deliver codes, without making it an admin
+const passwordlessScope = "auth:passwordless"
+
+// Sole scope of link tokens, which can only be used to complete a passwordless login
+const passwordlessLinkScope = "auth:passwordless_link"
+
+const (
+	passwordlessCode = "code"
+	passwordlessLink = "link"
+)
+
+/**
+ * Deliver a one time code or a login link to the credentials, replacing any pending one
+ * The caller vouches for the destination belonging to the credentials
+ */
+func (service *AuthServiceServer) StartPasswordlessLogin(ctx context.Context, req *pb.StartPasswordlessLoginRequest) (*pb.StartPasswordlessLoginResponse, error) {
+	err := authorizeScope(ctx, req.Realm, passwordlessScope)
+	if err != nil {
+		return nil, err
+	}
+
+	realm, keys, err := resolveRealm(req.Realm)
+	if err != nil {
+		return &pb.StartPasswordlessLoginResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	if req.Destination == "" {
+		err = fmt.Errorf("destination is required")
+		return &pb.StartPasswordlessLoginResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	// Inactive accounts could not log in with the code anyway
+	credentialsStatus, err := db.GetCredentialsStatus(realm.Id, req.LookupHash)
+	if err == nil {
+		err = checkAccountStatus(credentialsStatus.Status)
+	}
+	if err != nil {
+		return &pb.StartPasswordlessLoginResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	expiresAt := time.Now().Add(c.EnvPasswordlessTtl)
+	message := sender.Message{Destination: req.Destination, Channel: req.Channel, ExpiresAt: expiresAt}
+	login := m.PasswordlessLoginDTO{RealmId: realm.Id, LookupHash: req.LookupHash, ExpiresAt: expiresAt}
+	var loginId string
+
+	switch req.Channel {
+	case passwordlessCode:
+		loginId, message.Code, err = newPasswordlessCode()
+		login.LoginHash = passwordlessLoginHash(loginId)
+		login.CodeHash = passwordlessCodeHash(loginId, message.Code)
+
+	case passwordlessLink:
+		if c.EnvPasswordlessLinkURL == "" {
+			err = fmt.Errorf("passwordless links are not available, PASSWORDLESS_LINK_URL is not set")
+			break
+		}
+		var token, tokenId string
+		token, tokenId, err = issuePasswordlessLinkToken(realm, keys, req.LookupHash, expiresAt)
+		login.LoginHash = passwordlessLoginHash(tokenId)
+		message.Link = c.EnvPasswordlessLinkURL + url.QueryEscape(token)
+
+	default:
+		err = fmt.Errorf("channel must be %s or %s", passwordlessCode, passwordlessLink)
+	}
+	if err != nil {
+		return &pb.StartPasswordlessLoginResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	err = db.CreatePasswordlessLogin(login)
+	if err != nil {
+		return &pb.StartPasswordlessLoginResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	err = passwordlessSender().Send(message)
+	if err != nil {
+		log.Println(err)
+		err = fmt.Errorf("error delivering the passwordless login")
+		return &pb.StartPasswordlessLoginResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.StartPasswordlessLoginResponse{Error: "", LoginId: loginId, ExpiresAt: expiresAt.Unix()}, nil
+}
+
+/**
+ * Issue the token of GrantAuth for a delivered code or link, both work once
+ * Credentials with a second factor still get a challenge for CompleteMFA
+ */
+func (service *AuthServiceServer) CompletePasswordlessLogin(ctx context.Context, req *pb.CompletePasswordlessLoginRequest) (*pb.AuthResponse, error) {
+	err := checkCustomClaims(req.Claims)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	realm, keys, err := resolveRealm(req.Realm)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	// Out of range lifetimes are rejected before the code or link is used up
+	_, err = realmTokenTtl(realm, req.Ttl)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	var login m.PasswordlessLoginDTO
+	if req.Token != "" {
+		login, err = verifyPasswordlessLinkToken(realm, keys, req.Token)
+	} else {
+		login, err = verifyPasswordlessCode(realm, req.LoginId, req.Code)
+	}
+	if err == nil {
+		err = db.ConsumePasswordlessLogin(realm.Id, login.LoginHash)
+	}
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	grant := m.GrantDTO{
+		LookupHash: login.LookupHash,
+		Id:         req.Id,
+		Ttl:        req.Ttl,
+		Audience:   req.Audience,
+		Claims:     req.Claims,
+		Client:     clientFromPb(ctx, req.Client),
+	}
+
+	credentialsStatus, err := db.GetCredentialsStatus(realm.Id, login.LookupHash)
+	if err == nil {
+		err = checkAccountStatus(credentialsStatus.Status)
+	}
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	mfaResponse, err := startMFA(realm, grant)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+	if mfaResponse != nil {
+		return mfaResponse, nil
+	}
+
+	return grantToken(realm, keys, grant, credentialsStatus), nil
+}
+
+/**
+ * Sender of PASSWORDLESS_SENDER, built per message so configuration changes apply right away
+ */
+func passwordlessSender() sender.Sender {
+	switch c.EnvPasswordlessSender {
+	case "smtp":
+		return sender.NewSMTPSender(c.EnvSMTPConfig)
+	case "webhook":
+		return sender.NewWebhookSender(c.EnvPasswordlessWebhookURL, c.EnvPasswordlessWebhookSecret)
+	default:
+		return sender.NewFileSender(c.EnvPasswordlessFile)
+	}
+}
+
+/**
+ * Random login id and a 6 digit code, the code alone is short enough to guess so it only counts with the id
+ */
+func newPasswordlessCode() (string, string, error) {
+
+	loginIdBytes := make([]byte, 32)
+	_, err := rand.Read(loginIdBytes)
+	if err != nil {
+		return "", "", err
+	}
+
+	code, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(loginIdBytes), fmt.Sprintf("%06d", code.Int64()), nil
+}
+
+func verifyPasswordlessCode(realm m.RealmDTO, loginId string, code string) (m.PasswordlessLoginDTO, error) {
+
+	loginHash := passwordlessLoginHash(loginId)
+
+	login, err := db.ClaimPasswordlessAttempt(realm.Id, loginHash)
+	if err != nil {
+		return m.PasswordlessLoginDTO{}, err
+	}
+
+	codeHash := passwordlessCodeHash(loginId, strings.TrimSpace(code))
+	if login.CodeHash == "" || subtle.ConstantTimeCompare([]byte(codeHash), []byte(login.CodeHash)) != 1 {
+		return m.PasswordlessLoginDTO{}, fmt.Errorf("invalid code")
+	}
+
+	return login, nil
+}
+
+/**
+ * Short lived token for the login link, see PASSWORDLESS_TTL
+ * It carries no role scopes and is rejected as a bearer token, see checkRestricted
+ * @returns the token and its jti, which identifies the pending login
+ */
+func issuePasswordlessLinkToken(realm m.RealmDTO, keys *cert.KeySet, lookupHash string, expiresAt time.Time) (string, string, error) {
+
+	tokenId, err := newTokenId()
+	if err != nil {
+		return "", "", err
+	}
+
+	token, err := tokenHandler.CreateToken(m.TokenDTO{
+		IssuedAt:   time.Now().Unix(),
+		ExpiresAt:  expiresAt.Unix(),
+		Noise:      mathrand.Int63(),
+		Issuer:     realmIssuer(realm.Id),
+		Scopes:     []string{passwordlessLinkScope},
+		LookupHash: lookupHash,
+		TokenId:    tokenId,
+	}, keys.Active().Signer)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, tokenId, nil
+}
+
+func verifyPasswordlessLinkToken(realm m.RealmDTO, keys *cert.KeySet, token string) (m.PasswordlessLoginDTO, error) {
+
+	claims, err := tokenHandler.VerifyClaims(token, time.Now().Unix(), keys, realmIssuer(realm.Id), "")
+	if err != nil {
+		return m.PasswordlessLoginDTO{}, err
+	}
+
+	tokenClaims, err := tokenHandler.ParseClaims(claims)
+	if err != nil {
+		return m.PasswordlessLoginDTO{}, err
+	}
+
+	lookupHash, _ := claims["lookup_hash"].(string)
+	if !hasScope(tokenClaims.Scopes, passwordlessLinkScope) || lookupHash == "" || tokenClaims.TokenId == "" {
+		return m.PasswordlessLoginDTO{}, fmt.Errorf("token is not a passwordless login token")
+	}
+
+	// A newer code or link of the credentials replaced the pending login of the token
+	login, err := db.GetPasswordlessLogin(realm.Id, passwordlessLoginHash(tokenClaims.TokenId))
+	if err == nil && login.LookupHash != lookupHash {
+		err = errInvalidPasswordlessLogin
+	}
+	if err != nil {
+		return m.PasswordlessLoginDTO{}, err
+	}
+
+	return login, nil
+}
+
+func passwordlessLoginHash(loginId string) string {
+	digest := sha256.Sum256([]byte(loginId))
+	return hex.EncodeToString(digest[:])
+}
+
+func passwordlessCodeHash(loginId string, code string) string {
+	digest := sha256.Sum256([]byte(loginId + ":" + code))
+	return hex.EncodeToString(digest[:])
+}
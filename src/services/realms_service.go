@@ -0,0 +1,393 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	pb "simple-micro-auth/src/proto"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Realm of requests which name none, it comes with the schema and can not be deleted
+const DefaultRealm = "default"
+
+var realmIdPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+func (service *AuthServiceServer) CreateRealm(ctx context.Context, req *pb.CreateRealmRequest) (*pb.RealmResponse, error) {
+	err := authorizeAdmin(ctx, DefaultRealm)
+	if err != nil {
+		return nil, err
+	}
+
+	if !realmIdPattern.MatchString(req.Id) {
+		return nil, status.Errorf(codes.InvalidArgument, "realm id must consist of lowercase letters, digits, - and _")
+	}
+
+	realm, err := realmTokenTtlsFromPb(req.Id, req.TokenTtl, req.TokenTtlMin, req.TokenTtlMax)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	passwordPolicy, err := passwordPolicyFromPb(req.PasswordPolicy)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	sessionPolicy, err := sessionPolicyFromPb(req.SessionPolicy)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	realm.PasswordPolicy = passwordPolicy
+	realm.SessionPolicy = sessionPolicy
+
+	err = db.CreateRealm(realm)
+	if err != nil {
+		return &pb.RealmResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RealmResponse{Error: ""}, nil
+}
+
+func (service *AuthServiceServer) DeleteRealm(ctx context.Context, req *pb.DeleteRealmRequest) (*pb.RealmResponse, error) {
+	err := authorizeAdmin(ctx, DefaultRealm)
+	if err != nil {
+		return nil, err
+	}
+
+	if realmOrDefault(req.Id) == DefaultRealm {
+		return nil, status.Errorf(codes.InvalidArgument, "the default realm can not be deleted")
+	}
+
+	err = db.DeleteRealm(req.Id)
+	if err != nil {
+		return &pb.RealmResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	unloadSigningKeys(req.Id)
+
+	return &pb.RealmResponse{Error: ""}, nil
+}
+
+func (service *AuthServiceServer) GetRealms(ctx context.Context, req *pb.GetRealmsRequest) (*pb.GetRealmsResponse, error) {
+	err := authorizeAdmin(ctx, DefaultRealm)
+	if err != nil {
+		return nil, err
+	}
+
+	realms, err := db.GetRealms()
+	if err != nil {
+		return &pb.GetRealmsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	response := &pb.GetRealmsResponse{Realms: []*pb.Realm{}, Error: ""}
+	for _, realm := range realms {
+		tokenTtl := ""
+		if realm.TokenTtl > 0 {
+			tokenTtl = realm.TokenTtl.String()
+		}
+		tokenTtlMin, tokenTtlMax := realmTokenTtlBounds(realm)
+		response.Realms = append(response.Realms, &pb.Realm{
+			Id:             realm.Id,
+			TokenTtl:       tokenTtl,
+			Issuer:         realmIssuer(realm.Id),
+			PasswordPolicy: passwordPolicyToPb(realmPasswordPolicy(realm)),
+			SessionPolicy:  sessionPolicyToPb(realmSessionPolicy(realm)),
+			TokenTtlMin:    tokenTtlMin.String(),
+			TokenTtlMax:    tokenTtlMax.String(),
+		})
+	}
+
+	return response, nil
+}
+
+func (service *AuthServiceServer) SetPasswordPolicy(ctx context.Context, req *pb.SetPasswordPolicyRequest) (*pb.RealmResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	passwordPolicy, err := passwordPolicyFromPb(req.PasswordPolicy)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	err = db.SetRealmPasswordPolicy(req.Realm, passwordPolicy)
+	if err != nil {
+		return &pb.RealmResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RealmResponse{Error: ""}, nil
+}
+
+/**
+ * Replace the default token lifetime of the realm and the bounds of the ttl callers request
+ * Tokens issued before keep their exp, the bounds apply from their next refresh
+ */
+func (service *AuthServiceServer) SetTokenTtl(ctx context.Context, req *pb.SetTokenTtlRequest) (*pb.RealmResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	realm, err := realmTokenTtlsFromPb(req.Realm, req.TokenTtl, req.TokenTtlMin, req.TokenTtlMax)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	err = db.SetRealmTokenTtl(req.Realm, realm.TokenTtl, realm.TokenTtlMin, realm.TokenTtlMax)
+	if err != nil {
+		return &pb.RealmResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RealmResponse{Error: ""}, nil
+}
+
+func (service *AuthServiceServer) SetSessionPolicy(ctx context.Context, req *pb.SetSessionPolicyRequest) (*pb.RealmResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionPolicy, err := sessionPolicyFromPb(req.SessionPolicy)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	err = db.SetRealmSessionPolicy(req.Realm, sessionPolicy)
+	if err != nil {
+		return &pb.RealmResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RealmResponse{Error: ""}, nil
+}
+
+/**
+ * Validate a password policy of a request, nil stands for the PASSWORD_* defaults
+ */
+func passwordPolicyFromPb(policy *pb.PasswordPolicy) (*m.PasswordPolicy, error) {
+
+	if policy == nil {
+		return nil, nil
+	}
+
+	if policy.MinLength < 1 || policy.MaxLength < policy.MinLength || policy.MaxLength > maxPasswordBytes {
+		return nil, fmt.Errorf("password lengths must satisfy 1 <= minLength <= maxLength <= %d", maxPasswordBytes)
+	}
+
+	if policy.MaxRepeated < 0 {
+		return nil, fmt.Errorf("maxRepeated must not be negative")
+	}
+
+	if policy.MinStrength < 0 || policy.MinStrength > 4 {
+		return nil, fmt.Errorf("minStrength must be between 0 and 4")
+	}
+
+	if policy.HistorySize < 0 || policy.HistorySize > maxPasswordHistory {
+		return nil, fmt.Errorf("historySize must be between 0 and %d", maxPasswordHistory)
+	}
+
+	if policy.MaxAgeDays < 0 {
+		return nil, fmt.Errorf("maxAgeDays must not be negative")
+	}
+
+	return &m.PasswordPolicy{
+		MinLength:          int(policy.MinLength),
+		MaxLength:          int(policy.MaxLength),
+		RequireUppercase:   policy.RequireUppercase,
+		RequireLowercase:   policy.RequireLowercase,
+		RequireDigit:       policy.RequireDigit,
+		RequireSymbol:      policy.RequireSymbol,
+		MaxRepeated:        int(policy.MaxRepeated),
+		MinStrength:        int(policy.MinStrength),
+		DisallowLookupHash: policy.DisallowLookupHash,
+		HistorySize:        int(policy.HistorySize),
+		MaxAgeDays:         int(policy.MaxAgeDays),
+	}, nil
+}
+
+func passwordPolicyToPb(policy m.PasswordPolicy) *pb.PasswordPolicy {
+	return &pb.PasswordPolicy{
+		MinLength:          int32(policy.MinLength),
+		MaxLength:          int32(policy.MaxLength),
+		RequireUppercase:   policy.RequireUppercase,
+		RequireLowercase:   policy.RequireLowercase,
+		RequireDigit:       policy.RequireDigit,
+		RequireSymbol:      policy.RequireSymbol,
+		MaxRepeated:        int32(policy.MaxRepeated),
+		MinStrength:        int32(policy.MinStrength),
+		DisallowLookupHash: policy.DisallowLookupHash,
+		HistorySize:        int32(policy.HistorySize),
+		MaxAgeDays:         int32(policy.MaxAgeDays),
+	}
+}
+
+/**
+ * Validate the token lifetimes of a request, empty ones stand for the JWT_* defaults
+ * The default lifetime has to lie within the bounds
+ */
+func realmTokenTtlsFromPb(id string, tokenTtl string, tokenTtlMin string, tokenTtlMax string) (m.RealmDTO, error) {
+
+	realm := m.RealmDTO{Id: id}
+
+	ttls := []struct {
+		name     string
+		value    string
+		duration *time.Duration
+	}{
+		{"token ttl", tokenTtl, &realm.TokenTtl},
+		{"token ttl min", tokenTtlMin, &realm.TokenTtlMin},
+		{"token ttl max", tokenTtlMax, &realm.TokenTtlMax},
+	}
+	for _, ttl := range ttls {
+		if ttl.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(ttl.value)
+		if err != nil || duration <= 0 {
+			return m.RealmDTO{}, fmt.Errorf("%s must be a positive duration", ttl.name)
+		}
+		*ttl.duration = duration
+	}
+
+	minTtl, maxTtl := realmTokenTtlBounds(realm)
+	if minTtl > maxTtl {
+		return m.RealmDTO{}, fmt.Errorf("token ttl min %s must not exceed token ttl max %s", minTtl, maxTtl)
+	}
+
+	if realm.TokenTtl > 0 && (realm.TokenTtl < minTtl || realm.TokenTtl > maxTtl) {
+		return m.RealmDTO{}, fmt.Errorf("token ttl must be between %s and %s", minTtl, maxTtl)
+	}
+
+	return realm, nil
+}
+
+/**
+ * Validate a session policy of a request, nil stands for the SESSION_* defaults
+ */
+func sessionPolicyFromPb(policy *pb.SessionPolicy) (*m.SessionPolicy, error) {
+
+	if policy == nil {
+		return nil, nil
+	}
+
+	limits := map[string]string{"idleTimeout": policy.IdleTimeout, "maxLifetime": policy.MaxLifetime}
+	durations := map[string]time.Duration{}
+	for name, limit := range limits {
+		if limit == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(limit)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("%s must be a duration of at least 0", name)
+		}
+		durations[name] = duration
+	}
+
+	return &m.SessionPolicy{
+		IdleTimeout: durations["idleTimeout"],
+		MaxLifetime: durations["maxLifetime"],
+	}, nil
+}
+
+func sessionPolicyToPb(policy m.SessionPolicy) *pb.SessionPolicy {
+
+	sessionPolicy := &pb.SessionPolicy{}
+	if policy.IdleTimeout > 0 {
+		sessionPolicy.IdleTimeout = policy.IdleTimeout.String()
+	}
+	if policy.MaxLifetime > 0 {
+		sessionPolicy.MaxLifetime = policy.MaxLifetime.String()
+	}
+
+	return sessionPolicy
+}
+
+func realmOrDefault(realmId string) string {
+	if realmId == "" {
+		return DefaultRealm
+	}
+	return realmId
+}
+
+/**
+ * Key target of the realm, the default realm keeps the target it had before realms existed
+ */
+func realmTarget(realmId string) string {
+	if realmOrDefault(realmId) == DefaultRealm {
+		return "token"
+	}
+	return "realms/" + realmId
+}
+
+/**
+ * iss claim of tokens issued by the realm
+ * Tokens of the default realm keep JWT_ISSUER, so verifiers checking it are not broken
+ */
+func realmIssuer(realmId string) string {
+	if realmOrDefault(realmId) == DefaultRealm {
+		return c.EnvJWTIssuer
+	}
+	return c.EnvJWTIssuer + "/realms/" + realmId
+}
+
+/**
+ * Realm which issued the token according to its iss claim, the token is not verified
+ * Only use it to pick the keys to verify the token with
+ */
+func tokenRealm(token string) (string, bool) {
+
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil {
+		return "", false
+	}
+
+	issuer, _ := claims["iss"].(string)
+
+	return issuerRealm(issuer)
+}
+
+/**
+ * Realm of an iss claim, see realmIssuer
+ */
+func issuerRealm(issuer string) (string, bool) {
+
+	// Tokens issued before iss was introduced belong to the default realm
+	if issuer == "" || issuer == c.EnvJWTIssuer {
+		return DefaultRealm, true
+	}
+
+	realmId, ok := strings.CutPrefix(issuer, c.EnvJWTIssuer+"/realms/")
+	if !ok || !realmIdPattern.MatchString(realmId) {
+		return "", false
+	}
+
+	return realmId, true
+}
+
+/**
+ * Look up the realm and load its signing keys
+ */
+func resolveRealm(realmId string) (m.RealmDTO, *cert.KeySet, error) {
+
+	realm, err := db.GetRealm(realmOrDefault(realmId))
+	if err != nil {
+		return m.RealmDTO{}, nil, err
+	}
+
+	keys, err := realmKeys(realm.Id)
+	if err != nil {
+		return m.RealmDTO{}, nil, err
+	}
+
+	return realm, keys, nil
+}
@@ -0,0 +1,290 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	pb "simple-micro-auth/src/proto"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Scope required by the admin RPCs
+const adminScope = "auth:admin"
+
+/**
+ * Check that the token is valid and carries the permission as one of its scopes
+ */
+func (service *AuthServiceServer) CheckPermission(ctx context.Context, req *pb.CheckPermissionRequest) (*pb.CheckPermissionResponse, error) {
+	_, keys, err := resolveRealm(req.Realm)
+	if err != nil {
+		return &pb.CheckPermissionResponse{Allowed: false, Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	tokenClaims, err := verifyActiveToken(req.Token, keys)
+	if err != nil {
+		return &pb.CheckPermissionResponse{Allowed: false, Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.CheckPermissionResponse{Allowed: hasScope(tokenClaims.Scopes, req.Permission), Error: ""}, nil
+}
+
+func (service *AuthServiceServer) SetRole(ctx context.Context, req *pb.SetRoleRequest) (*pb.RoleResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "role name is required")
+	}
+
+	for _, scope := range req.Scopes {
+		if scope == "" || len(strings.Fields(scope)) != 1 {
+			return nil, status.Errorf(codes.InvalidArgument, "scope %q must not be empty or contain whitespace", scope)
+		}
+		if scope == passwordChangeScope || scope == passwordlessLinkScope {
+			return nil, status.Errorf(codes.InvalidArgument, "scope %s is reserved", scope)
+		}
+	}
+
+	err = db.SetRole(req.Realm, m.RoleDTO{Name: req.Name, Scopes: req.Scopes})
+	if err != nil {
+		return &pb.RoleResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RoleResponse{Error: ""}, nil
+}
+
+func (service *AuthServiceServer) DeleteRole(ctx context.Context, req *pb.DeleteRoleRequest) (*pb.RoleResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.DeleteRole(req.Realm, req.Name)
+	if err != nil {
+		return &pb.RoleResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RoleResponse{Error: ""}, nil
+}
+
+func (service *AuthServiceServer) AssignRole(ctx context.Context, req *pb.RoleAssignmentRequest) (*pb.RoleResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.AssignRole(req.Realm, req.LookupHash, req.Role)
+	if err != nil {
+		return &pb.RoleResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RoleResponse{Error: ""}, nil
+}
+
+func (service *AuthServiceServer) UnassignRole(ctx context.Context, req *pb.RoleAssignmentRequest) (*pb.RoleResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.UnassignRole(req.Realm, req.LookupHash, req.Role)
+	if err != nil {
+		return &pb.RoleResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RoleResponse{Error: ""}, nil
+}
+
+func (service *AuthServiceServer) GetRoles(ctx context.Context, req *pb.GetRolesRequest) (*pb.GetRolesResponse, error) {
+	err := authorizeAdmin(ctx, req.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := db.GetRoles(req.Realm, req.LookupHash)
+	if err != nil {
+		return &pb.GetRolesResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	response := &pb.GetRolesResponse{Roles: []*pb.Role{}, Error: ""}
+	for _, role := range roles {
+		response.Roles = append(response.Roles, &pb.Role{Name: role.Name, Scopes: role.Scopes})
+	}
+
+	return response, nil
+}
+
+/**
+ * Scopes granted to the credentials of the realm by their roles
+ * Credentials of the default realm listed in ADMIN_LOOKUP_HASHES are always admins
+ */
+func scopesOf(realmId string, lookupHash string) ([]string, error) {
+
+	scopes, err := db.GetScopes(realmId, lookupHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if realmOrDefault(realmId) != DefaultRealm {
+		return scopes, nil
+	}
+
+	for _, adminLookupHash := range c.EnvAdminLookupHashes {
+		if adminLookupHash == lookupHash && !hasScope(scopes, adminScope) {
+			scopes = append(scopes, adminScope)
+		}
+	}
+
+	return scopes, nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, granted := range scopes {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasAllScopes(scopes []string, required []string) bool {
+	for _, scope := range required {
+		if !hasScope(scopes, scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+ * Verify the token with the realm's keys including revocation and account status and read its claims
+ */
+func verifyActiveToken(token string, keys *cert.KeySet) (m.TokenClaims, error) {
+
+	claims, err := tokenHandler.VerifyClaims(token, time.Now().Unix(), keys, "", "")
+	if err != nil {
+		return m.TokenClaims{}, err
+	}
+
+	err = checkTokenActive(claims)
+	if err != nil {
+		return m.TokenClaims{}, err
+	}
+
+	return tokenHandler.ParseClaims(claims)
+}
+
+/**
+ * Admin RPCs require "authorization: Bearer <token>" metadata with a token carrying the admin scope
+ * Admins of the default realm manage every realm, admins of other realms only their own
+ */
+func authorizeAdmin(ctx context.Context, realmId string) error {
+	return authorizeScope(ctx, realmId, adminScope)
+}
+
+/**
+ * Credentials of ADMIN_LOOKUP_HASHES are admins by their lookup hash alone, so only admins may delete or create them
+ * Without any of them in db the first one can be created without a token, to bootstrap the admin
+ */
+func authorizeAdminCredentials(ctx context.Context, realmId string, lookupHash string, creating bool) error {
+
+	if realmOrDefault(realmId) != DefaultRealm || !slices.Contains(c.EnvAdminLookupHashes, lookupHash) {
+		return nil
+	}
+
+	if creating {
+		exist, err := db.AnyCredentialsExist(DefaultRealm, c.EnvAdminLookupHashes)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return nil
+		}
+	}
+
+	return authorizeAdmin(ctx, DefaultRealm)
+}
+
+/**
+ * Like authorizeAdmin for RPCs a narrower scope grants as well, e.g. to backend services
+ */
+func authorizeScope(ctx context.Context, realmId string, scope string) error {
+
+	tokenClaims, err := authorizeBearer(ctx, realmId)
+	if err != nil {
+		return err
+	}
+
+	if !hasScope(tokenClaims.Scopes, scope) && !hasScope(tokenClaims.Scopes, adminScope) {
+		return status.Errorf(codes.PermissionDenied, "token lacks the %s scope", scope)
+	}
+
+	return nil
+}
+
+/**
+ * Verify the bearer token of the authorization metadata for the realm
+ * Tokens of the default realm are accepted for every realm if they carry auth:admin, other scopes stay in their realm
+ * Callers check what the token grants
+ */
+func authorizeBearer(ctx context.Context, realmId string) (m.TokenClaims, error) {
+
+	realmId = realmOrDefault(realmId)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	authorization := md.Get("authorization")
+	if len(authorization) == 0 {
+		return m.TokenClaims{}, status.Errorf(codes.Unauthenticated, "authorization metadata is required")
+	}
+
+	token, ok := strings.CutPrefix(authorization[0], "Bearer ")
+	if !ok {
+		return m.TokenClaims{}, status.Errorf(codes.Unauthenticated, "authorization metadata must be a bearer token")
+	}
+
+	bearerRealm, ok := tokenRealm(token)
+	if !ok {
+		return m.TokenClaims{}, status.Errorf(codes.Unauthenticated, "invalid token")
+	}
+
+	if bearerRealm != DefaultRealm && bearerRealm != realmId {
+		return m.TokenClaims{}, status.Errorf(codes.PermissionDenied, "token is not issued for realm %s", realmId)
+	}
+
+	_, keys, err := resolveRealm(bearerRealm)
+	if err != nil {
+		return m.TokenClaims{}, status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+
+	tokenClaims, err := verifyActiveToken(token, keys)
+	if err != nil {
+		return m.TokenClaims{}, status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+
+	if bearerRealm != realmId && !hasScope(tokenClaims.Scopes, adminScope) {
+		return m.TokenClaims{}, status.Errorf(codes.PermissionDenied, "token is not issued for realm %s", realmId)
+	}
+
+	_, err = db.GetRealm(realmId)
+	if errors.Is(err, errRealmNotFound) {
+		return m.TokenClaims{}, status.Errorf(codes.NotFound, "unknown realm")
+	}
+	if err != nil {
+		return m.TokenClaims{}, err
+	}
+
+	return tokenClaims, nil
+}
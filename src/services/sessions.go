@@ -0,0 +1,314 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	pb "simple-micro-auth/src/proto"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Lengths of the client columns of sessions, longer values are cut off
+const (
+	maxUserAgentLength = 500
+	maxDeviceLength    = 100
+	maxIPLength        = 64
+)
+
+/**
+ * Sessions of the credentials, e.g. to let the user sign out other devices
+ */
+func (service *AuthServiceServer) ListSessions(ctx context.Context, req *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	tokenClaims, err := authorizeCredentials(ctx, req.Realm, req.LookupHash)
+	if err != nil {
+		return nil, err
+	}
+
+	realm, err := db.GetRealm(req.Realm)
+	if err == nil {
+		err = db.DeleteEndedSessions(realm.Id, req.LookupHash, realmSessionPolicy(realm), sessionRetention(realm))
+	}
+	if err != nil {
+		return &pb.ListSessionsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	sessions, err := db.GetSessions(realm.Id, req.LookupHash)
+	if err != nil {
+		return &pb.ListSessionsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	pbSessions := make([]*pb.Session, 0, len(sessions))
+	for _, session := range sessions {
+		pbSessions = append(pbSessions, &pb.Session{
+			SessionId: session.SessionId,
+			Client: &pb.ClientInfo{
+				UserAgent: strings.ToValidUTF8(session.Client.UserAgent, "UTF-8_BUGFIX"),
+				Device:    strings.ToValidUTF8(session.Client.Device, "UTF-8_BUGFIX"),
+				Ip:        session.Client.IP,
+			},
+			CreatedAt:       session.CreatedAt.Unix(),
+			LastRefreshedAt: session.LastRefreshedAt.Unix(),
+			Current:         session.SessionId == tokenClaims.SessionId,
+		})
+	}
+
+	return &pb.ListSessionsResponse{Sessions: pbSessions, Error: ""}, nil
+}
+
+/**
+ * Sign out a device, every token of the session stops working at once
+ */
+func (service *AuthServiceServer) RevokeSession(ctx context.Context, req *pb.RevokeSessionRequest) (*pb.RevokeSessionResponse, error) {
+	_, err := authorizeCredentials(ctx, req.Realm, req.LookupHash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.DeleteSession(req.Realm, req.LookupHash, req.SessionId)
+	if err != nil {
+		return &pb.RevokeSessionResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.RevokeSessionResponse{Error: ""}, nil
+}
+
+/**
+ * Record a new session of the credentials
+ * @returns the session id, the sid claim of the tokens of the session
+ */
+func startSession(realm m.RealmDTO, lookupHash string, client m.ClientDTO) (string, error) {
+
+	err := db.DeleteEndedSessions(realm.Id, lookupHash, realmSessionPolicy(realm), sessionRetention(realm))
+	if err != nil {
+		return "", err
+	}
+
+	sessionId, err := newTokenId()
+	if err != nil {
+		return "", err
+	}
+
+	err = db.CreateSession(m.SessionDTO{
+		SessionId:  sessionId,
+		RealmId:    realm.Id,
+		LookupHash: lookupHash,
+		Client:     client,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return sessionId, nil
+}
+
+/**
+ * Session policy of the realm, SESSION_* defaults if it has none
+ */
+func realmSessionPolicy(realm m.RealmDTO) m.SessionPolicy {
+
+	if realm.SessionPolicy != nil {
+		return *realm.SessionPolicy
+	}
+
+	return c.EnvSessionPolicy
+}
+
+/**
+ * How long sessions are kept after their last login or refresh, even without an idle timeout
+ * Tokens of the realm and OAuth refresh tokens do not live longer, so the session could not be used anymore
+ */
+func sessionRetention(realm m.RealmDTO) time.Duration {
+
+	_, maxTtl := realmTokenTtlBounds(realm)
+
+	return max(maxTtl, c.EnvOAuthRefreshTokenTtl)
+}
+
+/**
+ * Cut the token lifetime short where the session policy ends the session earlier
+ * @param authTime time.Time - login the token goes back to
+ */
+func sessionTokenTtl(policy m.SessionPolicy, authTime time.Time, ttl time.Duration) time.Duration {
+
+	if policy.IdleTimeout > 0 && ttl > policy.IdleTimeout {
+		ttl = policy.IdleTimeout
+	}
+
+	if policy.MaxLifetime > 0 {
+		remaining := time.Until(authTime.Add(policy.MaxLifetime))
+		if ttl > remaining {
+			ttl = remaining
+		}
+	}
+
+	return ttl
+}
+
+/**
+ * Lifetime of the token refreshing the one of the claims, fails once the session policy ended its session
+ * Tokens without auth_time count from their iat, which is their last activity as well if they have no session
+ */
+func refreshTokenTtl(realm m.RealmDTO, claims jwt.MapClaims, ttl time.Duration) (time.Duration, error) {
+
+	tokenClaims, err := tokenHandler.ParseClaims(claims)
+	if err != nil {
+		return 0, err
+	}
+
+	authTime := time.Unix(tokenClaims.AuthTime, 0)
+	if tokenClaims.AuthTime == 0 {
+		authTime = time.Unix(tokenClaims.IssuedAt, 0)
+	}
+
+	return continueSessionTtl(realm, tokenClaims.SessionId, authTime, time.Unix(tokenClaims.IssuedAt, 0), ttl)
+}
+
+/**
+ * Lifetime of the next token of the session, fails once the session policy ended it
+ * @param issuedAt time.Time - last activity if there is no session
+ */
+func continueSessionTtl(realm m.RealmDTO, sessionId string, authTime time.Time, issuedAt time.Time, ttl time.Duration) (time.Duration, error) {
+
+	policy := realmSessionPolicy(realm)
+
+	if policy.MaxLifetime > 0 && time.Now().After(authTime.Add(policy.MaxLifetime)) {
+		return 0, fmt.Errorf("session expired")
+	}
+
+	if policy.IdleTimeout > 0 {
+		lastActivity := issuedAt
+		if sessionId != "" {
+			session, err := db.GetSession(sessionId)
+			if err != nil {
+				return 0, err
+			}
+			lastActivity = session.LastRefreshedAt
+		}
+
+		if time.Now().After(lastActivity.Add(policy.IdleTimeout)) {
+			return 0, fmt.Errorf("session timed out")
+		}
+	}
+
+	return sessionTokenTtl(policy, authTime, ttl), nil
+}
+
+/**
+ * Client reported by the caller, its IP falls back to x-forwarded-for and then the address of the caller
+ */
+func clientFromPb(ctx context.Context, client *pb.ClientInfo) m.ClientDTO {
+
+	clientDTO := m.ClientDTO{
+		UserAgent: truncate(client.GetUserAgent(), maxUserAgentLength),
+		Device:    truncate(client.GetDevice(), maxDeviceLength),
+		IP:        client.GetIp(),
+	}
+
+	if clientDTO.IP == "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if forwardedFor := md.Get("x-forwarded-for"); len(forwardedFor) > 0 {
+			clientDTO.IP, _, _ = strings.Cut(forwardedFor[0], ",")
+			clientDTO.IP = strings.TrimSpace(clientDTO.IP)
+		}
+	}
+
+	if clientDTO.IP == "" {
+		if callerPeer, ok := peer.FromContext(ctx); ok && callerPeer.Addr != nil {
+			host, _, err := net.SplitHostPort(callerPeer.Addr.String())
+			if err == nil {
+				clientDTO.IP = host
+			}
+		}
+	}
+
+	clientDTO.IP = truncate(clientDTO.IP, maxIPLength)
+
+	return clientDTO
+}
+
+/**
+ * Client of an HTTP request, e.g. the browser on the login page, behind proxies its IP comes from x-forwarded-for
+ */
+func clientFromHTTP(r *http.Request) m.ClientDTO {
+
+	clientDTO := m.ClientDTO{UserAgent: truncate(r.UserAgent(), maxUserAgentLength)}
+
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		clientDTO.IP, _, _ = strings.Cut(forwardedFor, ",")
+		clientDTO.IP = strings.TrimSpace(clientDTO.IP)
+	}
+
+	if clientDTO.IP == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err == nil {
+			clientDTO.IP = host
+		}
+	}
+
+	clientDTO.IP = truncate(clientDTO.IP, maxIPLength)
+
+	return clientDTO
+}
+
+func truncate(value string, length int) string {
+	if len(value) <= length {
+		return value
+	}
+
+	// Cutting may split a multibyte character, its remains are dropped
+	return strings.ToValidUTF8(value[:length], "")
+}
+
+/**
+ * Session RPCs are for the credentials themselves, with a token of theirs, and for admins
+ * @returns the claims of the bearer token
+ */
+func authorizeCredentials(ctx context.Context, realmId string, lookupHash string) (m.TokenClaims, error) {
+
+	tokenClaims, err := authorizeBearer(ctx, realmId)
+	if err != nil {
+		return m.TokenClaims{}, err
+	}
+
+	tokenRealm, _ := issuerRealm(tokenClaims.Issuer)
+	ownToken := lookupHash != "" && tokenClaims.LookupHash == lookupHash && tokenRealm == realmOrDefault(realmId)
+
+	if !ownToken && !hasScope(tokenClaims.Scopes, adminScope) {
+		return m.TokenClaims{}, status.Errorf(codes.PermissionDenied, "token is not issued for the credentials")
+	}
+
+	return tokenClaims, nil
+}
+
+/**
+ * Fail for tokens of a revoked session
+ * Tokens without a sid claim are not bound to a session
+ */
+func checkSession(claims jwt.MapClaims) error {
+
+	sessionId, _ := claims["sid"].(string)
+	if sessionId == "" {
+		return nil
+	}
+
+	exists, err := db.SessionExists(sessionId)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("session revoked")
+	}
+
+	return nil
+}
@@ -1,92 +1,336 @@
 package services
 
 import (
-	"crypto/rsa"
+	cryptorand "crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"math/rand"
 	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
 	m "simple-micro-auth/src/models"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type ITokenHandler interface {
-	CreateToken(id int64, timeNow int64, expiresAt int64, noise int64, key *rsa.PrivateKey) (string, error)
-	VerifyToken(token string, timeNow int64, key interface{}) (int64, error)
-	RefreshToken(token string, tokenTtl time.Duration) *m.AuthResponse
+	CreateToken(claims m.TokenDTO, signer cert.Signer) (string, error)
+	VerifyToken(token string, timeNow int64, keys *cert.KeySet) (int64, error)
+	VerifyClaims(token string, timeNow int64, keys *cert.KeySet, issuer string, audience string) (jwt.MapClaims, error)
+	ParseClaims(claims jwt.MapClaims) (m.TokenClaims, error)
+	RefreshToken(token string, tokenTtl time.Duration, keys *cert.KeySet) *m.AuthResponse
 }
 
 type tokenHandlerImpl struct{}
 
-func (handler *tokenHandlerImpl) CreateToken(id int64, timeNow int64, expiresAt int64, noise int64, key *rsa.PrivateKey) (string, error) {
+// Claims set by the service itself, callers can not supply them as custom claims
+var registeredClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "iat": true, "nbf": true, "jti": true,
+	"scope": true, "sid": true, "auth_time": true, "id": true, "rand": true, "lookup_hash": true, "client_id": true,
+	"nonce": true, "acr": true, "amr": true, "token_use": true,
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"id":   id,
-		"rand": noise,
-		"exp":  expiresAt,
-		"iat":  timeNow,
-		"nbf":  timeNow,
-		"iss":  "simple-micro-auth",
-	})
+func (handler *tokenHandlerImpl) CreateToken(claims m.TokenDTO, signer cert.Signer) (string, error) {
+
+	signingMethod := jwt.GetSigningMethod(signer.Algorithm())
+	if signingMethod == nil {
+		return "", fmt.Errorf("unsupported signing algorithm")
+	}
+
+	tokenId := claims.TokenId
+	if tokenId == "" {
+		var err error
+		tokenId, err = newTokenId()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	mapClaims := jwt.MapClaims{}
+	for name, value := range claims.Claims {
+		if !registeredClaims[name] {
+			mapClaims[name] = value
+		}
+	}
+
+	mapClaims["sub"] = strconv.FormatInt(claims.Id, 10)
+	if claims.Subject != "" {
+		mapClaims["sub"] = claims.Subject
+	}
+	mapClaims["rand"] = claims.Noise
+	mapClaims["exp"] = claims.ExpiresAt
+	mapClaims["iat"] = claims.IssuedAt
+	mapClaims["nbf"] = claims.IssuedAt
+	mapClaims["iss"] = claims.Issuer
+	if claims.Issuer == "" {
+		mapClaims["iss"] = c.EnvJWTIssuer
+	}
+	mapClaims["jti"] = tokenId
+
+	if len(claims.Scopes) > 0 {
+		mapClaims["scope"] = strings.Join(claims.Scopes, " ")
+	}
+
+	if claims.LookupHash != "" {
+		mapClaims["lookup_hash"] = claims.LookupHash
+	}
+
+	if claims.SessionId != "" {
+		mapClaims["sid"] = claims.SessionId
+	}
+
+	if claims.AuthTime > 0 {
+		mapClaims["auth_time"] = claims.AuthTime
+	}
+
+	if claims.ClientId != "" {
+		mapClaims["client_id"] = claims.ClientId
+	}
+
+	if claims.Nonce != "" {
+		mapClaims["nonce"] = claims.Nonce
+	}
+
+	if claims.ACR != "" {
+		mapClaims["acr"] = claims.ACR
+	}
+
+	if len(claims.AMR) > 0 {
+		mapClaims["amr"] = claims.AMR
+	}
+
+	if claims.TokenUse != "" {
+		mapClaims["token_use"] = claims.TokenUse
+	}
+
+	if len(claims.Audience) == 1 {
+		mapClaims["aud"] = claims.Audience[0]
+	} else if len(claims.Audience) > 1 {
+		mapClaims["aud"] = claims.Audience
+	}
+
+	token := jwt.NewWithClaims(signingMethod, mapClaims)
 
-	tokenString, err := token.SignedString(key)
+	token.Header["kid"] = signer.KeyID()
+
+	signingString, err := token.SigningString()
+	if err != nil {
+		return "", err
+	}
+
+	// The signer may be remote, so the token is signed with it instead of a private key
+	signature, err := signer.Sign(signingString)
 	if err != nil {
 		return "", err
 	}
 
-	return tokenString, nil
+	return signingString + "." + token.EncodeSegment(signature), nil
 }
 
-func (handler *tokenHandlerImpl) VerifyToken(token string, timeNow int64, key interface{}) (int64, error) {
+func (handler *tokenHandlerImpl) VerifyToken(token string, timeNow int64, keys *cert.KeySet) (int64, error) {
+
+	claims, err := handler.VerifyClaims(token, timeNow, keys, "", "")
+	if err != nil {
+		return 0, err
+	}
+
+	return subjectId(claims)
+}
+
+/**
+ * Verify the token and return all of its claims
+ * @param issuer string - expected iss claim, not checked if empty
+ * @param audience string - audience the token must be issued for, not checked if empty
+ */
+func (handler *tokenHandlerImpl) VerifyClaims(token string, timeNow int64, keys *cert.KeySet, issuer string, audience string) (jwt.MapClaims, error) {
+	var key cert.Key
+
 	parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		return key, nil
+		var ok bool
+
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			// Tokens issued before key ids were introduced
+			key = keys.Active()
+		} else if key, ok = keys.Lookup(kid); !ok {
+			return nil, fmt.Errorf("unknown signing key")
+		}
+
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method")
+		}
+
+		return key.PublicKey, nil
 	})
 
 	if err != nil {
 		err = fmt.Errorf("invalid token or signature")
-		return 0, err
+		return nil, err
 	}
 
 	if !parsedToken.Valid {
 		err = fmt.Errorf("invalid token")
-		return 0, err
+		return nil, err
 	}
 
-	if parsedToken.Method != jwt.SigningMethodRS256 {
+	if parsedToken.Method.Alg() != key.Algorithm {
 		err = fmt.Errorf("unexpected signing method")
-		return 0, err
+		return nil, err
 	}
 
 	claims, ok := parsedToken.Claims.(jwt.MapClaims)
 	if !ok {
 		err = fmt.Errorf("claims malformed")
-		return 0, err
+		return nil, err
 	}
 
 	expiresAt, ok := claims["exp"].(float64)
 	if !ok {
 		err = fmt.Errorf("exp claim malformed")
-		return 0, err
+		return nil, err
 	}
 
 	if int64(expiresAt) < timeNow {
 		err = fmt.Errorf("token expired")
-		return 0, err
+		return nil, err
 	}
 
-	id, ok := claims["id"].(float64)
-	if !ok {
-		err = fmt.Errorf("id claim malformed")
-		return 0, err
+	if issuer != "" {
+		tokenIssuer, err := claims.GetIssuer()
+		if err != nil || tokenIssuer != issuer {
+			err = fmt.Errorf("unexpected issuer")
+			return nil, err
+		}
+	}
+
+	if audience != "" {
+		tokenAudience, err := claims.GetAudience()
+		if err != nil {
+			err = fmt.Errorf("aud claim malformed")
+			return nil, err
+		}
+
+		found := false
+		for _, tokenAudience := range tokenAudience {
+			found = found || tokenAudience == audience
+		}
+
+		if !found {
+			err = fmt.Errorf("token not issued for this audience")
+			return nil, err
+		}
 	}
 
-	return int64(id), nil
+	return claims, nil
 }
 
-func (handler *tokenHandlerImpl) RefreshToken(token string, tokenTtl time.Duration) *m.AuthResponse {
+/**
+ * Read the well known claims of a verified token into typed fields
+ * Every other claim ends up in Custom
+ */
+func (handler *tokenHandlerImpl) ParseClaims(claims jwt.MapClaims) (m.TokenClaims, error) {
 
-	id, err := handler.VerifyToken(token, time.Now().Unix(), cert.PublicKey)
+	tokenClaims := m.TokenClaims{Custom: map[string]interface{}{}}
+
+	id, err := subjectId(claims)
+	if err == nil {
+		tokenClaims.Id = id
+		tokenClaims.Subject = strconv.FormatInt(id, 10)
+	} else if clientId, ok := clientSubject(claims); ok {
+		tokenClaims.Subject = clientId
+	} else {
+		return m.TokenClaims{}, err
+	}
+
+	numericClaims := map[string]*int64{
+		"exp":       &tokenClaims.ExpiresAt,
+		"iat":       &tokenClaims.IssuedAt,
+		"nbf":       &tokenClaims.NotBefore,
+		"auth_time": &tokenClaims.AuthTime,
+	}
+	for name, field := range numericClaims {
+		if _, ok := claims[name]; !ok {
+			continue
+		}
+		value, ok := claims[name].(float64)
+		if !ok {
+			err = fmt.Errorf("%s claim malformed", name)
+			return m.TokenClaims{}, err
+		}
+		*field = int64(value)
+	}
+
+	stringClaims := map[string]*string{
+		"jti":         &tokenClaims.TokenId,
+		"iss":         &tokenClaims.Issuer,
+		"sid":         &tokenClaims.SessionId,
+		"lookup_hash": &tokenClaims.LookupHash,
+		"client_id":   &tokenClaims.ClientId,
+	}
+	for name, field := range stringClaims {
+		if _, ok := claims[name]; !ok {
+			continue
+		}
+		value, ok := claims[name].(string)
+		if !ok {
+			err = fmt.Errorf("%s claim malformed", name)
+			return m.TokenClaims{}, err
+		}
+		*field = value
+	}
+
+	tokenClaims.Audience, err = claims.GetAudience()
+	if err != nil {
+		err = fmt.Errorf("aud claim malformed")
+		return m.TokenClaims{}, err
+	}
+
+	// Scopes are a space separated list as in RFC 8693
+	if _, ok := claims["scope"]; ok {
+		scope, ok := claims["scope"].(string)
+		if !ok {
+			err = fmt.Errorf("scope claim malformed")
+			return m.TokenClaims{}, err
+		}
+		tokenClaims.Scopes = strings.Fields(scope)
+	}
+
+	for name, value := range claims {
+		if !registeredClaims[name] {
+			tokenClaims.Custom[name] = value
+		}
+	}
+
+	return tokenClaims, nil
+}
+
+/**
+ * Issue a new token for the subject of the token
+ * @param keys *cert.KeySet - keys of the realm which issued the token, its active key signs the new one
+ */
+func (handler *tokenHandlerImpl) RefreshToken(token string, tokenTtl time.Duration, keys *cert.KeySet) *m.AuthResponse {
+
+	claims, err := handler.VerifyClaims(token, time.Now().Unix(), keys, "", "")
+	if err != nil {
+		return &m.AuthResponse{
+			Id:    0,
+			Token: token,
+			Error: "TokenError: " + err.Error(),
+		}
+	}
+
+	// Machine clients get new tokens with their credentials
+	if _, ok := clientSubject(claims); ok {
+		return &m.AuthResponse{
+			Id:    0,
+			Token: token,
+			Error: "TokenError: tokens of machine clients can not be refreshed",
+		}
+	}
+
+	id, err := subjectId(claims)
 	if err != nil {
 		return &m.AuthResponse{
 			Id:    id,
@@ -95,7 +339,36 @@ func (handler *tokenHandlerImpl) RefreshToken(token string, tokenTtl time.Durati
 		}
 	}
 
-	tokenString, err := handler.CreateToken(id, time.Now().Unix(), time.Now().Add(tokenTtl).Unix(), rand.Int63(), cert.PrivateKey)
+	// Refreshed tokens keep issuer, audience, scopes, credentials, session, client and custom claims of the original one
+	issuer, _ := claims.GetIssuer()
+	audience, _ := claims.GetAudience()
+	scope, _ := claims["scope"].(string)
+	lookupHash, _ := claims["lookup_hash"].(string)
+	sessionId, _ := claims["sid"].(string)
+	clientId, _ := claims["client_id"].(string)
+
+	// Tokens issued before auth_time was introduced count from their iat
+	authTime, ok := claims["auth_time"].(float64)
+	if !ok {
+		authTime, _ = claims["iat"].(float64)
+	}
+
+	expiresAt := time.Now().Add(tokenTtl).Unix()
+
+	tokenString, err := handler.CreateToken(m.TokenDTO{
+		Id:         id,
+		IssuedAt:   time.Now().Unix(),
+		ExpiresAt:  expiresAt,
+		Noise:      rand.Int63(),
+		Issuer:     issuer,
+		Audience:   audience,
+		Scopes:     strings.Fields(scope),
+		Claims:     claims,
+		LookupHash: lookupHash,
+		SessionId:  sessionId,
+		AuthTime:   int64(authTime),
+		ClientId:   clientId,
+	}, keys.Active().Signer)
 	if err != nil {
 		return &m.AuthResponse{
 			Id:    id,
@@ -105,12 +378,69 @@ func (handler *tokenHandlerImpl) RefreshToken(token string, tokenTtl time.Durati
 	}
 
 	return &m.AuthResponse{
-		Id:    id,
-		Token: tokenString,
-		Error: "",
+		Id:        id,
+		Token:     tokenString,
+		Error:     "",
+		ExpiresAt: expiresAt,
 	}
 }
 
+/**
+ * Read the numeric id from the sub claim
+ * Tokens issued before sub was introduced carry it in the id claim
+ */
+func subjectId(claims jwt.MapClaims) (int64, error) {
+
+	if _, ok := claims["sub"]; !ok {
+		id, ok := claims["id"].(float64)
+		if !ok {
+			err := fmt.Errorf("id claim malformed")
+			return 0, err
+		}
+		return int64(id), nil
+	}
+
+	sub, ok := claims["sub"].(string)
+	if !ok {
+		err := fmt.Errorf("sub claim malformed")
+		return 0, err
+	}
+
+	id, err := strconv.ParseInt(sub, 10, 64)
+	if err != nil {
+		err = fmt.Errorf("sub claim malformed")
+		return 0, err
+	}
+
+	return id, nil
+}
+
+/**
+ * Random jti so every token can be told apart, e.g. to revoke it
+ */
+func newTokenId() (string, error) {
+	tokenId := make([]byte, 16)
+
+	_, err := cryptorand.Read(tokenId)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(tokenId), nil
+}
+
 func NewTokenHandler() ITokenHandler {
 	return &tokenHandlerImpl{}
 }
+
+/**
+ * client_id of tokens issued to machine clients, their sub is the client id instead of a numeric id
+ */
+func clientSubject(claims jwt.MapClaims) (string, bool) {
+
+	sub, _ := claims["sub"].(string)
+	clientId, _ := claims["client_id"].(string)
+	_, hasLookupHash := claims["lookup_hash"]
+
+	return clientId, clientId != "" && sub == clientId && !hasLookupHash
+}
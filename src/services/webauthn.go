@@ -0,0 +1,277 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	pb "simple-micro-auth/src/proto"
+	"simple-micro-auth/src/webauthn"
+	"strings"
+	"time"
+)
+
+const (
+	webAuthnRegistration = "registration"
+	webAuthnLogin        = "login"
+)
+
+/**
+ * Start registering a passkey, it logs in on its own afterwards
+ * Credentials with MFA need a code as well, a passkey would bypass it otherwise
+ */
+func (service *AuthServiceServer) BeginWebAuthnRegistration(ctx context.Context, req *pb.BeginWebAuthnRegistrationRequest) (*pb.WebAuthnOptionsResponse, error) {
+	realmId := realmOrDefault(req.Realm)
+
+	err := db.VerifyCredentials(m.CredentialsDTO{RealmId: realmId, LookupHash: req.LookupHash, Password: req.Password})
+	if err != nil {
+		return &pb.WebAuthnOptionsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	enrolled, err := mfaEnrolled(realmId, req.LookupHash)
+	if err == nil && enrolled {
+		_, err = verifySecondFactor(realmId, req.LookupHash, req.Code)
+	}
+	if err != nil {
+		return &pb.WebAuthnOptionsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	registered, err := db.GetWebAuthnCredentials(realmId, req.LookupHash)
+	if err != nil {
+		return &pb.WebAuthnOptionsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	challenge, err := startWebAuthn(realmId, req.LookupHash, webAuthnRegistration)
+	if err != nil {
+		return &pb.WebAuthnOptionsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	// The lookup hash is the user handle, discoverable credentials hand it back on login
+	options, err := json.Marshal(relyingParty().CreationOptions(challenge, []byte(req.LookupHash), req.LookupHash,
+		webAuthnCredentialIds(registered), c.EnvWebAuthnChallengeTtl))
+	if err != nil {
+		return &pb.WebAuthnOptionsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.WebAuthnOptionsResponse{Error: "", Options: string(options)}, nil
+}
+
+func (service *AuthServiceServer) FinishWebAuthnRegistration(ctx context.Context, req *pb.FinishWebAuthnRegistrationRequest) (*pb.WebAuthnRegistrationResponse, error) {
+	realmId := realmOrDefault(req.Realm)
+
+	challenge, err := consumeWebAuthn(realmId, req.ClientDataJSON, webAuthnRegistration)
+	if err == nil && challenge.LookupHash != req.LookupHash {
+		err = errInvalidWebAuthnChallenge
+	}
+	if err != nil {
+		return &pb.WebAuthnRegistrationResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	credential, err := relyingParty().VerifyRegistration(challenge.challenge, req.ClientDataJSON, req.AttestationObject)
+	if err != nil {
+		return &pb.WebAuthnRegistrationResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	err = db.CreateWebAuthnCredential(m.WebAuthnCredentialDTO{
+		CredentialId: credential.ID,
+		RealmId:      realmId,
+		LookupHash:   req.LookupHash,
+		PublicKey:    credential.PublicKey,
+		SignCount:    credential.SignCount,
+		Name:         req.Name,
+	})
+	if err != nil {
+		return &pb.WebAuthnRegistrationResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.WebAuthnRegistrationResponse{Error: "", CredentialId: credential.ID}, nil
+}
+
+/**
+ * Start a passkey login, for any discoverable credential of the realm if no lookup hash is given
+ */
+func (service *AuthServiceServer) BeginWebAuthnLogin(ctx context.Context, req *pb.BeginWebAuthnLoginRequest) (*pb.WebAuthnOptionsResponse, error) {
+	realmId := realmOrDefault(req.Realm)
+
+	var allowed [][]byte
+	if req.LookupHash != "" {
+		registered, err := db.GetWebAuthnCredentials(realmId, req.LookupHash)
+		if err == nil && len(registered) == 0 {
+			err = fmt.Errorf("no passkey registered")
+		}
+		if err != nil {
+			return &pb.WebAuthnOptionsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+		}
+		allowed = webAuthnCredentialIds(registered)
+	}
+
+	challenge, err := startWebAuthn(realmId, req.LookupHash, webAuthnLogin)
+	if err != nil {
+		return &pb.WebAuthnOptionsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	options, err := json.Marshal(relyingParty().RequestOptions(challenge, allowed, c.EnvWebAuthnChallengeTtl))
+	if err != nil {
+		return &pb.WebAuthnOptionsResponse{Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	return &pb.WebAuthnOptionsResponse{Error: "", Options: string(options)}, nil
+}
+
+/**
+ * Issue the token of GrantAuth for a valid assertion
+ * A passkey with user verification is a second factor of its own, a mere tap of one
+ * (WEBAUTHN_USER_VERIFICATION=preferred) goes through CompleteMFA like a password
+ */
+func (service *AuthServiceServer) FinishWebAuthnLogin(ctx context.Context, req *pb.FinishWebAuthnLoginRequest) (*pb.AuthResponse, error) {
+	err := checkCustomClaims(req.Claims)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	realm, keys, err := resolveRealm(req.Realm)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	// Out of range lifetimes are rejected before the challenge is used up
+	_, err = realmTokenTtl(realm, req.Ttl)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	challenge, err := consumeWebAuthn(realm.Id, req.ClientDataJSON, webAuthnLogin)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	credential, err := db.GetWebAuthnCredential(realm.Id, req.CredentialId)
+	if err == nil && challenge.LookupHash != "" && challenge.LookupHash != credential.LookupHash {
+		err = errInvalidWebAuthnChallenge
+	}
+	if err == nil && len(req.UserHandle) > 0 && !bytes.Equal(req.UserHandle, []byte(credential.LookupHash)) {
+		err = fmt.Errorf("user handle does not match the credential")
+	}
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	assertion, err := relyingParty().VerifyAssertion(challenge.challenge, webauthn.Credential{
+		ID:        credential.CredentialId,
+		PublicKey: credential.PublicKey,
+		SignCount: credential.SignCount,
+	}, req.ClientDataJSON, req.AuthenticatorData, req.Signature)
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	// Concurrent logins with the same sign count race for it, only one gets it
+	updated, err := db.UpdateWebAuthnSignCount(realm.Id, credential.CredentialId, credential.SignCount, assertion.SignCount)
+	if err == nil && !updated {
+		err = fmt.Errorf("sign count did not increase, the authenticator may be cloned")
+	}
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	credentialsStatus, err := db.GetCredentialsStatus(realm.Id, credential.LookupHash)
+	if err == nil {
+		err = checkAccountStatus(credentialsStatus.Status)
+	}
+	if err != nil {
+		return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+	}
+
+	grant := m.GrantDTO{
+		LookupHash: credential.LookupHash,
+		Id:         req.Id,
+		Ttl:        req.Ttl,
+		Audience:   req.Audience,
+		Claims:     req.Claims,
+		Client:     clientFromPb(ctx, req.Client),
+	}
+
+	if !assertion.UserVerified() {
+		mfaResponse, err := startMFA(realm, grant)
+		if err != nil {
+			return &pb.AuthResponse{Id: 0, Token: "", Error: strings.ToValidUTF8(err.Error(), "UTF-8_BUGFIX")}, nil
+		}
+		if mfaResponse != nil {
+			return mfaResponse, nil
+		}
+	}
+
+	return grantToken(realm, keys, grant, credentialsStatus), nil
+}
+
+type webAuthnChallenge struct {
+	m.WebAuthnChallengeDTO
+	challenge string
+}
+
+func relyingParty() webauthn.RelyingParty {
+	return webauthn.RelyingParty{
+		ID:                      c.EnvWebAuthnRPID,
+		Name:                    c.EnvWebAuthnRPName,
+		Origins:                 c.EnvWebAuthnOrigins,
+		RequireUserVerification: c.EnvWebAuthnRequireUserVerification,
+	}
+}
+
+func startWebAuthn(realmId string, lookupHash string, ceremony string) (string, error) {
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	err = db.CreateWebAuthnChallenge(m.WebAuthnChallengeDTO{
+		ChallengeHash: webAuthnChallengeHash(challenge),
+		RealmId:       realmId,
+		LookupHash:    lookupHash,
+		Ceremony:      ceremony,
+		ExpiresAt:     time.Now().Add(c.EnvWebAuthnChallengeTtl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, nil
+}
+
+/**
+ * Use up the ceremony the client data answers, whether or not the response turns out valid
+ */
+func consumeWebAuthn(realmId string, clientDataJSON []byte, ceremony string) (webAuthnChallenge, error) {
+
+	challenge, err := webauthn.Challenge(clientDataJSON)
+	if err != nil {
+		return webAuthnChallenge{}, err
+	}
+
+	stored, err := db.ConsumeWebAuthnChallenge(realmId, webAuthnChallengeHash(challenge), ceremony)
+	if err != nil {
+		return webAuthnChallenge{}, err
+	}
+
+	return webAuthnChallenge{WebAuthnChallengeDTO: stored, challenge: challenge}, nil
+}
+
+func webAuthnCredentialIds(credentials []m.WebAuthnCredentialDTO) [][]byte {
+
+	credentialIds := make([][]byte, 0, len(credentials))
+	for _, credential := range credentials {
+		credentialIds = append(credentialIds, credential.CredentialId)
+	}
+
+	return credentialIds
+}
+
+func webAuthnChallengeHash(challenge string) string {
+	digest := sha256.Sum256([]byte(challenge))
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"simple-micro-auth/src/breach"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBreachedPasswords(t *testing.T) {
+
+	// Large enough for the binary search to take several steps before scanning
+	lines := []string{}
+	for i := 1; i <= 5000; i++ {
+		digest := sha1.Sum([]byte(fmt.Sprintf("breached-%d", i)))
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(digest[:])), i))
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned-passwords-sha1.txt")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corpus, err := breach.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer corpus.Close()
+
+	for _, i := range []int{1, 2, 777, 2500, 4999, 5000} {
+		count, err := corpus.Count(fmt.Sprintf("breached-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != i {
+			t.Errorf("count of breached-%d is %d, want %d", i, count, i)
+		}
+	}
+
+	for _, password := range []string{"breached-0", "breached-5001", "Tr0ub4dor&3x!", "ÄÖÜ"} {
+		count, err := corpus.Count(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("%q is not breached but counted %d times", password, count)
+		}
+	}
+
+	// Sorted hashes around the well known NTLM hash of "password"
+	path = filepath.Join(t.TempDir(), "pwned-passwords-ntlm.txt")
+	err = os.WriteFile(path, []byte("0000000A0A0A0A0A0A0A0A0A0A0A0A0A:3\n"+
+		"8846F7EAEE8FB117AD06BDD830B7586C:9545824\n"+
+		"FFFFFFF1F1F1F1F1F1F1F1F1F1F1F1F1:1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corpus, err = breach.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer corpus.Close()
+
+	count, err := corpus.Count("password")
+	if err != nil || count != 9545824 {
+		t.Errorf("NTLM count of password is %d, %v", count, err)
+	}
+
+	count, err = corpus.Count("Password")
+	if err != nil || count != 0 {
+		t.Errorf("NTLM count of Password is %d, %v", count, err)
+	}
+
+	path = filepath.Join(t.TempDir(), "not-pwned-passwords.txt")
+	err = os.WriteFile(path, []byte("password\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = breach.Open(path)
+	if err == nil {
+		t.Error("file without hashes must not open")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"simple-micro-auth/src/cert"
 	m "simple-micro-auth/src/models"
 	s "simple-micro-auth/src/services"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -95,3 +97,260 @@ func TestUpdateCredentials(t *testing.T) {
 		t.Errorf("expected error: %s, got: %s", "something", err.Error())
 	}
 }
+
+func TestPasswordHistory(t *testing.T) {
+	db.FlushDB()
+
+	err := db.CreateCredentials(m.CredentialsDTO{
+		LookupHash: "test",
+		Password:   "first",
+	})
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	update := func(oldPassword string, newPassword string) error {
+		return db.UpdateCredentials(m.CredentialsDTOUpdate{
+			LookupHash:  "test",
+			OldPassword: oldPassword,
+			NewPassword: newPassword,
+			HistorySize: 3,
+		})
+	}
+
+	// The current password counts as part of the history
+	err = update("first", "first")
+	if err == nil || err.Error() != "password was used before" {
+		t.Errorf("expected error: %s, got: %v", "password was used before", err)
+	}
+
+	for _, passwords := range [][2]string{{"first", "second"}, {"second", "third"}} {
+		err = update(passwords[0], passwords[1])
+		if err != nil {
+			t.Fatalf("expected error to be empty, got: %s", err.Error())
+		}
+	}
+
+	err = update("third", "first")
+	if err == nil || err.Error() != "password was used before" {
+		t.Errorf("expected error: %s, got: %v", "password was used before", err)
+	}
+
+	// first drops out of the history of 3 once fourth is set
+	err = update("third", "fourth")
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	err = update("fourth", "first")
+	if err != nil {
+		t.Errorf("expected error to be empty, got: %s", err.Error())
+	}
+
+	// Without a history size the same password may be set again
+	err = db.UpdateCredentials(m.CredentialsDTOUpdate{
+		LookupHash:  "test",
+		OldPassword: "first",
+		NewPassword: "first",
+	})
+	if err != nil {
+		t.Errorf("expected error to be empty, got: %s", err.Error())
+	}
+}
+
+func TestRoles(t *testing.T) {
+	db.FlushDB()
+
+	err := db.CreateCredentials(m.CredentialsDTO{
+		LookupHash: "test",
+		Password:   "test",
+	})
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	// Test case 1: scopes of assigned roles
+	err = db.SetRole(s.DefaultRealm, m.RoleDTO{Name: "reader", Scopes: []string{"orders:read", "users:read"}})
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	err = db.SetRole(s.DefaultRealm, m.RoleDTO{Name: "writer", Scopes: []string{"orders:read", "orders:write"}})
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	for _, role := range []string{"reader", "writer"} {
+		err = db.AssignRole(s.DefaultRealm, "test", role)
+		if err != nil {
+			t.Fatalf("expected error to be empty, got: %s", err.Error())
+		}
+	}
+
+	scopes, err := db.GetScopes(s.DefaultRealm, "test")
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	if strings.Join(scopes, " ") != "orders:read orders:write users:read" {
+		t.Errorf("expected scopes: %s, got: %v", "orders:read orders:write users:read", scopes)
+	}
+
+	// Test case 2: replacing scopes of a role
+	err = db.SetRole(s.DefaultRealm, m.RoleDTO{Name: "writer", Scopes: []string{"orders:write"}})
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	roles, err := db.GetRoles(s.DefaultRealm, "test")
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	if len(roles) != 2 || roles[1].Name != "writer" || strings.Join(roles[1].Scopes, " ") != "orders:write" {
+		t.Errorf("expected roles reader and writer, got: %v", roles)
+	}
+
+	// Test case 3: unknown credentials and roles
+	err = db.AssignRole(s.DefaultRealm, "unknown", "reader")
+	if err == nil || err.Error() != "lookupHash not found" {
+		t.Errorf("expected error: %s, got: %v", "lookupHash not found", err)
+	}
+
+	err = db.AssignRole(s.DefaultRealm, "test", "unknown")
+	if err == nil || err.Error() != "role not found" {
+		t.Errorf("expected error: %s, got: %v", "role not found", err)
+	}
+
+	// Test case 4: unassigned and deleted roles grant nothing
+	err = db.UnassignRole(s.DefaultRealm, "test", "reader")
+	if err != nil {
+		t.Errorf("expected error to be empty, got: %s", err.Error())
+	}
+
+	err = db.DeleteRole(s.DefaultRealm, "writer")
+	if err != nil {
+		t.Errorf("expected error to be empty, got: %s", err.Error())
+	}
+
+	scopes, err = db.GetScopes(s.DefaultRealm, "test")
+	if err != nil || len(scopes) != 0 {
+		t.Errorf("expected no scopes, got: %v, %v", scopes, err)
+	}
+}
+
+func TestRealms(t *testing.T) {
+	db.FlushDB()
+
+	// Test case 1: realms are created once
+	err := db.CreateRealm(m.RealmDTO{Id: "acme", TokenTtl: time.Hour})
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	err = db.CreateRealm(m.RealmDTO{Id: "acme"})
+	if err == nil || err.Error() != "realm already exists" {
+		t.Errorf("expected error: %s, got: %v", "realm already exists", err)
+	}
+
+	realm, err := db.GetRealm("acme")
+	if err != nil || realm.TokenTtl != time.Hour {
+		t.Errorf("expected realm with token ttl: %v, got: %v, %v", time.Hour, realm, err)
+	}
+
+	// Test case 2: credentials and roles are isolated between realms
+	for realmId, password := range map[string]string{s.DefaultRealm: "default", "acme": "acme"} {
+		err = db.CreateCredentials(m.CredentialsDTO{RealmId: realmId, LookupHash: "test", Password: password})
+		if err != nil {
+			t.Fatalf("expected error to be empty, got: %s", err.Error())
+		}
+	}
+
+	err = db.VerifyCredentials(m.CredentialsDTO{RealmId: "acme", LookupHash: "test", Password: "default"})
+	if err == nil || err.Error() != "invalid password" {
+		t.Errorf("expected error: %s, got: %v", "invalid password", err)
+	}
+
+	err = db.VerifyCredentials(m.CredentialsDTO{RealmId: "acme", LookupHash: "test", Password: "acme"})
+	if err != nil {
+		t.Errorf("expected error to be empty, got: %s", err.Error())
+	}
+
+	err = db.SetRole("acme", m.RoleDTO{Name: "reader", Scopes: []string{"orders:read"}})
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	err = db.AssignRole(s.DefaultRealm, "test", "reader")
+	if err == nil || err.Error() != "role not found" {
+		t.Errorf("expected error: %s, got: %v", "role not found", err)
+	}
+
+	roles, err := db.GetRoles("acme", "")
+	if err != nil || len(roles) != 2 || roles[0].Name != "admin" || roles[1].Name != "reader" {
+		t.Errorf("expected roles admin and reader, got: %v, %v", roles, err)
+	}
+
+	// Test case 3: deleting a realm deletes its credentials
+	err = db.DeleteRealm("acme")
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	_, err = db.GetRealm("acme")
+	if err == nil || err.Error() != "realm not found" {
+		t.Errorf("expected error: %s, got: %v", "realm not found", err)
+	}
+
+	err = db.VerifyCredentials(m.CredentialsDTO{RealmId: s.DefaultRealm, LookupHash: "test", Password: "default"})
+	if err != nil {
+		t.Errorf("expected error to be empty, got: %s", err.Error())
+	}
+
+	err = db.VerifyCredentials(m.CredentialsDTO{RealmId: "acme", LookupHash: "test", Password: "acme"})
+	if err == nil {
+		t.Errorf("expected error: %s, got: %v", "lookupHash not found", err)
+	}
+}
+
+func TestDeleteEndedSessions(t *testing.T) {
+	db.FlushDB()
+
+	for _, lookupHash := range []string{"test", "other"} {
+		err := db.CreateCredentials(m.CredentialsDTO{LookupHash: lookupHash, Password: "test"})
+		if err != nil {
+			t.Fatalf("expected error to be empty, got: %s", err.Error())
+		}
+
+		err = db.CreateSession(m.SessionDTO{SessionId: lookupHash, LookupHash: lookupHash})
+		if err != nil {
+			t.Fatalf("expected error to be empty, got: %s", err.Error())
+		}
+	}
+
+	// Test case 1: without a session policy sessions are kept as long as tokens may live
+	err := db.DeleteEndedSessions(s.DefaultRealm, "test", m.SessionPolicy{}, time.Hour)
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	sessions, err := db.GetSessions(s.DefaultRealm, "test")
+	if err != nil || len(sessions) != 1 {
+		t.Errorf("expected 1 session, got: %v, %v", sessions, err)
+	}
+
+	// Test case 2: sessions of the realm unused for longer are purged, not only those of the credentials
+	time.Sleep(50 * time.Millisecond)
+
+	err = db.DeleteEndedSessions(s.DefaultRealm, "test", m.SessionPolicy{}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("expected error to be empty, got: %s", err.Error())
+	}
+
+	for _, lookupHash := range []string{"test", "other"} {
+		sessions, err = db.GetSessions(s.DefaultRealm, lookupHash)
+		if err != nil || len(sessions) != 0 {
+			t.Errorf("expected no sessions of %s, got: %v, %v", lookupHash, sessions, err)
+		}
+	}
+}
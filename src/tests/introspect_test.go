@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	m "simple-micro-auth/src/models"
+	s "simple-micro-auth/src/services"
+	"strings"
+	"testing"
+	"time"
+)
+
+func introspectRequest(form url.Values, clientId string, clientSecret string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/introspect", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientId != "" {
+		request.SetBasicAuth(clientId, clientSecret)
+	}
+
+	recorder := httptest.NewRecorder()
+	s.IntrospectionHandler(recorder, request)
+
+	return recorder
+}
+
+func TestIntrospection(t *testing.T) {
+	db.FlushDB()
+
+	clients := c.EnvIntrospectionClients
+	c.EnvIntrospectionClients = map[string]string{"gateway": "secret"}
+	defer func() { c.EnvIntrospectionClients = clients }()
+
+	token, err := tokenHandler.CreateToken(m.TokenDTO{
+		Id:        mockId,
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Audience:  []string{"orders"},
+	}, cert.Keys.Active().Signer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Test case 1: active token
+	recorder := introspectRequest(url.Values{"token": {token}}, "gateway", "secret")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status: %d, got: %d", http.StatusOK, recorder.Code)
+	}
+
+	var response map[string]interface{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if response["active"] != true || response["sub"] != "123" || response["jti"] == nil || response["exp"] == nil {
+		t.Errorf("expected active token of subject 123, got: %v", response)
+	}
+
+	// Test case 2: client credentials as form parameters
+	recorder = introspectRequest(url.Values{"token": {token}, "client_id": {"gateway"}, "client_secret": {"secret"}}, "", "")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status: %d, got: %d", http.StatusOK, recorder.Code)
+	}
+
+	// Test case 3: unknown client or wrong secret
+	for _, secret := range []string{"wrong", ""} {
+		recorder = introspectRequest(url.Values{"token": {token}}, "gateway", secret)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("expected status: %d, got: %d", http.StatusUnauthorized, recorder.Code)
+		}
+	}
+
+	recorder = introspectRequest(url.Values{"token": {token}}, "", "")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected status: %d, got: %d", http.StatusUnauthorized, recorder.Code)
+	}
+
+	// Test case 4: missing token
+	recorder = introspectRequest(url.Values{}, "gateway", "secret")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected status: %d, got: %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	// Test case 5: invalid and revoked tokens are inactive
+	recorder = introspectRequest(url.Values{"token": {"not-a-token"}}, "gateway", "secret")
+	if recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != `{"active":false}` {
+		t.Errorf("expected inactive token, got: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	claims, err := tokenHandler.VerifyClaims(token, time.Now().Unix(), cert.Keys, "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = db.RevokeToken(claims["jti"].(string), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	recorder = introspectRequest(url.Values{"token": {token}}, "gateway", "secret")
+	if recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != `{"active":false}` {
+		t.Errorf("expected inactive token, got: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Test case 6: only POST is allowed
+	recorder = httptest.NewRecorder()
+	s.IntrospectionHandler(recorder, httptest.NewRequest(http.MethodGet, "/introspect", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status: %d, got: %d", http.StatusMethodNotAllowed, recorder.Code)
+	}
+}
@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"simple-micro-auth/src/cert"
+	m "simple-micro-auth/src/models"
+	"testing"
+	"time"
+)
+
+func TestKeyRotation(t *testing.T) {
+
+	oldPrivateKey, err := cert.GenerateKey("RS256")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	oldKey, err := cert.NewKey(oldPrivateKey, "RS256")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	newPrivateKey, err := cert.GenerateKey("EdDSA")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	newKey, err := cert.NewKey(newPrivateKey, "EdDSA")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	keys := cert.NewKeySet(oldKey)
+
+	oldToken, err := tokenHandler.CreateToken(mockToken, keys.Active().Signer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Test case 1: token of the retired key still verifies after rotation
+	keys.Replace(newKey, []cert.Key{{ID: oldKey.ID, Algorithm: oldKey.Algorithm, PublicKey: oldKey.PublicKey}})
+
+	id, err := tokenHandler.VerifyToken(oldToken, mockTimeNow, keys)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if id != mockId {
+		t.Errorf("Expected ID: %d, got: %d", mockId, id)
+	}
+
+	newToken, err := tokenHandler.CreateToken(mockToken, keys.Active().Signer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = tokenHandler.VerifyToken(newToken, mockTimeNow, keys)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Test case 2: token of a dropped key is rejected
+	keys.Replace(newKey, nil)
+
+	_, err = tokenHandler.VerifyToken(oldToken, mockTimeNow, keys)
+	if err == nil {
+		t.Errorf("expected token of dropped key to be rejected")
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+
+	masterKey, err := cert.ParseMasterKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ciphertext, err := cert.Encrypt([]byte("secret"), masterKey, []byte("kid"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Test case 1: same master key and associated data
+	plaintext, err := cert.Decrypt(ciphertext, masterKey, []byte("kid"))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if string(plaintext) != "secret" {
+		t.Errorf("expected plaintext: %s, got: %s", "secret", plaintext)
+	}
+
+	// Test case 2: ciphertext moved to another key id
+	_, err = cert.Decrypt(ciphertext, masterKey, []byte("other-kid"))
+	if err == nil {
+		t.Errorf("expected error decrypting with other associated data")
+	}
+
+	// Test case 3: invalid master key
+	_, err = cert.ParseMasterKey("c2hvcnQ=")
+	if err == nil {
+		t.Errorf("expected error for short master key")
+	}
+}
+
+func TestSigningKeyStore(t *testing.T) {
+
+	target := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	generated := 0
+
+	generate := func() (m.SigningKeyDTO, error) {
+		generated++
+
+		privateKey, err := cert.GenerateKey("ES256")
+		if err != nil {
+			return m.SigningKeyDTO{}, err
+		}
+		kid, err := cert.KeyID(privateKey.Public())
+		if err != nil {
+			return m.SigningKeyDTO{}, err
+		}
+		publicKeyBytes, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+		if err != nil {
+			return m.SigningKeyDTO{}, err
+		}
+
+		return m.SigningKeyDTO{Kid: kid, Algorithm: "ES256", PrivateKey: []byte("encrypted"), PublicKey: publicKeyBytes}, nil
+	}
+
+	// Test case 1: key is generated once
+	for i := 0; i < 3; i++ {
+		err := db.EnsureSigningKey(target, "ES256", time.Hour, time.Minute, generate)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if generated != 1 {
+		t.Errorf("expected 1 generated key, got: %d", generated)
+	}
+
+	keys, err := db.GetSigningKeys(target, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 stored key, got: %d", len(keys))
+	}
+
+	// Test case 2: rotation keeps the previous key for verification
+	err = db.EnsureSigningKey(target, "ES256", time.Nanosecond, time.Minute, generate)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rotatedKeys, err := db.GetSigningKeys(target, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rotatedKeys) != 2 {
+		t.Fatalf("expected 2 stored keys, got: %d", len(rotatedKeys))
+	}
+
+	if !bytes.Equal(rotatedKeys[1].PublicKey, keys[0].PublicKey) {
+		t.Errorf("expected previous key to come second")
+	}
+
+	if !rotatedKeys[0].ActivatesAt.After(time.Now()) {
+		t.Errorf("expected rotated key to activate after publish delay")
+	}
+}
+
+func TestJWK(t *testing.T) {
+
+	for _, algorithm := range []string{"RS256", "ES256", "ES384", "EdDSA"} {
+
+		privateKey, err := cert.GenerateKey(algorithm)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		key, err := cert.NewKey(privateKey, algorithm)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		jwk, err := cert.PublicJWK(key)
+		if err != nil {
+			t.Fatalf("unexpected error encoding %s jwk: %v", algorithm, err)
+		}
+
+		if jwk.Kid != key.ID || jwk.Alg != algorithm {
+			t.Errorf("expected kid %s and alg %s, got: %s and %s", key.ID, algorithm, jwk.Kid, jwk.Alg)
+		}
+
+		publicKey, err := cert.ParseJWK(jwk)
+		if err != nil {
+			t.Fatalf("unexpected error decoding %s jwk: %v", algorithm, err)
+		}
+
+		kid, err := cert.KeyID(publicKey)
+		if err != nil || kid != key.ID {
+			t.Errorf("expected decoded %s jwk to match the key", algorithm)
+		}
+	}
+
+	// Unregistered targets are unknown
+	_, ok := cert.LookupTarget("../token")
+	if ok {
+		t.Errorf("expected unregistered target to be unknown")
+	}
+
+	keys, ok := cert.LookupTarget("token")
+	if !ok || keys != cert.Keys {
+		t.Errorf("expected token target to serve token keys")
+	}
+}
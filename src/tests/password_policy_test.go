@@ -0,0 +1,65 @@
+package tests
+
+import (
+	m "simple-micro-auth/src/models"
+	s "simple-micro-auth/src/services"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+
+	policy := m.PasswordPolicy{
+		MinLength:          10,
+		MaxLength:          20,
+		RequireUppercase:   true,
+		RequireLowercase:   true,
+		RequireDigit:       true,
+		RequireSymbol:      true,
+		MaxRepeated:        2,
+		MinStrength:        3,
+		DisallowLookupHash: true,
+	}
+
+	testCases := []struct {
+		password string
+		codes    []string
+	}{
+		{"Correct-Horse-9-Battery", []string{"too_long"}},
+		{"Tr0ub4dor&3x!", []string{}},
+		{"", []string{"too_short", "missing_uppercase", "missing_lowercase", "missing_digit", "missing_symbol"}},
+		{"short1A!", []string{"too_short", "too_weak"}},
+		{"aaaBBB111!!!", []string{"too_many_repeated", "too_weak"}},
+		{"Xj9!alice@example", []string{"contains_lookup_hash", "too_weak"}},
+		{"Password123!", []string{"too_weak"}},
+	}
+
+	for _, testCase := range testCases {
+		violations := s.CheckPassword(policy, "password", testCase.password, "alice")
+
+		codes := map[string]bool{}
+		for _, violation := range violations {
+			codes[violation.Code] = true
+
+			if violation.Field != "password" || violation.Message == "" {
+				t.Errorf("expected field password with a message, got: %v", violation)
+			}
+		}
+
+		for _, code := range testCase.codes {
+			if !codes[code] {
+				t.Errorf("expected %s to violate %s, got: %v", testCase.password, code, violations)
+			}
+		}
+
+		if len(codes) != len(testCase.codes) {
+			t.Errorf("expected %s to violate %v, got: %v", testCase.password, testCase.codes, violations)
+		}
+	}
+
+	// Bytes count for bcrypt even if characters are within the limit
+	violations := s.CheckPassword(m.PasswordPolicy{MinLength: 1, MaxLength: 72}, "password", strings.Repeat("ä", 40), "")
+	if len(violations) != 1 || violations[0].Code != "too_long" {
+		t.Errorf("expected too_long for more than 72 bytes, got: %v", violations)
+	}
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"simple-micro-auth/src/sender"
+	"strings"
+	"testing"
+	"time"
+
+	c "simple-micro-auth/src/configs"
+)
+
+func TestSenders(t *testing.T) {
+
+	message := sender.Message{
+		Destination: "user@example.com",
+		Channel:     "code",
+		Code:        "123456",
+		ExpiresAt:   time.Now().Add(10 * time.Minute),
+	}
+
+	// File sender, one JSON line per message
+	path := t.TempDir() + "/messages.jsonl"
+	fileSender := sender.NewFileSender(path)
+	for i := 0; i < 2; i++ {
+		err := fileSender.Send(message)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read messages: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 messages, got: %d", len(lines))
+	}
+
+	var written sender.Message
+	err = json.Unmarshal([]byte(lines[1]), &written)
+	if err != nil || written.Destination != message.Destination || written.Code != message.Code {
+		t.Errorf("expected message: %v, got: %v, %v", message, written, err)
+	}
+
+	// Webhook sender, signed with the secret
+	var received sender.Message
+	var signature string
+	var body []byte
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get(sender.SignatureHeader)
+		json.Unmarshal(body, &received)
+		if received.Destination == "fail@example.com" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer webhook.Close()
+
+	err = sender.NewWebhookSender(webhook.URL, "secret").Send(message)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	if signature != hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("expected valid signature, got: %s", signature)
+	}
+
+	if received.Code != message.Code || received.Channel != message.Channel {
+		t.Errorf("expected message: %v, got: %v", message, received)
+	}
+
+	failing := message
+	failing.Destination = "fail@example.com"
+	err = sender.NewWebhookSender(webhook.URL, "secret").Send(failing)
+	if err == nil || err.Error() != "webhook responded with status 502" {
+		t.Errorf("expected error: %s, got: %v", "webhook responded with status 502", err)
+	}
+
+	// A destination with a line break would add headers to the email
+	injected := message
+	injected.Destination = "user@example.com\r\nBcc: attacker@example.com"
+	err = sender.NewSMTPSender(c.SMTPConfig{Host: "127.0.0.1", Port: "1", From: "auth@example.com"}).Send(injected)
+	if err == nil || err.Error() != "invalid destination" {
+		t.Errorf("expected error: %s, got: %v", "invalid destination", err)
+	}
+}
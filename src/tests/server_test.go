@@ -3,18 +3,40 @@ package tests
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
 	"simple-micro-auth/src/cert"
 	c "simple-micro-auth/src/configs"
+	"simple-micro-auth/src/sender"
 	"simple-micro-auth/src/server"
+	s "simple-micro-auth/src/services"
+	"simple-micro-auth/src/totp"
+	"simple-micro-auth/src/webauthn"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	pb "simple-micro-auth/src/proto"
 
+	"github.com/golang-jwt/jwt/v5"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestMain(t *testing.T) {
@@ -67,6 +89,20 @@ func TestMain(t *testing.T) {
 		t.Errorf("expected token: %s, got: %s", "token", authRes.Token)
 	}
 
+	// Passwords violating the policy are reported per field
+	emptyPasswordRes, err := client.CreateAuth(context.Background(), &pb.AuthRequest{
+		Id:         124,
+		LookupHash: "empty",
+		Password:   "",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if emptyPasswordRes.Token != "" || len(emptyPasswordRes.FieldErrors) == 0 || emptyPasswordRes.FieldErrors[0].Code != "too_short" {
+		t.Errorf("expected field error: %s, got: %v", "too_short", emptyPasswordRes)
+	}
+
 	// Test 3: Update request
 	updateAuthReq := &pb.UpdateAuthRequest{
 		Id:          123,
@@ -190,40 +226,1540 @@ func TestMain(t *testing.T) {
 		t.Errorf("expected token: %s, got: %s", "token", verifyTokenRes.Token)
 	}
 
+	if verifyTokenRes.Claims.AsMap()["sub"] != fmt.Sprint(grantAuthRes.Id) {
+		t.Errorf("expected sub claim: %d, got: %v", grantAuthRes.Id, verifyTokenRes.Claims.AsMap()["sub"])
+	}
+
+	if verifyTokenRes.TokenClaims.Subject != fmt.Sprint(grantAuthRes.Id) || verifyTokenRes.TokenClaims.ExpiresAt <= time.Now().Unix() {
+		t.Errorf("expected subject: %d and a future expiry, got: %v", grantAuthRes.Id, verifyTokenRes.TokenClaims)
+	}
+
 	if verifyTokenRes.Error != "" {
 		t.Errorf("expected error: %s, got: %s", "", verifyTokenRes.Error)
 	}
 
-	// Test 8: Delete auth
-	deleteAuthReq := &pb.DeleteAuthRequest{
+	// Test 8: Revoke token
+	revokeTokenRes, err := client.RevokeToken(context.Background(), &pb.RevokeTokenRequest{Token: refreshTokenRes.Token})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if revokeTokenRes.Error != "" {
+		t.Errorf("expected error: %s, got: %s", "", revokeTokenRes.Error)
+	}
+
+	verifyTokenRes, err = client.VerifyToken(context.Background(), verifyTokenReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if verifyTokenRes.Error != "token revoked" {
+		t.Errorf("expected error: %s, got: %s", "token revoked", verifyTokenRes.Error)
+	}
+
+	refreshTokenRes, err = client.RefreshToken(context.Background(), &pb.RefreshTokenRequest{Token: refreshTokenRes.Token})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if refreshTokenRes.Error != "TokenError: token revoked" {
+		t.Errorf("expected error: %s, got: %s", "TokenError: token revoked", refreshTokenRes.Error)
+	}
+
+	// Test 9: Roles and permissions
+	adminLookupHashes := c.EnvAdminLookupHashes
+	c.EnvAdminLookupHashes = []string{"test"}
+
+	adminAuthRes, err := client.GrantAuth(context.Background(), grantAuthReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Credentials which are admins by their lookup hash can not be replaced without an admin token
+	_, err = client.DeleteAuth(context.Background(), &pb.DeleteAuthRequest{LookupHash: "test"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected unauthenticated without token, got: %v", err)
+	}
+
+	_, err = client.CreateAuth(context.Background(), &pb.AuthRequest{LookupHash: "test", Password: "other"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected unauthenticated without token, got: %v", err)
+	}
+
+	c.EnvAdminLookupHashes = adminLookupHashes
+
+	_, err = client.SetRole(context.Background(), &pb.SetRoleRequest{Name: "reader", Scopes: []string{"orders:read"}})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected unauthenticated without token, got: %v", err)
+	}
+
+	nonAdminCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+grantAuthRes.Token)
+
+	_, err = client.SetRole(nonAdminCtx, &pb.SetRoleRequest{Name: "reader", Scopes: []string{"orders:read"}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected permission denied without admin scope, got: %v", err)
+	}
+
+	adminCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+adminAuthRes.Token)
+
+	roleRes, err := client.SetRole(adminCtx, &pb.SetRoleRequest{Name: "reader", Scopes: []string{"orders:read"}})
+	if err != nil || roleRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, roleRes)
+	}
+
+	roleRes, err = client.AssignRole(adminCtx, &pb.RoleAssignmentRequest{LookupHash: "test", Role: "reader"})
+	if err != nil || roleRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, roleRes)
+	}
+
+	rolesRes, err := client.GetRoles(adminCtx, &pb.GetRolesRequest{LookupHash: "test"})
+	if err != nil || len(rolesRes.Roles) != 1 || rolesRes.Roles[0].Name != "reader" {
+		t.Errorf("expected role: %s, got: %v, %v", "reader", rolesRes, err)
+	}
+
+	readerAuthRes, err := client.GrantAuth(context.Background(), grantAuthReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for permission, allowed := range map[string]bool{"orders:read": true, "orders:write": false} {
+		checkPermissionRes, err := client.CheckPermission(context.Background(), &pb.CheckPermissionRequest{
+			Token:      readerAuthRes.Token,
+			Permission: permission,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if checkPermissionRes.Allowed != allowed {
+			t.Errorf("expected %s allowed: %v, got: %v", permission, allowed, checkPermissionRes.Allowed)
+		}
+	}
+
+	// Test 10: Realms
+	realmRes, err := client.CreateRealm(nonAdminCtx, &pb.CreateRealmRequest{Id: "acme"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected permission denied without admin scope, got: %v, %v", realmRes, err)
+	}
+
+	realmRes, err = client.CreateRealm(adminCtx, &pb.CreateRealmRequest{Id: "acme", TokenTtl: "1h"})
+	if err != nil || realmRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, realmRes)
+	}
+
+	realmAuthRes, err := client.CreateAuth(context.Background(), &pb.AuthRequest{
+		Id:         456,
 		LookupHash: "test",
+		Password:   "acme",
+		Realm:      "acme",
+	})
+	if err != nil || realmAuthRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, realmAuthRes)
 	}
 
-	deleteAuthRes, err := client.DeleteAuth(context.Background(), deleteAuthReq)
+	realmVerifyRes, err := client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: realmAuthRes.Token, Realm: "acme"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if deleteAuthRes.Error != "" {
-		t.Errorf("expected error: %s, got: %s", "", deleteAuthRes.Error)
+	if realmVerifyRes.Error != "" || realmVerifyRes.TokenClaims.Issuer != c.EnvJWTIssuer+"/realms/acme" {
+		t.Errorf("expected issuer: %s, got: %v", c.EnvJWTIssuer+"/realms/acme", realmVerifyRes)
 	}
 
-	// Test 9: Get public key
-	publicKeyRes, err := client.GetPublicKey(context.Background(), &pb.PublicKeyRequest{Target: "token"})
+	if realmVerifyRes.TokenClaims.ExpiresAt > time.Now().Add(time.Hour).Unix() {
+		t.Errorf("expected token to expire within the realm's token ttl, got: %d", realmVerifyRes.TokenClaims.ExpiresAt)
+	}
+
+	// Tokens of one realm are not valid in another
+	realmVerifyRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: realmAuthRes.Token})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	expectedPublicKeyBytes, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if realmVerifyRes.Error == "" {
+		t.Errorf("expected token of realm acme to be rejected by the default realm")
+	}
+
+	realmPublicKeyRes, err := client.GetPublicKey(context.Background(), &pb.PublicKeyRequest{Target: "token", Realm: "acme"})
 	if err != nil {
-		t.Fatalf("could not convert public key: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if !bytes.Equal(expectedPublicKeyBytes, publicKeyRes.PublicKey) {
-		t.Errorf("expected public key: %s, got: %s", expectedPublicKeyBytes, publicKeyRes.PublicKey)
+	if realmPublicKeyRes.KeyId == cert.Keys.Active().ID {
+		t.Errorf("expected realm acme to have its own signing key")
+	}
+
+	// Scopes of the default realm other than auth:admin do not reach into other realms
+	roleRes, err = client.SetRole(adminCtx, &pb.SetRoleRequest{Name: "resetter", Scopes: []string{"auth:password_reset"}})
+	if err == nil && roleRes.Error == "" {
+		roleRes, err = client.AssignRole(adminCtx, &pb.RoleAssignmentRequest{LookupHash: "test", Role: "resetter"})
+	}
+	if err != nil || roleRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, roleRes)
+	}
+
+	resetterAuthRes, err := client.GrantAuth(context.Background(), grantAuthReq)
+	if err != nil || resetterAuthRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, resetterAuthRes)
+	}
+	resetterCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+resetterAuthRes.Token)
+
+	_, err = client.RequestPasswordReset(resetterCtx, &pb.RequestPasswordResetRequest{LookupHash: "acme", Realm: "acme"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected permission denied in another realm, got: %v", err)
+	}
+
+	roleRes, err = client.DeleteRole(adminCtx, &pb.DeleteRoleRequest{Name: "resetter"})
+	if err != nil || roleRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, roleRes)
+	}
+
+	realmRes, err = client.DeleteRealm(adminCtx, &pb.DeleteRealmRequest{Id: "acme"})
+	if err != nil || realmRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, realmRes)
+	}
+
+	realmVerifyRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: realmAuthRes.Token, Realm: "acme"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if realmVerifyRes.Error != "realm not found" {
+		t.Errorf("expected error: %s, got: %s", "realm not found", realmVerifyRes.Error)
+	}
+
+	// Test 11: Forced password change
+	_, err = client.SetMustChangePassword(nonAdminCtx, &pb.SetMustChangePasswordRequest{LookupHash: "test", MustChangePassword: true})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected permission denied without admin scope, got: %v", err)
+	}
+
+	mustChangeRes, err := client.SetMustChangePassword(adminCtx, &pb.SetMustChangePasswordRequest{LookupHash: "test", MustChangePassword: true})
+	if err != nil || mustChangeRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, mustChangeRes)
+	}
+
+	passwordChangeRes, err := client.GrantAuth(context.Background(), grantAuthReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if passwordChangeRes.Error != "password change required" || !passwordChangeRes.PasswordChangeRequired || passwordChangeRes.Token == "" {
+		t.Fatalf("expected password change required with a token, got: %v", passwordChangeRes)
+	}
+
+	// The password change token is good for nothing but UpdateAuth
+	verifyTokenRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: passwordChangeRes.Token})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if verifyTokenRes.Error != "token can only be used to change the password" {
+		t.Errorf("expected error: %s, got: %s", "token can only be used to change the password", verifyTokenRes.Error)
+	}
+
+	passwordChangeReq := &pb.UpdateAuthRequest{
+		Id:                  123,
+		LookupHash:          "test",
+		NewPassword:         "test2",
+		PasswordChangeToken: passwordChangeRes.Token,
+	}
+
+	updAuthRes, err = client.UpdateAuth(context.Background(), passwordChangeReq)
+	if err != nil || updAuthRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, updAuthRes)
+	}
+
+	grantAuthRes, err = client.GrantAuth(context.Background(), &pb.AuthRequest{Id: 123, LookupHash: "test", Password: "test2"})
+	if err != nil || grantAuthRes.Error != "" || grantAuthRes.PasswordChangeRequired {
+		t.Errorf("expected regular token after the password change, got: %v, %v", err, grantAuthRes)
+	}
+
+	passwordChangeReq.NewPassword = "test3"
+	updAuthRes, err = client.UpdateAuth(context.Background(), passwordChangeReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if updAuthRes.Error != "token revoked" {
+		t.Errorf("expected error: %s, got: %s", "token revoked", updAuthRes.Error)
+	}
+
+	// Test 12: Password reset
+	_, err = client.RequestPasswordReset(nonAdminCtx, &pb.RequestPasswordResetRequest{LookupHash: "test"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected permission denied without password reset scope, got: %v", err)
+	}
+
+	resetRes, err := client.RequestPasswordReset(adminCtx, &pb.RequestPasswordResetRequest{LookupHash: "test"})
+	if err != nil || resetRes.Error != "" || resetRes.Token == "" {
+		t.Fatalf("unexpected error: %v, %v", err, resetRes)
+	}
+
+	// A password violating the policy leaves the reset token usable
+	confirmRes, err := client.ConfirmPasswordReset(context.Background(), &pb.ConfirmPasswordResetRequest{Token: resetRes.Token, NewPassword: ""})
+	if err != nil || len(confirmRes.FieldErrors) == 0 {
+		t.Errorf("expected field errors, got: %v, %v", err, confirmRes)
+	}
+
+	confirmRes, err = client.ConfirmPasswordReset(context.Background(), &pb.ConfirmPasswordResetRequest{Token: resetRes.Token, NewPassword: "test4"})
+	if err != nil || confirmRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, confirmRes)
+	}
+
+	confirmRes, err = client.ConfirmPasswordReset(context.Background(), &pb.ConfirmPasswordResetRequest{Token: resetRes.Token, NewPassword: "test5"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if confirmRes.Error != "invalid or expired reset token" {
+		t.Errorf("expected error: %s, got: %s", "invalid or expired reset token", confirmRes.Error)
+	}
+
+	grantAuthRes, err = client.GrantAuth(context.Background(), &pb.AuthRequest{Id: 123, LookupHash: "test", Password: "test4"})
+	if err != nil || grantAuthRes.Error != "" {
+		t.Errorf("expected login with the reset password, got: %v, %v", err, grantAuthRes)
+	}
+
+	_, err = client.SetPassword(nonAdminCtx, &pb.SetPasswordRequest{LookupHash: "test", Password: "test5"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected permission denied without admin scope, got: %v", err)
+	}
+
+	setPasswordRes, err := client.SetPassword(adminCtx, &pb.SetPasswordRequest{LookupHash: "test", Password: "test5", Temporary: true})
+	if err != nil || setPasswordRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, setPasswordRes)
+	}
+
+	grantAuthRes, err = client.GrantAuth(context.Background(), &pb.AuthRequest{Id: 123, LookupHash: "test", Password: "test5"})
+	if err != nil || !grantAuthRes.PasswordChangeRequired {
+		t.Errorf("expected password change required after a temporary password, got: %v, %v", err, grantAuthRes)
+	}
+
+	// Test 13: Account status
+	pendingReq := &pb.AuthRequest{Id: 789, LookupHash: "pending", Password: "pending", Pending: true}
+
+	pendingRes, err := client.CreateAuth(context.Background(), pendingReq)
+	if err != nil || pendingRes.Error != "" || pendingRes.Token != "" {
+		t.Fatalf("expected pending credentials without a token, got: %v, %v", err, pendingRes)
+	}
+
+	pendingRes, err = client.GrantAuth(context.Background(), pendingReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pendingRes.Error != "account pending verification" {
+		t.Errorf("expected error: %s, got: %s", "account pending verification", pendingRes.Error)
+	}
+
+	_, err = client.EnableAuth(nonAdminCtx, &pb.EnableAuthRequest{LookupHash: "pending"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected permission denied without admin scope, got: %v", err)
+	}
+
+	authStatusRes, err := client.EnableAuth(adminCtx, &pb.EnableAuthRequest{LookupHash: "pending"})
+	if err != nil || authStatusRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, authStatusRes)
+	}
+
+	activeRes, err := client.GrantAuth(context.Background(), pendingReq)
+	if err != nil || activeRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, activeRes)
+	}
+
+	authStatusRes, err = client.DisableAuth(adminCtx, &pb.DisableAuthRequest{LookupHash: "pending"})
+	if err != nil || authStatusRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, authStatusRes)
+	}
+
+	// Tokens issued before stop working at once
+	verifyTokenRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: activeRes.Token})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if verifyTokenRes.Error != "account disabled" {
+		t.Errorf("expected error: %s, got: %s", "account disabled", verifyTokenRes.Error)
+	}
+
+	refreshTokenRes, err = client.RefreshToken(context.Background(), &pb.RefreshTokenRequest{Token: activeRes.Token})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if refreshTokenRes.Error != "TokenError: account disabled" {
+		t.Errorf("expected error: %s, got: %s", "TokenError: account disabled", refreshTokenRes.Error)
+	}
+
+	disabledRes, err := client.GrantAuth(context.Background(), pendingReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if disabledRes.Error != "account disabled" {
+		t.Errorf("expected error: %s, got: %s", "account disabled", disabledRes.Error)
+	}
+
+	authStatusRes, err = client.EnableAuth(adminCtx, &pb.EnableAuthRequest{LookupHash: "pending"})
+	if err != nil || authStatusRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, authStatusRes)
+	}
+
+	verifyTokenRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: activeRes.Token})
+	if err != nil || verifyTokenRes.Error != "" {
+		t.Errorf("expected token to work again, got: %v, %v", err, verifyTokenRes)
+	}
+
+	// Test 14: TOTP
+	mfaMasterKey := c.EnvMFAMasterKey
+	c.EnvMFAMasterKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+	enrollRes, err := client.EnrollTOTP(context.Background(), &pb.EnrollTOTPRequest{LookupHash: "pending", Password: "pending"})
+	if err != nil || enrollRes.Error != "" || enrollRes.Uri == "" {
+		t.Fatalf("unexpected error: %v, %v", err, enrollRes)
+	}
+
+	totpSecret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollRes.Secret)
+	if err != nil {
+		t.Fatalf("could not decode totp secret: %v", err)
+	}
+
+	// Until confirmed GrantAuth does not ask for a code
+	activeRes, err = client.GrantAuth(context.Background(), pendingReq)
+	if err != nil || activeRes.Error != "" || activeRes.MfaRequired {
+		t.Errorf("expected token without mfa before confirmation, got: %v, %v", err, activeRes)
+	}
+
+	step := totp.Step(time.Now())
+
+	mfaRes, err := client.ConfirmTOTP(context.Background(), &pb.ConfirmTOTPRequest{LookupHash: "pending", Code: totp.Code(totpSecret, step)})
+	if err != nil || mfaRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, mfaRes)
+	}
+
+	challengeRes, err := client.GrantAuth(context.Background(), pendingReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if challengeRes.Error != "mfa required" || !challengeRes.MfaRequired || challengeRes.MfaChallengeId == "" || challengeRes.Token != "" {
+		t.Fatalf("expected mfa challenge without a token, got: %v", challengeRes)
+	}
+
+	// The code used for the confirmation can not be replayed
+	completeRes, err := client.CompleteMFA(context.Background(), &pb.CompleteMFARequest{ChallengeId: challengeRes.MfaChallengeId, Code: totp.Code(totpSecret, step)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if completeRes.Error != "invalid code" {
+		t.Errorf("expected error: %s, got: %s", "invalid code", completeRes.Error)
+	}
+
+	completeRes, err = client.CompleteMFA(context.Background(), &pb.CompleteMFARequest{ChallengeId: challengeRes.MfaChallengeId, Code: totp.Code(totpSecret, step+1)})
+	if err != nil || completeRes.Error != "" || completeRes.Token == "" || completeRes.Id != pendingReq.Id {
+		t.Fatalf("expected token, got: %v, %v", err, completeRes)
+	}
+
+	completeRes, err = client.CompleteMFA(context.Background(), &pb.CompleteMFARequest{ChallengeId: challengeRes.MfaChallengeId, Code: totp.Code(totpSecret, step+1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if completeRes.Error != "invalid or expired mfa challenge" {
+		t.Errorf("expected error: %s, got: %s", "invalid or expired mfa challenge", completeRes.Error)
+	}
+
+	// Concurrent wrong codes each count against the challenge, only maxMFAAttempts of them are checked
+	challengeRes, err = client.GrantAuth(context.Background(), pendingReq)
+	if err != nil || !challengeRes.MfaRequired {
+		t.Fatalf("expected mfa challenge, got: %v, %v", err, challengeRes)
+	}
+
+	guesses := make([]string, 20)
+	var guessing sync.WaitGroup
+	for i := range guesses {
+		guessing.Add(1)
+		go func(i int) {
+			defer guessing.Done()
+			guessRes, err := client.CompleteMFA(context.Background(), &pb.CompleteMFARequest{ChallengeId: challengeRes.MfaChallengeId, Code: totp.Code(totpSecret, step+100)})
+			if err == nil {
+				guesses[i] = guessRes.Error
+			}
+		}(i)
+	}
+	guessing.Wait()
+
+	checkedGuesses := 0
+	for _, guessError := range guesses {
+		if guessError == "invalid code" {
+			checkedGuesses++
+		} else if guessError != "invalid or expired mfa challenge" {
+			t.Errorf("unexpected error: %s", guessError)
+		}
+	}
+
+	if checkedGuesses != 5 {
+		t.Errorf("expected 5 checked codes, got: %d", checkedGuesses)
+	}
+
+	completeRes, err = client.CompleteMFA(context.Background(), &pb.CompleteMFARequest{ChallengeId: challengeRes.MfaChallengeId, Code: totp.Code(totpSecret, step+2)})
+	if err != nil || completeRes.Error != "invalid or expired mfa challenge" {
+		t.Errorf("expected error: %s, got: %v, %v", "invalid or expired mfa challenge", err, completeRes)
+	}
+
+	// Moving TOTP to another device takes a code of the current one
+	enrollRes, err = client.EnrollTOTP(context.Background(), &pb.EnrollTOTPRequest{LookupHash: "pending", Password: "pending"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if enrollRes.Error != "invalid code" {
+		t.Errorf("expected error: %s, got: %s", "invalid code", enrollRes.Error)
+	}
+
+	// Test 15: MFA recovery codes
+	if len(mfaRes.RecoveryCodes) != 10 {
+		t.Fatalf("expected 10 recovery codes, got: %v", mfaRes.RecoveryCodes)
+	}
+
+	challengeRes, err = client.GrantAuth(context.Background(), pendingReq)
+	if err != nil || !challengeRes.MfaRequired {
+		t.Fatalf("expected mfa challenge, got: %v, %v", err, challengeRes)
+	}
+
+	// Recovery codes are accepted in upper case and without the separator
+	recoveryCode := strings.ToUpper(strings.ReplaceAll(mfaRes.RecoveryCodes[0], "-", ""))
+
+	completeRes, err = client.CompleteMFA(context.Background(), &pb.CompleteMFARequest{ChallengeId: challengeRes.MfaChallengeId, Code: recoveryCode})
+	if err != nil || completeRes.Error != "" || completeRes.Token == "" {
+		t.Fatalf("expected token, got: %v, %v", err, completeRes)
+	}
+
+	if completeRes.RecoveryCodesRemaining != 9 {
+		t.Errorf("expected 9 recovery codes remaining, got: %d", completeRes.RecoveryCodesRemaining)
+	}
+
+	challengeRes, err = client.GrantAuth(context.Background(), pendingReq)
+	if err != nil || !challengeRes.MfaRequired {
+		t.Fatalf("expected mfa challenge, got: %v, %v", err, challengeRes)
+	}
+
+	completeRes, err = client.CompleteMFA(context.Background(), &pb.CompleteMFARequest{ChallengeId: challengeRes.MfaChallengeId, Code: mfaRes.RecoveryCodes[0]})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if completeRes.Error != "invalid code" {
+		t.Errorf("expected error: %s, got: %s", "invalid code", completeRes.Error)
+	}
+
+	regenerateRes, err := client.RegenerateRecoveryCodes(context.Background(), &pb.RegenerateRecoveryCodesRequest{LookupHash: "pending", Password: "pending", Code: mfaRes.RecoveryCodes[1]})
+	if err != nil || regenerateRes.Error != "" || len(regenerateRes.RecoveryCodes) != 10 {
+		t.Fatalf("expected new recovery codes, got: %v, %v", err, regenerateRes)
+	}
+	recoveryCodes := regenerateRes.RecoveryCodes
+
+	// Regenerating drops the old codes
+	regenerateRes, err = client.RegenerateRecoveryCodes(context.Background(), &pb.RegenerateRecoveryCodesRequest{LookupHash: "pending", Password: "pending", Code: mfaRes.RecoveryCodes[2]})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if regenerateRes.Error != "invalid code" {
+		t.Errorf("expected error: %s, got: %s", "invalid code", regenerateRes.Error)
+	}
+
+	c.EnvMFAMasterKey = mfaMasterKey
+
+	// Test 16: Passkeys
+	// With MFA enrolled the password alone does not register a passkey
+	optionsRes, err := client.BeginWebAuthnRegistration(context.Background(), &pb.BeginWebAuthnRegistrationRequest{LookupHash: "pending", Password: "pending"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if optionsRes.Error != "invalid code" {
+		t.Errorf("expected error: %s, got: %s", "invalid code", optionsRes.Error)
+	}
+
+	optionsRes, err = client.BeginWebAuthnRegistration(context.Background(), &pb.BeginWebAuthnRegistrationRequest{LookupHash: "pending", Password: "pending", Code: recoveryCodes[0]})
+	if err != nil || optionsRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, optionsRes)
+	}
+
+	var creationOptions struct {
+		Challenge string `json:"challenge"`
+		RP        struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+	}
+	err = json.Unmarshal([]byte(optionsRes.Options), &creationOptions)
+	if err != nil || creationOptions.RP.ID != c.EnvWebAuthnRPID {
+		t.Fatalf("unexpected options: %s, %v", optionsRes.Options, err)
+	}
+
+	authenticator := newSoftAuthenticator(t, c.EnvWebAuthnRPID, c.EnvWebAuthnOrigins[0], webauthn.AlgorithmES256)
+	clientDataJSON, attestationObject := authenticator.register(creationOptions.Challenge)
+
+	registrationReq := &pb.FinishWebAuthnRegistrationRequest{
+		LookupHash:        "pending",
+		ClientDataJSON:    clientDataJSON,
+		AttestationObject: attestationObject,
+		Name:              "software authenticator",
+	}
+
+	registrationRes, err := client.FinishWebAuthnRegistration(context.Background(), registrationReq)
+	if err != nil || registrationRes.Error != "" || !bytes.Equal(registrationRes.CredentialId, authenticator.credentialId) {
+		t.Fatalf("expected registered credential, got: %v, %v", err, registrationRes)
+	}
+
+	registrationRes, err = client.FinishWebAuthnRegistration(context.Background(), registrationReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if registrationRes.Error != "invalid or expired webauthn challenge" {
+		t.Errorf("expected error: %s, got: %s", "invalid or expired webauthn challenge", registrationRes.Error)
+	}
+
+	var requestOptions struct {
+		Challenge        string `json:"challenge"`
+		AllowCredentials []struct {
+			ID string `json:"id"`
+		} `json:"allowCredentials"`
+	}
+
+	optionsRes, err = client.BeginWebAuthnLogin(context.Background(), &pb.BeginWebAuthnLoginRequest{LookupHash: "pending"})
+	if err == nil && optionsRes.Error == "" {
+		err = json.Unmarshal([]byte(optionsRes.Options), &requestOptions)
+	}
+	if err != nil || optionsRes.Error != "" || len(requestOptions.AllowCredentials) != 1 {
+		t.Fatalf("expected options allowing the passkey, got: %v, %v", err, optionsRes)
+	}
+
+	clientDataJSON, authenticatorData, signature := authenticator.assert(requestOptions.Challenge)
+
+	loginReq := &pb.FinishWebAuthnLoginRequest{
+		CredentialId:      authenticator.credentialId,
+		ClientDataJSON:    clientDataJSON,
+		AuthenticatorData: authenticatorData,
+		Signature:         signature,
+		Id:                pendingReq.Id,
+	}
+
+	// The passkey replaces password and second factor
+	loginRes, err := client.FinishWebAuthnLogin(context.Background(), loginReq)
+	if err != nil || loginRes.Error != "" || loginRes.Token == "" || loginRes.MfaRequired || loginRes.Id != pendingReq.Id {
+		t.Fatalf("expected token, got: %v, %v", err, loginRes)
+	}
+
+	loginRes, err = client.FinishWebAuthnLogin(context.Background(), loginReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if loginRes.Error != "invalid or expired webauthn challenge" {
+		t.Errorf("expected error: %s, got: %s", "invalid or expired webauthn challenge", loginRes.Error)
+	}
+
+	// Discoverable credentials log in without a lookup hash
+	optionsRes, err = client.BeginWebAuthnLogin(context.Background(), &pb.BeginWebAuthnLoginRequest{})
+	if err == nil && optionsRes.Error == "" {
+		err = json.Unmarshal([]byte(optionsRes.Options), &requestOptions)
+	}
+	if err != nil || optionsRes.Error != "" || len(requestOptions.AllowCredentials) != 0 {
+		t.Fatalf("expected options without credentials, got: %v, %v", err, optionsRes)
+	}
+
+	clientDataJSON, authenticatorData, signature = authenticator.assert(requestOptions.Challenge)
+
+	loginRes, err = client.FinishWebAuthnLogin(context.Background(), &pb.FinishWebAuthnLoginRequest{
+		CredentialId:      authenticator.credentialId,
+		ClientDataJSON:    clientDataJSON,
+		AuthenticatorData: authenticatorData,
+		Signature:         signature,
+		UserHandle:        []byte("pending"),
+		Id:                pendingReq.Id,
+	})
+	if err != nil || loginRes.Error != "" || loginRes.Token == "" {
+		t.Fatalf("expected token, got: %v, %v", err, loginRes)
+	}
+
+	// A tap without user verification is no second factor, MFA enrolled credentials still need a code
+	requireUserVerification := c.EnvWebAuthnRequireUserVerification
+	c.EnvWebAuthnRequireUserVerification = false
+	authenticator.flags = webauthn.FlagUserPresent
+
+	optionsRes, err = client.BeginWebAuthnLogin(context.Background(), &pb.BeginWebAuthnLoginRequest{LookupHash: "pending"})
+	if err == nil && optionsRes.Error == "" {
+		err = json.Unmarshal([]byte(optionsRes.Options), &requestOptions)
+	}
+	if err != nil || optionsRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, optionsRes)
+	}
+
+	clientDataJSON, authenticatorData, signature = authenticator.assert(requestOptions.Challenge)
+
+	loginRes, err = client.FinishWebAuthnLogin(context.Background(), &pb.FinishWebAuthnLoginRequest{
+		CredentialId:      authenticator.credentialId,
+		ClientDataJSON:    clientDataJSON,
+		AuthenticatorData: authenticatorData,
+		Signature:         signature,
+		Id:                pendingReq.Id,
+	})
+	if err != nil || !loginRes.MfaRequired || loginRes.MfaChallengeId == "" || loginRes.Token != "" {
+		t.Fatalf("expected mfa challenge, got: %v, %v", err, loginRes)
+	}
+
+	completeRes, err = client.CompleteMFA(context.Background(), &pb.CompleteMFARequest{ChallengeId: loginRes.MfaChallengeId, Code: recoveryCodes[1]})
+	if err != nil || completeRes.Error != "" || completeRes.Token == "" {
+		t.Fatalf("expected token, got: %v, %v", err, completeRes)
+	}
+
+	c.EnvWebAuthnRequireUserVerification = requireUserVerification
+	authenticator.flags = webauthn.FlagUserPresent | webauthn.FlagUserVerified
+
+	// Test 17: Passwordless login
+	passwordlessReq := &pb.AuthRequest{Id: 456, LookupHash: "passwordless", Password: "passwordless"}
+
+	passwordlessRes, err := client.CreateAuth(context.Background(), passwordlessReq)
+	if err != nil || passwordlessRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, passwordlessRes)
+	}
+
+	passwordlessFile, passwordlessLinkURL := c.EnvPasswordlessFile, c.EnvPasswordlessLinkURL
+	c.EnvPasswordlessFile = t.TempDir() + "/passwordless.jsonl"
+	c.EnvPasswordlessLinkURL = "https://example.com/login?token="
+
+	// The latest message the file sender wrote
+	lastMessage := func() sender.Message {
+		content, err := os.ReadFile(c.EnvPasswordlessFile)
+		if err != nil {
+			t.Fatalf("could not read passwordless messages: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		var message sender.Message
+		err = json.Unmarshal([]byte(lines[len(lines)-1]), &message)
+		if err != nil {
+			t.Fatalf("could not decode passwordless message: %v", err)
+		}
+		return message
+	}
+
+	startReq := &pb.StartPasswordlessLoginRequest{LookupHash: "passwordless", Channel: "code", Destination: "user@example.com"}
+
+	_, err = client.StartPasswordlessLogin(nonAdminCtx, startReq)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected permission denied without passwordless scope, got: %v", err)
+	}
+
+	startRes, err := client.StartPasswordlessLogin(adminCtx, startReq)
+	if err != nil || startRes.Error != "" || startRes.LoginId == "" {
+		t.Fatalf("unexpected error: %v, %v", err, startRes)
+	}
+
+	message := lastMessage()
+	if message.Destination != "user@example.com" || len(message.Code) != 6 {
+		t.Fatalf("expected code for the destination, got: %v", message)
+	}
+
+	wrongCode := "000000"
+	if message.Code == wrongCode {
+		wrongCode = "000001"
+	}
+
+	completeRes, err = client.CompletePasswordlessLogin(context.Background(), &pb.CompletePasswordlessLoginRequest{LoginId: startRes.LoginId, Code: wrongCode, Id: 456})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if completeRes.Error != "invalid code" {
+		t.Errorf("expected error: %s, got: %s", "invalid code", completeRes.Error)
+	}
+
+	completeReq := &pb.CompletePasswordlessLoginRequest{LoginId: startRes.LoginId, Code: message.Code, Id: 456}
+
+	completeRes, err = client.CompletePasswordlessLogin(context.Background(), completeReq)
+	if err != nil || completeRes.Error != "" || completeRes.Token == "" || completeRes.Id != 456 {
+		t.Fatalf("expected token, got: %v, %v", err, completeRes)
+	}
+
+	completeRes, err = client.CompletePasswordlessLogin(context.Background(), completeReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if completeRes.Error != "invalid or expired passwordless login" {
+		t.Errorf("expected error: %s, got: %s", "invalid or expired passwordless login", completeRes.Error)
+	}
+
+	// Concurrent wrong codes each count against the login, only maxPasswordlessAttempts of them are checked
+	startRes, err = client.StartPasswordlessLogin(adminCtx, startReq)
+	if err != nil || startRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, startRes)
+	}
+
+	message = lastMessage()
+	wrongCode = "000000"
+	if message.Code == wrongCode {
+		wrongCode = "000001"
+	}
+
+	guesses = make([]string, 20)
+	for i := range guesses {
+		guessing.Add(1)
+		go func(i int) {
+			defer guessing.Done()
+			guessRes, err := client.CompletePasswordlessLogin(context.Background(), &pb.CompletePasswordlessLoginRequest{LoginId: startRes.LoginId, Code: wrongCode, Id: 456})
+			if err == nil {
+				guesses[i] = guessRes.Error
+			}
+		}(i)
+	}
+	guessing.Wait()
+
+	checkedGuesses = 0
+	for _, guessError := range guesses {
+		if guessError == "invalid code" {
+			checkedGuesses++
+		} else if guessError != "invalid or expired passwordless login" {
+			t.Errorf("unexpected error: %s", guessError)
+		}
+	}
+
+	if checkedGuesses != 5 {
+		t.Errorf("expected 5 checked codes, got: %d", checkedGuesses)
+	}
+
+	completeRes, err = client.CompletePasswordlessLogin(context.Background(), &pb.CompletePasswordlessLoginRequest{LoginId: startRes.LoginId, Code: message.Code, Id: 456})
+	if err != nil || completeRes.Error != "invalid or expired passwordless login" {
+		t.Errorf("expected error: %s, got: %v, %v", "invalid or expired passwordless login", err, completeRes)
+	}
+
+	startReq.Channel = "link"
+	startRes, err = client.StartPasswordlessLogin(adminCtx, startReq)
+	if err != nil || startRes.Error != "" || startRes.LoginId != "" {
+		t.Fatalf("unexpected error: %v, %v", err, startRes)
+	}
+
+	linkToken, ok := strings.CutPrefix(lastMessage().Link, c.EnvPasswordlessLinkURL)
+	if !ok || linkToken == "" {
+		t.Fatalf("expected link with token, got: %v", lastMessage())
+	}
+
+	// The link token is no bearer token
+	verifyTokenRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: linkToken})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if verifyTokenRes.Error != "token can only be used to complete a passwordless login" {
+		t.Errorf("expected error: %s, got: %s", "token can only be used to complete a passwordless login", verifyTokenRes.Error)
+	}
+
+	completeReq = &pb.CompletePasswordlessLoginRequest{Token: linkToken, Id: 456}
+
+	completeRes, err = client.CompletePasswordlessLogin(context.Background(), completeReq)
+	if err != nil || completeRes.Error != "" || completeRes.Token == "" {
+		t.Fatalf("expected token, got: %v, %v", err, completeRes)
+	}
+
+	completeRes, err = client.CompletePasswordlessLogin(context.Background(), completeReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if completeRes.Error != "invalid or expired passwordless login" {
+		t.Errorf("expected error: %s, got: %s", "invalid or expired passwordless login", completeRes.Error)
+	}
+
+	c.EnvPasswordlessFile, c.EnvPasswordlessLinkURL = passwordlessFile, passwordlessLinkURL
+
+	// Test 18: Sessions
+	sessionsRes, err := client.CreateAuth(context.Background(), &pb.AuthRequest{
+		Id: 789, LookupHash: "sessions", Password: "sessions", Client: &pb.ClientInfo{UserAgent: "laptop"},
+	})
+	if err != nil || sessionsRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, sessionsRes)
+	}
+
+	phoneRes, err := client.GrantAuth(context.Background(), &pb.AuthRequest{
+		Id: 789, LookupHash: "sessions", Password: "sessions", Client: &pb.ClientInfo{UserAgent: "phone", Ip: "203.0.113.7"},
+	})
+	if err != nil || phoneRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, phoneRes)
+	}
+
+	sessionsCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+sessionsRes.Token)
+
+	_, err = client.ListSessions(sessionsCtx, &pb.ListSessionsRequest{LookupHash: "passwordless"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected permission denied for other credentials, got: %v", err)
+	}
+
+	listSessionsRes, err := client.ListSessions(sessionsCtx, &pb.ListSessionsRequest{LookupHash: "sessions"})
+	if err != nil || listSessionsRes.Error != "" || len(listSessionsRes.Sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got: %v, %v", err, listSessionsRes)
+	}
+
+	var phoneSession *pb.Session
+	for _, session := range listSessionsRes.Sessions {
+		if session.Client.UserAgent == "laptop" && !session.Current {
+			t.Errorf("expected laptop session to be current, got: %v", session)
+		}
+		if session.Client.UserAgent == "phone" {
+			phoneSession = session
+		}
+	}
+
+	if phoneSession == nil || phoneSession.Current || phoneSession.Client.Ip != "203.0.113.7" {
+		t.Fatalf("expected phone session from 203.0.113.7, got: %v", listSessionsRes.Sessions)
+	}
+
+	revokeSessionReq := &pb.RevokeSessionRequest{LookupHash: "sessions", SessionId: phoneSession.SessionId}
+
+	revokeSessionRes, err := client.RevokeSession(sessionsCtx, revokeSessionReq)
+	if err != nil || revokeSessionRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, revokeSessionRes)
+	}
+
+	verifyTokenRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: phoneRes.Token})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if verifyTokenRes.Error != "session revoked" {
+		t.Errorf("expected error: %s, got: %s", "session revoked", verifyTokenRes.Error)
+	}
+
+	refreshTokenRes, err = client.RefreshToken(context.Background(), &pb.RefreshTokenRequest{Token: phoneRes.Token})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if refreshTokenRes.Error != "TokenError: session revoked" {
+		t.Errorf("expected error: %s, got: %s", "TokenError: session revoked", refreshTokenRes.Error)
+	}
+
+	revokeSessionRes, err = client.RevokeSession(adminCtx, revokeSessionReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if revokeSessionRes.Error != "session not found" {
+		t.Errorf("expected error: %s, got: %s", "session not found", revokeSessionRes.Error)
+	}
+
+	// Refreshed tokens stay in their session
+	refreshTokenRes, err = client.RefreshToken(context.Background(), &pb.RefreshTokenRequest{Token: sessionsRes.Token})
+	if err != nil || refreshTokenRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, refreshTokenRes)
+	}
+
+	verifyTokenRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: refreshTokenRes.Token})
+	if err != nil || verifyTokenRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, verifyTokenRes)
+	}
+
+	if verifyTokenRes.TokenClaims.SessionId == "" || verifyTokenRes.TokenClaims.SessionId == phoneSession.SessionId {
+		t.Errorf("expected sid of the laptop session, got: %s", verifyTokenRes.TokenClaims.SessionId)
+	}
+
+	// Test 19: Session lifetime
+	realmRes, err = client.CreateRealm(adminCtx, &pb.CreateRealmRequest{Id: "lifetime", SessionPolicy: &pb.SessionPolicy{MaxLifetime: "1h"}})
+	if err != nil || realmRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, realmRes)
+	}
+
+	lifetimeRes, err := client.CreateAuth(context.Background(), &pb.AuthRequest{
+		Id: 321, LookupHash: "lifetime", Password: "lifetime", Ttl: "24h", Realm: "lifetime",
+	})
+	if err != nil || lifetimeRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, lifetimeRes)
+	}
+
+	verifyTokenRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: lifetimeRes.Token, Realm: "lifetime"})
+	if err != nil || verifyTokenRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, verifyTokenRes)
+	}
+
+	authTime := verifyTokenRes.TokenClaims.AuthTime
+	if authTime != verifyTokenRes.TokenClaims.IssuedAt || verifyTokenRes.TokenClaims.ExpiresAt > authTime+3600 {
+		t.Errorf("expected token to expire within the max lifetime, got: %v", verifyTokenRes.TokenClaims)
+	}
+
+	refreshTokenRes, err = client.RefreshToken(context.Background(), &pb.RefreshTokenRequest{Token: lifetimeRes.Token, Ttl: "24h", Realm: "lifetime"})
+	if err != nil || refreshTokenRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, refreshTokenRes)
+	}
+
+	verifyTokenRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: refreshTokenRes.Token, Realm: "lifetime"})
+	if err != nil || verifyTokenRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, verifyTokenRes)
+	}
+
+	if verifyTokenRes.TokenClaims.AuthTime != authTime || verifyTokenRes.TokenClaims.ExpiresAt > authTime+3600 {
+		t.Errorf("expected refreshed token to keep auth_time and the max lifetime, got: %v", verifyTokenRes.TokenClaims)
+	}
+
+	realmRes, err = client.SetSessionPolicy(adminCtx, &pb.SetSessionPolicyRequest{
+		Realm: "lifetime", SessionPolicy: &pb.SessionPolicy{IdleTimeout: "1s", MaxLifetime: "1h"},
+	})
+	if err != nil || realmRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, realmRes)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	refreshTokenRes, err = client.RefreshToken(context.Background(), &pb.RefreshTokenRequest{Token: refreshTokenRes.Token, Realm: "lifetime"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if refreshTokenRes.Error != "TokenError: session timed out" {
+		t.Errorf("expected error: %s, got: %s", "TokenError: session timed out", refreshTokenRes.Error)
+	}
+
+	realmRes, err = client.DeleteRealm(adminCtx, &pb.DeleteRealmRequest{Id: "lifetime"})
+	if err != nil || realmRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, realmRes)
+	}
+
+	// Test 20: Token ttl bounds
+	boundsReq := &pb.AuthRequest{Id: 789, LookupHash: "sessions", Password: "sessions", Ttl: "87600h"}
+
+	boundsRes, err := client.GrantAuth(context.Background(), boundsReq)
+	if err != nil || boundsRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, boundsRes)
+	}
+
+	if boundsRes.ExpiresAt > time.Now().Add(c.EnvJWTTtlMax).Unix() {
+		t.Errorf("expected ttl to be clamped to %s, got exp: %d", c.EnvJWTTtlMax, boundsRes.ExpiresAt)
+	}
+
+	boundsReq.Ttl = "-1h"
+	boundsRes, err = client.GrantAuth(context.Background(), boundsReq)
+	if err != nil || boundsRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, boundsRes)
+	}
+
+	if boundsRes.ExpiresAt < time.Now().Add(c.EnvJWTTtlMin).Unix()-1 {
+		t.Errorf("expected ttl to be clamped to %s, got exp: %d", c.EnvJWTTtlMin, boundsRes.ExpiresAt)
+	}
+
+	boundsReq.Ttl = "a while"
+	boundsRes, err = client.GrantAuth(context.Background(), boundsReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if boundsRes.Error != "ttl must be a duration, e.g. 1h" {
+		t.Errorf("expected error: %s, got: %s", "ttl must be a duration, e.g. 1h", boundsRes.Error)
+	}
+
+	ttlOutOfRange := c.EnvJWTTtlOutOfRange
+	c.EnvJWTTtlOutOfRange = "reject"
+
+	boundsReq.Ttl = "87600h"
+	boundsRes, err = client.GrantAuth(context.Background(), boundsReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedError := fmt.Sprintf("ttl must be between %s and %s", c.EnvJWTTtlMin, c.EnvJWTTtlMax)
+	if boundsRes.Error != expectedError {
+		t.Errorf("expected error: %s, got: %s", expectedError, boundsRes.Error)
+	}
+
+	c.EnvJWTTtlOutOfRange = ttlOutOfRange
+
+	_, err = client.SetTokenTtl(adminCtx, &pb.SetTokenTtlRequest{TokenTtl: "1h", TokenTtlMin: "2h"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid argument for a token ttl below its min, got: %v", err)
+	}
+
+	// Test 21: OAuth
+	oauthClientRes, err := client.CreateOAuthClient(adminCtx, &pb.CreateOAuthClientRequest{
+		Name: "Orders app", RedirectUris: []string{"https://app.example/callback"}, Scopes: []string{"orders:read"},
+	})
+	if err != nil || oauthClientRes.Error != "" || oauthClientRes.ClientId == "" || oauthClientRes.ClientSecret != "" {
+		t.Fatalf("expected public client, got: %v, %v", err, oauthClientRes)
+	}
+
+	_, err = client.CreateOAuthClient(adminCtx, &pb.CreateOAuthClientRequest{Name: "Plain http", RedirectUris: []string{"http://app.example/callback"}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid argument for a plain http redirect uri, got: %v", err)
+	}
+
+	codeVerifier := strings.Repeat("v", 43)
+	codeChallenge := sha256.Sum256([]byte(codeVerifier))
+	authorizeForm := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oauthClientRes.ClientId},
+		"redirect_uri":          {"https://app.example/callback"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(codeChallenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	recorder := httptest.NewRecorder()
+	s.AuthorizeHandler(recorder, httptest.NewRequest(http.MethodGet, "/authorize?"+authorizeForm.Encode(), nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "Orders app") {
+		t.Errorf("expected login page, got: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	unregisteredForm := url.Values{"client_id": {oauthClientRes.ClientId}, "redirect_uri": {"https://evil.example/callback"}, "response_type": {"code"}}
+	recorder = httptest.NewRecorder()
+	s.AuthorizeHandler(recorder, httptest.NewRequest(http.MethodGet, "/authorize?"+unregisteredForm.Encode(), nil))
+	if recorder.Code != http.StatusBadRequest || recorder.Header().Get("Location") != "" {
+		t.Errorf("expected error page for an unregistered redirect uri, got: %d %s", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	authorize := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"sessions"}, "password": {password}}
+		for name, values := range authorizeForm {
+			form[name] = values
+		}
+		request := httptest.NewRequest(http.MethodPost, "/authorize", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		s.AuthorizeHandler(recorder, request)
+		return recorder
+	}
+
+	// Answers the consent step shown on the page of a login
+	consentIdPattern := regexp.MustCompile(`name="consent_id" value="([^"]+)"`)
+	consent := func(page *httptest.ResponseRecorder, decision string) *httptest.ResponseRecorder {
+		form := url.Values{"consent": {decision}}
+		if match := consentIdPattern.FindStringSubmatch(page.Body.String()); match != nil {
+			form.Set("consent_id", match[1])
+		}
+		for name, values := range authorizeForm {
+			form[name] = values
+		}
+		request := httptest.NewRequest(http.MethodPost, "/authorize", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		s.AuthorizeHandler(recorder, request)
+		return recorder
+	}
+
+	recorder = authorize("wrong")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected status: %d, got: %d", http.StatusUnauthorized, recorder.Code)
+	}
+
+	consentPage := authorize("sessions")
+	if consentPage.Code != http.StatusOK || !consentIdPattern.MatchString(consentPage.Body.String()) || !strings.Contains(consentPage.Body.String(), "orders:read") {
+		t.Fatalf("expected consent step for scopes not granted before, got: %d %s", consentPage.Code, consentPage.Body.String())
+	}
+
+	recorder = consent(consentPage, "deny")
+	redirect, _ := url.Parse(recorder.Header().Get("Location"))
+	if recorder.Code != http.StatusSeeOther || redirect.Query().Get("error") != "access_denied" || redirect.Query().Get("code") != "" {
+		t.Errorf("expected access_denied, got: %d %s", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	recorder = consent(consentPage, "approve")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected a decided consent step to be used up, got: %d %s", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	// A denial records no consent
+	consentPage = authorize("sessions")
+	if !consentIdPattern.MatchString(consentPage.Body.String()) {
+		t.Fatalf("expected consent step after a denial, got: %d %s", consentPage.Code, consentPage.Body.String())
+	}
+
+	recorder = consent(consentPage, "approve")
+	if recorder.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	redirect, err = url.Parse(recorder.Header().Get("Location"))
+	if err != nil || redirect.Host != "app.example" || redirect.Query().Get("state") != "xyz" || redirect.Query().Get("code") == "" {
+		t.Fatalf("expected redirect with code and state, got: %v, %s", err, recorder.Header().Get("Location"))
+	}
+
+	oauthToken := func(form url.Values) (int, map[string]interface{}) {
+		if !form.Has("client_id") {
+			form.Set("client_id", oauthClientRes.ClientId)
+		}
+		request := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		s.OAuthTokenHandler(recorder, request)
+		var response map[string]interface{}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response
+	}
+
+	code := redirect.Query().Get("code")
+	statusCode, tokenResponse := oauthToken(url.Values{"grant_type": {"authorization_code"}, "code": {code}, "code_verifier": {strings.Repeat("w", 43)}})
+	if statusCode != http.StatusBadRequest || tokenResponse["error"] != "invalid_grant" {
+		t.Errorf("expected invalid_grant for a wrong code_verifier, got: %d %v", statusCode, tokenResponse)
+	}
+
+	// The failed exchange used up the code
+	statusCode, tokenResponse = oauthToken(url.Values{"grant_type": {"authorization_code"}, "code": {code}, "code_verifier": {codeVerifier}})
+	if statusCode != http.StatusBadRequest || tokenResponse["error"] != "invalid_grant" {
+		t.Errorf("expected invalid_grant for a used code, got: %d %v", statusCode, tokenResponse)
+	}
+
+	// Granted scopes are not asked for again
+	recorder = authorize("sessions")
+	if recorder.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect without a consent step, got: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	redirect, _ = url.Parse(recorder.Header().Get("Location"))
+	statusCode, tokenResponse = oauthToken(url.Values{
+		"grant_type": {"authorization_code"}, "code": {redirect.Query().Get("code")}, "code_verifier": {codeVerifier}, "redirect_uri": {"https://app.example/callback"},
+	})
+	if statusCode != http.StatusOK || tokenResponse["access_token"] == nil || tokenResponse["refresh_token"] == nil || tokenResponse["token_type"] != "Bearer" {
+		t.Fatalf("expected tokens, got: %d %v", statusCode, tokenResponse)
+	}
+
+	oauthVerifyRes, err := client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: tokenResponse["access_token"].(string)})
+	if err != nil || oauthVerifyRes.Error != "" || oauthVerifyRes.TokenClaims.Subject != "789" || oauthVerifyRes.TokenClaims.ClientId != oauthClientRes.ClientId || oauthVerifyRes.TokenClaims.SessionId == "" {
+		t.Errorf("expected token of subject 789 for the client, got: %v, %v", err, oauthVerifyRes)
+	}
+
+	refreshToken := tokenResponse["refresh_token"].(string)
+
+	// Rejected refreshes keep the refresh token usable
+	statusCode, scopeResponse := oauthToken(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}, "scope": {"orders:delete"}})
+	if statusCode != http.StatusBadRequest || scopeResponse["error"] != "invalid_scope" {
+		t.Errorf("expected invalid_scope, got: %d %v", statusCode, scopeResponse)
+	}
+
+	statusCode, tokenResponse = oauthToken(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	if statusCode != http.StatusOK || tokenResponse["refresh_token"] == nil || tokenResponse["refresh_token"] == refreshToken {
+		t.Fatalf("expected new tokens, got: %d %v", statusCode, tokenResponse)
+	}
+
+	statusCode, _ = oauthToken(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	if statusCode != http.StatusBadRequest {
+		t.Errorf("expected a replaced refresh token to be rejected, got: %d", statusCode)
+	}
+
+	statusCode, grantResponse := oauthToken(url.Values{"grant_type": {"password"}})
+	if grantResponse["error"] != "unsupported_grant_type" {
+		t.Errorf("expected unsupported_grant_type, got: %d %v", statusCode, grantResponse)
+	}
+
+	oauthCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+tokenResponse["access_token"].(string))
+	consentsRes, err := client.ListOAuthConsents(oauthCtx, &pb.ListOAuthConsentsRequest{LookupHash: "sessions"})
+	if err != nil || consentsRes.Error != "" || len(consentsRes.Consents) != 1 || consentsRes.Consents[0].ClientName != "Orders app" {
+		t.Fatalf("expected consent to the client, got: %v, %v", err, consentsRes)
+	}
+
+	revokeConsentRes, err := client.RevokeOAuthConsent(adminCtx, &pb.RevokeOAuthConsentRequest{LookupHash: "sessions", ClientId: oauthClientRes.ClientId})
+	if err != nil || revokeConsentRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, revokeConsentRes)
+	}
+
+	// Revoking the consent ends the sessions of the client
+	oauthVerifyRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: tokenResponse["access_token"].(string)})
+	if err != nil || oauthVerifyRes.Error == "" {
+		t.Errorf("expected the token of a revoked consent to be rejected, got: %v, %v", err, oauthVerifyRes)
+	}
+
+	deleteClientRes, err := client.DeleteOAuthClient(adminCtx, &pb.DeleteOAuthClientRequest{ClientId: oauthClientRes.ClientId})
+	if err != nil || deleteClientRes.Error != "" {
+		t.Errorf("unexpected error: %v, %v", err, deleteClientRes)
+	}
+
+	// Test 22: OpenID Connect
+	recorder = httptest.NewRecorder()
+	s.OIDCMetadataHandler(recorder, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+
+	var openIdConfiguration map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &openIdConfiguration)
+	if recorder.Code != http.StatusOK || openIdConfiguration["issuer"] != c.EnvJWTIssuer || openIdConfiguration["jwks_uri"] != c.EnvJWTIssuer+"/jwks" {
+		t.Errorf("expected provider metadata of the default realm, got: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	s.OIDCMetadataHandler(recorder, httptest.NewRequest(http.MethodGet, "/jwks", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), cert.Keys.Active().ID) {
+		t.Errorf("expected jwks with the active key, got: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	s.OIDCMetadataHandler(recorder, httptest.NewRequest(http.MethodGet, "/realms/unknown/.well-known/openid-configuration", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected status: %d, got: %d", http.StatusNotFound, recorder.Code)
+	}
+
+	oidcClientRes, err := client.CreateOAuthClient(adminCtx, &pb.CreateOAuthClientRequest{
+		Name: "Portal", RedirectUris: []string{"https://app.example/callback"}, Scopes: []string{"openid", "orders:read"},
+	})
+	if err != nil || oidcClientRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, oidcClientRes)
+	}
+
+	authorizeForm.Set("client_id", oidcClientRes.ClientId)
+	authorizeForm.Set("scope", "openid")
+	authorizeForm.Set("nonce", "n-0S6_WzA2Mj")
+
+	redirect, _ = url.Parse(consent(authorize("sessions"), "approve").Header().Get("Location"))
+	statusCode, tokenResponse = oauthToken(url.Values{
+		"grant_type": {"authorization_code"}, "code": {redirect.Query().Get("code")}, "code_verifier": {codeVerifier}, "client_id": {oidcClientRes.ClientId},
+	})
+	if statusCode != http.StatusOK || tokenResponse["id_token"] == nil || tokenResponse["scope"] != "openid" {
+		t.Fatalf("expected tokens with an id token, got: %d %v", statusCode, tokenResponse)
+	}
+
+	idClaims, err := tokenHandler.VerifyClaims(tokenResponse["id_token"].(string), time.Now().Unix(), cert.Keys, c.EnvJWTIssuer, oidcClientRes.ClientId)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if idClaims["sub"] != "789" || idClaims["nonce"] != "n-0S6_WzA2Mj" || idClaims["acr"] != "1" || idClaims["auth_time"] == nil || idClaims["sid"] == nil ||
+		idClaims["token_use"] != "id" {
+		t.Errorf("expected id token of subject 789 with nonce, acr, auth_time and token_use, got: %v", idClaims)
+	}
+
+	if amr, _ := idClaims["amr"].([]interface{}); len(amr) != 1 || amr[0] != "pwd" {
+		t.Errorf("expected amr: [pwd], got: %v", idClaims["amr"])
+	}
+
+	idVerifyRes, err := client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: tokenResponse["id_token"].(string)})
+	if err != nil || idVerifyRes.Error != "id tokens can not be used as access tokens" {
+		t.Errorf("expected id token to be rejected as access token, got: %v, %v", err, idVerifyRes)
+	}
+
+	userInfo := func(token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		s.UserInfoHandler(recorder, request)
+		return recorder
+	}
+
+	recorder = userInfo(tokenResponse["access_token"].(string))
+	if recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != `{"sub":"789"}` {
+		t.Errorf("expected userinfo of subject 789, got: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// The nonce and amr of the login stay across refreshes
+	statusCode, tokenResponse = oauthToken(url.Values{
+		"grant_type": {"refresh_token"}, "refresh_token": {tokenResponse["refresh_token"].(string)}, "client_id": {oidcClientRes.ClientId},
+	})
+	if statusCode != http.StatusOK || tokenResponse["id_token"] == nil {
+		t.Fatalf("expected tokens with an id token, got: %d %v", statusCode, tokenResponse)
+	}
+
+	idClaims, err = tokenHandler.VerifyClaims(tokenResponse["id_token"].(string), time.Now().Unix(), cert.Keys, c.EnvJWTIssuer, oidcClientRes.ClientId)
+	if err != nil || idClaims["nonce"] != "n-0S6_WzA2Mj" || idClaims["amr"] == nil {
+		t.Errorf("expected refreshed id token with nonce and amr, got: %v, %v", err, idClaims)
+	}
+
+	grantRes, err := client.GrantAuth(context.Background(), &pb.AuthRequest{Id: 789, LookupHash: "sessions", Password: "sessions"})
+	if err != nil || grantRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, grantRes)
+	}
+
+	recorder = userInfo(grantRes.Token)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected status: %d for a token without openid, got: %d", http.StatusForbidden, recorder.Code)
+	}
+
+	authorizeForm.Set("prompt", "none")
+	recorder = httptest.NewRecorder()
+	s.AuthorizeHandler(recorder, httptest.NewRequest(http.MethodGet, "/authorize?"+authorizeForm.Encode(), nil))
+	redirect, _ = url.Parse(recorder.Header().Get("Location"))
+	if recorder.Code != http.StatusSeeOther || redirect.Query().Get("error") != "login_required" {
+		t.Errorf("expected login_required for prompt none, got: %d %s", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	// Test 23: Machine clients
+	machineRes, err := client.CreateMachineClient(adminCtx, &pb.CreateMachineClientRequest{Name: "Billing", Scopes: []string{"orders:read", "orders:write"}})
+	if err != nil || machineRes.Error != "" || machineRes.ClientId == "" || machineRes.ClientSecret == "" {
+		t.Fatalf("expected client with a secret, got: %v, %v", err, machineRes)
+	}
+
+	clientTokenRes, err := client.IssueClientToken(context.Background(), &pb.ClientTokenRequest{
+		ClientId: machineRes.ClientId, ClientSecret: machineRes.ClientSecret, Scopes: []string{"orders:read"},
+	})
+	if err != nil || clientTokenRes.Error != "" || clientTokenRes.Token == "" {
+		t.Fatalf("expected token, got: %v, %v", err, clientTokenRes)
+	}
+
+	clientVerifyRes, err := client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: clientTokenRes.Token})
+	if err != nil || clientVerifyRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, clientVerifyRes)
+	}
+
+	if clientVerifyRes.TokenClaims.Subject != machineRes.ClientId || clientVerifyRes.TokenClaims.ClientId != machineRes.ClientId ||
+		len(clientVerifyRes.TokenClaims.Scopes) != 1 || clientVerifyRes.TokenClaims.Scopes[0] != "orders:read" {
+		t.Errorf("expected token of the client with scope orders:read, got: %v", clientVerifyRes.TokenClaims)
+	}
+
+	clientTokenRes, err = client.IssueClientToken(context.Background(), &pb.ClientTokenRequest{ClientId: machineRes.ClientId, ClientSecret: "wrong"})
+	if err != nil || clientTokenRes.Error != "invalid client credentials" {
+		t.Errorf("expected error: %s, got: %v, %v", "invalid client credentials", err, clientTokenRes)
+	}
+
+	clientTokenRes, err = client.IssueClientToken(context.Background(), &pb.ClientTokenRequest{
+		ClientId: machineRes.ClientId, ClientSecret: machineRes.ClientSecret, Scopes: []string{"auth:admin"},
+	})
+	if err != nil || clientTokenRes.Error != "scope auth:admin is not allowed" {
+		t.Errorf("expected error: %s, got: %v, %v", "scope auth:admin is not allowed", err, clientTokenRes)
+	}
+
+	refreshClientRes, err := client.RefreshToken(context.Background(), &pb.RefreshTokenRequest{Token: clientVerifyRes.Token})
+	if err != nil || refreshClientRes.Error == "" {
+		t.Errorf("expected tokens of machine clients not to be refreshed, got: %v, %v", err, refreshClientRes)
+	}
+
+	_, assertionKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	signingKey, err := cert.NewKey(assertionKey, "EdDSA")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	publicJWK, err := cert.PublicJWK(signingKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	publicKey, _ := json.Marshal(publicJWK)
+	keyClientRes, err := client.CreateMachineClient(adminCtx, &pb.CreateMachineClientRequest{Name: "Reports", PublicKey: string(publicKey)})
+	if err != nil || keyClientRes.Error != "" || keyClientRes.ClientSecret != "" {
+		t.Fatalf("expected client without a secret, got: %v, %v", err, keyClientRes)
+	}
+
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"iss": keyClientRes.ClientId,
+		"sub": keyClientRes.ClientId,
+		"aud": c.EnvJWTIssuer + "/token",
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"jti": "assertion-1",
+	}).SignedString(assertionKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	clientCredentials := func(form url.Values) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		s.OAuthTokenHandler(recorder, request)
+		return recorder
+	}
+
+	assertionForm := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+	}
+
+	recorder = clientCredentials(assertionForm)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"access_token"`) || strings.Contains(recorder.Body.String(), `"refresh_token"`) {
+		t.Errorf("expected access token, got: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Assertions work once
+	recorder = clientCredentials(assertionForm)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected status: %d, got: %d", http.StatusUnauthorized, recorder.Code)
+	}
+
+	recorder = clientCredentials(url.Values{"grant_type": {"client_credentials"}, "client_id": {machineRes.ClientId}, "client_secret": {machineRes.ClientSecret}})
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status: %d, got: %d %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	deleteMachineRes, err := client.DeleteMachineClient(adminCtx, &pb.DeleteMachineClientRequest{ClientId: machineRes.ClientId})
+	if err != nil || deleteMachineRes.Error != "" {
+		t.Fatalf("unexpected error: %v, %v", err, deleteMachineRes)
+	}
+
+	clientVerifyRes, err = client.VerifyToken(context.Background(), &pb.VerifyTokenRequest{Token: clientVerifyRes.Token})
+	if err != nil || clientVerifyRes.Error != "client deleted" {
+		t.Errorf("expected error: %s, got: %v, %v", "client deleted", err, clientVerifyRes)
+	}
+
+	// Test 24: Delete auth
+	deleteAuthReq := &pb.DeleteAuthRequest{
+		LookupHash: "test",
+	}
+
+	deleteAuthRes, err := client.DeleteAuth(context.Background(), deleteAuthReq)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if deleteAuthRes.Error != "" {
+		t.Errorf("expected error: %s, got: %s", "", deleteAuthRes.Error)
+	}
+
+	// Test 25: Get public key
+	publicKeyRes, err := client.GetPublicKey(context.Background(), &pb.PublicKeyRequest{Target: "token"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedPublicKeyBytes, err := x509.MarshalPKIXPublicKey(cert.Keys.Active().PublicKey)
+	if err != nil {
+		t.Fatalf("could not convert public key: %v", err)
+	}
+
+	if !bytes.Equal(expectedPublicKeyBytes, publicKeyRes.PublicKey) {
+		t.Errorf("expected public key: %s, got: %s", expectedPublicKeyBytes, publicKeyRes.PublicKey)
+	}
+
+	if publicKeyRes.Algorithm != cert.Keys.Active().Algorithm {
+		t.Errorf("expected algorithm: %s, got: %s", cert.Keys.Active().Algorithm, publicKeyRes.Algorithm)
+	}
+
+	if publicKeyRes.KeyId != cert.Keys.Active().ID {
+		t.Errorf("expected key id: %s, got: %s", cert.Keys.Active().ID, publicKeyRes.KeyId)
+	}
+
+	publicKeyPEMRes, err := client.GetPublicKey(context.Background(), &pb.PublicKeyRequest{Target: "token", Format: pb.KeyFormat_PEM})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	publicKeyBlock, _ := pem.Decode(publicKeyPEMRes.PublicKey)
+	if publicKeyBlock == nil || !bytes.Equal(expectedPublicKeyBytes, publicKeyBlock.Bytes) {
+		t.Errorf("expected pem encoded public key, got: %s", publicKeyPEMRes.PublicKey)
+	}
+
+	publicKeyJWKRes, err := client.GetPublicKey(context.Background(), &pb.PublicKeyRequest{Target: "token", Format: pb.KeyFormat_JWK})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var jwk cert.JWK
+	err = json.Unmarshal(publicKeyJWKRes.PublicKey, &jwk)
+	if err != nil || jwk.Kid != cert.Keys.Active().ID {
+		t.Errorf("expected jwk of key %s, got: %s", cert.Keys.Active().ID, publicKeyJWKRes.PublicKey)
+	}
+
+	// Unknown targets and paths must not be looked up
+	for _, target := range []string{"unknown", "../token", "../../../../etc/passwd"} {
+		_, err = client.GetPublicKey(context.Background(), &pb.PublicKeyRequest{Target: target})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("expected not found for target %s, got: %v", target, err)
+		}
+	}
+
+	_, err = client.GetPublicKey(context.Background(), &pb.PublicKeyRequest{Target: "token", KeyId: "unknown"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected not found for unknown key id, got: %v", err)
 	}
 
-	// Test 10: Flush db request
+	// Test 26: Flush db request
 	flushResult, err := client.FlushDB(context.Background(), &pb.FlushDBRequest{Reason: "test"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -0,0 +1,71 @@
+//go:build pkcs11
+
+package tests
+
+import (
+	"crypto/elliptic"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+/**
+ * Runs against SoftHSM or any other PKCS#11 module configured with PKCS11_* variables:
+ * softhsm2-util --init-token --free --label test --pin 1234 --so-pin 1234
+ * PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so PKCS11_TOKEN_LABEL=test PKCS11_PIN=1234 go test -tags pkcs11 ./src/tests
+ */
+func TestPKCS11Signer(t *testing.T) {
+
+	config := c.EnvPKCS11Config
+	if config.Module == "" {
+		t.Skip("PKCS11_MODULE is not set")
+	}
+
+	context, err := crypto11.Configure(&crypto11.Config{
+		Path:       config.Module,
+		TokenLabel: config.TokenLabel,
+		Pin:        config.Pin,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer context.Close()
+
+	for algorithm, generate := range map[string]func(label []byte) (crypto11.Signer, error){
+		"RS256": func(label []byte) (crypto11.Signer, error) {
+			return context.GenerateRSAKeyPairWithLabel(label, label, 2048)
+		},
+		"ES256": func(label []byte) (crypto11.Signer, error) {
+			return context.GenerateECDSAKeyPairWithLabel(label, label, elliptic.P256())
+		},
+	} {
+		label := []byte("test-" + algorithm)
+
+		_, err := generate(label)
+		if err != nil {
+			t.Fatalf("unexpected error generating %s key: %v", algorithm, err)
+		}
+
+		config.KeyLabel = string(label)
+
+		key, err := cert.LoadPKCS11Key(config, algorithm)
+		if err != nil {
+			t.Fatalf("unexpected error loading %s key: %v", algorithm, err)
+		}
+
+		tokenString, err := tokenHandler.CreateToken(mockToken, key.Signer)
+		if err != nil {
+			t.Errorf("unexpected error signing with %s PKCS#11 key: %v", algorithm, err)
+		}
+
+		id, err := tokenHandler.VerifyToken(tokenString, mockTimeNow, cert.NewKeySet(key))
+		if err != nil {
+			t.Errorf("unexpected error verifying %s PKCS#11 token: %v", algorithm, err)
+		}
+		if id != mockId {
+			t.Errorf("Expected ID: %d, got: %d", mockId, id)
+		}
+	}
+}
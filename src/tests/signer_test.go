@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"simple-micro-auth/src/cert"
+	c "simple-micro-auth/src/configs"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+ * Minimal Vault transit API signing with local keys
+ */
+func newVaultStub(t *testing.T, keyType string, algorithm string, versions []crypto.Signer) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/transit/keys/token":
+			keys := map[string]interface{}{}
+			for i, key := range versions {
+				var publicKey string
+				if keyType == "ed25519" {
+					publicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+				} else {
+					publicKeyBytes, _ := x509.MarshalPKIXPublicKey(key.Public())
+					publicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes}))
+				}
+				keys[fmt.Sprint(i+1)] = map[string]interface{}{"public_key": publicKey, "creation_time": time.Now()}
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"type":           keyType,
+				"latest_version": len(versions),
+				"keys":           keys,
+			}})
+
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/v1/transit/sign/token"):
+			var request struct {
+				Input      string `json:"input"`
+				KeyVersion int    `json:"key_version"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+
+			input, _ := base64.StdEncoding.DecodeString(request.Input)
+
+			// Vault marshals ECDSA signatures for JWS the same way local keys do
+			signature, err := cert.NewSigner(versions[request.KeyVersion-1], "", algorithm).Sign(string(input))
+			if err != nil {
+				t.Errorf("vault stub could not sign: %v", err)
+			}
+
+			encoded := base64.StdEncoding.EncodeToString(signature)
+			if keyType == "ecdsa-p256" || keyType == "ecdsa-p384" {
+				encoded = base64.RawURLEncoding.EncodeToString(signature)
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"signature": fmt.Sprintf("vault:v%d:%s", request.KeyVersion, encoded),
+			}})
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestVaultSigner(t *testing.T) {
+
+	keyTypes := map[string]string{
+		"RS256": "rsa-2048",
+		"PS256": "rsa-2048",
+		"ES256": "ecdsa-p256",
+		"ES384": "ecdsa-p384",
+		"EdDSA": "ed25519",
+	}
+
+	for algorithm, keyType := range keyTypes {
+
+		oldKey, err := cert.GenerateKey(algorithm)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		latestKey, err := cert.GenerateKey(algorithm)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		vault := newVaultStub(t, keyType, algorithm, []crypto.Signer{oldKey, latestKey})
+
+		config := c.VaultConfig{Address: vault.URL, Token: "test-token", Mount: "transit", KeyName: "token"}
+
+		active, others, err := cert.LoadVaultKeys(config, algorithm)
+		if err != nil {
+			t.Fatalf("unexpected error loading %s vault keys: %v", algorithm, err)
+		}
+
+		if len(others) != 1 {
+			t.Errorf("expected 1 previous key version, got: %d", len(others))
+		}
+
+		keys := cert.NewKeySet(append([]cert.Key{active}, others...)...)
+
+		// Test case 1: token signed by vault verifies with its public key
+		tokenString, err := tokenHandler.CreateToken(mockToken, active.Signer)
+		if err != nil {
+			t.Errorf("unexpected error signing with %s vault key: %v", algorithm, err)
+		}
+
+		id, err := tokenHandler.VerifyToken(tokenString, mockTimeNow, keys)
+		if err != nil {
+			t.Errorf("unexpected error verifying %s vault token: %v", algorithm, err)
+		}
+		if id != mockId {
+			t.Errorf("Expected ID: %d, got: %d", mockId, id)
+		}
+
+		// Test case 2: tokens of previous key versions still verify
+		oldTokenKey, err := cert.NewKey(oldKey, algorithm)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		oldTokenString, err := tokenHandler.CreateToken(mockToken, oldTokenKey.Signer)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		_, err = tokenHandler.VerifyToken(oldTokenString, mockTimeNow, keys)
+		if err != nil {
+			t.Errorf("unexpected error verifying token of previous %s key version: %v", algorithm, err)
+		}
+
+		// Test case 3: key type must match algorithm
+		_, _, err = cert.LoadVaultKeys(config, "RS512")
+		if keyType != "rsa-2048" && err == nil {
+			t.Errorf("expected error loading %s vault key for RS512", keyType)
+		}
+
+		// Test case 4: vault errors are reported
+		_, _, err = cert.LoadVaultKeys(c.VaultConfig{Address: vault.URL, Token: "wrong", Mount: "transit", KeyName: "token"}, algorithm)
+		if err == nil {
+			t.Errorf("expected error with invalid vault token")
+		}
+
+		vault.Close()
+	}
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"simple-micro-auth/src/totp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+
+	// SHA-1 test vectors of RFC 6238 appendix B, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, testCase := range testCases {
+		code := totp.Code(secret, totp.Step(time.Unix(testCase.unix, 0)))
+		if code != testCase.code {
+			t.Errorf("expected code at %d: %s, got: %s", testCase.unix, testCase.code, code)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	current := totp.Step(now)
+
+	// Codes of the neighbouring steps are accepted for clock drift, older ones are not
+	for offset, valid := range map[int64]bool{-2: false, -1: true, 0: true, 1: true, 2: false} {
+		step, ok := totp.Validate(secret, totp.Code(secret, current+offset), now, 0)
+		if ok != valid || (ok && step != current+offset) {
+			t.Errorf("expected code of step offset %d valid: %v, got: %v at step %d", offset, valid, ok, step)
+		}
+	}
+
+	// A used step and those before it can not be replayed
+	_, ok := totp.Validate(secret, totp.Code(secret, current), now, current)
+	if ok {
+		t.Errorf("expected used code to be rejected")
+	}
+
+	_, ok = totp.Validate(secret, totp.Code(secret, current+1), now, current)
+	if !ok {
+		t.Errorf("expected code of a later step to be accepted")
+	}
+
+	_, ok = totp.Validate(secret, "12345", now, 0)
+	if ok {
+		t.Errorf("expected short code to be rejected")
+	}
+
+	uri := totp.URI("simple-micro-auth", "alice@example.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/simple-micro-auth:alice@example.com?") ||
+		!strings.Contains(uri, "secret="+totp.EncodeSecret(secret)) {
+		t.Errorf("unexpected otpauth uri: %s", uri)
+	}
+}
@@ -0,0 +1,300 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"simple-micro-auth/src/webauthn"
+	"sort"
+	"testing"
+)
+
+/**
+ * Authenticator in software, answering ceremonies like a security key would
+ */
+type softAuthenticator struct {
+	rpId         string
+	origin       string
+	credentialId []byte
+	ecdsaKey     *ecdsa.PrivateKey
+	ed25519Key   ed25519.PrivateKey
+	signCount    uint32
+	// Sign count stays 0 like on authenticators without a counter
+	noCounter bool
+	flags     byte
+}
+
+func newSoftAuthenticator(t *testing.T, rpId string, origin string, algorithm int64) *softAuthenticator {
+
+	authenticator := &softAuthenticator{
+		rpId:         rpId,
+		origin:       origin,
+		credentialId: make([]byte, 16),
+		flags:        webauthn.FlagUserPresent | webauthn.FlagUserVerified,
+	}
+
+	_, err := rand.Read(authenticator.credentialId)
+	if err != nil {
+		t.Fatalf("could not create credential id: %v", err)
+	}
+
+	switch algorithm {
+	case webauthn.AlgorithmES256:
+		authenticator.ecdsaKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case webauthn.AlgorithmEdDSA:
+		_, authenticator.ed25519Key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatalf("could not create authenticator key: %v", err)
+	}
+
+	return authenticator
+}
+
+func (authenticator *softAuthenticator) register(challenge string) ([]byte, []byte) {
+
+	clientDataJSON := authenticator.clientData("webauthn.create", challenge)
+
+	attestedData := append(make([]byte, 16), byte(len(authenticator.credentialId)>>8), byte(len(authenticator.credentialId)))
+	attestedData = append(attestedData, authenticator.credentialId...)
+	attestedData = append(attestedData, authenticator.coseKey()...)
+
+	authenticatorData := append(authenticator.authenticatorData(webauthn.FlagAttestedData), attestedData...)
+
+	attestationObject := cborEncode(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": authenticatorData,
+	})
+
+	return clientDataJSON, attestationObject
+}
+
+func (authenticator *softAuthenticator) assert(challenge string) ([]byte, []byte, []byte) {
+
+	if !authenticator.noCounter {
+		authenticator.signCount++
+	}
+
+	clientDataJSON := authenticator.clientData("webauthn.get", challenge)
+	authenticatorData := authenticator.authenticatorData(0)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authenticatorData...), clientDataHash[:]...)
+
+	var signature []byte
+	if authenticator.ecdsaKey != nil {
+		digest := sha256.Sum256(signed)
+		signature, _ = ecdsa.SignASN1(rand.Reader, authenticator.ecdsaKey, digest[:])
+	} else {
+		signature = ed25519.Sign(authenticator.ed25519Key, signed)
+	}
+
+	return clientDataJSON, authenticatorData, signature
+}
+
+func (authenticator *softAuthenticator) clientData(ceremony string, challenge string) []byte {
+
+	clientDataJSON, _ := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   challenge,
+		"origin":      authenticator.origin,
+		"crossOrigin": false,
+	})
+
+	return clientDataJSON
+}
+
+func (authenticator *softAuthenticator) authenticatorData(flags byte) []byte {
+
+	rpIdHash := sha256.Sum256([]byte(authenticator.rpId))
+
+	data := append(rpIdHash[:], authenticator.flags|flags)
+
+	return binary.BigEndian.AppendUint32(data, authenticator.signCount)
+}
+
+func (authenticator *softAuthenticator) coseKey() []byte {
+
+	if authenticator.ecdsaKey != nil {
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		authenticator.ecdsaKey.X.FillBytes(x)
+		authenticator.ecdsaKey.Y.FillBytes(y)
+		return cborEncode(map[interface{}]interface{}{1: 2, 3: webauthn.AlgorithmES256, -1: 1, -2: x, -3: y})
+	}
+
+	publicKey := authenticator.ed25519Key.Public().(ed25519.PublicKey)
+	return cborEncode(map[interface{}]interface{}{1: 1, 3: webauthn.AlgorithmEdDSA, -1: 6, -2: []byte(publicKey)})
+}
+
+/**
+ * Encode the few CBOR types authenticators use, map keys in a fixed order
+ */
+func cborEncode(value interface{}) []byte {
+
+	head := func(major byte, argument uint64) []byte {
+		switch {
+		case argument < 24:
+			return []byte{major<<5 | byte(argument)}
+		case argument < 1<<8:
+			return []byte{major<<5 | 24, byte(argument)}
+		case argument < 1<<16:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(argument))
+		default:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(argument))
+		}
+	}
+
+	switch value := value.(type) {
+	case int:
+		if value < 0 {
+			return head(1, uint64(-1-value))
+		}
+		return head(0, uint64(value))
+	case string:
+		return append(head(3, uint64(len(value))), value...)
+	case []byte:
+		return append(head(2, uint64(len(value))), value...)
+	case map[interface{}]interface{}:
+		keys := make([][]byte, 0, len(value))
+		encoded := map[string][]byte{}
+		for key, item := range value {
+			encodedKey := cborEncode(key)
+			keys = append(keys, encodedKey)
+			encoded[string(encodedKey)] = cborEncode(item)
+		}
+		sort.Slice(keys, func(i, j int) bool { return string(keys[i]) < string(keys[j]) })
+		result := head(5, uint64(len(value)))
+		for _, key := range keys {
+			result = append(append(result, key...), encoded[string(key)]...)
+		}
+		return result
+	}
+
+	panic("unsupported cbor value")
+}
+
+func TestWebAuthn(t *testing.T) {
+
+	rp := webauthn.RelyingParty{
+		ID:                      "example.com",
+		Origins:                 []string{"https://example.com"},
+		RequireUserVerification: true,
+	}
+
+	for _, algorithm := range []int64{webauthn.AlgorithmES256, webauthn.AlgorithmEdDSA} {
+		authenticator := newSoftAuthenticator(t, "example.com", "https://example.com", algorithm)
+
+		challenge, err := webauthn.NewChallenge()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		clientDataJSON, attestationObject := authenticator.register(challenge)
+
+		received, err := webauthn.Challenge(clientDataJSON)
+		if err != nil || received != challenge {
+			t.Errorf("expected challenge: %s, got: %s, %v", challenge, received, err)
+		}
+
+		credential, err := rp.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+		if err != nil {
+			t.Fatalf("unexpected error for algorithm %d: %v", algorithm, err)
+		}
+
+		if string(credential.ID) != string(authenticator.credentialId) || credential.SignCount != 0 {
+			t.Errorf("unexpected credential: %v", credential)
+		}
+
+		_, err = rp.VerifyRegistration("other", clientDataJSON, attestationObject)
+		if err == nil || err.Error() != "challenge mismatch" {
+			t.Errorf("expected error: %s, got: %v", "challenge mismatch", err)
+		}
+
+		// The assertion of a login does not pass as a registration
+		assertionClientData, _, _ := authenticator.assert(challenge)
+		_, err = rp.VerifyRegistration(challenge, assertionClientData, attestationObject)
+		if err == nil || err.Error() != "unexpected client data type" {
+			t.Errorf("expected error: %s, got: %v", "unexpected client data type", err)
+		}
+		authenticator.signCount = 0
+
+		_, err = rp.VerifyRegistration(challenge, clientDataJSON, attestationObject[:len(attestationObject)-1])
+		if err == nil || err.Error() != "attestation object malformed" {
+			t.Errorf("expected error: %s, got: %v", "attestation object malformed", err)
+		}
+
+		clientDataJSON, authenticatorData, signature := authenticator.assert(challenge)
+
+		assertion, err := rp.VerifyAssertion(challenge, credential, clientDataJSON, authenticatorData, signature)
+		if err != nil || assertion.SignCount != 1 || !assertion.UserVerified() {
+			t.Fatalf("expected verified assertion with sign count 1, got: %v, %v", assertion, err)
+		}
+		credential.SignCount = assertion.SignCount
+
+		// A replayed assertion does not count up
+		_, err = rp.VerifyAssertion(challenge, credential, clientDataJSON, authenticatorData, signature)
+		if err == nil || err.Error() != "sign count did not increase, the authenticator may be cloned" {
+			t.Errorf("expected error: %s, got: %v", "sign count did not increase, the authenticator may be cloned", err)
+		}
+
+		clientDataJSON, authenticatorData, signature = authenticator.assert(challenge)
+		signature[len(signature)-1] ^= 1
+		_, err = rp.VerifyAssertion(challenge, credential, clientDataJSON, authenticatorData, signature)
+		if err == nil || err.Error() != "invalid signature" {
+			t.Errorf("expected error: %s, got: %v", "invalid signature", err)
+		}
+	}
+
+	authenticator := newSoftAuthenticator(t, "example.com", "https://example.com", webauthn.AlgorithmES256)
+	clientDataJSON, attestationObject := authenticator.register("challenge")
+	credential, err := rp.VerifyRegistration("challenge", clientDataJSON, attestationObject)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Authenticators without a counter always send 0
+	authenticator.noCounter = true
+	for i := 0; i < 2; i++ {
+		clientDataJSON, authenticatorData, signature := authenticator.assert("challenge")
+		_, err = rp.VerifyAssertion("challenge", credential, clientDataJSON, authenticatorData, signature)
+		if err != nil {
+			t.Errorf("expected assertion without counter to pass, got: %v", err)
+		}
+	}
+
+	authenticator.flags = webauthn.FlagUserPresent
+	clientDataJSON, authenticatorData, signature := authenticator.assert("challenge")
+	_, err = rp.VerifyAssertion("challenge", credential, clientDataJSON, authenticatorData, signature)
+	if err == nil || err.Error() != "user not verified" {
+		t.Errorf("expected error: %s, got: %v", "user not verified", err)
+	}
+
+	// Without required user verification the caller learns that the user was only present
+	rp.RequireUserVerification = false
+	clientDataJSON, authenticatorData, signature = authenticator.assert("challenge")
+	assertion, err := rp.VerifyAssertion("challenge", credential, clientDataJSON, authenticatorData, signature)
+	if err != nil || assertion.UserVerified() {
+		t.Errorf("expected assertion without user verification, got: %v, %v", assertion, err)
+	}
+	rp.RequireUserVerification = true
+
+	phishing := newSoftAuthenticator(t, "example.com", "https://example.com.evil", webauthn.AlgorithmES256)
+	clientDataJSON, attestationObject = phishing.register("challenge")
+	_, err = rp.VerifyRegistration("challenge", clientDataJSON, attestationObject)
+	if err == nil || err.Error() != "unexpected origin" {
+		t.Errorf("expected error: %s, got: %v", "unexpected origin", err)
+	}
+
+	otherRP := newSoftAuthenticator(t, "evil.com", "https://example.com", webauthn.AlgorithmES256)
+	clientDataJSON, attestationObject = otherRP.register("challenge")
+	_, err = rp.VerifyRegistration("challenge", clientDataJSON, attestationObject)
+	if err == nil || err.Error() != "credential not scoped to this relying party" {
+		t.Errorf("expected error: %s, got: %v", "credential not scoped to this relying party", err)
+	}
+}
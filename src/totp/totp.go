@@ -0,0 +1,117 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 defaults, the only parameters authenticator apps reliably support
+const (
+	Period = 30
+	Digits = 6
+	// Steps before and after the current one a code is accepted for, to allow for clock drift
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/**
+ * New random secret of 160 bits as recommended by RFC 4226
+ */
+func NewSecret() ([]byte, error) {
+
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+/**
+ * Secret in the base32 form users type into authenticator apps
+ */
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+/**
+ * otpauth:// URI for QR codes, see https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+ */
+func URI(issuer string, account string, secret []byte) string {
+
+	query := url.Values{}
+	query.Set("secret", EncodeSecret(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(Period))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+/**
+ * Time step of the moment
+ */
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+/**
+ * Code of the time step
+ */
+func Code(secret []byte, step int64) string {
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < Digits; i++ {
+		modulus *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, value%modulus)
+}
+
+/**
+ * Step the code is valid for around the moment, steps up to lastStep are used up and rejected
+ * @returns the matching step, to be stored as lastStep so the code can not be replayed
+ */
+func Validate(secret []byte, code string, t time.Time, lastStep int64) (int64, bool) {
+
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	current := Step(t)
+	for step := current - Skew; step <= current+Skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(Code(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
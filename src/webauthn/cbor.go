@@ -0,0 +1,139 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Nesting WebAuthn payloads never come close to, guards against stack exhaustion
+const maxCBORDepth = 16
+
+/**
+ * Decode the first CBOR item of data, enough of RFC 8949 for attestation objects and COSE keys
+ * Integers decode to int64, maps to map[interface{}]interface{} with int64 or string keys
+ * @returns the item and the bytes following it
+ */
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("cbor nested too deeply")
+	}
+
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("cbor truncated")
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		default:
+			return nil, nil, fmt.Errorf("unsupported cbor simple value %d", info)
+		}
+	}
+
+	var argument uint64
+	switch {
+	case info < 24:
+		argument = uint64(info)
+	case info == 24 && len(data) >= 1:
+		argument, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		argument, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		argument, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		argument, data = binary.BigEndian.Uint64(data), data[8:]
+	case info >= 28:
+		// Indefinite lengths are not allowed in the CTAP2 canonical encoding
+		return nil, nil, fmt.Errorf("unsupported cbor length encoding")
+	default:
+		return nil, nil, fmt.Errorf("cbor truncated")
+	}
+
+	switch major {
+	case 0:
+		if argument > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("cbor integer out of range")
+		}
+		return int64(argument), data, nil
+
+	case 1:
+		if argument > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("cbor integer out of range")
+		}
+		return -1 - int64(argument), data, nil
+
+	case 2, 3:
+		if argument > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("cbor truncated")
+		}
+		value := data[:argument]
+		if major == 3 {
+			return string(value), data[argument:], nil
+		}
+		return value, data[argument:], nil
+
+	case 4:
+		// Every item takes at least a byte, longer arrays can only be truncated
+		if argument > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("cbor truncated")
+		}
+		items := make([]interface{}, 0, argument)
+		for i := uint64(0); i < argument; i++ {
+			var item interface{}
+			var err error
+			item, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+
+	case 5:
+		if argument > uint64(len(data))/2 {
+			return nil, nil, fmt.Errorf("cbor truncated")
+		}
+		entries := make(map[interface{}]interface{}, argument)
+		for i := uint64(0); i < argument; i++ {
+			var key, value interface{}
+			var err error
+			key, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("unsupported cbor map key")
+			}
+			if _, ok := entries[key]; ok {
+				return nil, nil, fmt.Errorf("duplicate cbor map key")
+			}
+			value, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			entries[key] = value
+		}
+		return entries, data, nil
+
+	default:
+		// Tags, the only major type left, do not occur in WebAuthn payloads
+		return nil, nil, fmt.Errorf("unsupported cbor major type %d", major)
+	}
+}
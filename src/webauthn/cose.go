@@ -0,0 +1,126 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms of RFC 9053 offered to authenticators, in order of preference
+const (
+	AlgorithmES256 = -7
+	AlgorithmEdDSA = -8
+	AlgorithmRS256 = -257
+)
+
+var Algorithms = []int64{AlgorithmES256, AlgorithmEdDSA, AlgorithmRS256}
+
+// COSE key parameters
+const (
+	coseKeyType   = 1
+	coseAlgorithm = 3
+	coseCurve     = -1 // n of RSA keys
+	coseX         = -2 // e of RSA keys
+	coseY         = -3
+
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+type publicKey struct {
+	algorithm int64
+	key       crypto.PublicKey
+}
+
+/**
+ * Read a COSE_Key as stored for a credential
+ */
+func parsePublicKey(coseKey []byte) (publicKey, error) {
+
+	decoded, rest, err := decodeCBOR(coseKey)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("trailing bytes")
+	}
+	if err != nil {
+		return publicKey{}, fmt.Errorf("public key malformed: %v", err)
+	}
+
+	return publicKeyFromCOSE(decoded)
+}
+
+func publicKeyFromCOSE(decoded interface{}) (publicKey, error) {
+
+	parameters, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return publicKey{}, fmt.Errorf("public key malformed")
+	}
+
+	keyType, _ := parameters[int64(coseKeyType)].(int64)
+	algorithm, _ := parameters[int64(coseAlgorithm)].(int64)
+	curve, _ := parameters[int64(coseCurve)].(int64)
+	x, _ := parameters[int64(coseX)].([]byte)
+	y, _ := parameters[int64(coseY)].([]byte)
+
+	switch {
+	case algorithm == AlgorithmES256 && keyType == coseKeyTypeEC2 && curve == coseCurveP256:
+		if len(x) != 32 || len(y) != 32 {
+			return publicKey{}, fmt.Errorf("public key malformed")
+		}
+		// crypto/ecdh rejects points which are not on the curve
+		uncompressed := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(uncompressed); err != nil {
+			return publicKey{}, fmt.Errorf("public key malformed")
+		}
+		return publicKey{algorithm: algorithm, key: &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}}, nil
+
+	case algorithm == AlgorithmEdDSA && keyType == coseKeyTypeOKP && curve == coseCurveEd25519:
+		if len(x) != ed25519.PublicKeySize {
+			return publicKey{}, fmt.Errorf("public key malformed")
+		}
+		return publicKey{algorithm: algorithm, key: ed25519.PublicKey(x)}, nil
+
+	case algorithm == AlgorithmRS256 && keyType == coseKeyTypeRSA:
+		modulus, _ := parameters[int64(coseCurve)].([]byte)
+		exponent := new(big.Int).SetBytes(x)
+		if len(modulus)*8 < 2048 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return publicKey{}, fmt.Errorf("public key malformed")
+		}
+		return publicKey{algorithm: algorithm, key: &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(exponent.Int64()),
+		}}, nil
+
+	default:
+		return publicKey{}, fmt.Errorf("unsupported public key algorithm")
+	}
+}
+
+func (key publicKey) verify(message []byte, signature []byte) bool {
+
+	digest := sha256.Sum256(message)
+
+	switch key.algorithm {
+	case AlgorithmES256:
+		return ecdsa.VerifyASN1(key.key.(*ecdsa.PublicKey), digest[:], signature)
+	case AlgorithmEdDSA:
+		return ed25519.Verify(key.key.(ed25519.PublicKey), message, signature)
+	case AlgorithmRS256:
+		return rsa.VerifyPKCS1v15(key.key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	}
+
+	return false
+}
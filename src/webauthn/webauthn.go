@@ -0,0 +1,391 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Authenticator data flags, see https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+const (
+	FlagUserPresent       = 0x01
+	FlagUserVerified      = 0x04
+	FlagAttestedData      = 0x40
+	FlagExtensionIncluded = 0x80
+)
+
+// Relying party the ceremonies are verified for
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+	// Whether the authenticator has to verify the user, e.g. by PIN or biometrics, not only their presence
+	RequireUserVerification bool
+}
+
+// Credential registered for a user
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key
+	SignCount uint32
+}
+
+// Verified response to navigator.credentials.get()
+type Assertion struct {
+	SignCount uint32 // new sign count to store
+	Flags     byte
+}
+
+/**
+ * Whether the authenticator verified the user, not only their presence
+ */
+func (assertion Assertion) UserVerified() bool {
+	return assertion.Flags&FlagUserVerified != 0
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type authenticatorData struct {
+	rpIdHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialId []byte
+	publicKey    []byte
+}
+
+/**
+ * New random challenge, base64url encoded as it comes back in the client data
+ */
+func NewChallenge() (string, error) {
+
+	challenge := make([]byte, 32)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(challenge), nil
+}
+
+/**
+ * Challenge of the client data, to find the ceremony it belongs to before verifying it
+ */
+func Challenge(clientDataJSON []byte) (string, error) {
+
+	var data clientData
+	err := json.Unmarshal(clientDataJSON, &data)
+	if err != nil || data.Challenge == "" {
+		return "", fmt.Errorf("client data malformed")
+	}
+
+	return data.Challenge, nil
+}
+
+/**
+ * Verify the response to navigator.credentials.create()
+ * Only the "none" attestation format is accepted, the authenticator model is not checked
+ */
+func (rp RelyingParty) VerifyRegistration(challenge string, clientDataJSON []byte, attestationObject []byte) (Credential, error) {
+
+	err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	decoded, rest, err := decodeCBOR(attestationObject)
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if err != nil || len(rest) > 0 || !ok {
+		return Credential{}, fmt.Errorf("attestation object malformed")
+	}
+
+	format, _ := attestation["fmt"].(string)
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+	if format != "none" || len(statement) > 0 {
+		return Credential{}, fmt.Errorf("unsupported attestation format")
+	}
+
+	rawAuthenticatorData, _ := attestation["authData"].([]byte)
+	data, err := parseAuthenticatorData(rawAuthenticatorData)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	err = rp.verifyAuthenticatorData(data)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	if data.flags&FlagAttestedData == 0 {
+		return Credential{}, fmt.Errorf("attested credential data missing")
+	}
+
+	_, err = parsePublicKey(data.publicKey)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	return Credential{
+		ID:        data.credentialId,
+		PublicKey: data.publicKey,
+		SignCount: data.signCount,
+	}, nil
+}
+
+/**
+ * Verify the response to navigator.credentials.get() against the stored credential
+ * Without RequireUserVerification the flags tell whether the user was verified
+ */
+func (rp RelyingParty) VerifyAssertion(challenge string, credential Credential, clientDataJSON []byte, rawAuthenticatorData []byte, signature []byte) (Assertion, error) {
+
+	err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	data, err := parseAuthenticatorData(rawAuthenticatorData)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	err = rp.verifyAuthenticatorData(data)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	key, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthenticatorData...), clientDataHash[:]...)
+	if !key.verify(signed, signature) {
+		return Assertion{}, fmt.Errorf("invalid signature")
+	}
+
+	// Authenticators without a counter always send 0, any other has to count up or was cloned
+	if (data.signCount != 0 || credential.SignCount != 0) && data.signCount <= credential.SignCount {
+		return Assertion{}, fmt.Errorf("sign count did not increase, the authenticator may be cloned")
+	}
+
+	return Assertion{SignCount: data.signCount, Flags: data.flags}, nil
+}
+
+func (rp RelyingParty) verifyClientData(clientDataJSON []byte, ceremony string, challenge string) error {
+
+	var data clientData
+	err := json.Unmarshal(clientDataJSON, &data)
+	if err != nil {
+		return fmt.Errorf("client data malformed")
+	}
+
+	if data.Type != ceremony {
+		return fmt.Errorf("unexpected client data type")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(challenge)) != 1 {
+		return fmt.Errorf("challenge mismatch")
+	}
+
+	// Embedding the ceremony in a frame of another origin is not supported
+	if data.CrossOrigin {
+		return fmt.Errorf("unexpected origin")
+	}
+
+	for _, origin := range rp.Origins {
+		if data.Origin == origin {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unexpected origin")
+}
+
+func (rp RelyingParty) verifyAuthenticatorData(data authenticatorData) error {
+
+	rpIdHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(data.rpIdHash, rpIdHash[:]) {
+		return fmt.Errorf("credential not scoped to this relying party")
+	}
+
+	if data.flags&FlagUserPresent == 0 {
+		return fmt.Errorf("user not present")
+	}
+
+	if rp.RequireUserVerification && data.flags&FlagUserVerified == 0 {
+		return fmt.Errorf("user not verified")
+	}
+
+	return nil
+}
+
+func parseAuthenticatorData(raw []byte) (authenticatorData, error) {
+
+	malformed := fmt.Errorf("authenticator data malformed")
+
+	if len(raw) < 37 {
+		return authenticatorData{}, malformed
+	}
+
+	data := authenticatorData{
+		rpIdHash:  raw[:32],
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	rest := raw[37:]
+
+	if data.flags&FlagAttestedData != 0 {
+		// AAGUID and credential id length
+		if len(rest) < 18 {
+			return authenticatorData{}, malformed
+		}
+		credentialIdLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if credentialIdLength == 0 || credentialIdLength > 1023 || len(rest) < credentialIdLength {
+			return authenticatorData{}, malformed
+		}
+		data.credentialId, rest = rest[:credentialIdLength], rest[credentialIdLength:]
+
+		// The key is only delimited by its own encoding
+		_, afterKey, err := decodeCBOR(rest)
+		if err != nil {
+			return authenticatorData{}, malformed
+		}
+		data.publicKey, rest = rest[:len(rest)-len(afterKey)], afterKey
+	}
+
+	if data.flags&FlagExtensionIncluded != 0 {
+		_, afterExtensions, err := decodeCBOR(rest)
+		if err != nil {
+			return authenticatorData{}, malformed
+		}
+		rest = afterExtensions
+	}
+
+	if len(rest) > 0 {
+		return authenticatorData{}, malformed
+	}
+
+	return data, nil
+}
+
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     relyingPartyEntity     `json:"rp"`
+	User                   userEntity             `json:"user"`
+	PubKeyCredParams       []credentialParameters `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+type relyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credentialParameters struct {
+	Type      string `json:"type"`
+	Algorithm int64  `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+/**
+ * Options for navigator.credentials.create(), binary values are base64url encoded
+ * @param userHandle []byte - opaque user id, returned by logins with discoverable credentials
+ * @param exclude [][]byte - ids of credentials already registered, so an authenticator is not registered twice
+ */
+func (rp RelyingParty) CreationOptions(challenge string, userHandle []byte, userName string, exclude [][]byte, timeout time.Duration) CreationOptions {
+
+	parameters := make([]credentialParameters, 0, len(Algorithms))
+	for _, algorithm := range Algorithms {
+		parameters = append(parameters, credentialParameters{Type: "public-key", Algorithm: algorithm})
+	}
+
+	return CreationOptions{
+		Challenge: challenge,
+		RP:        relyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User: userEntity{
+			ID:          base64.RawURLEncoding.EncodeToString(userHandle),
+			Name:        userName,
+			DisplayName: userName,
+		},
+		PubKeyCredParams:   parameters,
+		Timeout:            timeout.Milliseconds(),
+		ExcludeCredentials: credentialDescriptors(exclude),
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: rp.userVerification(),
+		},
+		Attestation: "none",
+	}
+}
+
+/**
+ * Options for navigator.credentials.get(), binary values are base64url encoded
+ * @param allow [][]byte - ids of the user's credentials, empty to let the user pick a discoverable one
+ */
+func (rp RelyingParty) RequestOptions(challenge string, allow [][]byte, timeout time.Duration) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          timeout.Milliseconds(),
+		AllowCredentials: credentialDescriptors(allow),
+		UserVerification: rp.userVerification(),
+	}
+}
+
+func (rp RelyingParty) userVerification() string {
+	if rp.RequireUserVerification {
+		return "required"
+	}
+	return "preferred"
+}
+
+func credentialDescriptors(credentialIds [][]byte) []credentialDescriptor {
+
+	descriptors := make([]credentialDescriptor, 0, len(credentialIds))
+	for _, credentialId := range credentialIds {
+		descriptors = append(descriptors, credentialDescriptor{
+			Type: "public-key",
+			ID:   base64.RawURLEncoding.EncodeToString(credentialId),
+		})
+	}
+
+	return descriptors
+}